@@ -19,9 +19,15 @@ this program. If not, see <https://www.gnu.org/licenses/>.
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -31,8 +37,13 @@ import (
 	"github.com/google/uuid"
 	"github.com/volatiletech/authboss/v3"
 
-	// TBD: "github.com/volatiletech/authboss/v3/otp/twofactor/sms2fa"
-	// TBD: "github.com/volatiletech/authboss/v3/otp/twofactor/totp2fa"
+	aboauth2 "github.com/volatiletech/authboss/v3/oauth2"
+	"github.com/volatiletech/authboss/v3/otp/twofactor/sms2fa"
+	"github.com/volatiletech/authboss/v3/otp/twofactor/totp2fa"
+
+	// WebAuthn (passkeys)
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 
 	// GORM
 	// If you prefer the CGO driver to SQLite, uncomment:
@@ -47,6 +58,10 @@ import (
 
 const (
 	workedUserdb = "worked_udata.sqlite3"
+	// Wait this long for another connection's write (e.g., Authboss sending a confirmation
+	// e-mail into the outbox from its own goroutine, or abossctl) instead of failing with
+	// SQLITE_BUSY.
+	workedUserdbBusyTimeout = "?_pragma=busy_timeout(5000)"
 )
 
 // AuthStorer holds the SQLite database state
@@ -55,6 +70,21 @@ type AuthStorer struct {
 	log *log.Logger
 	// GORM's connection to the SQLite database...
 	UserDB *gorm.DB
+	// OAuth2 providers whose identities are linked to the existing account with
+	// the same e-mail address (see NewFromOAuth2.)
+	oauth2LinkByEmail map[string]bool
+	// How long remember-me tokens last (remember:max_age) and the expired token reaper
+	// (see rememberReaper.go.)
+	rememberMaxAge time.Duration
+	reaper         *rememberReaper
+	// The outbound mail queue's delivery worker (see mailOutbox.go.)
+	outbox *MailOutbox
+	// Key for the remember-me token hashes (seeds:remember.)
+	rememberKey []byte
+	// Session timeouts (sessions:idle_timeout, sessions:max_lifetime), which tell when a
+	// session in the user session index has expired.
+	sessionIdleTimeout time.Duration
+	sessionMaxLifetime time.Duration
 }
 
 // WorkedUser is the glue structure that connects user state to Authboss.
@@ -68,6 +98,11 @@ type WorkedUser struct {
 	// Authboss "arbitrary" data map -- this is where Authboss stashes form data
 	// that needs to be retained across forms/pages.
 	arbitraryData map[string]string
+
+	// The OAuth2 identity with which the user signed in, if any.
+	oauth2Identity OAuth2Identities
+	// The OAuth2 provider verified the user's e-mail address.
+	oauth2EmailVerified bool
 }
 
 // This pattern is useful in real code to ensure that
@@ -82,23 +117,43 @@ var (
 	_ authboss.LockableUser    = assertUser
 	_ authboss.RecoverableUser = assertUser
 	_ authboss.ArbitraryUser   = assertUser
+	_ authboss.OAuth2User      = assertUser
 
-	// TBD: _ totp2fa.User = assertUser
-	// TBD: _ sms2fa.User  = assertUser
+	_ totp2fa.User        = assertUser
+	_ totp2fa.UserOneTime = assertUser
+	_ sms2fa.User         = assertUser
+	_ webauthn.User       = assertUser
 
 	_ authboss.ServerStorer            = assertStorer
 	_ authboss.CreatingServerStorer    = assertStorer
 	_ authboss.ConfirmingServerStorer  = assertStorer
 	_ authboss.RecoveringServerStorer  = assertStorer
 	_ authboss.RememberingServerStorer = assertStorer
+	_ authboss.OAuth2ServerStorer      = assertStorer
 )
 
-// OpenUserDB opens the user database and creates the database structure if it
-// doesn't already exist.
+// OpenUserDB opens the user database and migrates its schema to the latest version (see
+// migrations.go), creating the schema if it doesn't already exist. It fails if the schema
+// doesn't match the signature recorded by the last migration.
 func OpenUserDB(workedRoot string) (storer *AuthStorer, err error) {
+	if storer, err = openUserDB(workedRoot, os.Stdout); err != nil {
+		return nil, err
+	}
+
+	if err = storer.MigrateTo(latestSchemaVersion()); err != nil {
+		storer.Close()
+		return nil, err
+	}
+
+	return storer, nil
+}
+
+// openUserDB opens the user database, logging to logOutput, without touching its schema. The
+// command line tool (abossctl) doesn't want the SQL statements mixed into its output.
+func openUserDB(workedRoot string, logOutput io.Writer) (storer *AuthStorer, err error) {
 	storer = &AuthStorer{}
 
-	storer.log = log.New(os.Stdout, "[USERDB] ", log.LstdFlags)
+	storer.log = log.New(logOutput, "[USERDB] ", log.LstdFlags)
 	storeLogger := logger.New(
 		storer.log,
 		logger.Config{
@@ -112,7 +167,7 @@ func OpenUserDB(workedRoot string) (storer *AuthStorer, err error) {
 	workedUserDBPath := strings.Join([]string{workedRoot, workedUserdb}, string(os.PathSeparator))
 	storer.log.Printf("userdb path %s", workedUserDBPath)
 
-	storer.UserDB, err = gorm.Open(sqlite.Open(workedUserDBPath), &gorm.Config{
+	storer.UserDB, err = gorm.Open(sqlite.Open(workedUserDBPath+workedUserdbBusyTimeout), &gorm.Config{
 		Logger: storeLogger,
 	})
 
@@ -120,20 +175,15 @@ func OpenUserDB(workedRoot string) (storer *AuthStorer, err error) {
 		return nil, err
 	}
 
-	// Create or update the database's structure:
-	userDBTables := []interface{}{
-		&UserData{},
-		&Confirmations{},
-		&LockedAccount{},
-		&RecoveryRequests{},
-		&RememberMeTokens{},
-	}
-
-	return storer, storer.UserDB.AutoMigrate(userDBTables...)
+	return storer, nil
 }
 
 // Close and cleanup for SQLStorer.
 func (storer *AuthStorer) Close() {
+	// The reaper can't reap without a database, and the outbox can't deliver without one.
+	storer.StopRememberReaper()
+	storer.StopMailOutbox()
+
 	// Really. Close the database connection.
 	sqlDB, err := storer.UserDB.DB()
 	if err == nil {
@@ -162,19 +212,47 @@ func (storer AuthStorer) Load(ctx context.Context, key string) (authboss.User, e
 		UserData:   UserData{},
 	}
 
-	/* OAuth2: TBD
 	if provider, oauthUID, err := authboss.ParseOAuth2PID(key); err == nil {
-		tx = storer.UserDB.Model(&UserData{}).
-			Where(UserData{
-				OAuth2UID:      sql.NullString{String: oauthUID, Valid: true},
-				OAuth2Provider: provider,
-			}).First(&workedUser)
-	} else */
+		// Lookup by OAuth2 identity, joining back to the linked user.
+		var identity OAuth2Identities
+
+		tx = storer.UserDB.Model(&OAuth2Identities{}).
+			Where(OAuth2Identities{Provider: provider, UID: oauthUID}).
+			Joins("User").
+			First(&identity)
 
-	// Lookup by Primary User Identifier (email)
-	tx = storer.UserDB.Model(&UserData{}).Where(UserData{Email: key}).First(&workedUser.UserData)
+		workedUser.UserData = identity.User
+		workedUser.oauth2Identity = identity
+	} else {
+		// Lookup by Primary User Identifier (email)
+		tx = storer.UserDB.Model(&UserData{}).Where(UserData{Email: key}).First(&workedUser.UserData)
+	}
 
-	storer.log.Printf("Load(ctx, %v) -> %v", key, workedUser)
+	// Only the PID and GUID: the user carries their OAuth2 identity's tokens.
+	storer.log.Printf("Load(ctx, %v) -> GUID %s", key, workedUser.UserData.GUID)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return nil, authboss.ErrUserNotFound
+	} else if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	return workedUser, nil
+}
+
+// LoadByGUID looks up the user by their GUID rather than their PID. WebAuthn identifies
+// the user by their GUID (see WebAuthnID.)
+func (storer AuthStorer) LoadByGUID(ctx context.Context, guid string) (*WorkedUser, error) {
+	workedUser := &WorkedUser{
+		AuthStorer: &storer,
+		UserData:   UserData{},
+	}
+
+	// Careful: GORM ignores zero-valued struct fields in Where().
+	if len(guid) == 0 {
+		return nil, authboss.ErrUserNotFound
+	}
+
+	tx := storer.UserDB.Model(&UserData{}).Where(UserData{GUID: guid}).First(&workedUser.UserData)
 	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
 		return nil, authboss.ErrUserNotFound
 	} else if tx.Error != nil {
@@ -322,71 +400,922 @@ func (storer AuthStorer) LoadByRecoverSelector(ctx context.Context, selector str
 	} else if result.Error != nil {
 		return &WorkedUser{}, result.Error
 	}
-
-	return &WorkedUser{
-		AuthStorer:    &storer,
-		UserData:      recovery.User,
-		arbitraryData: map[string]string{},
-	}, nil
+
+	return &WorkedUser{
+		AuthStorer:    &storer,
+		UserData:      recovery.User,
+		arbitraryData: map[string]string{},
+	}, nil
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// RememberingServerStorer implementation
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// AddRememberToken associates a "remember me" token with the user
+func (storer AuthStorer) AddRememberToken(ctx context.Context, pid, token string) error {
+	var userGUID string
+
+	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	// UTC, so that the expiry dates compare correctly as SQLite text.
+	now := time.Now().UTC()
+	guidTX := storer.UserDB.Model(&RememberMeTokens{}).Create(&RememberMeTokens{
+		GUID:      userGUID,
+		TokenHash: storer.rememberTokenHash(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(storer.rememberTokenMaxAge()),
+	})
+
+	storer.log.Printf("AddRememberToken: %v rows affected.", guidTX.RowsAffected)
+	return guidTX.Error
+}
+
+// DelRememberTokens removes all "remember me" tokens previously associated with the user
+func (storer AuthStorer) DelRememberTokens(ctx context.Context, pid string) error {
+	var userGUID string
+
+	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	// GUID is not the primary key, so a "WHERE" clause is required to delete:
+	guidToDelete := RememberMeTokens{GUID: userGUID}
+	guidTX := storer.UserDB.Model(&guidToDelete).Where(&guidToDelete).Delete(&guidToDelete)
+
+	storer.log.Printf("DelRememberTokens: %v rows deleted.", guidTX.RowsAffected)
+	return guidTX.Error
+}
+
+// UseRememberToken finds the pid-token pair and deletes it (consumes the remember token).
+// If the token could not be found or has expired, return ErrTokenNotFound
+func (storer AuthStorer) UseRememberToken(ctx context.Context, pid, token string) error {
+	var userGUID string
+
+	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	var remembered RememberMeTokens
+
+	tokenHash := storer.rememberTokenHash(token)
+	tx = storer.UserDB.Where("guid = ? AND token_hash = ? AND series = ''", userGUID, tokenHash).First(&remembered)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		storer.log.Print("UseRememberToken: (GUID, token) pair not found.")
+		return authboss.ErrTokenNotFound
+	} else if tx.Error != nil {
+		storer.log.Printf("UseRememberToken: GORM database error: %v.", tx.Error)
+		return tx.Error
+	}
+
+	guidTX := storer.UserDB.Where("guid = ? AND token_hash = ?", userGUID, tokenHash).Delete(&RememberMeTokens{})
+
+	storer.log.Printf("UseRememberToken: %v rows affected (GUID: %v).", guidTX.RowsAffected, userGUID)
+	if guidTX.Error != nil {
+		storer.log.Printf("UseRememberToken: GORM database error: %v.", guidTX.Error)
+		return guidTX.Error
+	}
+
+	// Expired tokens are consumed all the same, they just don't sign the user in.
+	if !remembered.ExpiresAt.After(time.Now()) {
+		storer.log.Printf("UseRememberToken: token expired %v.", remembered.ExpiresAt)
+		return authboss.ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// rememberTokenHash is the keyed hash of a remember-me token, which is what the remember table
+// stores instead of the token.
+func (storer AuthStorer) rememberTokenHash(token string) string {
+	mac := hmac.New(sha256.New, storer.rememberKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReapRememberTokens deletes the expired remember-me tokens and returns how many it deleted.
+func (storer AuthStorer) ReapRememberTokens() (int64, error) {
+	tx := storer.UserDB.Where("expires_at <= ?", time.Now().UTC()).Delete(&RememberMeTokens{})
+	return tx.RowsAffected, tx.Error
+}
+
+// AddRememberSeries starts a new remember-me series for the user, i.e., remembers the user on
+// another browser, with the series' first token.
+func (storer AuthStorer) AddRememberSeries(ctx context.Context, pid, series, token string) error {
+	var userGUID string
+
+	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	now := time.Now().UTC()
+	return storer.UserDB.Create(&RememberMeTokens{
+		GUID:      userGUID,
+		TokenHash: storer.rememberTokenHash(token),
+		Series:    series,
+		CreatedAt: now,
+		ExpiresAt: now.Add(storer.rememberTokenMaxAge()),
+		RotatedAt: now,
+	}).Error
+}
+
+// RotateRememberToken replaces the remember-me series' current token with newToken and
+// extends the series' expiry. It returns:
+//
+//   - authboss.ErrTokenNotFound if there is no such series or the series expired, in which
+//     case the series is deleted.
+//   - ErrRememberTokenReused if the series exists, but token isn't its current token: the
+//     token was already used, so someone else has (had) a copy of the cookie.
+//   - rotated = false if token is the series' previous token and it was rotated less than
+//     rememberRotationGrace ago. The browser's concurrent requests all carry the same
+//     cookie; the request that got there first already sent the browser the new token.
+func (storer AuthStorer) RotateRememberToken(ctx context.Context, pid, series, token, newToken string) (rotated bool, err error) {
+	var userGUID string
+
+	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return false, authboss.ErrTokenNotFound
+	} else if tx.Error != nil {
+		return false, tx.Error
+	}
+
+	// The expired series is deleted after the transaction, which the error rolls back.
+	var expired *RememberMeTokens
+
+	err = storer.UserDB.Transaction(func(tx *gorm.DB) error {
+		var remembered RememberMeTokens
+
+		result := tx.Where("guid = ? AND series = ?", userGUID, series).First(&remembered)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return authboss.ErrTokenNotFound
+		} else if result.Error != nil {
+			return result.Error
+		}
+
+		now := time.Now().UTC()
+		if !remembered.ExpiresAt.After(now) {
+			expired = &remembered
+			return authboss.ErrTokenNotFound
+		}
+
+		tokenHash := storer.rememberTokenHash(token)
+		switch {
+		case hmac.Equal([]byte(tokenHash), []byte(remembered.TokenHash)):
+			// Rotate the token (the hash is the primary key.)
+			rotated = true
+			return tx.Model(&RememberMeTokens{}).Where("token_hash = ?", remembered.TokenHash).Updates(map[string]interface{}{
+				"token_hash":          storer.rememberTokenHash(newToken),
+				"previous_token_hash": remembered.TokenHash,
+				"rotated_at":          now,
+				"expires_at":          now.Add(storer.rememberTokenMaxAge()),
+			}).Error
+
+		case hmac.Equal([]byte(tokenHash), []byte(remembered.PreviousTokenHash)) &&
+			now.Sub(remembered.RotatedAt) < rememberRotationGrace:
+			return nil
+
+		default:
+			return ErrRememberTokenReused
+		}
+	})
+
+	if expired != nil {
+		if tx := storer.UserDB.Delete(expired); tx.Error != nil {
+			storer.log.Printf("RotateRememberToken: unable to delete the expired series: %v", tx.Error)
+		}
+	}
+
+	return rotated, err
+}
+
+// DelRememberSeries forgets the user on one browser: it deletes the remember-me series. Deleting a
+// series that doesn't exist (any more) is not an error.
+func (storer AuthStorer) DelRememberSeries(ctx context.Context, pid, series string) error {
+	tx := storer.UserDB.
+		Where("series = ? AND guid IN (SELECT guid FROM udata WHERE email = ?)", series, pid).
+		Delete(&RememberMeTokens{})
+
+	storer.log.Printf("DelRememberSeries: %v rows deleted.", tx.RowsAffected)
+	return tx.Error
+}
+
+// rememberTokenMaxAge is how long remember-me tokens last.
+func (storer AuthStorer) rememberTokenMaxAge() time.Duration {
+	if storer.rememberMaxAge <= 0 {
+		return defaultConfig.Remember.MaxAge
+	}
+
+	return storer.rememberMaxAge
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Security events
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// AddSecurityEvent records a security event for the user.
+func (storer AuthStorer) AddSecurityEvent(ctx context.Context, pid, event, detail, remoteAddr string) error {
+	var userGUID string
+
+	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	return storer.UserDB.Create(&SecurityEvents{
+		GUID:       userGUID,
+		Event:      event,
+		Detail:     detail,
+		RemoteAddr: remoteAddr,
+	}).Error
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Active sessions (the user session index, see activeSessions.go)
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// TouchUserSession adds the session to the user session index, or updates its last seen time,
+// browser and address. It doesn't write to the database if the session was already seen, for
+// the same user, within the last userSessionTouchInterval.
+func (storer AuthStorer) TouchUserSession(sessionID, pid, rememberSeries, userAgent, remoteAddr string) error {
+	now := time.Now().UTC()
+
+	var seen int64
+	tx := storer.UserDB.Model(&UserSessions{}).
+		Joins("JOIN udata ON udata.guid = user_sessions.guid").
+		Where("user_sessions.session_id = ? AND udata.email = ? AND user_sessions.remember_series = ? AND user_sessions.last_seen > ?",
+			sessionID, pid, rememberSeries, now.Add(-userSessionTouchInterval)).
+		Count(&seen)
+
+	if tx.Error != nil {
+		return tx.Error
+	} else if seen > 0 {
+		return nil
+	}
+
+	var userGUID string
+	tx = storer.UserDB.Model(&UserData{}).Select("guid").Where("email = ?", pid).First(&userGUID)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return authboss.ErrUserNotFound
+	} else if tx.Error != nil {
+		return tx.Error
+	}
+
+	// A session that changes hands (someone else signs in on the same browser) starts over.
+	updates := append(clause.AssignmentColumns([]string{"guid", "remember_series", "user_agent", "remote_addr", "last_seen"}),
+		clause.Assignment{
+			Column: clause.Column{Name: "created_at"},
+			Value:  gorm.Expr("CASE WHEN `user_sessions`.`guid` = excluded.`guid` THEN `user_sessions`.`created_at` ELSE excluded.`created_at` END"),
+		})
+
+	return storer.UserDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}},
+		DoUpdates: updates,
+	}).Create(&UserSessions{
+		SessionID:      sessionID,
+		GUID:           userGUID,
+		RememberSeries: rememberSeries,
+		UserAgent:      userAgent,
+		RemoteAddr:     remoteAddr,
+		CreatedAt:      now,
+		LastSeen:       now,
+	}).Error
+}
+
+// HasUserSession returns true if the session is in the user session index.
+func (storer AuthStorer) HasUserSession(sessionID string) (bool, error) {
+	var indexed int64
+	tx := storer.UserDB.Model(&UserSessions{}).Where("session_id = ?", sessionID).Count(&indexed)
+
+	return indexed > 0, tx.Error
+}
+
+// UserSessionIDs returns the IDs of the user's sessions in the user session index.
+func (storer AuthStorer) UserSessionIDs(pid string) (sessionIDs []string, err error) {
+	err = storer.UserDB.Model(&UserSessions{}).
+		Joins("JOIN udata ON udata.guid = user_sessions.guid").
+		Where("udata.email = ?", pid).
+		Pluck("user_sessions.session_id", &sessionIDs).Error
+
+	return sessionIDs, err
+}
+
+// DelUserSession removes the session from the user session index, e.g., when the user signs
+// out. The session itself is the session store's business.
+func (storer AuthStorer) DelUserSession(sessionID string) error {
+	return storer.UserDB.Where("session_id = ?", sessionID).Delete(&UserSessions{}).Error
+}
+
+// RevokeStoredSessions signs the user out of the sessions that the user database can revoke on
+// its own, for abossctl, which doesn't have the web site's session store: it deletes the GORM
+// session backend's sessions and puts the sessions' IDs on the JWT client state's deny-list
+// until denyUntil, then drops them from the user session index. Sessions kept in memory or in
+// Redis are out of its reach. Returns how many sessions the index had.
+func (storer AuthStorer) RevokeStoredSessions(pid string, denyUntil time.Time) (int64, error) {
+	sessionIDs, err := storer.UserSessionIDs(pid)
+	if err != nil || len(sessionIDs) == 0 {
+		return 0, err
+	}
+
+	// The GORM session backend creates its table when the web site first starts with it.
+	if storer.UserDB.Migrator().HasTable(sessionsTable) {
+		if err := storer.UserDB.Where("id IN ?", sessionIDs).Delete(&sessionRecord{}).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	for _, sessionID := range sessionIDs {
+		if err := storer.RevokeToken(sessionID, denyUntil); err != nil {
+			return 0, err
+		}
+	}
+
+	tx := storer.UserDB.Where("session_id IN ?", sessionIDs).Delete(&UserSessions{})
+	return int64(len(sessionIDs)), tx.Error
+}
+
+// ReapUserSessions removes the expired sessions from the user session index and returns how
+// many it removed.
+func (storer AuthStorer) ReapUserSessions() (int64, error) {
+	idleSince, signedInSince := storer.userSessionCutoffs()
+	tx := storer.UserDB.
+		Where("last_seen <= ? OR created_at <= ?", idleSince, signedInSince).
+		Delete(&UserSessions{})
+
+	return tx.RowsAffected, tx.Error
+}
+
+// userSessionCutoffs returns the times before which a session in the user session index has
+// expired: last seen before idleSince (sessions:idle_timeout), or signed in before
+// signedInSince (sessions:max_lifetime.) The index is independent of the session backend, so
+// it goes by the session timeouts rather than the backend's own expiration. The last seen time
+// lags by up to userSessionTouchInterval.
+func (storer AuthStorer) userSessionCutoffs() (idleSince, signedInSince time.Time) {
+	idleTimeout, maxLifetime := storer.sessionIdleTimeout, storer.sessionMaxLifetime
+	if idleTimeout <= 0 {
+		idleTimeout = defaultConfig.Sessions.IdleTimeout
+	}
+
+	if maxLifetime <= 0 {
+		maxLifetime = defaultConfig.Sessions.MaxLifetime
+	}
+
+	now := time.Now().UTC()
+	return now.Add(-idleTimeout - userSessionTouchInterval), now.Add(-maxLifetime)
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Revoked tokens (the JWT client state's deny-list, see jwtClientState.go)
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// RevokeToken adds the token ID to the deny-list until expiresAt, when every token with the ID
+// has expired. Revoking a token twice keeps the later expiration.
+func (storer AuthStorer) RevokeToken(jti string, expiresAt time.Time) error {
+	return storer.UserDB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "jti"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"expires_at": gorm.Expr("MAX(`revoked_tokens`.`expires_at`, excluded.`expires_at`)"),
+		}),
+	}).Create(&RevokedTokens{
+		JTI:       jti,
+		ExpiresAt: expiresAt.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}).Error
+}
+
+// IsTokenRevoked returns true if the token ID is on the deny-list.
+func (storer AuthStorer) IsTokenRevoked(jti string) (bool, error) {
+	var revoked int64
+	tx := storer.UserDB.Model(&RevokedTokens{}).Where("jti = ?", jti).Count(&revoked)
+
+	return revoked > 0, tx.Error
+}
+
+// ReapRevokedTokens removes the tokens that have expired from the deny-list and returns how
+// many it removed.
+func (storer AuthStorer) ReapRevokedTokens() (int64, error) {
+	tx := storer.UserDB.Where("expires_at <= ?", time.Now().UTC()).Delete(&RevokedTokens{})
+	return tx.RowsAffected, tx.Error
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Outbox (the outbound mail queue, see mailOutbox.go)
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// EnqueueMail adds the e-mail to the outbox, due now, and returns its ID.
+func (storer AuthStorer) EnqueueMail(email authboss.Email) (uint64, error) {
+	encoded, err := json.Marshal(email)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	queued := &Outbox{
+		Recipients:    strings.Join(append(append(append([]string{}, email.To...), email.Cc...), email.Bcc...), ", "),
+		Subject:       email.Subject,
+		Email:         string(encoded),
+		Status:        outboxPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+
+	err = storer.UserDB.Create(queued).Error
+	return queued.ID, err
+}
+
+// DueMail returns up to limit pending e-mails that are due, the longest overdue first.
+func (storer AuthStorer) DueMail(limit int) (due []Outbox, err error) {
+	err = storer.UserDB.Where("status = ? AND next_attempt_at <= ?", outboxPending, time.Now().UTC()).
+		Order("next_attempt_at, id").Limit(limit).Find(&due).Error
+
+	return due, err
+}
+
+// ClaimMail claims a due e-mail for delivery by pushing its next attempt lease into the
+// future. Only one server can claim the e-mail; if that server dies while delivering it, the
+// e-mail is due again once the lease is up.
+func (storer AuthStorer) ClaimMail(id uint64, lease time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	tx := storer.UserDB.Model(&Outbox{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", id, outboxPending, now).
+		Update("next_attempt_at", now.Add(lease))
+
+	return tx.RowsAffected == 1, tx.Error
+}
+
+// MarkMailSent records the e-mail's delivery and clears its body, which carries the
+// confirmation or recovery link's token.
+func (storer AuthStorer) MarkMailSent(id uint64) error {
+	return storer.UserDB.Model(&Outbox{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":     outboxSent,
+		"email":      "",
+		"last_error": "",
+		"sent_at":    time.Now().UTC(),
+	}).Error
+}
+
+// MarkMailFailed records a failed delivery attempt: the e-mail is due again at nextAttempt or,
+// if dead, is given up on (dead-lettered.)
+func (storer AuthStorer) MarkMailFailed(id uint64, attempts int, lastError string, nextAttempt time.Time, dead bool) error {
+	status := outboxPending
+	if dead {
+		status = outboxDead
+	}
+
+	return storer.UserDB.Model(&Outbox{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":          status,
+		"attempts":        attempts,
+		"last_error":      lastError,
+		"next_attempt_at": nextAttempt.UTC(),
+	}).Error
+}
+
+// ListMail returns up to limit e-mails in the outbox with the status, newest first. The
+// "stuck" status lists the dead e-mails and the pending e-mails that have failed at least once.
+func (storer AuthStorer) ListMail(status string, limit int) (mail []Outbox, err error) {
+	tx := storer.UserDB.Order("id DESC").Limit(limit)
+	if status == outboxStuck {
+		tx = tx.Where("status = ? OR (status = ? AND attempts > 0)", outboxDead, outboxPending)
+	} else {
+		tx = tx.Where("status = ?", status)
+	}
+
+	err = tx.Find(&mail).Error
+	return mail, err
+}
+
+// CountStuckMail returns how many e-mails are stuck: dead, or pending after a failed attempt.
+func (storer AuthStorer) CountStuckMail() (stuck int64, err error) {
+	err = storer.UserDB.Model(&Outbox{}).
+		Where("status = ? OR (status = ? AND attempts > 0)", outboxDead, outboxPending).
+		Count(&stuck).Error
+
+	return stuck, err
+}
+
+// GetMail returns the e-mail in the outbox with the ID.
+func (storer AuthStorer) GetMail(id uint64) (*Outbox, error) {
+	queued := &Outbox{}
+	tx := storer.UserDB.Where("id = ?", id).First(queued)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrMailNotFound
+	}
+
+	return queued, tx.Error
+}
+
+// RetryMail makes a pending or dead e-mail due now, with a fresh set of attempts.
+func (storer AuthStorer) RetryMail(id uint64) error {
+	tx := storer.UserDB.Model(&Outbox{}).Where("id = ? AND status IN ?", id, []string{outboxPending, outboxDead}).
+		Updates(map[string]interface{}{
+			"status":          outboxPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now().UTC(),
+		})
+	if tx.Error == nil && tx.RowsAffected == 0 {
+		return ErrMailNotFound
+	}
+
+	return tx.Error
+}
+
+// DeleteMail removes the e-mail from the outbox.
+func (storer AuthStorer) DeleteMail(id uint64) error {
+	tx := storer.UserDB.Where("id = ?", id).Delete(&Outbox{})
+	if tx.Error == nil && tx.RowsAffected == 0 {
+		return ErrMailNotFound
+	}
+
+	return tx.Error
+}
+
+// ReapSentMail removes the e-mails that were delivered before sentBefore and returns how many
+// it removed.
+func (storer AuthStorer) ReapSentMail(sentBefore time.Time) (int64, error) {
+	tx := storer.UserDB.Where("status = ? AND sent_at <= ?", outboxSent, sentBefore.UTC()).Delete(&Outbox{})
+	return tx.RowsAffected, tx.Error
+}
+
+// ReapDeadMail removes the e-mails that were dead-lettered before deadBefore and returns how
+// many it removed.
+func (storer AuthStorer) ReapDeadMail(deadBefore time.Time) (int64, error) {
+	tx := storer.UserDB.Where("status = ? AND next_attempt_at <= ?", outboxDead, deadBefore.UTC()).Delete(&Outbox{})
+	return tx.RowsAffected, tx.Error
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// OAuth2ServerStorer implementation
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// NewFromOAuth2 returns the user for the OAuth2 identity described by details (the
+// provider's user details.) The identity is linked to a user's GUID, in order of
+// preference:
+//
+// 1. The user to which the identity was previously linked.
+// 2. The user who is currently signed in (linking from the user management page.)
+// 3. The user with the same e-mail address, if the provider is configured with
+// "link_by_email" and the provider verified the address.
+//
+// Otherwise, the user is new and SaveOAuth2 creates the user. This only returns
+// the user, it does not persist the identity (SaveOAuth2 does that.)
+func (storer AuthStorer) NewFromOAuth2(ctx context.Context, provider string, details map[string]string) (authboss.OAuth2User, error) {
+	uid := details[aboauth2.OAuth2UID]
+	email := details[aboauth2.OAuth2Email]
+	emailVerified := details[oauth2EmailVerified] == "true"
+
+	if len(uid) == 0 {
+		return nil, fmt.Errorf("%s OAuth2 provider did not return a user identifier", provider)
+	}
+
+	identity := OAuth2Identities{Provider: provider, UID: uid}
+
+	// 1. Previously linked identity:
+	var linked OAuth2Identities
+	tx := storer.UserDB.Model(&OAuth2Identities{}).Where(identity).Joins("User").First(&linked)
+	if tx.Error == nil {
+		storer.log.Printf("NewFromOAuth2: %s identity %s linked to GUID %s", provider, uid, linked.GUID)
+		return &WorkedUser{
+			AuthStorer:     &storer,
+			UserData:       linked.User,
+			oauth2Identity: linked,
+		}, nil
+	} else if !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return nil, tx.Error
+	}
+
+	// 2. Currently signed in user:
+	if state, valid := ctx.Value(authboss.CTXKeySessionState).(authboss.ClientState); valid {
+		if pid, signedIn := state.Get(authboss.SessionKey); signedIn && len(pid) > 0 {
+			abUser, err := storer.Load(ctx, pid)
+			if err != nil {
+				return nil, err
+			}
+
+			user := abUser.(*WorkedUser)
+			identity.GUID = user.GUID
+			user.oauth2Identity = identity
+
+			storer.log.Printf("NewFromOAuth2: linking %s identity %s to GUID %s", provider, uid, user.GUID)
+			return user, nil
+		}
+	}
+
+	// Careful: GORM ignores zero-valued struct fields in Where(), so an empty e-mail would
+	// match the first user in the udata table.
+	if len(email) == 0 {
+		return nil, fmt.Errorf("%s OAuth2 provider did not return an e-mail address", provider)
+	}
+
+	// 3. Existing user with the same e-mail address:
+	var userData UserData
+	tx = storer.UserDB.Model(&UserData{}).Where(UserData{Email: email}).First(&userData)
+	switch {
+	case tx.Error == nil && storer.oauth2LinkByEmail[provider] && emailVerified:
+		identity.GUID = userData.GUID
+		storer.log.Printf("NewFromOAuth2: linking %s identity %s to GUID %s by e-mail", provider, uid, userData.GUID)
+		return &WorkedUser{
+			AuthStorer:     &storer,
+			UserData:       userData,
+			oauth2Identity: identity,
+		}, nil
+	case tx.Error == nil:
+		return nil, fmt.Errorf("%w: %s, sign in and link the %s identity from the user page",
+			errOAuth2AccountExists, email, provider)
+	case !errors.Is(tx.Error, gorm.ErrRecordNotFound):
+		return nil, tx.Error
+	}
+
+	// New user:
+	return &WorkedUser{
+		AuthStorer:          &storer,
+		UserData:            UserData{Email: email},
+		oauth2Identity:      identity,
+		oauth2EmailVerified: emailVerified,
+	}, nil
+}
+
+// SaveOAuth2 creates the user if they're new, then creates or updates their OAuth2
+// identity (access token, refresh token and token expiration.)
+func (storer AuthStorer) SaveOAuth2(ctx context.Context, abUser authboss.OAuth2User) error {
+	user, valid := abUser.(*WorkedUser)
+	if !valid {
+		storer.log.Printf("SaveOAuth2(): Expected a User struct in authboss.OAuth2User annotation.")
+		return errors.New("expected a User struct in authboss.OAuth2User annotation in SaveOAuth2()")
+	}
+
+	if len(user.GUID) == 0 {
+		// New user, who doesn't have a password. They can only sign in via OAuth2, unless they
+		// set a password via account recovery.
+		if err := storer.Create(ctx, user); err != nil {
+			return err
+		}
+
+		// Confirmed if the provider vouches for the e-mail address. Otherwise, the user has to
+		// confirm it (see setupOAuth2.)
+		user.PutConfirmed(user.oauth2EmailVerified)
+	}
+
+	user.oauth2Identity.GUID = user.GUID
+
+	// UPSERT the identity. Omit the User association, which may have been filled in by a join.
+	tx := storer.UserDB.Omit("User").Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "provider"}, {Name: "uid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"access_token", "refresh_token", "expiry", "updated_at"}),
+	}).Create(&user.oauth2Identity)
+
+	storer.log.Printf("SaveOAuth2(): rows affected %v", tx.RowsAffected)
+	return tx.Error
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// OpenID Connect provider storage (not an Authboss interface, see oidcProvider.go)
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// SaveOIDCClient adds the client application to the client registry, or updates it if the
+// client ID is already registered.
+func (storer AuthStorer) SaveOIDCClient(client *OIDCClients) error {
+	return storer.UserDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret_hash", "name", "redirect_uris", "updated_at"}),
+	}).Create(client).Error
+}
+
+// LoadOIDCClient looks up the client application, returning authboss.ErrTokenNotFound if the
+// client ID isn't registered.
+func (storer AuthStorer) LoadOIDCClient(clientID string) (*OIDCClients, error) {
+	if len(clientID) == 0 {
+		return nil, authboss.ErrTokenNotFound
+	}
+
+	var client OIDCClients
+
+	tx := storer.UserDB.Where("client_id = ?", clientID).First(&client)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return nil, authboss.ErrTokenNotFound
+	} else if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	return &client, nil
+}
+
+// AddOIDCAuthCode stores a new authorization code, removing expired codes along the way.
+func (storer AuthStorer) AddOIDCAuthCode(code *OIDCAuthCodes) error {
+	if tx := storer.UserDB.Where("expiry < ?", time.Now()).Delete(&OIDCAuthCodes{}); tx.Error != nil {
+		storer.log.Printf("AddOIDCAuthCode: unable to remove expired codes: %v", tx.Error)
+	}
+
+	return storer.UserDB.Create(code).Error
+}
+
+// UseOIDCAuthCode looks up and deletes the authorization code with the hash, so that the
+// code can only be used once. Returns authboss.ErrTokenNotFound if there is no such code or
+// it has expired.
+func (storer AuthStorer) UseOIDCAuthCode(codeHash string) (*OIDCAuthCodes, error) {
+	var code OIDCAuthCodes
+
+	err := storer.UserDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("code_hash = ?", codeHash).First(&code).Error; err != nil {
+			return err
+		}
+
+		// Whoever deletes the row gets to use the code.
+		deleted := tx.Where("code_hash = ?", codeHash).Delete(&OIDCAuthCodes{})
+		if deleted.Error == nil && deleted.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return deleted.Error
+	})
+
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && time.Now().After(code.Expiry)) {
+		return nil, authboss.ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &code, nil
+}
+
+// GetOIDCConsent returns the scopes that the user already allowed the client to access.
+func (storer AuthStorer) GetOIDCConsent(guid, clientID string) []string {
+	var consent OIDCConsents
+
+	tx := storer.UserDB.Where("guid = ? AND client_id = ?", guid, clientID).First(&consent)
+	if tx.Error != nil {
+		if !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			storer.log.Printf("GetOIDCConsent failed: %v", tx.Error)
+		}
+
+		return nil
+	}
+
+	return strings.Fields(consent.Scope)
+}
+
+// PutOIDCConsent records the scopes that the user allowed the client to access.
+func (storer AuthStorer) PutOIDCConsent(guid, clientID string, scopes []string) error {
+	return storer.UserDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "guid"}, {Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scope", "updated_at"}),
+	}).Create(&OIDCConsents{
+		GUID:     guid,
+		ClientID: clientID,
+		Scope:    strings.Join(scopes, " "),
+	}).Error
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Personal access token storage (not an Authboss interface, see apiTokens.go)
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// AddAPIToken stores a new personal access token.
+func (storer AuthStorer) AddAPIToken(token *APITokens) error {
+	return storer.UserDB.Create(token).Error
+}
+
+// LoadAPIToken looks up a personal access token by its hash, returning
+// authboss.ErrTokenNotFound if there isn't one. Expiry is the caller's problem.
+func (storer AuthStorer) LoadAPIToken(tokenHash string) (*APITokens, error) {
+	if len(tokenHash) == 0 {
+		return nil, authboss.ErrTokenNotFound
+	}
+
+	var token APITokens
+
+	tx := storer.UserDB.Where("token_hash = ?", tokenHash).First(&token)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return nil, authboss.ErrTokenNotFound
+	} else if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	return &token, nil
+}
+
+// PutAPITokenUse records when the personal access token was last used.
+func (storer AuthStorer) PutAPITokenUse(tokenID string) {
+	tx := storer.UserDB.Model(&APITokens{}).
+		Where("token_id = ?", tokenID).
+		Update("last_used", time.Now())
+
+	if tx.Error != nil {
+		storer.log.Printf("PutAPITokenUse failed: %v", tx.Error)
+	}
 }
 
 // =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
-// RememberingServerStorer implementation
+// Role-based access control storage (not an Authboss interface, see rbac.go)
 // =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
 
-// AddRememberToken associates a "remember me" token with the user
-func (storer AuthStorer) AddRememberToken(ctx context.Context, pid, token string) error {
-	var userGUID string
+// SaveRole adds the role, or updates its description if it already exists, and replaces the
+// role's permissions.
+func (storer AuthStorer) SaveRole(name, description string, permissions []string) error {
+	return storer.UserDB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"description", "updated_at"}),
+		}).Create(&Roles{Name: name, Description: description}).Error
+		if err != nil {
+			return err
+		}
 
-	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
-	if tx.Error != nil {
-		return tx.Error
-	}
+		if err := tx.Where("role = ?", name).Delete(&RolePermissions{}).Error; err != nil {
+			return err
+		}
 
-	guidTX := storer.UserDB.Model(&RememberMeTokens{}).Create(&RememberMeTokens{GUID: userGUID, Token: token})
+		for _, permission := range permissions {
+			if err := tx.Create(&RolePermissions{Role: name, Permission: permission}).Error; err != nil {
+				return err
+			}
+		}
 
-	storer.log.Printf("AddRememberToken: %v rows affected.", guidTX.RowsAffected)
-	return guidTX.Error
+		return nil
+	})
 }
 
-// DelRememberTokens removes all "remember me" tokens previously associated with the user
-func (storer AuthStorer) DelRememberTokens(ctx context.Context, pid string) error {
-	var userGUID string
-
-	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
-	if tx.Error != nil {
-		return tx.Error
+// LoadRoles returns all of the roles, ordered by name.
+func (storer AuthStorer) LoadRoles() (roles []Roles) {
+	if tx := storer.UserDB.Order("name").Find(&roles); tx.Error != nil {
+		storer.log.Printf("LoadRoles failed: %v", tx.Error)
+		return nil
 	}
 
-	// GUID is not the primary key, so a "WHERE" clause is required to delete:
-	guidToDelete := RememberMeTokens{GUID: userGUID}
-	guidTX := storer.UserDB.Model(&guidToDelete).Where(&guidToDelete).Delete(&guidToDelete)
-
-	storer.log.Printf("DelRememberTokens: %v rows deleted.", guidTX.RowsAffected)
-	return guidTX.Error
+	return roles
 }
 
-// UseRememberToken finds the pid-token pair and deletes it (consumes the remember token).
-// If the token could not be found return ErrTokenNotFound
-func (storer AuthStorer) UseRememberToken(ctx context.Context, pid, token string) error {
-	var userGUID string
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Administrator console storage (not an Authboss interface, see adminConsole.go)
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
 
-	tx := storer.UserDB.Model(&UserData{}).Select("guid").Where(UserData{Email: pid}).First(&userGUID)
-	if tx.Error != nil {
-		return tx.Error
+// SearchUsers returns a page of the users whose e-mail address contains query (all users if
+// query is empty), ordered by e-mail address, and the total number of matching users.
+func (storer AuthStorer) SearchUsers(query string, offset, limit int) (users []UserData, total int64, err error) {
+	// Count() and Find() each need their own statement: GORM's chained statements aren't
+	// reusable.
+	search := func() *gorm.DB {
+		tx := storer.UserDB.Model(&UserData{})
+		if len(query) > 0 {
+			// Escape LIKE's wildcards, so that "_" and "%" match themselves.
+			pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query)
+			tx = tx.Where(`email LIKE ? ESCAPE '\'`, "%"+pattern+"%")
+		}
+
+		return tx
 	}
 
-	guidTX := storer.UserDB.Model(&RememberMeTokens{}).Delete(&RememberMeTokens{GUID: userGUID, Token: token})
+	if err = search().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
 
-	storer.log.Printf("UseRememberToken: %v rows affected (GUID: %v, token %v).", guidTX.RowsAffected, userGUID, token)
-	if errors.Is(guidTX.Error, gorm.ErrRecordNotFound) {
-		storer.log.Print("UseRememberToken: (GUID, token) pair not found.")
-		return authboss.ErrTokenNotFound
-	} else if guidTX.Error != nil {
-		storer.log.Print("UseRememberToken: GORM database error: %w.", guidTX.Error)
+	err = search().Order("email").Offset(offset).Limit(limit).Find(&users).Error
+	return users, total, err
+}
+
+// DeleteUser deletes the user and all of the rows that refer to the user's GUID.
+func (storer AuthStorer) DeleteUser(guid string) error {
+	if len(guid) == 0 {
+		return authboss.ErrUserNotFound
 	}
 
-	return guidTX.Error
+	return storer.UserDB.Transaction(func(tx *gorm.DB) error {
+		related := []interface{}{
+			&Confirmations{},
+			&LockedAccount{},
+			&RecoveryRequests{},
+			&RememberMeTokens{},
+			&TwoFactorTOTP{},
+			&TwoFactorSMS{},
+			&OAuth2Identities{},
+			&WebAuthnCredentials{},
+			&OIDCAuthCodes{},
+			&OIDCConsents{},
+			&APITokens{},
+			&UserRoles{},
+			&SecurityEvents{},
+			&UserSessions{},
+		}
+
+		for _, table := range related {
+			if err := tx.Where("guid = ?", guid).Delete(table).Error; err != nil {
+				return err
+			}
+		}
+
+		result := tx.Where("guid = ?", guid).Delete(&UserData{})
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return authboss.ErrUserNotFound
+		}
+
+		return nil
+	})
 }
 
 // =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
@@ -624,7 +1553,10 @@ func (user *WorkedUser) GetAttemptCount() (attempts int) {
 		Where("guid IN (?)", subq).
 		First(&attempts)
 
-	if result.Error != nil {
+	// No locked_accounts row: the user hasn't failed to sign in (yet.)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		attempts = 0
+	} else if result.Error != nil {
 		attempts = 9999
 	}
 
@@ -839,41 +1771,488 @@ func (user *WorkedUser) PutRecoverExpiry(expiry time.Time) {
 
 }
 
-/* 2FA: TBD
-// GetTOTPSecretKey returns the time-based one time password (TOTP) secret key
+// getTOTPByGUID gets the user's TOTP 2fa data by the user's GUID.
+func (user *WorkedUser) getTOTPByGUID() (totp TwoFactorTOTP, err error) {
+	// This might seem to be overkill -- joining back to the UserData user via the user's GUID.
+	// It does ensure that the user really does exist.
+	result := user.AuthStorer.UserDB.Model(&TwoFactorTOTP{}).
+		Where(TwoFactorTOTP{GUID: user.GUID}).
+		Joins("User").
+		First(&totp)
+
+	if result.Error != nil {
+		// Error or inner join fail.
+		return TwoFactorTOTP{}, result.Error
+	} else if len(totp.User.GUID) == 0 {
+		return TwoFactorTOTP{}, errors.New("inner join to UserData failed")
+	}
+
+	return totp, nil
+}
+
+// GetTOTPSecretKey returns the time-based one time password (TOTP) secret key. An
+// empty secret key means that the user hasn't enabled TOTP 2fa.
 func (user *WorkedUser) GetTOTPSecretKey() string {
-	return user.TOTPSecretKey
+	totp, err := user.getTOTPByGUID()
+	if err != nil {
+		return ""
+	}
+
+	return totp.TOTPSecretKey.String
 }
 
-// PutTOTPSecretKey stores the time-based one time password (TOTP) secret key
+// PutTOTPSecretKey stores the time-based one time password (TOTP) secret key. Authboss
+// removes TOTP 2fa by storing an empty secret key, which becomes a SQL NULL.
 func (user *WorkedUser) PutTOTPSecretKey(totpSecret string) {
-	user.TOTPSecretKey = totpSecret
+	// UPSERT to update the secret key -- if the GUID already exists, then only update
+	// the secret key.
+	tx := user.AuthStorer.UserDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "guid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"totp_secret_key"}),
+	}).Create(&TwoFactorTOTP{
+		GUID:          user.GUID,
+		TOTPSecretKey: makeSQLNullString(totpSecret),
+	})
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("PutTOTPSecretKey failed: %v", tx.Error)
+	}
+}
+
+// GetTOTPLastCode returns the last TOTP code the user successfully used (totp2fa.UserOneTime
+// interface.)
+func (user *WorkedUser) GetTOTPLastCode() string {
+	totp, err := user.getTOTPByGUID()
+	if err != nil {
+		return ""
+	}
+
+	return totp.TOTPLastCode
+}
+
+// PutTOTPLastCode stores the last TOTP code the user used so that it cannot be replayed
+// (totp2fa.UserOneTime interface.)
+func (user *WorkedUser) PutTOTPLastCode(code string) {
+	tx := user.AuthStorer.UserDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "guid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"totp_last_code"}),
+	}).Create(&TwoFactorTOTP{
+		GUID:         user.GUID,
+		TOTPLastCode: code,
+	})
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("PutTOTPLastCode failed: %v", tx.Error)
+	}
 }
 
 // GetRecoveryCodes retrieves a CSV string of bcrypt'd recovery codes
 func (user *WorkedUser) GetRecoveryCodes() string {
-	return user.RecoveryCodes
+	totp, err := user.getTOTPByGUID()
+	if err != nil {
+		return ""
+	}
+
+	return totp.RecoveryCodes
 }
 
 // PutRecoveryCodes uses a single string to store many bcrypt'd recovery codes
 func (user *WorkedUser) PutRecoveryCodes(codes string) {
-	user.RecoveryCodes = codes
+	tx := user.AuthStorer.UserDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "guid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"recovery_codes"}),
+	}).Create(&TwoFactorTOTP{
+		GUID:          user.GUID,
+		RecoveryCodes: codes,
+	})
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("PutRecoveryCodes failed: %v", tx.Error)
+	}
 }
-*/
 
-/* SMS 2FA: TBD
 // GetSMSPhoneNumber returns the user's phone number to which a text message
-// with a 2FA code will be sent
+// with a 2FA code will be sent. An empty phone number means that the user hasn't
+// enabled SMS 2fa.
 func (user *WorkedUser) GetSMSPhoneNumber() string {
-	return user.SMSPhoneNumber
+	// See note in GetAttemptCount.
+
+	var phoneNumber sql.NullString
+
+	subq := user.AuthStorer.UserDB.Model(&UserData{}).Select("guid").Where(&UserData{Email: user.GetPID()})
+	result := user.AuthStorer.UserDB.Model(&TwoFactorSMS{}).
+		Select("phone_number").
+		Where("guid IN (?)", subq).
+		First(&phoneNumber)
+
+	if result.Error == nil && phoneNumber.Valid {
+		return phoneNumber.String
+	}
+
+	return ""
 }
 
-// PutSMSPhoneNumber returns the user's phone number to which a text message
-// will be sent
+// PutSMSPhoneNumber stores the user's phone number to which a text message
+// will be sent. Authboss removes SMS 2fa by storing an empty phone number,
+// which becomes a SQL NULL.
 func (user *WorkedUser) PutSMSPhoneNumber(phnumber string) {
-	user.SMSPhoneNumber = phnumber
+	tx := user.AuthStorer.UserDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "guid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"phone_number"}),
+	}).Create(&TwoFactorSMS{
+		GUID:        user.GUID,
+		PhoneNumber: makeSQLNullString(phnumber),
+	})
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("PutSMSPhoneNumber failed: %v", tx.Error)
+	}
+}
+
+// IsOAuth2User returns true if the user signed in with an OAuth2 identity.
+func (user *WorkedUser) IsOAuth2User() bool {
+	return len(user.oauth2Identity.Provider) > 0
+}
+
+// GetOAuth2UID returns the user's identifier at the OAuth2 provider
+func (user *WorkedUser) GetOAuth2UID() (uid string) {
+	return user.oauth2Identity.UID
+}
+
+// GetOAuth2Provider returns the OAuth2 provider's name
+func (user *WorkedUser) GetOAuth2Provider() (provider string) {
+	return user.oauth2Identity.Provider
+}
+
+// GetOAuth2AccessToken returns the OAuth2 access token
+func (user *WorkedUser) GetOAuth2AccessToken() (token string) {
+	return user.oauth2Identity.AccessToken
+}
+
+// GetOAuth2RefreshToken returns the OAuth2 refresh token
+func (user *WorkedUser) GetOAuth2RefreshToken() (refreshToken string) {
+	return user.oauth2Identity.RefreshToken
+}
+
+// GetOAuth2Expiry returns the OAuth2 access token's expiration
+func (user *WorkedUser) GetOAuth2Expiry() (expiry time.Time) {
+	return user.oauth2Identity.Expiry
+}
+
+// PutOAuth2UID stores the user's identifier at the OAuth2 provider. The OAuth2 Put
+// functions only update the WorkedUser; SaveOAuth2 persists the identity.
+func (user *WorkedUser) PutOAuth2UID(uid string) {
+	user.oauth2Identity.UID = uid
+}
+
+// PutOAuth2Provider stores the OAuth2 provider's name
+func (user *WorkedUser) PutOAuth2Provider(provider string) {
+	user.oauth2Identity.Provider = provider
+}
+
+// PutOAuth2AccessToken stores the OAuth2 access token
+func (user *WorkedUser) PutOAuth2AccessToken(token string) {
+	user.oauth2Identity.AccessToken = token
+}
+
+// PutOAuth2RefreshToken stores the OAuth2 refresh token
+func (user *WorkedUser) PutOAuth2RefreshToken(refreshToken string) {
+	user.oauth2Identity.RefreshToken = refreshToken
+}
+
+// PutOAuth2Expiry stores the OAuth2 access token's expiration
+func (user *WorkedUser) PutOAuth2Expiry(expiry time.Time) {
+	user.oauth2Identity.Expiry = expiry
+}
+
+// GetOAuth2Providers returns the names of the OAuth2 providers whose identities are
+// linked to the user's account.
+func (user *WorkedUser) GetOAuth2Providers() (providers []string) {
+	result := user.AuthStorer.UserDB.Model(&OAuth2Identities{}).
+		Distinct("provider").
+		Where("guid = ?", user.GUID).
+		Order("provider").
+		Find(&providers)
+
+	if result.Error != nil {
+		user.AuthStorer.log.Printf("GetOAuth2Providers failed: %v", result.Error)
+		return nil
+	}
+
+	return providers
+}
+
+// WebAuthnID returns the user handle that WebAuthn stores with the user's passkeys. It's the
+// user's GUID, not their e-mail, so that the e-mail address can change. (webauthn.User
+// interface)
+func (user *WorkedUser) WebAuthnID() []byte {
+	return []byte(user.GUID)
+}
+
+// WebAuthnName returns the name that the browser shows when choosing a passkey (webauthn.User
+// interface)
+func (user *WorkedUser) WebAuthnName() string {
+	return user.Email
+}
+
+// WebAuthnDisplayName returns the user's display name (webauthn.User interface)
+func (user *WorkedUser) WebAuthnDisplayName() string {
+	return user.Email
+}
+
+// WebAuthnIcon is deprecated in the WebAuthn spec, but still part of the webauthn.User
+// interface.
+func (user *WorkedUser) WebAuthnIcon() string {
+	return ""
+}
+
+// WebAuthnCredentials returns the user's registered passkeys (webauthn.User interface)
+func (user *WorkedUser) WebAuthnCredentials() []webauthn.Credential {
+	rows := user.GetWebAuthnCredentials()
+	credentials := make([]webauthn.Credential, 0, len(rows))
+
+	for _, row := range rows {
+		id, err := base64.RawURLEncoding.DecodeString(row.CredentialID)
+		if err != nil {
+			user.AuthStorer.log.Printf("WebAuthnCredentials: bad credential ID %s: %v", row.CredentialID, err)
+			continue
+		}
+
+		var transports []protocol.AuthenticatorTransport
+		if len(row.Transports) > 0 {
+			for _, transport := range strings.Split(row.Transports, ",") {
+				transports = append(transports, protocol.AuthenticatorTransport(transport))
+			}
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       row.PublicKey,
+			AttestationType: row.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				UserPresent:    row.UserPresent,
+				UserVerified:   row.UserVerified,
+				BackupEligible: row.BackupEligible,
+				BackupState:    row.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:       row.AAGUID,
+				SignCount:    row.SignCount,
+				CloneWarning: row.CloneWarning,
+			},
+		})
+	}
+
+	return credentials
+}
+
+// GetWebAuthnCredentials returns the database rows for the user's passkeys, oldest first.
+func (user *WorkedUser) GetWebAuthnCredentials() (credentials []WebAuthnCredentials) {
+	result := user.AuthStorer.UserDB.Model(&WebAuthnCredentials{}).
+		Where("guid = ?", user.GUID).
+		Order("created_at").
+		Find(&credentials)
+
+	if result.Error != nil {
+		user.AuthStorer.log.Printf("GetWebAuthnCredentials failed: %v", result.Error)
+		return nil
+	}
+
+	return credentials
+}
+
+// AddWebAuthnCredential stores a newly registered passkey.
+func (user *WorkedUser) AddWebAuthnCredential(credential *webauthn.Credential, name string) error {
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	tx := user.AuthStorer.UserDB.Create(&WebAuthnCredentials{
+		CredentialID:    base64.RawURLEncoding.EncodeToString(credential.ID),
+		GUID:            user.GUID,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		UserPresent:     credential.Flags.UserPresent,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	})
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("AddWebAuthnCredential failed: %v", tx.Error)
+	}
+
+	return tx.Error
+}
+
+// PutWebAuthnCredentialUse updates the passkey's signature counter, clone warning and
+// backup state after the user signs in with it.
+func (user *WorkedUser) PutWebAuthnCredentialUse(credential *webauthn.Credential) {
+	tx := user.AuthStorer.UserDB.Model(&WebAuthnCredentials{}).
+		Where("credential_id = ? AND guid = ?", base64.RawURLEncoding.EncodeToString(credential.ID), user.GUID).
+		Updates(map[string]interface{}{
+			"sign_count":    credential.Authenticator.SignCount,
+			"clone_warning": credential.Authenticator.CloneWarning,
+			"backup_state":  credential.Flags.BackupState,
+			"last_used":     time.Now(),
+		})
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("PutWebAuthnCredentialUse failed: %v", tx.Error)
+	}
+}
+
+// DelWebAuthnCredential removes one of the user's passkeys, returning authboss.ErrTokenNotFound
+// if the user doesn't have a passkey with the credential ID.
+func (user *WorkedUser) DelWebAuthnCredential(credentialID string) error {
+	tx := user.AuthStorer.UserDB.
+		Where("credential_id = ? AND guid = ?", credentialID, user.GUID).
+		Delete(&WebAuthnCredentials{})
+
+	if tx.Error != nil {
+		return tx.Error
+	} else if tx.RowsAffected == 0 {
+		return authboss.ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// GetAPITokens returns the user's personal access tokens, oldest first.
+func (user *WorkedUser) GetAPITokens() (tokens []APITokens) {
+	result := user.AuthStorer.UserDB.Model(&APITokens{}).
+		Where("guid = ?", user.GUID).
+		Order("created_at").
+		Find(&tokens)
+
+	if result.Error != nil {
+		user.AuthStorer.log.Printf("GetAPITokens failed: %v", result.Error)
+		return nil
+	}
+
+	return tokens
+}
+
+// DelAPIToken revokes one of the user's personal access tokens, returning
+// authboss.ErrTokenNotFound if the user doesn't have a token with the token ID.
+func (user *WorkedUser) DelAPIToken(tokenID string) error {
+	tx := user.AuthStorer.UserDB.
+		Where("token_id = ? AND guid = ?", tokenID, user.GUID).
+		Delete(&APITokens{})
+
+	if tx.Error != nil {
+		return tx.Error
+	} else if tx.RowsAffected == 0 {
+		return authboss.ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// GetRoles returns the names of the user's roles, in alphabetical order.
+func (user *WorkedUser) GetRoles() (roles []string) {
+	tx := user.AuthStorer.UserDB.Model(&UserRoles{}).
+		Where("guid = ?", user.GUID).
+		Order("role").
+		Pluck("role", &roles)
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("GetRoles failed: %v", tx.Error)
+		return nil
+	}
+
+	return roles
+}
+
+// GetPermissions returns the permissions granted by the user's roles, in alphabetical order.
+func (user *WorkedUser) GetPermissions() (permissions []string) {
+	tx := user.AuthStorer.UserDB.Model(&RolePermissions{}).
+		Distinct("role_permissions.permission").
+		Joins("JOIN user_roles ON user_roles.role = role_permissions.role").
+		Where("user_roles.guid = ?", user.GUID).
+		Order("role_permissions.permission").
+		Pluck("role_permissions.permission", &permissions)
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("GetPermissions failed: %v", tx.Error)
+		return nil
+	}
+
+	return permissions
+}
+
+// AddRole assigns the role to the user. Assigning a role that the user already has is not
+// an error; assigning a role that doesn't exist is.
+func (user *WorkedUser) AddRole(role string) error {
+	var count int64
+	if tx := user.AuthStorer.UserDB.Model(&Roles{}).Where("name = ?", role).Count(&count); tx.Error != nil {
+		return tx.Error
+	} else if count == 0 {
+		return fmt.Errorf("unknown role '%s'", role)
+	}
+
+	return user.AuthStorer.UserDB.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&UserRoles{GUID: user.GUID, Role: role}).Error
+}
+
+// DelRole removes the role from the user, returning authboss.ErrTokenNotFound if the user
+// doesn't have the role.
+func (user *WorkedUser) DelRole(role string) error {
+	tx := user.AuthStorer.UserDB.
+		Where("guid = ? AND role = ?", user.GUID, role).
+		Delete(&UserRoles{})
+
+	if tx.Error != nil {
+		return tx.Error
+	} else if tx.RowsAffected == 0 {
+		return authboss.ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// GetRememberTokenCount returns the number of remember-me tokens (browsers where the user
+// checked "Remember me") that the user has.
+func (user *WorkedUser) GetRememberTokenCount() (count int64) {
+	tx := user.AuthStorer.UserDB.Model(&RememberMeTokens{}).Where("guid = ?", user.GUID).Count(&count)
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("GetRememberTokenCount failed: %v", tx.Error)
+	}
+
+	return count
+}
+
+// GetSecurityEvents returns the user's most recent security events, newest first.
+func (user *WorkedUser) GetSecurityEvents(limit int) (events []SecurityEvents) {
+	tx := user.AuthStorer.UserDB.Where("guid = ?", user.GUID).Order("created_at desc, id desc").Limit(limit).Find(&events)
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("GetSecurityEvents failed: %v", tx.Error)
+	}
+
+	return events
+}
+
+// GetUserSessions returns the user's unexpired sessions, most recently used first.
+func (user *WorkedUser) GetUserSessions() (sessions []UserSessions) {
+	idleSince, signedInSince := user.AuthStorer.userSessionCutoffs()
+	tx := user.AuthStorer.UserDB.
+		Where("guid = ? AND last_seen > ? AND created_at > ?", user.GUID, idleSince, signedInSince).
+		Order("last_seen desc").
+		Find(&sessions)
+
+	if tx.Error != nil {
+		user.AuthStorer.log.Printf("GetUserSessions failed: %v", tx.Error)
+		return nil
+	}
+
+	return sessions
 }
-*/
 
 // GetArbitrary returns the authboss "arbitrary" form data that should be preserved across
 // form invocations.
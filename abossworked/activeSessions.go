@@ -0,0 +1,286 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	gsessions "github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	// How often a session's last seen time is updated
+	userSessionTouchInterval = time.Minute
+	// Longest user agent kept in the user session index
+	userSessionMaxUserAgent = 256
+
+	// Where the user manages their sessions
+	activeSessionsManagePath = "/app/user"
+)
+
+// ActiveSessions lists the user's sessions (where they're signed in) on the user management
+// page and lets them revoke a session or sign out everywhere.
+//
+// The session backend's sessions are encoded with the session seed and don't say whose session
+// they are. The track middleware keeps an index (user_sessions table): after each request, it
+// records the signed in user's session, browser, address and when the session was last used,
+// and drops the session from the index when the user signs out. Revoking a session deletes it
+// from the session backend (or puts its JWT on the deny-list, see jwtClientState.go) and the
+// index; a session the backend can't delete (a cookie) is signed out by verify, since it's no
+// longer in the index.
+type ActiveSessions struct {
+	aboss    *authboss.Authboss
+	storer   *AuthStorer
+	sessions SessionRevoker
+
+	// Sign out revoked sessions that weren't deleted (see verify.)
+	verifyIndexed bool
+
+	logger *log.Logger
+}
+
+// SessionRevoker signs users out of their sessions. The session store (SessionStore) and the
+// JWT client state (JWTClientState) both implement it, whichever keeps the Authboss session.
+type SessionRevoker interface {
+	// RevokeUserSessions signs the user out everywhere and returns how many sessions it
+	// revoked.
+	RevokeUserSessions(pid string) (int64, error)
+	// RevokeSession signs out whoever is using the session.
+	RevokeSession(sessionID string) error
+}
+
+// makeActiveSessions creates the session tracking middleware and the session management
+// handlers. verifyIndexed is true if revoking a session doesn't delete it (the cookie session
+// backend), so that verify has to sign it out.
+func makeActiveSessions(aboss *authboss.Authboss, storer *AuthStorer, sessions SessionRevoker, verifyIndexed bool) *ActiveSessions {
+	return &ActiveSessions{
+		aboss:         aboss,
+		storer:        storer,
+		sessions:      sessions,
+		verifyIndexed: verifyIndexed,
+		logger:        log.New(os.Stdout, "[SESSIONS] ", log.LstdFlags),
+	}
+}
+
+// routes adds the session management endpoints to the /app group (which requires a signed in
+// user.)
+func (active *ActiveSessions) routes(appspace *gin.RouterGroup) {
+	appspace.POST("/user/sessions/revoke", active.revoke)
+	appspace.POST("/user/sessions/revoke-all", active.revokeAll)
+}
+
+// track is Gin middleware that keeps the user session index up to date. It has to run after
+// the session middleware; it does its work after the request's handlers, once the request has
+// signed the user in (or out.)
+func (active *ActiveSessions) track(ctx *gin.Context) {
+	if active.verifyIndexed {
+		active.verify(ctx)
+	}
+
+	ctx.Next()
+
+	session := gsessions.Default(ctx)
+	sessionID := session.ID()
+	if len(sessionID) == 0 {
+		// A new session that was never saved.
+		return
+	}
+
+	pid, _ := session.Get(authboss.SessionKey).(string)
+	if len(pid) == 0 {
+		if err := active.storer.DelUserSession(sessionID); err != nil {
+			active.logger.Printf("Unable to remove session from the index: %v", err)
+		}
+
+		return
+	}
+
+	series, _ := session.Get(rememberSeriesSessionKey).(string)
+
+	userAgent := ctx.Request.UserAgent()
+	if len(userAgent) > userSessionMaxUserAgent {
+		userAgent = userAgent[:userSessionMaxUserAgent]
+	}
+
+	err := active.storer.TouchUserSession(sessionID, pid, series, userAgent, ctx.ClientIP())
+	if err != nil && !errors.Is(err, authboss.ErrUserNotFound) {
+		active.logger.Printf("Unable to index session: %v", err)
+	}
+}
+
+// verify signs out a revoked session that the session backend couldn't delete: a signed in
+// session that isn't in the user session index. track indexes a session by the end of the
+// request that signs it in, so a signed in session is only missing if it was revoked (or its
+// user was deleted.)
+func (active *ActiveSessions) verify(ctx *gin.Context) {
+	session := gsessions.Default(ctx)
+	sessionID := session.ID()
+	pid, _ := session.Get(authboss.SessionKey).(string)
+	if len(sessionID) == 0 || len(pid) == 0 {
+		return
+	}
+
+	indexed, err := active.storer.HasUserSession(sessionID)
+	if err != nil {
+		active.logger.Printf("Unable to look up session in the index: %v", err)
+		return
+	} else if indexed {
+		return
+	}
+
+	active.logger.Printf("Signing %s out of a revoked session.", pid)
+
+	session.Clear()
+	session.Set(sessionRegenerateKey, true)
+	if err := session.Save(); err != nil {
+		active.logger.Printf("Unable to save the session: %v", err)
+	}
+}
+
+// revoke revokes one of the signed in user's other sessions ("session" form value, the
+// session's handle.)
+func (active *ActiveSessions) revoke(ctx *gin.Context) {
+	user := active.currentUser(ctx)
+	if user == nil {
+		return
+	}
+
+	handle := ctx.PostForm("session")
+	if handle == sessionHandle(gsessions.Default(ctx).ID()) {
+		active.redirect(ctx, "", "That's this session: sign out instead.")
+		return
+	}
+
+	if err := revokeUserSession(ctx.Request.Context(), active.sessions, user, handle); err != nil {
+		if !errors.Is(err, authboss.ErrTokenNotFound) {
+			active.logger.Printf("Unable to revoke session: %v", err)
+		}
+
+		active.redirect(ctx, "", "Unable to revoke the session.")
+		return
+	}
+
+	active.logger.Printf("%s revoked a session", user.Email)
+	active.redirect(ctx, "Session revoked.", "")
+}
+
+// revokeAll signs the user out everywhere, including this session, and forgets them on every
+// browser.
+func (active *ActiveSessions) revokeAll(ctx *gin.Context) {
+	user := active.currentUser(ctx)
+	if user == nil {
+		return
+	}
+
+	revoked, err := signOutEverywhere(ctx.Request.Context(), active.sessions, user)
+	if err != nil {
+		active.logger.Printf("Unable to sign %s out everywhere: %v", user.Email, err)
+		active.redirect(ctx, "", "Unable to sign out everywhere.")
+		return
+	}
+
+	active.logger.Printf("%s signed out everywhere (%d sessions)", user.Email, revoked)
+
+	// This session's row is gone; delete the cookies, too.
+	authboss.DelAllSession(ctx.Writer, []string{})
+	authboss.DelKnownCookie(ctx.Writer)
+	ctx.Redirect(http.StatusFound, "/")
+}
+
+// currentUser returns the signed in user. The /app middleware has already checked that
+// there is one, so failing is an internal error (and the response has been sent.)
+func (active *ActiveSessions) currentUser(ctx *gin.Context) *WorkedUser {
+	abUser, err := active.aboss.LoadCurrentUser(&ctx.Request)
+	if user, valid := abUser.(*WorkedUser); err == nil && valid {
+		return user
+	}
+
+	active.logger.Printf("Unable to load the current user: %v", err)
+	ctx.AbortWithStatus(http.StatusInternalServerError)
+	return nil
+}
+
+// redirect sends the user back to the user management page with a success or failure message.
+func (active *ActiveSessions) redirect(ctx *gin.Context, success, failure string) {
+	err := active.aboss.Core.Redirector.Redirect(ctx.Writer, ctx.Request, authboss.RedirectOptions{
+		Code:         http.StatusFound,
+		RedirectPath: activeSessionsManagePath,
+		Success:      success,
+		Failure:      failure,
+	})
+
+	if err != nil {
+		active.logger.Printf("Redirect failed: %v", err)
+	}
+}
+
+// revokeUserSession revokes the user's session with the handle, and the remember-me series that
+// signed it in, so that the browser's remember-me cookie doesn't just sign it back in. Returns
+// authboss.ErrTokenNotFound if the user doesn't have a session with the handle.
+func revokeUserSession(ctx context.Context, sessions SessionRevoker, user *WorkedUser, handle string) error {
+	for _, session := range user.GetUserSessions() {
+		if session.Handle() != handle {
+			continue
+		}
+
+		if len(session.RememberSeries) > 0 {
+			if err := user.DelRememberSeries(ctx, user.GetPID(), session.RememberSeries); err != nil {
+				return err
+			}
+		}
+
+		return sessions.RevokeSession(session.SessionID)
+	}
+
+	return authboss.ErrTokenNotFound
+}
+
+// signOutEverywhere revokes all of the user's sessions and remember-me tokens, returning how
+// many sessions it revoked.
+func signOutEverywhere(ctx context.Context, sessions SessionRevoker, user *WorkedUser) (int64, error) {
+	if err := user.DelRememberTokens(ctx, user.GetPID()); err != nil {
+		return 0, err
+	}
+
+	return sessions.RevokeUserSessions(user.GetPID())
+}
+
+// Handle identifies the session on the user management and administrator console pages. The
+// session ID itself stays on the server.
+func (session UserSessions) Handle() string {
+	return sessionHandle(session.SessionID)
+}
+
+// sessionHandle is the session ID's handle: a prefix of its SHA-256 hash.
+func sessionHandle(sessionID string) string {
+	if len(sessionID) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,465 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/authboss/v3"
+	"github.com/volatiletech/authboss/v3/lock"
+)
+
+const (
+	// PageAdminUsers is the administrator console's user list.
+	PageAdminUsers = "admin_users"
+	// PageAdminUser is the administrator console's page for a single user.
+	PageAdminUser = "admin_user"
+	// PageAdminOutbox is the administrator console's view of the outbound mail queue.
+	PageAdminOutbox = "admin_outbox"
+
+	// Role that the administrator console requires
+	adminRole = "admin"
+	// Route group for the administrator console
+	adminPath = "/admin"
+	// Users per page in the user list
+	adminUsersPerPage = 20
+	// Most recent security events shown for a user
+	adminSecurityEventCount = 10
+	// Most recent e-mails shown in the outbox
+	adminOutboxCount = 100
+)
+
+// AdminConsole is the administrator console (/admin): search and page through the users, look
+// at a user's confirmation, lock and recovery state, and fix things that used to require
+// editing the SQLite database by hand (force-confirm, unlock, reset the attempt count, revoke
+// remember-me tokens and sessions, delete the account.) The outbox page shows the e-mails that
+// couldn't be delivered (see mailOutbox.go) and retries or deletes them.
+//
+// Only users with the "admin" role (see rbac.go) get in.
+type AdminConsole struct {
+	aboss     *authboss.Authboss
+	storer    *AuthStorer
+	sessions  SessionRevoker
+	templates *Templates
+
+	logger *log.Logger
+}
+
+// adminUserView is what the administrator console (and abossctl) shows about a user. It
+// doesn't embed UserData: the password hash stays out of abossctl's JSON output.
+type adminUserView struct {
+	GUID      string    `json:"guid"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Confirmed bool `json:"confirmed"`
+	// The user has been sent a confirmation e-mail and hasn't clicked on the link yet.
+	ConfirmPending bool `json:"confirm_pending"`
+
+	AttemptCount int       `json:"attempt_count"`
+	LastAttempt  time.Time `json:"last_attempt"`
+	Locked       time.Time `json:"locked_until"`
+	IsLocked     bool      `json:"locked"`
+
+	// The user asked to recover their account and hasn't followed through (yet.)
+	RecoveryPending bool      `json:"recovery_pending"`
+	RecoverExpiry   time.Time `json:"recovery_expiry"`
+
+	RememberTokens int64    `json:"remember_tokens"`
+	Roles          []string `json:"roles"`
+
+	SecurityEvents []adminSecurityEvent `json:"security_events"`
+	Sessions       []adminSession       `json:"sessions"`
+}
+
+// adminSecurityEvent is one of the user's security events (see SecurityEvents.)
+type adminSecurityEvent struct {
+	Event      string    `json:"event"`
+	Detail     string    `json:"detail"`
+	RemoteAddr string    `json:"remote_addr"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// adminSession is one of the user's active sessions (see UserSessions.)
+type adminSession struct {
+	Handle     string    `json:"handle"`
+	UserAgent  string    `json:"user_agent"`
+	RemoteAddr string    `json:"remote_addr"`
+	Remembered bool      `json:"remembered"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// makeAdminUserView collects the user's account state.
+func makeAdminUserView(user *WorkedUser) adminUserView {
+	view := adminUserView{
+		GUID:           user.GUID,
+		Email:          user.Email,
+		CreatedAt:      user.CreatedAt,
+		Confirmed:      user.GetConfirmed(),
+		ConfirmPending: len(user.GetConfirmSelector()) > 0,
+		AttemptCount:   user.GetAttemptCount(),
+		LastAttempt:    user.GetLastAttempt(),
+		Locked:         user.GetLocked(),
+		IsLocked:       lock.IsLocked(user),
+		RememberTokens: user.GetRememberTokenCount(),
+		Roles:          user.GetRoles(),
+	}
+
+	if len(user.GetRecoverSelector()) > 0 {
+		view.RecoverExpiry = user.GetRecoverExpiry()
+		view.RecoveryPending = time.Now().Before(view.RecoverExpiry)
+	}
+
+	view.SecurityEvents = []adminSecurityEvent{}
+	for _, event := range user.GetSecurityEvents(adminSecurityEventCount) {
+		view.SecurityEvents = append(view.SecurityEvents, adminSecurityEvent{
+			Event:      event.Event,
+			Detail:     event.Detail,
+			RemoteAddr: event.RemoteAddr,
+			CreatedAt:  event.CreatedAt,
+		})
+	}
+
+	view.Sessions = []adminSession{}
+	for _, session := range user.GetUserSessions() {
+		view.Sessions = append(view.Sessions, adminSession{
+			Handle:     session.Handle(),
+			UserAgent:  session.UserAgent,
+			RemoteAddr: session.RemoteAddr,
+			Remembered: len(session.RememberSeries) > 0,
+			CreatedAt:  session.CreatedAt,
+			LastSeen:   session.LastSeen,
+		})
+	}
+
+	return view
+}
+
+// forceConfirm confirms the user's account without the confirmation e-mail.
+func forceConfirm(user *WorkedUser) {
+	user.PutConfirmed(true)
+	user.PutConfirmSelector("")
+	user.PutConfirmVerifier("")
+}
+
+// unlockUser unlocks the user's account and resets the failed sign in attempt count.
+func unlockUser(user *WorkedUser) {
+	user.PutLocked(time.Time{})
+	user.PutAttemptCount(0)
+}
+
+// makeAdminConsole creates the administrator console's handlers.
+func makeAdminConsole(aboss *authboss.Authboss, storer *AuthStorer, templates *Templates) *AdminConsole {
+	sessions, _ := aboss.Config.Storage.SessionState.(SessionRevoker)
+
+	return &AdminConsole{
+		aboss:     aboss,
+		storer:    storer,
+		sessions:  sessions,
+		templates: templates,
+		logger:    log.New(os.Stdout, "[ADMIN] ", log.LstdFlags),
+	}
+}
+
+// routes adds the administrator console's pages to the /admin group. The group's middleware
+// has to ensure that the user is an administrator.
+func (admin *AdminConsole) routes(group *gin.RouterGroup) {
+	group.GET("/", admin.users)
+	group.GET("/users/:guid", admin.user)
+
+	group.POST("/users/:guid/confirm", admin.action(admin.confirm))
+	group.POST("/users/:guid/unlock", admin.action(admin.unlock))
+	group.POST("/users/:guid/reset-attempts", admin.action(admin.resetAttempts))
+	group.POST("/users/:guid/revoke-remember", admin.action(admin.revokeRemember))
+	group.POST("/users/:guid/revoke-session", admin.action(admin.revokeSession))
+	group.POST("/users/:guid/revoke-sessions", admin.action(admin.revokeSessions))
+	group.POST("/users/:guid/delete", admin.action(admin.delete))
+
+	group.GET("/outbox", admin.outbox)
+	group.POST("/outbox/:id/retry", admin.mailAction(admin.storer.RetryMail, "E-mail #%d will be retried."))
+	group.POST("/outbox/:id/delete", admin.mailAction(admin.storer.DeleteMail, "E-mail #%d deleted."))
+}
+
+// users lists the users whose e-mail addresses contain the "q" query parameter, a page
+// ("page" query parameter) at a time.
+func (admin *AdminConsole) users(ctx *gin.Context) {
+	query := strings.TrimSpace(ctx.Query("q"))
+
+	page, err := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	users, total, err := admin.storer.SearchUsers(query, (page-1)*adminUsersPerPage, adminUsersPerPage)
+	if err != nil {
+		admin.logger.Printf("Unable to search users: %v", err)
+		ctx.String(http.StatusInternalServerError, "unable to search users")
+		return
+	}
+
+	pages := int((total + adminUsersPerPage - 1) / adminUsersPerPage)
+	pageLink := func(page int) string {
+		if page < 1 || page > pages {
+			return ""
+		}
+
+		return adminPath + "/?" + url.Values{"q": {query}, "page": {strconv.Itoa(page)}}.Encode()
+	}
+
+	stuckMail, err := admin.storer.CountStuckMail()
+	if err != nil {
+		admin.logger.Printf("Unable to count the stuck e-mails: %v", err)
+	}
+
+	admin.render(ctx, PageAdminUsers,
+		"admin_users", users,
+		"admin_stuck_mail", stuckMail,
+		"admin_query", query,
+		"admin_total", total,
+		"admin_page", page,
+		"admin_pages", pages,
+		"admin_prev", pageLink(page-1),
+		"admin_next", pageLink(page+1),
+	)
+}
+
+// user shows the user's account state.
+func (admin *AdminConsole) user(ctx *gin.Context) {
+	user := admin.loadUser(ctx)
+	if user == nil {
+		return
+	}
+
+	admin.render(ctx, PageAdminUser, "admin_user", makeAdminUserView(user))
+}
+
+// outbox lists the e-mails in the outbox with the "status" query parameter: "stuck" (the
+// default), "pending", "dead" or "sent".
+func (admin *AdminConsole) outbox(ctx *gin.Context) {
+	status := ctx.DefaultQuery("status", outboxStuck)
+	switch status {
+	case outboxStuck, outboxPending, outboxDead, outboxSent:
+	default:
+		status = outboxStuck
+	}
+
+	mail, err := admin.storer.ListMail(status, adminOutboxCount)
+	if err != nil {
+		admin.logger.Printf("Unable to list the outbox: %v", err)
+		ctx.String(http.StatusInternalServerError, "unable to list the outbox")
+		return
+	}
+
+	admin.render(ctx, PageAdminOutbox,
+		"admin_outbox", mail,
+		"admin_outbox_status", status,
+		"admin_outbox_statuses", []string{outboxStuck, outboxPending, outboxDead, outboxSent},
+	)
+}
+
+// mailAction wraps an action on the outbox e-mail whose ID is in the URL: it performs the
+// action and redirects back to the outbox with the action's result (done, with the e-mail's
+// ID.)
+func (admin *AdminConsole) mailAction(perform func(id uint64) error, done string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ro := authboss.RedirectOptions{Code: http.StatusFound, RedirectPath: adminPath + "/outbox"}
+
+		id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+		if err != nil {
+			err = ErrMailNotFound
+		} else {
+			err = perform(id)
+		}
+
+		if err != nil {
+			admin.logger.Printf("Outbox #%s: %v", ctx.Param("id"), err)
+			ro.Failure = err.Error()
+		} else {
+			ro.Success = fmt.Sprintf(done, id)
+			admin.logger.Printf("%s (by %s)", ro.Success, admin.currentAdmin(ctx))
+		}
+
+		if err := admin.aboss.Core.Redirector.Redirect(ctx.Writer, ctx.Request, ro); err != nil {
+			admin.logger.Printf("Redirect failed: %v", err)
+		}
+	}
+}
+
+// action wraps an action on the user whose GUID is in the URL: it loads the user, performs
+// the action and redirects back with the action's result.
+func (admin *AdminConsole) action(perform func(ctx *gin.Context, user *WorkedUser) (redirectPath, message string, err error)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		user := admin.loadUser(ctx)
+		if user == nil {
+			return
+		}
+
+		ro := authboss.RedirectOptions{Code: http.StatusFound}
+
+		redirectPath, message, err := perform(ctx, user)
+		if err != nil {
+			admin.logger.Printf("%s: %v", user.Email, err)
+			ro.RedirectPath = adminPath + "/users/" + user.GUID
+			ro.Failure = err.Error()
+		} else {
+			admin.logger.Printf("%s: %s (by %s)", user.Email, message, admin.currentAdmin(ctx))
+			ro.RedirectPath = redirectPath
+			ro.Success = message
+		}
+
+		if err := admin.aboss.Core.Redirector.Redirect(ctx.Writer, ctx.Request, ro); err != nil {
+			admin.logger.Printf("Redirect failed: %v", err)
+		}
+	}
+}
+
+// confirm confirms the user's account without the confirmation e-mail.
+func (admin *AdminConsole) confirm(ctx *gin.Context, user *WorkedUser) (string, string, error) {
+	forceConfirm(user)
+
+	return adminPath + "/users/" + user.GUID, "Account confirmed.", nil
+}
+
+// unlock unlocks the user's account and resets the failed sign in attempt count.
+func (admin *AdminConsole) unlock(ctx *gin.Context, user *WorkedUser) (string, string, error) {
+	unlockUser(user)
+
+	return adminPath + "/users/" + user.GUID, "Account unlocked.", nil
+}
+
+// resetAttempts resets the user's failed sign in attempt count.
+func (admin *AdminConsole) resetAttempts(ctx *gin.Context, user *WorkedUser) (string, string, error) {
+	user.PutAttemptCount(0)
+
+	return adminPath + "/users/" + user.GUID, "Sign in attempt count reset.", nil
+}
+
+// revokeRemember signs the user out of the browsers where they checked "Remember me".
+func (admin *AdminConsole) revokeRemember(ctx *gin.Context, user *WorkedUser) (string, string, error) {
+	if err := admin.storer.DelRememberTokens(ctx.Request.Context(), user.GetPID()); err != nil {
+		return "", "", fmt.Errorf("unable to revoke remember-me tokens: %w", err)
+	}
+
+	return adminPath + "/users/" + user.GUID, "Remember-me tokens revoked.", nil
+}
+
+// revokeSession signs the user out of one session ("session" form value, the session's handle.)
+func (admin *AdminConsole) revokeSession(ctx *gin.Context, user *WorkedUser) (string, string, error) {
+	if admin.sessions == nil {
+		return "", "", errors.New("sessions can't be revoked with this session store")
+	}
+
+	if err := revokeUserSession(ctx.Request.Context(), admin.sessions, user, ctx.PostForm("session")); err != nil {
+		return "", "", fmt.Errorf("unable to revoke the session: %w", err)
+	}
+
+	return adminPath + "/users/" + user.GUID, "Session revoked.", nil
+}
+
+// revokeSessions signs the user out everywhere: all of their sessions and remember-me tokens.
+func (admin *AdminConsole) revokeSessions(ctx *gin.Context, user *WorkedUser) (string, string, error) {
+	if admin.sessions == nil {
+		return "", "", errors.New("sessions can't be revoked with this session store")
+	}
+
+	revoked, err := signOutEverywhere(ctx.Request.Context(), admin.sessions, user)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to sign the user out everywhere: %w", err)
+	}
+
+	return adminPath + "/users/" + user.GUID, fmt.Sprintf("Signed out of %d sessions, remember-me tokens revoked.", revoked), nil
+}
+
+// delete signs the user out everywhere and deletes their account. Administrators can't delete
+// their own account here, so that the last administrator can't lock everyone out of the
+// console.
+//
+// The sessions go first: they're found through the user session index, which goes with the
+// account, and they're signed in as the user's e-mail address, which someone may register
+// again.
+func (admin *AdminConsole) delete(ctx *gin.Context, user *WorkedUser) (string, string, error) {
+	if user.Email == admin.currentAdmin(ctx) {
+		return "", "", errors.New("you can't delete your own account")
+	}
+
+	if admin.sessions != nil {
+		if _, err := signOutEverywhere(ctx.Request.Context(), admin.sessions, user); err != nil {
+			return "", "", fmt.Errorf("unable to sign the user out everywhere: %w", err)
+		}
+	}
+
+	if err := admin.storer.DeleteUser(user.GUID); err != nil {
+		return "", "", fmt.Errorf("unable to delete the account: %w", err)
+	}
+
+	return adminPath + "/", fmt.Sprintf("Account %s deleted.", user.Email), nil
+}
+
+// loadUser loads the user whose GUID is in the URL. If there isn't one, the response has been
+// sent.
+func (admin *AdminConsole) loadUser(ctx *gin.Context) *WorkedUser {
+	user, err := admin.storer.LoadByGUID(ctx.Request.Context(), ctx.Param("guid"))
+	if err == nil {
+		return user
+	}
+
+	if errors.Is(err, authboss.ErrUserNotFound) {
+		ctx.String(http.StatusNotFound, "no such user")
+	} else {
+		admin.logger.Printf("Unable to load user: %v", err)
+		ctx.String(http.StatusInternalServerError, "unable to load user")
+	}
+
+	return nil
+}
+
+// currentAdmin returns the signed in administrator's e-mail address, for the log.
+func (admin *AdminConsole) currentAdmin(ctx *gin.Context) string {
+	abUser, err := admin.aboss.LoadCurrentUser(&ctx.Request)
+	if user, valid := abUser.(*WorkedUser); err == nil && valid {
+		return user.Email
+	}
+
+	return ""
+}
+
+// render renders the administrator console's page with the page-specific data (key, value
+// pairs.)
+func (admin *AdminConsole) render(ctx *gin.Context, page string, data ...interface{}) {
+	r := ctx.Request
+	pageData := authboss.NewHTMLData().Merge(r.Context().Value(authboss.CTXKeyData).(authboss.HTMLData))
+	pageData.MergeKV(data...)
+
+	result, contentType, err := admin.templates.Render(r.Context(), page, pageData)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, fmt.Sprintf("template render error: %v", err))
+		return
+	}
+
+	ctx.Data(http.StatusOK, contentType, result)
+}
@@ -0,0 +1,58 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestAdminDeleteSignsOut(t *testing.T) {
+	for _, backend := range []string{sessionBackendGORM, sessionBackendMemory, sessionBackendCookie} {
+		t.Run(backend, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Sessions.Backend = backend
+			cfg.RBAC = rbacData{
+				Roles:       map[string]roleData{adminRole: {Description: "Administrators"}},
+				Assignments: map[string][]string{"admin@example.com": {adminRole}},
+			}
+			server := startTestServer(t, cfg)
+
+			server.createUser(t, "admin@example.com", "admin password")
+			user := server.createUser(t, "gone@example.com", "secret1")
+
+			admin := server.client(t)
+			admin.signIn(t, "admin@example.com", "admin password")
+
+			client := server.client(t)
+			client.signIn(t, "gone@example.com", "secret1")
+
+			resp, _ := admin.postForm(t, adminPath+"/users/"+user.GUID+"/delete", url.Values{})
+			if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || location != adminPath+"/" {
+				t.Fatalf("delete: %d to %q", resp.StatusCode, location)
+			}
+
+			// Someone registers the address again: the old sessions aren't theirs.
+			server.createUser(t, "gone@example.com", "another secret")
+			if client.signedIn(t) {
+				t.Error("the deleted account's session is signed in as the new account")
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/csrf"
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	// Prefix that makes the worked example's tokens easy to recognize (and to scan for in
+	// source code that shouldn't contain them.)
+	apiTokenPrefix = "abw_"
+	// Maximum length of the token's user-supplied name
+	apiTokenMaxNameLength = 64
+	// Longest lifetime that the user can pick, in days. Zero means "never expires".
+	apiTokenMaxDays = 365
+
+	// Route group for the token-authenticated API
+	apiPath = "/api"
+	// Where the user manages their tokens
+	apiTokenManagePath = "/app/user"
+
+	// Gin context keys for the token's user and the token
+	apiUserKey  = "api_user"
+	apiTokenKey = "api_token"
+)
+
+// apiScope is a permission that a personal access token can be granted.
+type apiScope struct {
+	Name        string
+	Description string
+}
+
+// apiScopes are the scopes that the /api endpoints check, in the order that the user
+// management page lists them.
+var apiScopes = []apiScope{
+	{Name: "user:read", Description: "Read your account details"},
+	{Name: "tokens:read", Description: "List your personal access tokens"},
+}
+
+// PersonalAccessTokens lets scripts call the /api endpoints as the user, without a browser
+// session. The user creates tokens on the user management page, picking the token's scopes
+// and lifetime. Scripts send the token in the Authorization header:
+//
+//	curl -H "Authorization: Bearer abw_..." http://localhost:3000/api/user
+//
+// Only the token's SHA-256 hash is stored (api_tokens table), so the user sees the token
+// once, when it's created.
+type PersonalAccessTokens struct {
+	aboss     *authboss.Authboss
+	storer    *AuthStorer
+	templates *Templates
+
+	// Which token owners get through
+	access userAccess
+
+	logger *log.Logger
+}
+
+// makePersonalAccessTokens creates the token management and /api handlers.
+func makePersonalAccessTokens(cfg *ConfigData, aboss *authboss.Authboss, storer *AuthStorer, templates *Templates) *PersonalAccessTokens {
+	return &PersonalAccessTokens{
+		aboss:     aboss,
+		storer:    storer,
+		templates: templates,
+		access:    makeUserAccess(cfg),
+		logger:    log.New(os.Stdout, "[APITOKENS] ", log.LstdFlags),
+	}
+}
+
+// routes adds the token management endpoints to the /app group (which requires a signed in
+// user) and the token-authenticated /api group.
+func (tokens *PersonalAccessTokens) routes(engine *gin.Engine, appspace *gin.RouterGroup) {
+	appspace.POST("/user/tokens", tokens.create)
+	appspace.POST("/user/tokens/revoke", tokens.revoke)
+
+	api := engine.Group(apiPath, tokens.authenticate)
+	api.GET("/user", requireAPIScope("user:read"), tokens.apiUser)
+	api.GET("/tokens", requireAPIScope("tokens:read"), tokens.apiTokens)
+}
+
+// skipCSRF is Gin middleware that exempts /api from CSRF protection: the bearer token, not a
+// cookie, authenticates the request, so there's no cross-site request to forge. It has to
+// run before the CSRF middleware.
+func (tokens *PersonalAccessTokens) skipCSRF(ctx *gin.Context) {
+	if strings.HasPrefix(ctx.Request.URL.Path, apiPath+"/") {
+		ctx.Request = csrf.UnsafeSkipCheck(ctx.Request)
+	}
+}
+
+// create creates a new token for the signed in user ("name", "scopes" and "expires_days"
+// form values.) The response shows the token, the only time the user sees it: the token
+// doesn't go through a redirect's flash message, which is kept in the session.
+func (tokens *PersonalAccessTokens) create(ctx *gin.Context) {
+	user := tokens.currentUser(ctx)
+	if user == nil {
+		return
+	}
+
+	name := strings.TrimSpace(ctx.PostForm("name"))
+	scopes := ctx.PostFormArray("scopes")
+	days, err := strconv.Atoi(ctx.DefaultPostForm("expires_days", "0"))
+
+	switch {
+	case len(name) == 0 || len(name) > apiTokenMaxNameLength:
+		tokens.redirect(ctx, "", fmt.Sprintf("Token name must be 1 to %d characters.", apiTokenMaxNameLength))
+		return
+	case len(scopes) == 0:
+		tokens.redirect(ctx, "", "Pick at least one scope.")
+		return
+	case err != nil || days < 0 || days > apiTokenMaxDays:
+		tokens.redirect(ctx, "", "Invalid token lifetime.")
+		return
+	}
+
+	for _, scope := range scopes {
+		if !validAPIScope(scope) {
+			tokens.redirect(ctx, "", fmt.Sprintf("Unknown scope '%s'.", scope))
+			return
+		}
+	}
+
+	tokenID, token, err := newAPIToken()
+	if err != nil {
+		tokens.logger.Printf("Unable to generate a token: %v", err)
+		tokens.redirect(ctx, "", "Unable to create the token.")
+		return
+	}
+
+	record := &APITokens{
+		TokenID:   tokenID,
+		TokenHash: apiTokenHash(token),
+		GUID:      user.GUID,
+		Name:      name,
+		Scopes:    strings.Join(scopes, " "),
+	}
+
+	if days > 0 {
+		record.Expiry = time.Now().AddDate(0, 0, days)
+	}
+
+	if err := tokens.storer.AddAPIToken(record); err != nil {
+		tokens.logger.Printf("Unable to store the token: %v", err)
+		tokens.redirect(ctx, "", "Unable to create the token.")
+		return
+	}
+
+	tokens.logger.Printf("%s created token %s (%s)", user.Email, tokenID, record.Scopes)
+
+	ctx.Header("Cache-Control", "no-store")
+	if wantsJSON(ctx.Request) {
+		respondJSON(ctx.Writer, http.StatusOK, map[string]string{
+			"status":   "success",
+			"token_id": tokenID,
+			"name":     name,
+			"token":    token,
+		})
+		return
+	}
+
+	// The user management page, with the new token in its list and the token itself.
+	r := ctx.Request
+	pageData := authboss.NewHTMLData().Merge(r.Context().Value(authboss.CTXKeyData).(authboss.HTMLData))
+	pageData.MergeKV(
+		"api_tokens", user.GetAPITokens(),
+		"api_token_created", map[string]string{"name": name, "token": token},
+	)
+
+	result, contentType, err := tokens.templates.Render(r.Context(), "app_user", pageData)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, fmt.Sprintf("template render error: %v", err))
+		return
+	}
+
+	ctx.Data(http.StatusOK, contentType, result)
+}
+
+// revoke revokes one of the signed in user's tokens ("token_id" form value.)
+func (tokens *PersonalAccessTokens) revoke(ctx *gin.Context) {
+	user := tokens.currentUser(ctx)
+	if user == nil {
+		return
+	}
+
+	if err := user.DelAPIToken(ctx.PostForm("token_id")); err != nil {
+		if !errors.Is(err, authboss.ErrTokenNotFound) {
+			tokens.logger.Printf("Unable to revoke token: %v", err)
+		}
+
+		tokens.redirect(ctx, "", "Unable to revoke the token.")
+		return
+	}
+
+	tokens.redirect(ctx, "Token revoked.", "")
+}
+
+// currentUser returns the signed in user. The /app middleware has already checked that
+// there is one, so failing is an internal error (and the response has been sent.)
+func (tokens *PersonalAccessTokens) currentUser(ctx *gin.Context) *WorkedUser {
+	abUser, err := tokens.aboss.LoadCurrentUser(&ctx.Request)
+	if user, valid := abUser.(*WorkedUser); err == nil && valid {
+		return user
+	}
+
+	tokens.logger.Printf("Unable to load the current user: %v", err)
+	ctx.AbortWithStatus(http.StatusInternalServerError)
+	return nil
+}
+
+// redirect sends the user back to the user management page with a success or failure message.
+func (tokens *PersonalAccessTokens) redirect(ctx *gin.Context, success, failure string) {
+	err := tokens.aboss.Core.Redirector.Redirect(ctx.Writer, ctx.Request, authboss.RedirectOptions{
+		Code:         http.StatusFound,
+		RedirectPath: apiTokenManagePath,
+		Success:      success,
+		Failure:      failure,
+	})
+
+	if err != nil {
+		tokens.logger.Printf("Redirect failed: %v", err)
+	}
+}
+
+// authenticate is the /api group's middleware: it resolves the bearer token to its user and
+// puts both in the Gin context. Expired tokens and users who couldn't sign in (unconfirmed,
+// locked) are turned away.
+func (tokens *PersonalAccessTokens) authenticate(ctx *gin.Context) {
+	scheme, bearer, found := strings.Cut(ctx.GetHeader("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || !strings.HasPrefix(bearer, apiTokenPrefix) {
+		abortAPI(ctx, http.StatusUnauthorized, "invalid_request", "Bearer token required")
+		return
+	}
+
+	token, err := tokens.storer.LoadAPIToken(apiTokenHash(bearer))
+	if err != nil {
+		if !errors.Is(err, authboss.ErrTokenNotFound) {
+			tokens.logger.Printf("Unable to load token: %v", err)
+		}
+
+		abortAPI(ctx, http.StatusUnauthorized, "invalid_token", "Invalid token")
+		return
+	}
+
+	if !token.Expiry.IsZero() && time.Now().After(token.Expiry) {
+		abortAPI(ctx, http.StatusUnauthorized, "invalid_token", "Token expired")
+		return
+	}
+
+	user, err := tokens.storer.LoadByGUID(ctx.Request.Context(), token.GUID)
+	if err != nil || !tokens.access.allowed(user) {
+		abortAPI(ctx, http.StatusUnauthorized, "invalid_token", "Account not available")
+		return
+	}
+
+	tokens.storer.PutAPITokenUse(token.TokenID)
+
+	ctx.Set(apiUserKey, user)
+	ctx.Set(apiTokenKey, token)
+}
+
+// requireAPIScope is /api middleware that requires the token to have been granted scope.
+func requireAPIScope(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := ctx.MustGet(apiTokenKey).(*APITokens)
+		if !slices.Contains(strings.Fields(token.Scopes), scope) {
+			abortAPI(ctx, http.StatusForbidden, "insufficient_scope", "Token needs the '"+scope+"' scope")
+		}
+	}
+}
+
+// abortAPI ends the /api request with an RFC 6750 bearer token error.
+func abortAPI(ctx *gin.Context, code int, errorCode, description string) {
+	ctx.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api", error="%s"`, errorCode))
+	ctx.AbortWithStatusJSON(code, gin.H{
+		"error":             errorCode,
+		"error_description": description,
+	})
+}
+
+// apiUser returns the token's user (GET /api/user, "user:read" scope.)
+func (tokens *PersonalAccessTokens) apiUser(ctx *gin.Context) {
+	user := ctx.MustGet(apiUserKey).(*WorkedUser)
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"guid":       user.GUID,
+		"email":      user.Email,
+		"confirmed":  user.GetConfirmed(),
+		"created_at": user.CreatedAt,
+	})
+}
+
+// apiTokens lists the user's tokens (GET /api/tokens, "tokens:read" scope.)
+func (tokens *PersonalAccessTokens) apiTokens(ctx *gin.Context) {
+	user := ctx.MustGet(apiUserKey).(*WorkedUser)
+
+	list := []gin.H{}
+	for _, token := range user.GetAPITokens() {
+		entry := gin.H{
+			"id":         token.TokenID,
+			"name":       token.Name,
+			"scopes":     strings.Fields(token.Scopes),
+			"created_at": token.CreatedAt,
+		}
+
+		if !token.Expiry.IsZero() {
+			entry["expiry"] = token.Expiry
+		}
+		if !token.LastUsed.IsZero() {
+			entry["last_used"] = token.LastUsed
+		}
+
+		list = append(list, entry)
+	}
+
+	ctx.JSON(http.StatusOK, list)
+}
+
+// validAPIScope returns true if scope is one of the apiScopes.
+func validAPIScope(scope string) bool {
+	for _, known := range apiScopes {
+		if known.Name == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newAPIToken generates a token and its (public) token ID.
+func newAPIToken() (tokenID, token string, err error) {
+	random := make([]byte, 40)
+	if _, err = rand.Read(random); err != nil {
+		return "", "", fmt.Errorf("unable to generate token: %w", err)
+	}
+
+	return hex.EncodeToString(random[:8]), apiTokenPrefix + base64.RawURLEncoding.EncodeToString(random[8:]), nil
+}
+
+// apiTokenHash hashes tokens for storage.
+func apiTokenHash(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
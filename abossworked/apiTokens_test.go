@@ -0,0 +1,104 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestAPITokenCreate(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Features.UseAPITokens = true
+	server := startTestServer(t, cfg)
+	server.createUser(t, "tokens@example.com", "secret1")
+
+	client := server.client(t)
+	client.signIn(t, "tokens@example.com", "secret1")
+
+	// The token is in the POST's response, not in a redirect's flash message.
+	resp, page := client.postForm(t, "/app/user/tokens", url.Values{"name": {"script"}, "scopes": {"user:read"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /app/user/tokens: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	token := regexp.MustCompile(apiTokenPrefix + `[A-Za-z0-9_-]+`).FindString(page)
+	if len(token) == 0 {
+		t.Fatal("no token in the response")
+	}
+
+	if _, page = client.get(t, "/app/user"); bytes.Contains([]byte(page), []byte(token)) {
+		t.Error("the token is still on the user management page")
+	}
+
+	// The session store (GORM) doesn't have it either: the sessions are signed, not encrypted.
+	var sessions []sessionRecord
+	if err := server.storer.UserDB.Find(&sessions).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, session := range sessions {
+		if sessionRecordContains(t, session.Data, token) {
+			t.Errorf("session %s has the token", session.ID)
+		}
+	}
+
+	// The token works.
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/user", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	apiResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiResp.Body.Close()
+
+	if apiResp.StatusCode != http.StatusOK {
+		t.Errorf("GET /api/user with the token: %d", apiResp.StatusCode)
+	}
+}
+
+// sessionRecordContains returns true if the GORM session store's record has the value. The
+// record is a securecookie: base64("date|base64(gob values)|MAC").
+func sessionRecordContains(t *testing.T, data, value string) bool {
+	t.Helper()
+
+	decoded, err := base64.URLEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatalf("session data: %v", err)
+	}
+
+	parts := bytes.SplitN(decoded, []byte("|"), 3)
+	if len(parts) != 3 {
+		t.Fatalf("session data has %d parts", len(parts))
+	}
+
+	values, err := base64.URLEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		t.Fatalf("session values: %v", err)
+	}
+
+	return bytes.Contains(values, []byte(value))
+}
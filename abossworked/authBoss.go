@@ -35,12 +35,13 @@ import (
 	_ "github.com/volatiletech/authboss/v3/confirm"
 	_ "github.com/volatiletech/authboss/v3/lock"
 	_ "github.com/volatiletech/authboss/v3/logout"
+	_ "github.com/volatiletech/authboss/v3/oauth2"
 	_ "github.com/volatiletech/authboss/v3/recover"
 	_ "github.com/volatiletech/authboss/v3/register"
 )
 
 // configureAuthboss initializes an authboss.Authboss entity.
-func configureAuthboss(cfg *ConfigData, sessionStore *SessionStore, cookieStore *CookieStorer, templates *Templates,
+func configureAuthboss(cfg *ConfigData, sessionState, cookieState authboss.ClientStateReadWriter, templates *Templates,
 	storer *AuthStorer) (ab *authboss.Authboss, err error) {
 	ab = authboss.New()
 
@@ -54,8 +55,8 @@ func configureAuthboss(cfg *ConfigData, sessionStore *SessionStore, cookieStore
 
 	ab.Config.Paths.RootURL = "http://" + cfg.HostPortString()
 	ab.Config.Storage.Server = storer
-	ab.Config.Storage.SessionState = sessionStore
-	ab.Config.Storage.CookieState = cookieStore
+	ab.Config.Storage.SessionState = sessionState
+	ab.Config.Storage.CookieState = cookieState
 
 	// The URL prefix for Authboss' URL namespace.
 	ab.Config.Paths.Mount = "/auth"
@@ -70,19 +71,26 @@ func configureAuthboss(cfg *ConfigData, sessionStore *SessionStore, cookieStore
 	ab.Config.Paths.ConfirmNotOK = "/"
 	ab.Config.Paths.LockNotOK = "/"
 	ab.Config.Paths.LogoutOK = "/logout"
-	ab.Config.Paths.OAuth2LoginOK = "/"
+	ab.Config.Paths.OAuth2LoginOK = "/app/"
 	ab.Config.Paths.OAuth2LoginNotOK = "/"
 	ab.Config.Paths.RecoverOK = "/"
 	ab.Config.Paths.RegisterOK = "/"
-	ab.Config.Paths.TwoFactorEmailAuthNotOK = "/"
+	// Where the user lands after requesting (or failing) the e-mail verification that
+	// precedes 2fa enrollment. The user management page shows the flash messages.
+	ab.Config.Paths.TwoFactorEmailAuthNotOK = "/app/user"
 
 	// This is the connection between Authboss and YOUR HTML, when Authboss needs to render a form for
 	// self-registration or login. Each module ("auth", "register", "recover", ...) has its own path
 	// and needs to support GET and POST methods in your favorite Web framework's router.
 	ab.Config.Core.ViewRenderer = templates
 
-	// Use the same template renderer for the MailRenderer.
-	ab.Config.Core.MailRenderer = templates
+	// The e-mails have their own templates, layout and fragments (see mail_templates.go.)
+	ab.Config.Core.MailRenderer = templates.MailRenderer()
+
+	// Who Authboss' e-mails come from.
+	ab.Config.Mail.From = cfg.Mail.From
+	ab.Config.Mail.FromName = cfg.Mail.FromName
+	ab.Config.Mail.SubjectPrefix = cfg.Mail.SubjectPrefix
 
 	// Preserve the email and name fields during user registration (prevents having
 	// to type them again)
@@ -94,9 +102,31 @@ func configureAuthboss(cfg *ConfigData, sessionStore *SessionStore, cookieStore
 	ab.Config.Modules.LockDuration = time.Duration(5) * time.Minute
 	ab.Config.Modules.LockWindow = time.Duration(3) * time.Minute
 
+	// Issuer that shows up in the user's TOTP authenticator app.
+	ab.Config.Modules.TOTP2FAIssuer = totpIssuer
+
+	// Require the user to click on a link sent to their e-mail address before they can
+	// enroll in a 2fa method (TOTP, SMS.) This proves that the person enrolling has access
+	// to the account's e-mail as well as its password.
+	ab.Config.Modules.TwoFactorEmailAuthRequired = cfg.Features.TwoFactorEmailVerify
+
 	// defaults.SetCore() has to be called to set up Authboss internals.
 	defaults.SetCore(&ab.Config, false, false)
 
+	// SetCore() installs a mailer that only logs the e-mails. The configured mailer replaces
+	// it (see mailer.go), behind the outbound mail queue if it's enabled (see mailOutbox.go.)
+	if ab.Config.Core.Mailer, err = makeMailer(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Mail.Outbox.Enabled {
+		ab.Config.Core.Mailer = storer.StartMailOutbox(ab.Config.Core.Mailer, cfg.Mail.Outbox)
+	}
+
+	// Answer JSON clients (SPA, mobile) with JSON instead of HTML pages and redirects. See
+	// jsonAPI.go.
+	setupJSONAPI(ab)
+
 	/* READ THE CODE in authboss/defaults/values.go.
 
 	   HTTPBodyReader and its constructor, NewHTTPBodyReader(), define which
@@ -157,15 +187,37 @@ func configureAuthboss(cfg *ConfigData, sessionStore *SessionStore, cookieStore
 
 	bodyReader.Whitelist["register"] = []string{"email", "name", "password"}
 
-	ab.Config.Core.BodyReader = *bodyReader
+	// Wrap the body reader so that 2fa recovery codes are actually checked. See
+	// recoveryCodeBodyReader in twoFactor.go. The body reader underneath reads JSON request
+	// bodies as well as forms (jsonAPI.go).
+	ab.Config.Core.BodyReader = recoveryCodeBodyReader{
+		BodyReader: makeNegotiatingBodyReader(bodyReader),
+		storer:     storer,
+	}
 
 	// Note: Don't
 
+	// OAuth2 providers have to be configured before ab.Init().
+	if err := setupOAuth2(cfg, ab, storer); err != nil {
+		return nil, err
+	}
+
+	// So does the WebAuthn (passkey) module, which ab.Init() initializes like the other modules.
+	setupWebAuthn(cfg, ab, storer)
+
+	// And the remember-me module, which replaces Authboss' (see rememberSeries.go.)
+	setupRememberSeries(cfg, ab)
+
 	if err := ab.Init(); err != nil {
 		// Handle error, don't let program continue to run
 		log.Fatalln(err)
 		return nil, err
 	}
 
+	// Two factor authentication modules are set up after ab.Init().
+	if err := setupTwoFactor(cfg, ab); err != nil {
+		return nil, err
+	}
+
 	return ab, nil
 }
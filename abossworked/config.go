@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"gopkg.in/yaml.v3"
@@ -56,6 +57,8 @@ type seedData struct {
 	CookieSeed string `yaml:"cookie"`
 	// CSRF seed
 	CSRFSeed string `yaml:"csrf"`
+	// Remember-me token hash key
+	RememberSeed string `yaml:"remember"`
 }
 
 // featureData holds the authboss features that can be enabled and disabled.
@@ -63,19 +66,276 @@ type featureData struct {
 	UseConfirm  bool `yaml:"confirm"`
 	UseLock     bool `yaml:"lock"`
 	UseRemember bool `yaml:"remember"`
+	// Time-based one time password (TOTP) two factor authentication
+	UseTOTP bool `yaml:"totp"`
+	// SMS two factor authentication
+	UseSMS bool `yaml:"sms"`
+	// Require the user to verify their e-mail address before enrolling in any
+	// two factor authentication method.
+	TwoFactorEmailVerify bool `yaml:"twofactor_email_verify"`
+	// OAuth2 ("social") login, providers are configured in the "oauth2" section.
+	UseOAuth2 bool `yaml:"oauth2"`
+	// WebAuthn (passkey) passwordless sign in
+	UseWebAuthn bool `yaml:"webauthn"`
+	// OpenID Connect identity provider for other applications, configured in the
+	// "oidc_provider" section.
+	UseOIDCProvider bool `yaml:"oidc_provider"`
+	// Forward-auth endpoint (/auth/verify) for reverse proxies, configured in the
+	// "forward_auth" section.
+	UseForwardAuth bool `yaml:"forward_auth"`
+	// Personal access tokens for the /api endpoints
+	UseAPITokens bool `yaml:"api_tokens"`
+}
+
+// smsData configures how SMS two factor authentication codes are sent.
+type smsData struct {
+	// Sender: "file" appends text messages to File, "log" logs them.
+	Sender string `yaml:"sender"`
+	// File that collects the text messages for the "file" sender. Relative paths are
+	// relative to the worked example's root directory.
+	File string `yaml:"file"`
+}
+
+// mailData configures how Authboss' e-mails (confirmation, recovery, 2fa e-mail verification)
+// are sent.
+type mailData struct {
+	// Mailer: "log" logs the e-mails, "smtp" sends them to SMTP, "file" appends them to the
+	// File mbox and "maildir" delivers them to Maildir. See mailer.go.
+	Mailer string `yaml:"mailer"`
+	// The e-mails' From address and name, and what goes in front of their subjects.
+	From          string `yaml:"from"`
+	FromName      string `yaml:"from_name"`
+	SubjectPrefix string `yaml:"subject_prefix"`
+	// The "smtp" mailer's server.
+	SMTP smtpData `yaml:"smtp"`
+	// The "file" mailer's mbox and the "maildir" mailer's Maildir. Relative paths are
+	// relative to the worked example's root directory.
+	File    string `yaml:"file"`
+	Maildir string `yaml:"maildir"`
+	// The outbound mail queue.
+	Outbox outboxData `yaml:"outbox"`
+}
+
+// confirmData configures account confirmation (see resendConfirm.go.)
+type confirmData struct {
+	// How long after a confirmation e-mail an account can be sent another one.
+	ResendAccountCooldown time.Duration `yaml:"resend_account_cooldown"`
+	// How long after asking for a confirmation e-mail an address can ask again.
+	ResendIPCooldown time.Duration `yaml:"resend_ip_cooldown"`
+}
+
+// outboxData configures the outbound mail queue (see mailOutbox.go.)
+type outboxData struct {
+	// Queue the e-mails and deliver them in the background, instead of while Authboss
+	// handles the request.
+	Enabled bool `yaml:"enabled"`
+	// Give up on an e-mail (dead-letter it) after this many failed delivery attempts.
+	MaxAttempts int `yaml:"max_attempts"`
+	// How long to wait after the first failed attempt. The wait doubles with each failed
+	// attempt, up to MaxBackoff.
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	// How often the worker looks for e-mails that are due.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// How long delivered e-mails stay in the outbox.
+	KeepSent time.Duration `yaml:"keep_sent"`
+	// How long dead-lettered e-mails stay in the outbox, waiting to be retried.
+	KeepDead time.Duration `yaml:"keep_dead"`
+}
+
+// smtpData configures the SMTP server for the "smtp" mailer.
+type smtpData struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// User name and password for SMTP authentication (PLAIN), if the server needs them.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Require STARTTLS before authenticating and sending.
+	StartTLS bool `yaml:"starttls"`
+	// Implicit TLS (SMTPS, usually port 465) instead of STARTTLS.
+	TLS bool `yaml:"tls"`
+	// Don't verify the server's certificate. Only for a development server with a
+	// self-signed certificate.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// Give up on the server after this long.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// rememberData configures the remember-me tokens.
+type rememberData struct {
+	// How long a remember-me token (and its cookie) lasts.
+	MaxAge time.Duration `yaml:"max_age"`
+	// How often the reaper deletes the expired remember-me tokens (and the expired sessions'
+	// index entries.)
+	ReapInterval time.Duration `yaml:"reap_interval"`
+}
+
+// sessionData configures where sessions are kept and how long they last.
+type sessionData struct {
+	// Backend: "cookie" (encrypted cookie), "gorm" (the user database), "memory" or "redis".
+	// See sessionBackends.go.
+	Backend string `yaml:"backend"`
+	// The "redis" backend's server.
+	Redis redisData `yaml:"redis"`
+	// Signed in sessions end after this long without a request.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ... and this long after the user signed in, no matter what.
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+	// Pages warn the user this long before their session ends.
+	WarnBefore time.Duration `yaml:"warn_before"`
+}
+
+// clientStateData selects where Authboss keeps its session and cookie state.
+type clientStateData struct {
+	// Store: "session" (the session store and encrypted cookies, see ginRouter.go) or "jwt"
+	// (signed tokens, see jwtClientState.go.)
+	Store string `yaml:"store"`
+	// The "jwt" store's keys and options.
+	JWT jwtData `yaml:"jwt"`
+}
+
+// jwtData configures the JWT client state.
+type jwtData struct {
+	// Signing keys, newest first: the first key signs new tokens, all of them verify tokens
+	// (key rotation.) Without keys, the tokens are signed with a key derived from the session
+	// seed.
+	Keys []jwtKeyData `yaml:"keys"`
+	// Encrypt the Authboss state in the tokens, not just sign it.
+	Encrypt bool `yaml:"encrypt"`
+}
+
+// jwtKeyData is a JWT signing key and its ID (the tokens' "kid" header.)
+type jwtKeyData struct {
+	ID string `yaml:"id"`
+	// Base64-encoded HMAC-SHA256 key, at least 32 bytes.
+	Secret string `yaml:"secret"`
+}
+
+// redisData configures the Redis server for the "redis" session backend.
+type redisData struct {
+	// Server address (host:port), password and database number.
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// oauth2ProviderData configures an OAuth2 login provider. The provider's name ("mock",
+// "google", "facebook") is its key in the yamlConfig's OAuth2 map.
+type oauth2ProviderData struct {
+	// Client ID and secret issued by the provider. Not needed for the "mock" provider.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// Scopes requested from the provider, if not the provider's defaults.
+	Scopes []string `yaml:"scopes"`
+	// Link the provider's identity to the existing account with the same e-mail address, if
+	// the provider says that it verified the address. Only turn this on if you trust the
+	// provider to verify e-mail addresses.
+	LinkByEmail bool `yaml:"link_by_email"`
+}
+
+// webAuthnData configures the WebAuthn relying party, i.e., this web site.
+type webAuthnData struct {
+	// Relying party ID: the web site's domain name. Passkeys are bound to the RP ID.
+	// Defaults to the listenAddr host.
+	RPID string `yaml:"rp_id"`
+	// Name that browsers display when creating or choosing a passkey
+	RPDisplayName string `yaml:"rp_display_name"`
+	// Origins (scheme://host[:port]) from which passkey requests are accepted. Defaults
+	// to the worked example's root URL.
+	Origins []string `yaml:"origins"`
+}
+
+// oidcProviderData configures the worked example as an OpenID Connect identity provider.
+type oidcProviderData struct {
+	// Issuer identifier, which appears in the tokens and the discovery document. Defaults
+	// to the worked example's root URL.
+	Issuer string `yaml:"issuer"`
+	// PEM file with the RSA private key that signs the tokens. Generated if it doesn't
+	// exist. Relative paths are relative to the worked example's root directory.
+	SigningKey string `yaml:"signing_key"`
+	// Client applications, registered in the oidc_clients table at startup.
+	Clients []oidcClientData `yaml:"clients"`
+}
+
+// oidcClientData registers an OpenID Connect client application.
+type oidcClientData struct {
+	ClientID string `yaml:"client_id"`
+	// Client secret for confidential (server-side) clients. Public clients (single page
+	// and native apps) don't have a secret and have to use PKCE.
+	ClientSecret string `yaml:"client_secret"`
+	// Name shown on the consent page
+	Name string `yaml:"name"`
+	// Callback URLs to which the authorization response can be sent (exact match)
+	RedirectURIs []string `yaml:"redirect_uris"`
+}
+
+// forwardAuthData configures the forward-auth endpoint for reverse proxies.
+type forwardAuthData struct {
+	// Redirect users who aren't signed in to the login page, instead of returning
+	// 401 Unauthorized and leaving the redirect to the proxy.
+	RedirectToLogin bool `yaml:"redirect_to_login"`
+	// The login page's URL as the browser sees it. Defaults to the worked example's
+	// root URL + /auth/login.
+	LoginURL string `yaml:"login_url"`
+	// Hosts (host[:port]) to which users are sent back after they sign in.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// rbacData declares the roles for role-based access control and bootstraps the users' role
+// assignments.
+type rbacData struct {
+	// Roles, keyed by role name. The roles (and their permissions) are saved in the
+	// roles and role_permissions tables at startup.
+	Roles map[string]roleData `yaml:"roles"`
+	// Role assignments, keyed by the user's e-mail address. Roles are assigned to confirmed
+	// users at startup and when they sign in.
+	Assignments map[string][]string `yaml:"assignments"`
+}
+
+// roleData declares a role.
+type roleData struct {
+	Description string   `yaml:"description"`
+	Permissions []string `yaml:"permissions"`
 }
 
 // Debugging features
 type debugFeatures struct {
 	TemplateVars bool `yaml:"template_vars"`
+	// Capture the e-mails and show them at /dev/mail (see devMail.go.)
+	MailViewer bool `yaml:"mail_viewer"`
 }
 type yamlConfig struct {
 	// Listen host/address and port
 	ListenAddr map[string]string `yaml:"listenAddr"`
+	// Reverse proxies (addresses or CIDR ranges) whose X-Forwarded-For and X-Real-IP headers
+	// name the client. None by default: the client is the connection's remote address.
+	TrustedProxies []string `yaml:"trusted_proxies"`
 	// Seed data for session identifiers and cookies:
 	Seeds seedData `yaml:"seeds"`
 	// Features:
 	Features featureData `yaml:"features"`
+	// SMS 2fa sender:
+	SMS smsData `yaml:"sms"`
+	// E-mail delivery:
+	Mail mailData `yaml:"mail"`
+	// Account confirmation:
+	Confirm confirmData `yaml:"confirm"`
+	// Remember-me tokens:
+	Remember rememberData `yaml:"remember"`
+	// Session backend and timeouts:
+	Sessions sessionData `yaml:"sessions"`
+	// Authboss' client state (session and cookies):
+	ClientState clientStateData `yaml:"client_state"`
+	// OAuth2 login providers:
+	OAuth2 map[string]oauth2ProviderData `yaml:"oauth2"`
+	// WebAuthn relying party:
+	WebAuthn webAuthnData `yaml:"webauthn"`
+	// OpenID Connect identity provider:
+	OIDCProvider oidcProviderData `yaml:"oidc_provider"`
+	// Forward-auth for reverse proxies:
+	ForwardAuth forwardAuthData `yaml:"forward_auth"`
+	// Role-based access control:
+	RBAC rbacData `yaml:"rbac"`
 	// Debugging
 	Debugging debugFeatures `yaml:"debugging"`
 }
@@ -92,17 +352,92 @@ var (
 				"port": "3000",
 			},
 			Seeds: seedData{
-				SessionSeed: "",
-				CookieSeed:  "",
-				CSRFSeed:    "",
+				SessionSeed:  "",
+				CookieSeed:   "",
+				CSRFSeed:     "",
+				RememberSeed: "",
 			},
 			Features: featureData{
 				UseConfirm:  true,
 				UseLock:     true,
 				UseRemember: true,
+				UseTOTP:     false,
+				UseSMS:      false,
+				// Don't require e-mail verification before 2fa enrollment
+				TwoFactorEmailVerify: false,
+				UseOAuth2:            false,
+				UseWebAuthn:          false,
+				UseOIDCProvider:      false,
+				UseForwardAuth:       false,
+				UseAPITokens:         false,
+			},
+			SMS: smsData{
+				Sender: "file",
+				File:   "sms_outbox.txt",
+			},
+			Mail: mailData{
+				Mailer:   mailerLog,
+				From:     "authboss-worked@localhost",
+				FromName: "Authboss Worked",
+				SMTP: smtpData{
+					Port:     587,
+					StartTLS: true,
+					Timeout:  10 * time.Second,
+				},
+				File:    "mail_outbox.mbox",
+				Maildir: "maildir",
+				Outbox: outboxData{
+					Enabled:        true,
+					MaxAttempts:    8,
+					InitialBackoff: 30 * time.Second,
+					MaxBackoff:     time.Hour,
+					PollInterval:   15 * time.Second,
+					KeepSent:       24 * time.Hour,
+					KeepDead:       7 * 24 * time.Hour,
+				},
+			},
+			Confirm: confirmData{
+				ResendAccountCooldown: 5 * time.Minute,
+				ResendIPCooldown:      time.Minute,
+			},
+			Remember: rememberData{
+				MaxAge:       12 * time.Hour,
+				ReapInterval: time.Hour,
+			},
+			Sessions: sessionData{
+				Backend: sessionBackendGORM,
+				Redis: redisData{
+					Address: "localhost:6379",
+				},
+				IdleTimeout: 30 * time.Minute,
+				MaxLifetime: 12 * time.Hour,
+				WarnBefore:  5 * time.Minute,
+			},
+			ClientState: clientStateData{
+				Store: clientStateSession,
+			},
+			WebAuthn: webAuthnData{
+				RPID:          "",
+				RPDisplayName: "Authboss Worked",
+				Origins:       nil,
+			},
+			OIDCProvider: oidcProviderData{
+				Issuer:     "",
+				SigningKey: "oidc_signing_key.pem",
+				Clients:    nil,
+			},
+			ForwardAuth: forwardAuthData{
+				RedirectToLogin: false,
+				LoginURL:        "",
+				AllowedHosts:    nil,
+			},
+			RBAC: rbacData{
+				Roles:       nil,
+				Assignments: nil,
 			},
 			Debugging: debugFeatures{
 				TemplateVars: true,
+				MailViewer:   false,
 			},
 		},
 	}
@@ -161,6 +496,30 @@ func GetWorkedConfig() (retval *ConfigData, err error) {
 		return nil, errors.New("missing CSRF seed in configuration")
 	}
 
+	if retval.yamlConfig.Features.UseRemember && len(retval.yamlConfig.Seeds.RememberSeed) == 0 {
+		return nil, errors.New("missing remember seed in configuration (seeds:remember, needed by features:remember)")
+	}
+
+	if retval.yamlConfig.Remember.MaxAge <= 0 || retval.yamlConfig.Remember.ReapInterval <= 0 {
+		return nil, errors.New("remember:max_age and remember:reap_interval have to be positive")
+	}
+
+	if sessions := retval.yamlConfig.Sessions; sessions.IdleTimeout <= 0 || sessions.MaxLifetime <= 0 || sessions.WarnBefore <= 0 {
+		return nil, errors.New("sessions:idle_timeout, sessions:max_lifetime and sessions:warn_before have to be positive")
+	} else if sessions.WarnBefore >= sessions.IdleTimeout {
+		return nil, errors.New("sessions:warn_before has to be shorter than sessions:idle_timeout")
+	}
+
+	if outbox := retval.yamlConfig.Mail.Outbox; outbox.Enabled &&
+		(outbox.MaxAttempts <= 0 || outbox.InitialBackoff <= 0 || outbox.MaxBackoff <= 0 || outbox.PollInterval <= 0 || outbox.KeepSent <= 0 || outbox.KeepDead <= 0) {
+		return nil, errors.New("mail:outbox:max_attempts, initial_backoff, max_backoff, poll_interval, keep_sent and keep_dead have to be positive")
+	}
+
+	if confirm := retval.yamlConfig.Confirm; retval.yamlConfig.Features.UseConfirm &&
+		(confirm.ResendAccountCooldown <= 0 || confirm.ResendIPCooldown <= 0) {
+		return nil, errors.New("confirm:resend_account_cooldown and resend_ip_cooldown have to be positive")
+	}
+
 	return retval, nil
 }
 
@@ -206,14 +565,17 @@ func GenerateWorkedConfig() {
 	sessionSeed := securecookie.GenerateRandomKey(64)
 	cookieSeed := securecookie.GenerateRandomKey(64)
 	csrfSeed := securecookie.GenerateRandomKey(32)
+	rememberSeed := securecookie.GenerateRandomKey(64)
 
 	retval.ConfigLog.Printf("Generated session seed: %x\n", sessionSeed)
 	retval.ConfigLog.Printf("Generated cookie seed:  %x\n", cookieSeed)
 	retval.ConfigLog.Printf("Generated csrf seed:    %x\n", csrfSeed)
+	retval.ConfigLog.Printf("Generated remember seed: %x\n", rememberSeed)
 
 	retval.yamlConfig.Seeds.SessionSeed = base64.StdEncoding.EncodeToString(sessionSeed)
 	retval.yamlConfig.Seeds.CookieSeed = base64.StdEncoding.EncodeToString(cookieSeed)
 	retval.yamlConfig.Seeds.CSRFSeed = base64.StdEncoding.EncodeToString(csrfSeed)
+	retval.yamlConfig.Seeds.RememberSeed = base64.StdEncoding.EncodeToString(rememberSeed)
 
 	retval.ConfigLog.Printf("Writing %s.", workedYAML)
 
@@ -0,0 +1,231 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* The developer mail viewer.
+
+   Instead of grepping the log for confirmation and recovery links, turn on
+   debugging:mail_viewer and open /dev/mail: DevMailViewer is Authboss' mailer, keeps the most
+   recent e-mails in memory and passes them on to the configured mailer (or the outbox.) The
+   viewer shows an e-mail's HTML and text parts side by side, with its links.
+
+   There's no sign in: the viewer shows every user's confirmation and recovery links. NEVER turn
+   it on for a site that anyone else can reach.
+*/
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	// PageDevMail is the developer mail viewer's list of captured e-mails.
+	PageDevMail = "dev_mail"
+	// PageDevMailMessage is the developer mail viewer's page for a single e-mail.
+	PageDevMailMessage = "dev_mail_message"
+
+	// Route group for the developer mail viewer
+	devMailPath = "/dev/mail"
+	// Most recent e-mails the viewer keeps
+	devMailCapacity = 50
+)
+
+// devMailLinkPattern finds the links in an e-mail's parts.
+var devMailLinkPattern = regexp.MustCompile(`https?://[^\s"'<>\\]+`)
+
+var _ authboss.Mailer = &DevMailViewer{}
+
+// DevMailViewer captures the e-mails that Authboss sends and shows them at /dev/mail.
+type DevMailViewer struct {
+	// Delivers the e-mails
+	mailer    authboss.Mailer
+	templates *Templates
+
+	// The captured e-mails, oldest first.
+	mutex    sync.Mutex
+	messages []devMailMessage
+	lastID   uint64
+
+	logger *log.Logger
+}
+
+// devMailMessage is a captured e-mail.
+type devMailMessage struct {
+	ID         uint64
+	Email      authboss.Email
+	CapturedAt time.Time
+	// The links in the text and HTML parts, e.g., the confirmation or recovery URL.
+	Links []string
+	// The mailer's error, if it couldn't send the e-mail.
+	SendError string
+}
+
+// makeDevMailViewer creates the mail viewer, which passes the e-mails on to mailer.
+func makeDevMailViewer(mailer authboss.Mailer, templates *Templates) *DevMailViewer {
+	viewer := &DevMailViewer{
+		mailer:    mailer,
+		templates: templates,
+		messages:  []devMailMessage{},
+		logger:    log.New(os.Stdout, "[DEVMAIL] ", log.LstdFlags),
+	}
+
+	viewer.logger.Printf("Capturing e-mails, see %s. Don't turn debugging:mail_viewer on in production.", devMailPath)
+	return viewer
+}
+
+// Send captures the e-mail, then sends it with the configured mailer.
+func (viewer *DevMailViewer) Send(ctx context.Context, email authboss.Email) error {
+	err := viewer.mailer.Send(ctx, email)
+
+	message := devMailMessage{
+		Email:      email,
+		CapturedAt: time.Now(),
+		Links:      devMailLinks(email),
+	}
+	if err != nil {
+		message.SendError = err.Error()
+	}
+
+	viewer.mutex.Lock()
+	defer viewer.mutex.Unlock()
+
+	viewer.lastID++
+	message.ID = viewer.lastID
+	viewer.messages = append(viewer.messages, message)
+	if len(viewer.messages) > devMailCapacity {
+		viewer.messages = viewer.messages[len(viewer.messages)-devMailCapacity:]
+	}
+
+	return err
+}
+
+// routes adds the mail viewer's pages to the Gin router.
+func (viewer *DevMailViewer) routes(engine *gin.Engine) {
+	group := engine.Group(devMailPath)
+	group.GET("/", viewer.list)
+	group.GET("/:id", viewer.show)
+	group.POST("/clear", viewer.clear)
+}
+
+// list shows the captured e-mails, newest first.
+func (viewer *DevMailViewer) list(ctx *gin.Context) {
+	viewer.mutex.Lock()
+	messages := make([]devMailMessage, 0, len(viewer.messages))
+	for i := len(viewer.messages) - 1; i >= 0; i-- {
+		messages = append(messages, viewer.messages[i])
+	}
+	viewer.mutex.Unlock()
+
+	viewer.render(ctx, PageDevMail, "dev_mail_messages", messages)
+}
+
+// show shows one e-mail: its HTML part (in a sandboxed frame), its text part and its links.
+func (viewer *DevMailViewer) show(ctx *gin.Context) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.String(http.StatusNotFound, "no such e-mail")
+		return
+	}
+
+	message, found := viewer.message(id)
+	if !found {
+		ctx.String(http.StatusNotFound, "no such e-mail")
+		return
+	}
+
+	// The links in the frame have to replace the viewer, not load the site inside the frame.
+	htmlPart := message.Email.HTMLBody
+	if strings.Contains(htmlPart, "<head>") {
+		htmlPart = strings.Replace(htmlPart, "<head>", `<head><base target="_top">`, 1)
+	} else if len(htmlPart) > 0 {
+		htmlPart = `<base target="_top">` + htmlPart
+	}
+
+	viewer.render(ctx, PageDevMailMessage,
+		"dev_mail_message", message,
+		"dev_mail_html", htmlPart,
+	)
+}
+
+// clear forgets the captured e-mails.
+func (viewer *DevMailViewer) clear(ctx *gin.Context) {
+	viewer.mutex.Lock()
+	viewer.messages = []devMailMessage{}
+	viewer.mutex.Unlock()
+
+	ctx.Redirect(http.StatusFound, devMailPath+"/")
+}
+
+// message finds a captured e-mail by its ID.
+func (viewer *DevMailViewer) message(id uint64) (devMailMessage, bool) {
+	viewer.mutex.Lock()
+	defer viewer.mutex.Unlock()
+
+	for _, message := range viewer.messages {
+		if message.ID == id {
+			return message, true
+		}
+	}
+
+	return devMailMessage{}, false
+}
+
+// render renders one of the mail viewer's pages with the request's template data.
+func (viewer *DevMailViewer) render(ctx *gin.Context, page string, data ...interface{}) {
+	r := ctx.Request
+	pageData := authboss.NewHTMLData().Merge(r.Context().Value(authboss.CTXKeyData).(authboss.HTMLData))
+	pageData.MergeKV(data...)
+
+	result, contentType, err := viewer.templates.Render(r.Context(), page, pageData)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, fmt.Sprintf("template render error: %v", err))
+		return
+	}
+
+	ctx.Data(http.StatusOK, contentType, result)
+}
+
+// devMailLinks collects the distinct links in the e-mail's text and HTML parts, in order.
+func devMailLinks(email authboss.Email) []string {
+	links := []string{}
+	seen := map[string]bool{}
+
+	for _, part := range []string{email.TextBody, email.HTMLBody} {
+		for _, link := range devMailLinkPattern.FindAllString(part, -1) {
+			link = strings.TrimRight(html.UnescapeString(link), ".,;)")
+			if !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+		}
+	}
+
+	return links
+}
@@ -0,0 +1,187 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/csrf"
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	// Forward-auth paths, relative to the authboss mount point (/auth)
+	forwardAuthVerifyPath = "/verify"
+	forwardAuthReturnPath = "/verify/return"
+
+	// Response headers that tell the reverse proxy (and the service behind it) who the user is
+	forwardAuthUserHeader  = "X-Auth-User"
+	forwardAuthGUIDHeader  = "X-Auth-GUID"
+	forwardAuthEmailHeader = "X-Auth-Email"
+)
+
+// ForwardAuth lets a reverse proxy protect other services with the worked example's login.
+// The proxy asks /auth/verify whether the request's session belongs to a signed in user
+// before passing the request along (nginx's auth_request, Traefik's forwardAuth):
+//
+//   - 200 OK, with the user in the X-Auth-User, X-Auth-GUID and X-Auth-Email headers, for
+//     signed in (or remembered), confirmed and unlocked users.
+//   - 401 Unauthorized otherwise, or a redirect to the login page if redirect_to_login is
+//     configured.
+//
+// The login page sends the user back to the original URL via /auth/verify/return, which
+// only redirects to the hosts listed in allowed_hosts.
+//
+// The session cookie has to reach /auth/verify, i.e., the protected services have to be
+// on the same host (or the cookie's domain) as the worked example.
+type ForwardAuth struct {
+	aboss *authboss.Authboss
+
+	// Which signed in users get through
+	access userAccess
+
+	// Redirect to loginURL instead of returning 401 Unauthorized.
+	redirectToLogin bool
+	loginURL        string
+	// Hosts (host[:port]) to which /auth/verify/return sends the user back.
+	allowedHosts []string
+
+	logger *log.Logger
+}
+
+// makeForwardAuth creates the forward-auth endpoints' handler.
+func makeForwardAuth(cfg *ConfigData, aboss *authboss.Authboss) *ForwardAuth {
+	forwardAuth := &ForwardAuth{
+		aboss:           aboss,
+		access:          makeUserAccess(cfg),
+		redirectToLogin: cfg.ForwardAuth.RedirectToLogin,
+		loginURL:        cfg.ForwardAuth.LoginURL,
+		allowedHosts:    cfg.ForwardAuth.AllowedHosts,
+		logger:          log.New(os.Stdout, "[FORWARDAUTH] ", log.LstdFlags),
+	}
+
+	if len(forwardAuth.loginURL) == 0 {
+		forwardAuth.loginURL = aboss.Config.Paths.RootURL + aboss.Config.Paths.Mount + "/login"
+	}
+
+	return forwardAuth
+}
+
+// routes adds the forward-auth endpoints to the authboss router. Gin can't route /auth/verify
+// alongside the /auth/*wild catch-all that hands /auth to authboss.
+func (forwardAuth *ForwardAuth) routes(router authboss.Router) {
+	// The proxy's subrequest may use the original request's method.
+	router.Get(forwardAuthVerifyPath, http.HandlerFunc(forwardAuth.verify))
+	router.Post(forwardAuthVerifyPath, http.HandlerFunc(forwardAuth.verify))
+	router.Delete(forwardAuthVerifyPath, http.HandlerFunc(forwardAuth.verify))
+
+	router.Get(forwardAuthReturnPath, http.HandlerFunc(forwardAuth.returnTo))
+}
+
+// skipCSRF is Gin middleware that exempts /auth/verify from CSRF protection. The proxy's
+// subrequest doesn't have a CSRF token, and verify doesn't change anything. It has to run
+// before the CSRF middleware.
+func (forwardAuth *ForwardAuth) skipCSRF(ctx *gin.Context) {
+	if ctx.Request.URL.Path == forwardAuth.aboss.Config.Paths.Mount+forwardAuthVerifyPath {
+		ctx.Request = csrf.UnsafeSkipCheck(ctx.Request)
+	}
+}
+
+// verify tells the reverse proxy whether the request comes from a signed in user.
+func (forwardAuth *ForwardAuth) verify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	abUser, err := forwardAuth.aboss.LoadCurrentUser(&r)
+	if err != nil && !errors.Is(err, authboss.ErrUserNotFound) {
+		forwardAuth.logger.Printf("Unable to load the current user: %v", err)
+	}
+
+	if user, valid := abUser.(*WorkedUser); err == nil && valid && forwardAuth.access.allowed(user) {
+		w.Header().Set(forwardAuthUserHeader, user.GetPID())
+		w.Header().Set(forwardAuthGUIDHeader, user.GUID)
+		w.Header().Set(forwardAuthEmailHeader, user.Email)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if forwardAuth.redirectToLogin {
+		login := forwardAuth.loginURL
+
+		// Preserve the original URL: the login page redirects to /auth/verify/return, which
+		// sends the user back. (authboss only follows relative redirects.)
+		if original := forwardAuthOriginalURL(r); len(original) > 0 {
+			returnPath := forwardAuth.aboss.Config.Paths.Mount + forwardAuthReturnPath + "?" +
+				url.Values{"url": {original}}.Encode()
+			login += "?" + url.Values{authboss.FormValueRedirect: {returnPath}}.Encode()
+		}
+
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// returnTo sends the user back to the original URL after signing in, as long as the URL's
+// host is one of the allowed hosts. Otherwise, the user goes to the usual post-login page.
+func (forwardAuth *ForwardAuth) returnTo(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("url")
+
+	returnURL, err := url.Parse(target)
+	if err != nil || (returnURL.Scheme != "http" && returnURL.Scheme != "https") || !forwardAuth.hostAllowed(returnURL.Host) {
+		forwardAuth.logger.Printf("Not returning to '%s': host not allowed", target)
+		http.Redirect(w, r, forwardAuth.aboss.Config.Paths.AuthLoginOK, http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, returnURL.String(), http.StatusFound)
+}
+
+// hostAllowed returns true if the user can be sent back to the host.
+func (forwardAuth *ForwardAuth) hostAllowed(host string) bool {
+	for _, allowed := range forwardAuth.allowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardAuthOriginalURL reconstructs the URL that the user originally requested from the
+// reverse proxy's headers: X-Original-URL (nginx, "proxy_set_header X-Original-URL
+// $scheme://$http_host$request_uri;") or X-Forwarded-Proto, -Host and -Uri (Traefik.)
+func forwardAuthOriginalURL(r *http.Request) string {
+	if original := r.Header.Get("X-Original-URL"); len(original) > 0 {
+		return original
+	}
+
+	proto := r.Header.Get("X-Forwarded-Proto")
+	host := r.Header.Get("X-Forwarded-Host")
+	if len(proto) == 0 || len(host) == 0 {
+		return ""
+	}
+
+	return proto + "://" + host + r.Header.Get("X-Forwarded-Uri")
+}
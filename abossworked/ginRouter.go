@@ -23,17 +23,13 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	gsessions "github.com/gin-contrib/sessions"
-	// If you want cookie-based session storage, uncomment the line below
-	// gcookie "github.com/gin-contrib/sessions/cookie"
-	//
-	// Example code uses GORM-based SQLite:
-	gsqlite "github.com/gin-contrib/sessions/gorm"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/securecookie"
@@ -42,7 +38,7 @@ import (
 
 	"github.com/volatiletech/authboss/v3/confirm"
 	"github.com/volatiletech/authboss/v3/lock"
-	"github.com/volatiletech/authboss/v3/remember"
+	"gorm.io/gorm"
 
 	// Remove this import and the adapter subdirectory if and when the gin adapter
 	// package exposes the swappedResponseWriter field. This is supposed to be a
@@ -74,25 +70,146 @@ func GinRouter(cfg *ConfigData, storer *AuthStorer, templates *Templates) (engin
 		return nil, fmt.Errorf("unable to decode CSRF seed: %w", err)
 	}
 
+	rememberSeed, err := base64.StdEncoding.DecodeString(cfg.yamlConfig.Seeds.RememberSeed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode remember seed: %w", err)
+	}
+
 	logger := log.New(os.Stdout, "[ABOSSWORKED] ", log.LstdFlags)
-	sessionStore := makeSessionStore(storer, sessionCookieParams, sessionCookieName, sessionSeed, nil)
+
+	storer.sessionIdleTimeout = cfg.Sessions.IdleTimeout
+	storer.sessionMaxLifetime = cfg.Sessions.MaxLifetime
 
 	cookieStore := makeCookieStorer(cookieSeed, nil, logger)
 	cookieStore.HttpOnly = false
 	cookieStore.Secure = false
 
+	// The remember-me cookie lasts as long as its token. The reaper deletes the tokens whose
+	// cookies have expired.
+	cookieStore.Cookie.MaxAge = int(cfg.Remember.MaxAge / time.Second)
+	storer.rememberMaxAge = cfg.Remember.MaxAge
+	storer.rememberKey = rememberSeed
+
+	// The client state: the session store and the cookie storer, or JWTs (see
+	// jwtClientState.go.) Either way, the session is a gin-contrib session, which the session
+	// middleware loads.
+	var sessionState, cookieState authboss.ClientStateReadWriter
+	var sessionMiddleware gin.HandlerFunc
+	var sessionRevoker SessionRevoker
+	var jwtSessions *JWTClientState
+	verifyIndexed := false
+
+	switch cfg.ClientState.Store {
+	case clientStateSession:
+		sessionParams := sessionCookieParams
+		sessionParams.MaxAge = int(cfg.Sessions.MaxLifetime / time.Second)
+		sessionStore, err := makeSessionStore(cfg, storer, sessionParams, sessionCookieName, sessionSeed)
+		if err != nil {
+			return nil, err
+		}
+
+		// The user session index (see activeSessions.go) has to know about the sessions that were
+		// signed in before it existed, and forget the ones that didn't survive the restart.
+		if err = sessionStore.indexSessions(storer); err != nil {
+			return nil, fmt.Errorf("unable to index the existing sessions: %w", err)
+		}
+
+		sessionState, cookieState, sessionRevoker = sessionStore, cookieStore, sessionStore
+		sessionMiddleware = gsessions.Sessions(sessionCookieName, sessionStore.gstore)
+		verifyIndexed = !sessionStore.backend.serverSide()
+	case clientStateJWT:
+		var jwtCookies *JWTClientState
+		if jwtSessions, jwtCookies, err = makeJWTClientStates(cfg, storer, sessionSeed); err != nil {
+			return nil, err
+		}
+
+		sessionState, cookieState, sessionRevoker = jwtSessions, jwtCookies, jwtSessions
+		sessionMiddleware = jwtSessions.sessions
+	default:
+		return nil, fmt.Errorf("unknown client state store '%s'", cfg.ClientState.Store)
+	}
+
+	// The reaper also removes expired sessions from the user session index, so it runs even
+	// without "Remember me".
+	storer.StartRememberReaper(cfg.Remember.ReapInterval)
+
 	var aboss *authboss.Authboss
 
-	aboss, err = configureAuthboss(cfg, sessionStore, cookieStore, templates, storer)
+	aboss, err = configureAuthboss(cfg, sessionState, cookieState, templates, storer)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionTimeouts := makeSessionTimeouts(cfg, aboss)
+
+	// The developer mail viewer, if enabled, captures the e-mails that Authboss sends.
+	var devMail *DevMailViewer
+	if cfg.Debugging.MailViewer {
+		devMail = makeDevMailViewer(aboss.Config.Core.Mailer, templates)
+		aboss.Config.Core.Mailer = devMail
+	}
+
+	// The in-process mock OAuth2 provider, if configured. Its client configuration is complete
+	// (callback URL) only after configureAuthboss().
+	var oauth2Mock *MockOAuth2Server
+	if mockProvider, useMock := aboss.Config.Modules.OAuth2Providers[mockOAuth2ProviderName]; useMock {
+		oauth2Mock = makeMockOAuth2Server(mockProvider.OAuth2Config, templates)
+	}
+
+	oauth2Providers := oauth2ProviderNames(aboss)
+
+	// OpenID Connect provider, if enabled:
+	var oidcProvider *OIDCProvider
+	if cfg.Features.UseOIDCProvider {
+		if oidcProvider, err = makeOIDCProvider(cfg, aboss, storer, templates); err != nil {
+			return nil, err
+		}
+	}
+
+	// Forward-auth for reverse proxies, if enabled:
+	var forwardAuth *ForwardAuth
+	if cfg.Features.UseForwardAuth {
+		forwardAuth = makeForwardAuth(cfg, aboss)
+		forwardAuth.routes(aboss.Config.Core.Router)
+	}
+
+	// Resend confirmation e-mails, if confirmation is enabled:
+	if cfg.Features.UseConfirm {
+		resendConfirm, err := makeResendConfirmation(cfg, aboss)
+		if err != nil {
+			return nil, err
+		}
+
+		resendConfirm.routes(aboss.Config.Core.Router)
+	}
+
+	// Role-based access control: saves the configured roles and role assignments. Routes that
+	// need a role or a permission use the RBAC's RequireRole and RequirePermission middleware,
+	// e.g.:
+	//
+	//	appspace.GET("/reports", rbac.RequirePermission("reports:read"), reportsHandler)
+	rbac, err := makeRBAC(cfg, aboss, storer, templates)
 	if err != nil {
 		return nil, err
 	}
 
+	// Active sessions: the user session index and the user management page's session list.
+	activeSessions := makeActiveSessions(aboss, storer, sessionRevoker, verifyIndexed)
+
+	// Personal access tokens for the /api endpoints, if enabled:
+	var apiTokens *PersonalAccessTokens
+	if cfg.Features.UseAPITokens {
+		apiTokens = makePersonalAccessTokens(cfg, aboss, storer, templates)
+	}
+
 	// Gin Gonic setup:
 	engine = gin.New()
 	engine.Use(gin.Logger())
 	engine.Use(gin.Recovery())
-	engine.SetTrustedProxies(nil)
+	if err := engine.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	engine.Use(hoistClientIP)
 
 	// Setup middleware (functions invoked before the handler)
 
@@ -105,17 +222,32 @@ func GinRouter(cfg *ConfigData, storer *AuthStorer, templates *Templates) (engin
 		adapter.Wrap(csrf.Protect(csrfSeed,
 			// In a production environment, you should use csrf.Secure(true)
 			csrf.Secure(false),
+			// One CSRF cookie for the whole site. Otherwise, the cookie's path defaults to the
+			// request's "directory" and a page under /app ends up with a different CSRF cookie
+			// (and token) than the /auth endpoints it POSTs to.
+			csrf.Path("/"),
 			// And a more robust error handler:
-			csrf.ErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-				w.WriteHeader(http.StatusForbidden)
-				w.Write([]byte(`{"message": "Forbidden - CSRF token invalid"}`))
+			csrf.ErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if wantsJSON(r) {
+					respondJSON(w, http.StatusForbidden, map[string]string{
+						"status": "failure",
+						"error":  "Forbidden - CSRF token invalid",
+					})
+					return
+				}
+
+				http.Error(w, "Forbidden - CSRF token invalid", http.StatusForbidden)
 			})),
 		)),
 
 		// Gin-contrib session middleware: This acquires the session data and puts it into the
 		// gin context, after which you can work with the session via its Set() and Get()
-		// interface functions.
-		gsessions.Sessions(sessionCookieName, sessionStore.gstore),
+		// interface functions. (With the JWT client state, JWTClientState.sessions does the
+		// same.)
+		sessionMiddleware,
+
+		// Index the signed in user's session once the request is done (see activeSessions.go.)
+		activeSessions.track,
 
 		// Authboss doesn't know about the Gin context, so you need this lambda to run
 		// after the gsessions.Sessions() handler to hoist the session data into the
@@ -137,6 +269,10 @@ func GinRouter(cfg *ConfigData, storer *AuthStorer, templates *Templates) (engin
 			}
 		}(),
 
+		// Sign the user out of idle and overly long-lived sessions before Authboss loads the
+		// session (see sessionTimeouts.go.)
+		sessionTimeouts.enforce,
+
 		// Session state code MUST INVOKE before aboss.LoadClientStateMiddleWare handlers, or you
 		// will never log the user into your system.
 
@@ -144,9 +280,34 @@ func GinRouter(cfg *ConfigData, storer *AuthStorer, templates *Templates) (engin
 		adapter.Wrap(aboss.LoadClientStateMiddleware),
 	}
 
+	// The mock OAuth2 provider's token endpoint has to skip the CSRF check.
+	if oauth2Mock != nil {
+		middleware = append([]gin.HandlerFunc{oauth2Mock.skipCSRF}, middleware...)
+	}
+
+	// So do the OpenID Connect provider's token and userinfo endpoints.
+	if oidcProvider != nil {
+		middleware = append([]gin.HandlerFunc{oidcProvider.skipCSRF}, middleware...)
+	}
+
+	// And /auth/verify, which reverse proxies call without a CSRF token.
+	if forwardAuth != nil {
+		middleware = append([]gin.HandlerFunc{forwardAuth.skipCSRF}, middleware...)
+	}
+
+	// The /api endpoints authenticate with bearer tokens, not cookies.
+	if apiTokens != nil {
+		middleware = append([]gin.HandlerFunc{apiTokens.skipCSRF}, middleware...)
+	}
+
+	// And requests with a session token in the Authorization header.
+	if jwtSessions != nil {
+		middleware = append([]gin.HandlerFunc{jwtSessions.skipCSRF}, middleware...)
+	}
+
 	// Conditionally add "Remember me" just after authboss.LoadClientStateMiddleWare()
 	if cfg.yamlConfig.Features.UseRemember {
-		middleware = append(middleware, adapter.Wrap(remember.Middleware(aboss)))
+		middleware = append(middleware, adapter.Wrap(rememberSeriesMiddleware(aboss)))
 	}
 
 	middleware = append(middleware,
@@ -185,6 +346,58 @@ func GinRouter(cfg *ConfigData, storer *AuthStorer, templates *Templates) (engin
 				abossCTXData["flash_success"] = authboss.FlashSuccess(w, r)
 				abossCTXData["flash_error"] = authboss.FlashError(w, r)
 				abossCTXData["feature_remember"] = cfg.Features.UseRemember
+				abossCTXData["feature_totp"] = cfg.Features.UseTOTP
+				abossCTXData["feature_sms"] = cfg.Features.UseSMS
+				abossCTXData["oauth2_providers"] = oauth2Providers
+				abossCTXData["dev_mail_viewer"] = devMail != nil
+
+				// Two factor status for the user management page:
+				if user, validUser := currentUser.(*WorkedUser); validUser {
+					if cfg.Features.UseTOTP {
+						abossCTXData["totp_enabled"] = len(user.GetTOTPSecretKey()) > 0
+					}
+					if cfg.Features.UseSMS {
+						abossCTXData["sms_phone_number"] = user.GetSMSPhoneNumber()
+					}
+				}
+
+				// Linked OAuth2 identities for the user management page:
+				if user, validUser := currentUser.(*WorkedUser); validUser && len(oauth2Providers) > 0 {
+					linked := map[string]bool{}
+					for _, provider := range user.GetOAuth2Providers() {
+						linked[provider] = true
+					}
+
+					abossCTXData["oauth2_linked"] = linked
+				}
+
+				// Passkeys for the user management page:
+				if user, validUser := currentUser.(*WorkedUser); validUser && aboss.IsLoaded(webAuthnModuleName) {
+					abossCTXData["webauthn_credentials"] = user.GetWebAuthnCredentials()
+				}
+
+				// The user's roles and permissions, so that templates can show or hide what the
+				// user can (or can't) get to:
+				if user, validUser := currentUser.(*WorkedUser); validUser {
+					abossCTXData["current_user_roles"] = user.GetRoles()
+					abossCTXData["current_user_permissions"] = user.GetPermissions()
+				}
+
+				// Personal access tokens for the user management page:
+				abossCTXData["feature_api_tokens"] = apiTokens != nil
+				if user, validUser := currentUser.(*WorkedUser); validUser && apiTokens != nil {
+					abossCTXData["api_tokens"] = user.GetAPITokens()
+					abossCTXData["api_scopes"] = apiScopes
+				}
+
+				// Active sessions for the user management page:
+				if user, validUser := currentUser.(*WorkedUser); validUser {
+					abossCTXData["user_sessions"] = user.GetUserSessions()
+					abossCTXData["current_session"] = sessionHandle(gsessions.Default(ctx).ID())
+				}
+
+				// When the session ends, so that pages can warn the user:
+				abossCTXData.Merge(sessionTimeouts.htmlData(ctx))
 
 				// Grab the recovery token if it's present (usually in the query string), make it
 				// available in the template renderer. Use Gin's BindQuery method to add the "token"
@@ -241,6 +454,34 @@ func GinRouter(cfg *ConfigData, storer *AuthStorer, templates *Templates) (engin
 	appspace.GET("/", renderPageAsTemplate("app_index", templates))
 	appspace.GET("/user", renderPageAsTemplate("app_user", templates))
 	appspace.POST("/user", userManagementPost(aboss))
+	activeSessions.routes(appspace)
+	rbac.routes(appspace)
+
+	/* The administrator console: same middleware as /app, plus the admin role. */
+	adminspace := engine.Group(adminPath)
+	adminspace.Use(appMiddleware...)
+	adminspace.Use(rbac.RequireRole(adminRole))
+	makeAdminConsole(aboss, storer, templates).routes(adminspace)
+
+	// Personal access token management (/app/user/tokens) and the /api endpoints:
+	if apiTokens != nil {
+		apiTokens.routes(engine, appspace)
+	}
+
+	// Mock OAuth2 provider:
+	if oauth2Mock != nil {
+		oauth2Mock.routes(engine)
+	}
+
+	// OpenID Connect provider:
+	if oidcProvider != nil {
+		oidcProvider.routes(engine)
+	}
+
+	// Developer mail viewer:
+	if devMail != nil {
+		devMail.routes(engine)
+	}
 
 	// Static content:
 	engine.StaticFS("/images", http.Dir("content/images"))
@@ -336,14 +577,41 @@ func userManagementPost(aboss *authboss.Authboss) gin.HandlerFunc {
 	}
 }
 
+// clientIPKeyType is the request context key for the client's address (see hoistClientIP.)
+type clientIPKeyType struct{}
+
+// hoistClientIP puts the client's address into the request's context, for the handlers behind
+// Authboss' router, which don't see the Gin context. Gin takes it from the X-Forwarded-For or
+// X-Real-IP header when the request comes from one of the trusted_proxies, so that visitors
+// behind a reverse proxy don't all share the proxy's address.
+func hoistClientIP(ctx *gin.Context) {
+	ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), clientIPKeyType{}, ctx.ClientIP()))
+}
+
+// clientIP returns the client's address that hoistClientIP found, or the request's remote
+// address (without the port) if the request didn't go through it.
+func clientIP(r *http.Request) string {
+	if ip, valid := r.Context().Value(clientIPKeyType{}).(string); valid && len(ip) > 0 {
+		return ip
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
 // =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
 // Session management:
 // =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
 
 const (
 	sessionCookieName string = "abossworked_session"
-	// 30 minute session ages:
-	sessionMaxAge = int(30 * time.Minute / time.Second)
+
+	// Session key that tells the session store to give the session a new ID when it's saved
+	// (see regeneratingStore.) It's never stored.
+	sessionRegenerateKey = "session_regenerate"
 )
 
 // HTTP session key type. goLint suggests using something other than a string type as the
@@ -360,9 +628,11 @@ var (
 		// session cookie's path to another part of your web server's URl namespace,
 		// e.g., "/webapp" (although this may impact how Authboss ultimately works,
 		// and you may need to experiment a bit.)
-		Path:     "/",
-		Domain:   "",
-		MaxAge:   sessionMaxAge,
+		Path:   "/",
+		Domain: "",
+		// The cookie lasts as long as a session can (GinRouter sets sessions:max_lifetime);
+		// SessionTimeouts enforces the idle timeout.
+		MaxAge:   int(defaultConfig.Sessions.MaxLifetime / time.Second),
 		Secure:   false,
 		HttpOnly: false,
 		SameSite: http.SameSiteDefaultMode,
@@ -388,45 +658,172 @@ func (s SessionState) Get(key string) (string, bool) {
 	}
 
 	gValue, gOk := gSessionValue.(string)
-	s.logger.Printf("SessionState.Get(%v) -> %v %v", key, gValue, gOk)
+	s.logger.Printf("SessionState.Get(%v) -> %v", key, gOk)
 
 	return gValue, gOk
 }
 
-// SessionStore stores sessions in a Gin-contrib, GORM-backed session store.
+// SessionStore stores sessions in a Gin-contrib session store, the session backend (see
+// sessionBackends.go.)
 type SessionStore struct {
 	Name     string
 	logger   *log.Logger
 	pprinter *spew.ConfigState
 	gstore   gsessions.Store
+	backend  sessionBackend
+
+	// The session cookie's parameters, so that deleting the session deletes the right cookie.
+	cookieParams gsessions.Options
+
+	// The user database (the user session index) and the GORM backend's codecs, to index the
+	// sessions that predate the user session index (see indexSessions.)
+	storer *AuthStorer
+	db     *gorm.DB
+	codecs []securecookie.Codec
 }
 
-// makeSessionStore creates a new Gin-contrib, GORM-backed session store that also
-// implements the interface functions for Authboss.
-//
-// The keypairs arguments are (HMAC, encryption) key pairs. See github.com/gorilla/securecookie
-// for more complete documentation.
+// sessionRecord is a row in the GORM session store's table (github.com/wader/gormstore.)
+type sessionRecord struct {
+	ID        string
+	Data      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// TableName returns the session store's table name for sessionRecord.
+func (sessionRecord) TableName() string {
+	return sessionsTable
+}
+
+// makeSessionStore creates the session store, which keeps the sessions in the session backend
+// selected in the configuration (see sessionBackends.go) and implements the interface functions
+// for Authboss.
 //
-// The code currently uses the Gorm-based, SQLite3-backed database for session storage.
-// Uncomment the cookie store constructor code and update to return gcookieStore instead
-// of gsqliteStore.
-func makeSessionStore(storer *AuthStorer, defaultCookieParams gsessions.Options, sessionName string, keypairs ...[]byte) *SessionStore {
-	/* gcookieStore := gcookie.NewStore(keypairs...)
-	   gcookieStore.Options(defaultCookieParams) */
+// The session seed is the session cookie's HMAC key (see github.com/gorilla/securecookie.)
+func makeSessionStore(cfg *ConfigData, storer *AuthStorer, defaultCookieParams gsessions.Options, sessionName string, sessionSeed []byte) (*SessionStore, error) {
+	backend, err := makeSessionBackend(cfg, storer, sessionSeed)
+	if err != nil {
+		return nil, err
+	}
 
-	gsqliteStore := gsqlite.NewStore(storer.UserDB, true, keypairs...)
-	gsqliteStore.Options(defaultCookieParams)
+	gstore := &regeneratingStore{
+		sessionBackend: backend,
+		storer:         storer,
+	}
+	gstore.Options(defaultCookieParams)
 
 	pprinter := spew.NewDefaultConfig()
 	pprinter.Indent = "  "
 	pprinter.SortKeys = true
 
 	return &SessionStore{
-		Name:     sessionName,
-		logger:   log.New(os.Stdout, "[SESSION] ", log.LstdFlags),
-		pprinter: pprinter,
-		gstore:   gsqliteStore,
+		Name:         sessionName,
+		logger:       log.New(os.Stdout, "[SESSION] ", log.LstdFlags),
+		pprinter:     pprinter,
+		gstore:       gstore,
+		backend:      backend,
+		cookieParams: defaultCookieParams,
+		storer:       storer,
+		db:           storer.UserDB,
+		codecs:       securecookie.CodecsFromPairs(sessionSeed, nil),
+	}, nil
+}
+
+// RevokeUserSessions deletes all of the user's sessions, signing the user out everywhere, and
+// returns how many it deleted. The user session index (see activeSessions.go) finds the user's
+// sessions.
+func (s SessionStore) RevokeUserSessions(pid string) (int64, error) {
+	sessionIDs, err := s.storer.UserSessionIDs(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked, err := s.revokeSessions(sessionIDs)
+	s.logger.Printf("Revoked %d sessions for %s.", revoked, pid)
+
+	return revoked, err
+}
+
+// RevokeSession deletes the session, signing out whoever was using it.
+func (s SessionStore) RevokeSession(sessionID string) error {
+	_, err := s.revokeSessions([]string{sessionID})
+	return err
+}
+
+// revokeSessions deletes the sessions from the session backend and their user session index
+// entries, returning how many sessions it revoked. A session that the backend can't delete (a
+// cookie) is signed out once it's no longer in the index (see ActiveSessions.verify.)
+func (s SessionStore) revokeSessions(sessionIDs []string) (int64, error) {
+	if len(sessionIDs) == 0 {
+		return 0, nil
+	}
+
+	for _, sessionID := range sessionIDs {
+		if err := s.backend.deleteSession(nil, sessionID); err != nil {
+			return 0, err
+		}
 	}
+
+	tx := s.db.Where("session_id IN ?", sessionIDs).Delete(&UserSessions{})
+	return tx.RowsAffected, tx.Error
+}
+
+// indexSessions brings the user session index up to date with the session backend when the
+// server starts. The GORM backend's signed in sessions that aren't in the index are added to
+// it: these are the sessions that were created before there was an index; the session data is
+// encoded, so this decodes each one to find its user. The sessions kept in memory didn't
+// survive the restart, so their index entries go.
+func (s SessionStore) indexSessions(storer *AuthStorer) error {
+	switch backend := s.backend.(type) {
+	case *gormBackend:
+	case *keyValueBackend:
+		if !backend.persistent {
+			return s.db.Where("1 = 1").Delete(&UserSessions{}).Error
+		}
+
+		return nil
+	default:
+		return nil
+	}
+
+	var records []sessionRecord
+
+	err := s.db.Where("expires_at > ? AND id NOT IN (SELECT session_id FROM user_sessions)", time.Now()).
+		Find(&records).Error
+	if err != nil {
+		return err
+	}
+
+	indexed := 0
+	for _, record := range records {
+		values := make(map[interface{}]interface{})
+		if err := securecookie.DecodeMulti(s.Name, record.Data, &values, s.codecs...); err != nil {
+			continue
+		}
+
+		pid, _ := values[authboss.SessionKey].(string)
+		if len(pid) == 0 {
+			continue
+		}
+
+		series, _ := values[rememberSeriesSessionKey].(string)
+
+		err := storer.TouchUserSession(record.ID, pid, series, "", "")
+		if errors.Is(err, authboss.ErrUserNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		indexed++
+	}
+
+	if indexed > 0 {
+		s.logger.Printf("Indexed %d existing sessions.", indexed)
+	}
+
+	return nil
 }
 
 // ReadState loads the session from the http.Request context
@@ -449,23 +846,44 @@ func (s SessionStore) ReadState(r *http.Request) (authboss.ClientState, error) {
 
 // WriteState to the responsewriter
 func (s SessionStore) WriteState(w http.ResponseWriter, state authboss.ClientState, ev []authboss.ClientStateEvent) error {
-	ses := state.(*SessionState)
+	return writeSessionState(state.(*SessionState), ev, s.Name, s.cookieParams, s.logger)
+}
+
+// writeSessionState applies Authboss' client state events to the session and saves it. The
+// session store and the JWT client state (see jwtClientState.go) share it.
+//
+// The session gets a new ID when the user signs in, signs out, or goes from "half" (remember-me)
+// to fully authenticated, see regeneratingStore. Signing in also stamps the session for
+// SessionTimeouts.
+func writeSessionState(ses *SessionState, ev []authboss.ClientStateEvent, name string, cookieParams gsessions.Options,
+	logger *log.Logger) error {
+	signedIn, regenerate := false, false
+
 	for _, ev := range ev {
 		switch ev.Kind {
 		case authboss.ClientStateEventPut:
 			ses.gSessionData.Set(ev.Key, ev.Value)
-			s.logger.Printf("WriteState(%s): %v -> %v", s.Name, ev.Key, ev.Value)
+			logger.Printf("WriteState(%s): %v set.", name, ev.Key)
+
+			signedIn = signedIn || ev.Key == authboss.SessionKey
 
 		case authboss.ClientStateEventDel:
+			regenerate = regenerate || ((ev.Key == authboss.SessionKey || ev.Key == authboss.SessionHalfAuthKey) &&
+				ses.gSessionData.Get(ev.Key) != nil)
+
 			ses.gSessionData.Delete(ev.Key)
-			s.logger.Printf("WriteState(%s): %s deleted.", s.Name, ev.Key)
+			logger.Printf("WriteState(%s): %s deleted.", name, ev.Key)
 
 		case authboss.ClientStateEventDelAll:
 			if len(ev.Key) == 0 {
-				// Delete the entire session
-				ses.gSessionData.Options(gsessions.Options{
-					MaxAge: -1,
-				})
+				// Delete the entire session. Clear the values too: the session is still
+				// in the Gin context for the rest of the request (see ActiveSessions.track.)
+				// Options replaces all of the cookie's parameters, not just MaxAge; without
+				// the path, the browser wouldn't delete the session cookie.
+				ses.gSessionData.Clear()
+				options := cookieParams
+				options.MaxAge = -1
+				ses.gSessionData.Options(options)
 			} else {
 				/* The bummer here is that gsessions.Session doesn't have an
 				   interface function to grab the Values map. Save all of the
@@ -474,6 +892,9 @@ func (s SessionStore) WriteState(w http.ResponseWriter, state authboss.ClientSta
 				whitelist := strings.Split(ev.Key, ",")
 				saveWhitelist := make(map[string]interface{}, len(whitelist))
 
+				// Signing out (Authboss' logout deletes everything but the whitelist.)
+				regenerate = regenerate || ses.gSessionData.Get(authboss.SessionKey) != nil
+
 				for _, key := range whitelist {
 					saveWhitelist[key] = ses.gSessionData.Get(key)
 				}
@@ -487,6 +908,17 @@ func (s SessionStore) WriteState(w http.ResponseWriter, state authboss.ClientSta
 		}
 	}
 
+	if signedIn {
+		now := time.Now().Unix()
+		ses.gSessionData.Set(sessionSignedInKey, now)
+		ses.gSessionData.Set(sessionLastActiveKey, now)
+		regenerate = true
+	}
+
+	if regenerate {
+		ses.gSessionData.Set(sessionRegenerateKey, true)
+	}
+
 	return ses.gSessionData.Save()
 }
 
@@ -566,7 +998,8 @@ func (c CookieStorer) ReadState(r *http.Request) (authboss.ClientState, error) {
 					return nil, err
 				}
 
-				c.logger.Printf("CookieStorer.ReadState: %v -> %s", n, str)
+				// Not the value: the remember-me cookie's token signs the user in.
+				c.logger.Printf("CookieStorer.ReadState: %v", n)
 				cs[n] = str
 			}
 		}
@@ -585,9 +1018,9 @@ func (c CookieStorer) WriteState(w http.ResponseWriter, state authboss.ClientSta
 				return errmgmt.Wrap(err, "failed to encode cookie")
 			}
 
-			c.logger.Printf("CookieStorer.WriteState: Put %v -> %v", ev.Key, ev.Value)
+			c.logger.Printf("CookieStorer.WriteState: Put %v", ev.Key)
 			http.SetCookie(w, &http.Cookie{
-				Expires: time.Now().UTC().AddDate(1, 0, 0),
+				Expires: time.Now().UTC().Add(time.Duration(c.Cookie.MaxAge) * time.Second),
 				Name:    ev.Key,
 				Value:   encoded,
 
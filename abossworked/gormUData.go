@@ -17,7 +17,10 @@ You should have received a copy of the GNU General Public License along with
 this program. If not, see <https://www.gnu.org/licenses/>.
 */
 
-/* These are all of the structure types that are stored in the GORM database database. */
+/* These are all of the structure types that are stored in the GORM database database.
+
+   The tables themselves are created by the versioned migrations in migrations.go, not
+   GORM's AutoMigrate: a change to a structure here needs a matching migration. */
 
 import (
 	"database/sql"
@@ -38,22 +41,7 @@ type UserData struct {
 	// bCrypt-ed password
 	UIDData string `gorm:"column:uid_data;not null;type:varchar(64)"`
 
-	// OAuth2: TBD
-	/*
-		OAuth2UID          sql.NullString `gorm:"uniqueIndex"`
-		OAuth2Provider     string
-		OAuth2AccessToken  string
-		OAuth2RefreshToken string
-		OAuth2Expiry       time.Time
-	*/
-
-	// 2fa: TBD
-	/*
-		TOTPSecretKey      string
-		SMSPhoneNumber     string
-		SMSSeedPhoneNumber string
-		RecoveryCodes      string
-	*/
+	// OAuth2 identities, TOTP and SMS 2fa are in other tables
 
 	// Remember is in another table
 
@@ -125,20 +113,416 @@ type RecoveryRequests struct {
 	// DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
+// TwoFactorTOTP is the underlying database table object for time-based one time
+// password (TOTP) two factor authentication. Like Confirmations, a row only exists
+// once the user starts down the TOTP path, and the user has TOTP enabled only if
+// the secret key is non-NULL.
+type TwoFactorTOTP struct {
+	GUID          string         `gorm:"primaryKey;not null;type:char(36)"`
+	TOTPSecretKey sql.NullString `gorm:"column:totp_secret_key"`
+	// Last TOTP code used, prevents code replay within the TOTP time window.
+	TOTPLastCode string `gorm:"column:totp_last_code"`
+	// Comma-separated list of bcrypt-ed recovery codes. Authboss shares the
+	// recovery codes across all of its 2fa modules, SMS included.
+	RecoveryCodes string
+
+	// 1-to-1 association with UserData via GUID join
+	User UserData `gorm:"foreignKey:GUID"`
+
+	// GORM's Model members:
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// If you want to use GORM's "soft delete", uncomment
+	// DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName returns the "totp2fa" table name for TwoFactorTOTP.
+func (TwoFactorTOTP) TableName() string {
+	return "totp2fa"
+}
+
+// TwoFactorSMS is the underlying database table object for SMS two factor
+// authentication. The user has SMS 2fa enabled only if the phone number is
+// non-NULL. (The recovery codes live in the TwoFactorTOTP table.)
+type TwoFactorSMS struct {
+	GUID        string         `gorm:"primaryKey;not null;type:char(36)"`
+	PhoneNumber sql.NullString `gorm:"type:varchar(32)"`
+
+	// 1-to-1 association with UserData via GUID join
+	User UserData `gorm:"foreignKey:GUID"`
+
+	// GORM's Model members:
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// If you want to use GORM's "soft delete", uncomment
+	// DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName returns the "sms2fa" table name for TwoFactorSMS.
+func (TwoFactorSMS) TableName() string {
+	return "sms2fa"
+}
+
+// OAuth2Identities is the underlying database table object for OAuth2 ("social login")
+// identities. A user can link more than one OAuth2 identity to their account, one per
+// provider, so the GUID is not unique here. The (provider, provider UID) pair identifies
+// the identity.
+type OAuth2Identities struct {
+	Provider string `gorm:"primaryKey;not null;type:varchar(64)"`
+	// The user's identifier at the provider
+	UID  string `gorm:"primaryKey;column:uid;not null;type:varchar(256)"`
+	GUID string `gorm:"not null;index;type:char(36)"`
+
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+
+	// Many-to-1 association with UserData via GUID join
+	User UserData `gorm:"foreignKey:GUID"`
+
+	// GORM's Model members:
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// If you want to use GORM's "soft delete", uncomment
+	// DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName returns the "oauth2" table name for OAuth2Identities.
+func (OAuth2Identities) TableName() string {
+	return "oauth2"
+}
+
+// WebAuthnCredentials is the underlying database table object for WebAuthn (passkey)
+// credentials. A user can register more than one passkey (phone, laptop, security key),
+// so the GUID is not unique here. The credential ID identifies the credential.
+type WebAuthnCredentials struct {
+	// Base64 URL-encoded credential ID
+	CredentialID string `gorm:"primaryKey;not null;type:varchar(1024)"`
+	GUID         string `gorm:"not null;index;type:char(36)"`
+	// User-supplied name, so that the user can tell their passkeys apart
+	Name string `gorm:"type:varchar(64)"`
+
+	PublicKey       []byte
+	AttestationType string
+	// Comma-separated list of authenticator transports ("usb", "internal", "hybrid", ...)
+	Transports     string
+	AAGUID         []byte `gorm:"column:aaguid"`
+	SignCount      uint32
+	CloneWarning   bool
+	UserPresent    bool
+	UserVerified   bool
+	BackupEligible bool
+	BackupState    bool
+	LastUsed       time.Time
+
+	// Many-to-1 association with UserData via GUID join. GORM guesses that this is a
+	// 1-to-1 association, like the other tables, and would constrain udata's GUID to a
+	// (non-unique) credential GUID. "constraint:-" skips that constraint.
+	User UserData `gorm:"foreignKey:GUID;references:GUID;constraint:-"`
+
+	// GORM's Model members:
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// If you want to use GORM's "soft delete", uncomment
+	// DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName returns the "webauthn_credentials" table name for WebAuthnCredentials.
+func (WebAuthnCredentials) TableName() string {
+	return "webauthn_credentials"
+}
+
+// OIDCClients is the underlying database table object for the OpenID Connect provider's
+// client registry: the applications that can ask the worked example to sign their users
+// in.
+type OIDCClients struct {
+	ClientID string `gorm:"primaryKey;not null;type:varchar(256)"`
+	// bcrypt-ed client secret. Empty for public clients, which have to use PKCE.
+	SecretHash string
+	Name       string `gorm:"type:varchar(256)"`
+	// Space-separated list of the client's callback URLs
+	RedirectURIs string `gorm:"column:redirect_uris"`
+
+	// GORM's Model members:
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// If you want to use GORM's "soft delete", uncomment
+	// DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName returns the "oidc_clients" table name for OIDCClients.
+func (OIDCClients) TableName() string {
+	return "oidc_clients"
+}
+
+// OIDCAuthCodes is the underlying database table object for the OpenID Connect provider's
+// outstanding authorization codes. Like the confirmation and recovery tokens, only the
+// code's SHA-256 hash is stored. A code is deleted when it's exchanged for tokens.
+type OIDCAuthCodes struct {
+	CodeHash string `gorm:"primaryKey;not null;type:char(64)"`
+	ClientID string `gorm:"not null;type:varchar(256)"`
+	GUID     string `gorm:"not null;type:char(36)"`
+
+	RedirectURI string
+	// Space-separated list of the granted scopes
+	Scope string
+	Nonce string
+	// PKCE code challenge and method ("S256")
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Expiry              time.Time
+
+	// GORM's Model members:
+	CreatedAt time.Time
+}
+
+// TableName returns the "oidc_codes" table name for OIDCAuthCodes.
+func (OIDCAuthCodes) TableName() string {
+	return "oidc_codes"
+}
+
+// OIDCConsents is the underlying database table object for the scopes that a user allowed
+// a client application to access, so that the user isn't asked every time they sign in.
+type OIDCConsents struct {
+	GUID     string `gorm:"primaryKey;not null;type:char(36)"`
+	ClientID string `gorm:"primaryKey;not null;type:varchar(256)"`
+	// Space-separated list of the scopes
+	Scope string
+
+	// GORM's Model members:
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// If you want to use GORM's "soft delete", uncomment
+	// DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName returns the "oidc_consents" table name for OIDCConsents.
+func (OIDCConsents) TableName() string {
+	return "oidc_consents"
+}
+
+// APITokens is the underlying database table object for personal access tokens, which
+// scripts use to call the /api endpoints on the user's behalf. Like the OIDC authorization
+// codes, only the token's SHA-256 hash is stored: the user sees the token once, when it's
+// created.
+type APITokens struct {
+	// Random identifier, so that the user can revoke the token without knowing it
+	TokenID   string `gorm:"primaryKey;not null;type:char(16)"`
+	TokenHash string `gorm:"uniqueIndex;not null;type:char(64)"`
+	GUID      string `gorm:"not null;index;type:char(36)"`
+	// User-supplied name, so that the user can tell their tokens apart
+	Name string `gorm:"type:varchar(64)"`
+	// Space-separated list of the scopes granted to the token
+	Scopes string
+	// Zero if the token never expires
+	Expiry   time.Time
+	LastUsed time.Time
+
+	// Many-to-1 association with UserData via GUID join (see WebAuthnCredentials for
+	// "constraint:-".)
+	User UserData `gorm:"foreignKey:GUID;references:GUID;constraint:-"`
+
+	// GORM's Model members:
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// If you want to use GORM's "soft delete", uncomment
+	// DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName returns the "api_tokens" table name for APITokens.
+func (APITokens) TableName() string {
+	return "api_tokens"
+}
+
+// Roles is the underlying database table object for the roles used in role-based access
+// control. A role is a named set of permissions (RolePermissions), assigned to users via
+// UserRoles.
+type Roles struct {
+	Name        string `gorm:"primaryKey;not null;type:varchar(64)"`
+	Description string
+
+	// GORM's Model members:
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// If you want to use GORM's "soft delete", uncomment
+	// DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// TableName returns the "roles" table name for Roles.
+func (Roles) TableName() string {
+	return "roles"
+}
+
+// RolePermissions is the underlying database table object for the permissions granted by a
+// role, one row per (role, permission) pair.
+type RolePermissions struct {
+	Role       string `gorm:"primaryKey;not null;type:varchar(64)"`
+	Permission string `gorm:"primaryKey;not null;type:varchar(128)"`
+
+	// GORM's Model members:
+	CreatedAt time.Time
+}
+
+// TableName returns the "role_permissions" table name for RolePermissions.
+func (RolePermissions) TableName() string {
+	return "role_permissions"
+}
+
+// UserRoles is the underlying database table object for the users' role assignments, one
+// row per (user, role) pair.
+type UserRoles struct {
+	GUID string `gorm:"primaryKey;not null;type:char(36)"`
+	Role string `gorm:"primaryKey;not null;index;type:varchar(64)"`
+
+	// Many-to-1 association with UserData via GUID join (see WebAuthnCredentials for
+	// "constraint:-".)
+	User UserData `gorm:"foreignKey:GUID;references:GUID;constraint:-"`
+
+	// GORM's Model members:
+	CreatedAt time.Time
+}
+
+// TableName returns the "user_roles" table name for UserRoles.
+func (UserRoles) TableName() string {
+	return "user_roles"
+}
+
 // RememberMeTokens is the underlying database table object for Primary IDentifier
 // and remember-me tokens. This is intentionally disconnected (no direct foreign key
 // relationship, no association) from the UserData table.
 type RememberMeTokens struct {
 	// User's GUID: This will not be unique, since the user can use multiple browsers.
 	GUID string `gorm:"not null;index;type:char(36)"`
-	// Remember-me token. There can be multiple tokens associated with the
-	// user, each of which are distinct.
-	Token string `gorm:"primaryKey;not null"`
+	// Keyed hash (HMAC-SHA256, hex) of the remember-me token. There can be multiple
+	// tokens associated with the user, each of which are distinct. The token itself is
+	// never stored, so reading the database doesn't let anyone sign in as the user.
+	TokenHash string `gorm:"primaryKey;not null"`
+	// The remember-me series: one per browser (device) that the user asked to be remembered
+	// on. The token rotates each time it's used, the series stays the same (see
+	// rememberSeries.go.) Empty for the tokens issued by Authboss' own remember module.
+	Series string `gorm:"index;type:varchar(64)"`
+	// The token's previous hash and when it was rotated, so that the browser's concurrent
+	// requests with the previous token aren't mistaken for a stolen cookie.
+	PreviousTokenHash string
+	RotatedAt         time.Time
 
-	// Really needs an expiration to reap the token...
+	// When the token was issued and when it expires. UseRememberToken rejects expired
+	// tokens; the remember-me token reaper deletes them (see rememberReaper.go.)
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
 }
 
 // TableName returns the "remember" table name for RememberMeTokens.
 func (RememberMeTokens) TableName() string {
 	return "remember"
 }
+
+// SchemaMigrations is the user database's schema history, one row per applied
+// migration (see migrations.go). Signature is the schema signature recorded after the
+// migration ran.
+type SchemaMigrations struct {
+	Version   int    `gorm:"primaryKey;not null;autoIncrement:false"`
+	Name      string `gorm:"type:text"`
+	Signature string `gorm:"type:char(64)"`
+	AppliedAt time.Time
+}
+
+// TableName returns the "schema_migrations" table name for SchemaMigrations.
+func (SchemaMigrations) TableName() string {
+	return "schema_migrations"
+}
+
+// SecurityEvents is the underlying database table object for the users' security events,
+// such as a stolen remember-me cookie.
+type SecurityEvents struct {
+	ID   uint   `gorm:"primaryKey"`
+	GUID string `gorm:"not null;index;type:char(36)"`
+	// What happened (e.g., "remember_token_theft") and the details.
+	Event  string `gorm:"not null;type:varchar(64)"`
+	Detail string
+	// Where the request that triggered the event came from.
+	RemoteAddr string `gorm:"type:varchar(64)"`
+
+	// Many-to-1 association with UserData via GUID join (see WebAuthnCredentials for
+	// "constraint:-".)
+	User UserData `gorm:"foreignKey:GUID;references:GUID;constraint:-"`
+
+	CreatedAt time.Time
+}
+
+// TableName returns the "security_events" table name for SecurityEvents.
+func (SecurityEvents) TableName() string {
+	return "security_events"
+}
+
+// UserSessions indexes the session store's sessions (the "sessions" table) by user, so that
+// the user can see where they're signed in and revoke a session (see activeSessions.go.) The
+// session store's own rows are encoded, so the index is the only way to find a user's
+// sessions without decoding every one of them.
+type UserSessions struct {
+	// The session store's session ID ("sessions" table "id".)
+	SessionID string `gorm:"primaryKey;not null;type:varchar(64)"`
+	GUID      string `gorm:"not null;index;type:char(36)"`
+	// The remember-me series that signed the session in, if any. Revoking the session also
+	// revokes the series, otherwise the browser's remember-me cookie just signs it back in.
+	RememberSeries string `gorm:"type:varchar(64)"`
+	// The browser (device) and where its requests come from, as of the last request.
+	UserAgent  string
+	RemoteAddr string `gorm:"type:varchar(64)"`
+
+	// Many-to-1 association with UserData via GUID join (see WebAuthnCredentials for
+	// "constraint:-".)
+	User UserData `gorm:"foreignKey:GUID;references:GUID;constraint:-"`
+
+	// When the user signed in and when the session was last used (updated at most once
+	// every userSessionTouchInterval.)
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+// TableName returns the "user_sessions" table name for UserSessions.
+func (UserSessions) TableName() string {
+	return "user_sessions"
+}
+
+// RevokedTokens is the JWT client state's deny-list (see jwtClientState.go): the IDs ("jti") of
+// the tokens that were revoked (signed out, revoked from the user management page) before they
+// expired. The tokens themselves aren't stored anywhere.
+type RevokedTokens struct {
+	JTI string `gorm:"primaryKey;not null;type:varchar(64)"`
+	// The revoked tokens' latest expiration. The entry can go after that.
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// TableName returns the "revoked_tokens" table name for RevokedTokens.
+func (RevokedTokens) TableName() string {
+	return "revoked_tokens"
+}
+
+// Outbox is the outbound mail queue (see mailOutbox.go): the e-mails that Authboss sent,
+// waiting to be delivered, delivered (for a while) or given up on.
+type Outbox struct {
+	ID uint64 `gorm:"primaryKey"`
+	// The e-mail's recipients and subject, for the administrator console and abossctl
+	Recipients string
+	Subject    string
+	// The authboss.Email, JSON-encoded. Cleared once the e-mail is delivered: its links carry
+	// confirmation and recovery tokens.
+	Email string `gorm:"not null"`
+
+	// "pending", "sent" or "dead" (given up after too many failed attempts.)
+	Status string `gorm:"not null;type:varchar(16);index:idx_outbox_status_next_attempt_at,priority:1"`
+	// Failed delivery attempts so far, when to try next and why the last attempt failed.
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt time.Time `gorm:"index:idx_outbox_status_next_attempt_at,priority:2"`
+	LastError     string
+
+	CreatedAt time.Time
+	SentAt    time.Time
+}
+
+// TableName returns the "outbox" table name for Outbox.
+func (Outbox) TableName() string {
+	return "outbox"
+}
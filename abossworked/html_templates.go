@@ -27,6 +27,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/oxtoacart/bpool"
@@ -76,6 +77,10 @@ type Templates struct {
 	masterTemplateFile string
 	// Template helper functions
 	templateFuncs template.FuncMap
+	// The e-mail templates, with their own master layout and fragments (see mail_templates.go.)
+	// Authboss renders e-mails from its own goroutines.
+	mail      mailTemplateSet
+	mailMutex sync.Mutex
 }
 
 // pathFilterFunc filters file names within directory traversals. For example, fragment
@@ -91,15 +96,6 @@ type actionFunc func(name string, path string, relPath string, content []byte) e
 // thundering herds...
 var (
 	bufPool = bpool.NewBufferPool(4)
-
-	// These templates are not rendered in the normal way with ExecuteTemplate or
-	// with a master layout template.
-	nonRenderedTemplates = map[string]string{
-		"confirm_txt":  contentTypeText,
-		"confirm_html": contentTypeHTML,
-		"recover_txt":  contentTypeText,
-		"recover_html": contentTypeHTML,
-	}
 )
 
 // =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
@@ -153,33 +149,25 @@ func (templates *Templates) Render(ctx context.Context, page string, data authbo
 		return []byte(errString), contentTypeText, fmt.Errorf(errString)
 	}
 
-	contentType := contentTypeHTML
-	if specialContent, special := nonRenderedTemplates[page]; !special {
-		// Not special.
-		// Combine the incoming with the additional static data.
-		combined := authboss.NewHTMLData().Merge(data)
-		// Add the Authboss page
-		combined["abosspage"] = page
-		// Merge extra data from the template
-		if htmlData, valid := templates.TemplateData[page]; valid {
-			combined.Merge(htmlData)
-		}
-
-		if templates.showTemplateVars {
-			templates.logger.Printf("Template data:\n%s", templates.pprint.Sdump(combined))
-		}
+	// Combine the incoming with the additional static data.
+	combined := authboss.NewHTMLData().Merge(data)
+	// Add the Authboss page
+	combined["abosspage"] = page
+	// Merge extra data from the template
+	if htmlData, valid := templates.TemplateData[page]; valid {
+		combined.Merge(htmlData)
+	}
 
-		err = tmpl.html.ExecuteTemplate(buf, htmlMasterLayout, combined)
-	} else {
-		contentType = specialContent
-		err = tmpl.html.Execute(buf, data)
+	if templates.showTemplateVars {
+		templates.logger.Printf("Template data:\n%s", templates.pprint.Sdump(combined))
 	}
 
+	err = tmpl.html.ExecuteTemplate(buf, htmlMasterLayout, combined)
 	if err != nil {
 		return []byte(fmt.Sprintf("%v", err)), contentTypeText, err
 	}
 
-	return buf.Bytes(), contentType, nil
+	return buf.Bytes(), contentTypeHTML, nil
 }
 
 // =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
@@ -284,12 +272,14 @@ func (templates *Templates) loadTemplates() error {
 	}
 
 	// Then sweep through templateDir for the regular templates. Ingore files starting with "_"
-	// or not ending in ".gohtml"
+	// or not ending in ".gohtml", and the e-mail templates (see mail_templates.go.)
 	masterTemplatePath := filepath.Join(templates.templateDir, templates.masterTemplateFile)
+	mailDirPrefix := filepath.Join(templates.templateDir, mailTemplateDir) + string(os.PathSeparator)
 	err = filepath.WalkDir(templates.templateDir, walkFunction(templates.templateDir,
 		// Path name filter function:
 		func(fullPath, baseName string) bool {
-			return fullPath != masterTemplatePath && !strings.HasPrefix(baseName, "_") && strings.HasSuffix(baseName, ".gohtml")
+			return fullPath != masterTemplatePath && !strings.HasPrefix(fullPath, mailDirPrefix) &&
+				!strings.HasPrefix(baseName, "_") && strings.HasSuffix(baseName, ".gohtml")
 		},
 		// Action function:
 		func(name, path, relPath string, content []byte) error {
@@ -318,7 +308,10 @@ func (templates *Templates) loadTemplates() error {
 		return fmt.Errorf("failed to load templates: %v", err)
 	}
 
-	return nil
+	templates.mailMutex.Lock()
+	defer templates.mailMutex.Unlock()
+
+	return templates.loadMailTemplates()
 }
 
 func (templates *Templates) reloadTemplate(key string) error {
@@ -0,0 +1,277 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/volatiletech/authboss/v3"
+	"github.com/volatiletech/authboss/v3/defaults"
+	"github.com/volatiletech/authboss/v3/otp/twofactor"
+	"github.com/volatiletech/authboss/v3/otp/twofactor/sms2fa"
+	"github.com/volatiletech/authboss/v3/otp/twofactor/totp2fa"
+	"github.com/volatiletech/authboss/v3/recover"
+)
+
+// JSON API mode: SPA and mobile clients that ask for JSON ("Accept: application/json", or a
+// JSON request body) get JSON from the authboss flows instead of HTML pages and redirects.
+// Browsers keep the HTML experience. Each of authboss' HTTP pieces (responder, redirector,
+// error handler and body reader) has a JSON counterpart, and the negotiating wrappers below
+// pick one per request.
+//
+// The JSON responses look like:
+//
+//	{"status": "success", "page": "login", ...page data...}
+//	{"status": "failure", "page": "login", "error": "Invalid Credentials"}
+//	{"status": "failure", "page": "register", "errors": {"email": ["..."]}}
+//	{"status": "success", "location": "/app/", "message": "..."}
+//
+// "location" is where the client should go next (the page that a browser would have been
+// redirected to.) JSON clients still need the session cookie and have to send the CSRF token
+// from the X-CSRF-Token response header with their POSTs.
+
+const (
+	jsonContentType = "application/json"
+)
+
+// jsonPageData are the page data that JSON clients get: the errors, the form values to
+// preserve, where to go after signing in and the authboss pages' own data. The responder
+// merges the request's template data into the page's, which also has the signed in user's
+// sessions, tokens and passkeys (for the user management page), the flashes and the CSRF
+// field. None of that goes into the JSON responses.
+var jsonPageData = map[string]bool{
+	authboss.DataErr:               true,
+	authboss.DataValidation:        true,
+	authboss.DataPreserve:          true,
+	authboss.FormValueRedirect:     true,
+	recover.DataRecoverToken:       true,
+	twofactor.DataRecoveryCodes:    true,
+	twofactor.DataNumRecoveryCodes: true,
+	twofactor.DataVerifyEmail:      true,
+	twofactor.DataVerifyURL:        true,
+	totp2fa.DataTOTPSecret:         true,
+	sms2fa.DataSMSPhoneNumber:      true,
+}
+
+// wantsJSON returns true if the client asked for JSON (Accept header) or sent JSON.
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == jsonContentType {
+			return true
+		}
+	}
+
+	return sentJSON(r)
+}
+
+// sentJSON returns true if the request's body is JSON.
+func sentJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == jsonContentType
+}
+
+// respondJSON writes a JSON response.
+func respondJSON(w http.ResponseWriter, code int, data interface{}) error {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(data)
+}
+
+// setupJSONAPI replaces authboss' HTML-only responder, redirector and error handler with ones
+// that negotiate between HTML and JSON. Call it after defaults.SetCore().
+func setupJSONAPI(ab *authboss.Authboss) {
+	ab.Config.Core.Responder = negotiatingResponder{
+		html: ab.Config.Core.Responder,
+		json: defaults.NewResponder(jsonRenderer{}),
+	}
+
+	ab.Config.Core.Redirector = negotiatingRedirector{
+		html: ab.Config.Core.Redirector,
+	}
+
+	ab.Config.Core.ErrorHandler = negotiatingErrorHandler{
+		ErrorHandler: ab.Config.Core.ErrorHandler,
+	}
+}
+
+// jsonRenderer renders the page data as JSON (authboss.Renderer interface). The page name
+// tells the client which step of the flow it's at.
+type jsonRenderer struct{}
+
+// Load is a no-op: there are no templates to load.
+func (jsonRenderer) Load(names ...string) error {
+	return nil
+}
+
+// Render the page's data (jsonPageData) as JSON.
+func (jsonRenderer) Render(ctx context.Context, page string, data authboss.HTMLData) ([]byte, string, error) {
+	response := map[string]interface{}{}
+
+	for key, value := range data {
+		if jsonPageData[key] {
+			response[key] = value
+		}
+	}
+
+	response["page"] = page
+	response["status"] = "success"
+	if _, failed := data[authboss.DataErr]; failed {
+		response["status"] = "failure"
+	} else if _, failed := data[authboss.DataValidation]; failed {
+		response["status"] = "failure"
+	}
+
+	encoded, err := json.Marshal(response)
+	return encoded, jsonContentType, err
+}
+
+// negotiatingResponder renders pages as HTML or JSON (authboss.HTTPResponder interface)
+type negotiatingResponder struct {
+	html authboss.HTTPResponder
+	json authboss.HTTPResponder
+}
+
+// Respond with the page as JSON if the client wants JSON, HTML otherwise.
+func (responder negotiatingResponder) Respond(w http.ResponseWriter, r *http.Request, code int, page string, data authboss.HTMLData) error {
+	if wantsJSON(r) {
+		return responder.json.Respond(w, r, code, page, data)
+	}
+
+	return responder.html.Respond(w, r, code, page, data)
+}
+
+// negotiatingRedirector redirects browsers and tells JSON clients where to go next
+// (authboss.HTTPRedirector interface)
+type negotiatingRedirector struct {
+	html authboss.HTTPRedirector
+}
+
+// Redirect the browser, or respond to the JSON client with the location and message.
+//
+// authboss' own redirector has an API mode, but only for JSON request bodies and it needs a
+// "redirect" template. It also answers with the redirect's status code (307), which clients
+// don't expect to see with a JSON body.
+func (redirector negotiatingRedirector) Redirect(w http.ResponseWriter, r *http.Request, ro authboss.RedirectOptions) error {
+	if !wantsJSON(r) {
+		return redirector.html.Redirect(w, r, ro)
+	}
+
+	location := ro.RedirectPath
+	if redir := redirParam(r); ro.FollowRedirParam && len(redir) > 0 && !strings.Contains(redir, "://") {
+		location = redir
+	}
+
+	response := map[string]string{
+		"status":   "success",
+		"location": location,
+	}
+
+	if len(ro.Success) > 0 {
+		response["message"] = ro.Success
+	}
+
+	if len(ro.Failure) > 0 {
+		response["status"] = "failure"
+		response["message"] = ro.Failure
+	}
+
+	return respondJSON(w, http.StatusOK, response)
+}
+
+// redirParam returns the request's "redir" value: the JSON body's, or the form's (the POST body or
+// the query, like authboss' own redirector.)
+func redirParam(r *http.Request) string {
+	if sentJSON(r) && r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var values map[string]interface{}
+		if err == nil && json.Unmarshal(body, &values) == nil {
+			if redir, _ := values[authboss.FormValueRedirect].(string); len(redir) > 0 {
+				return redir
+			}
+		}
+	}
+
+	return r.FormValue(authboss.FormValueRedirect)
+}
+
+// negotiatingErrorHandler answers JSON clients with a JSON error when a handler fails
+// (authboss.ErrorHandler interface). The wrapped error handler still logs the error, and
+// browsers get whatever it does.
+type negotiatingErrorHandler struct {
+	authboss.ErrorHandler
+}
+
+// Wrap the handler.
+func (errorHandler negotiatingErrorHandler) Wrap(handler func(w http.ResponseWriter, r *http.Request) error) http.Handler {
+	return errorHandler.ErrorHandler.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+		err := handler(w, r)
+		if err != nil && wantsJSON(r) {
+			respondJSON(w, http.StatusInternalServerError, map[string]string{
+				"status": "failure",
+				"error":  "Internal server error",
+			})
+		}
+
+		return err
+	})
+}
+
+// negotiatingBodyReader reads JSON request bodies as well as HTML forms (authboss.BodyReader
+// interface)
+type negotiatingBodyReader struct {
+	form authboss.BodyReader
+	json authboss.BodyReader
+}
+
+// makeNegotiatingBodyReader creates a body reader that reads JSON bodies with the same
+// validation rules as forms.
+func makeNegotiatingBodyReader(formReader *defaults.HTTPBodyReader) negotiatingBodyReader {
+	jsonReader := *formReader
+	jsonReader.ReadJSON = true
+
+	return negotiatingBodyReader{
+		form: formReader,
+		json: &jsonReader,
+	}
+}
+
+// Read the page's values from the request's body. A JSON body is put back afterwards, for the
+// redirector's "redir" (see redirParam.)
+func (reader negotiatingBodyReader) Read(page string, r *http.Request) (authboss.Validator, error) {
+	if sentJSON(r) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		defer func() { r.Body = io.NopCloser(bytes.NewReader(body)) }()
+
+		return reader.json.Read(page, r)
+	}
+
+	return reader.form.Read(page, r)
+}
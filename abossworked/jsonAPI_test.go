@@ -0,0 +1,129 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/volatiletech/authboss/v3"
+)
+
+func TestJSONRendererPageData(t *testing.T) {
+	encoded, _, err := jsonRenderer{}.Render(context.Background(), "login", authboss.HTMLData{
+		authboss.DataErr:        "Invalid Credentials",
+		authboss.DataValidation: map[string][]string{"email": {"Required"}},
+		// The request's template data
+		"csrfField":     template.HTML(`<input type="hidden">`),
+		"user_sessions": []UserSessions{{SessionID: "raw session ID"}},
+		"api_tokens":    []APITokens{{TokenHash: "hash"}},
+		"flash_success": "Your token: pat_secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(encoded, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{authboss.DataErr, authboss.DataValidation, "page", "status"}
+	if len(response) != len(expected) {
+		t.Errorf("response has %d keys, expected %v: %v", len(response), expected, response)
+	}
+
+	for _, key := range expected {
+		if _, present := response[key]; !present {
+			t.Errorf("response doesn't have %s: %v", key, response)
+		}
+	}
+
+	if response["status"] != "failure" || response["page"] != "login" {
+		t.Errorf("status %v, page %v", response["status"], response["page"])
+	}
+}
+
+func TestJSONRedirectFollowsRedir(t *testing.T) {
+	server := startTestServer(t, testConfig(t))
+	server.createUser(t, "user@example.com", "user password")
+
+	credentials := map[string]string{"email": "user@example.com", "password": "user password"}
+	withRedir := func(redir string) map[string]string {
+		values := map[string]string{"redir": redir}
+		for name, value := range credentials {
+			values[name] = value
+		}
+
+		return values
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		body     map[string]string
+		location string
+	}{
+		{"JSON body", "/auth/login", withRedir("/app/user"), "/app/user"},
+		{"query", "/auth/login?redir=%2Fapp%2Fuser", credentials, "/app/user"},
+		{"absolute URL", "/auth/login", withRedir("https://elsewhere.example.com/"), "/app/"},
+		{"no redir", "/auth/login", credentials, "/app/"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var result map[string]string
+			if resp := server.client(t).postJSON(t, test.path, test.body, &result); resp.StatusCode != http.StatusOK ||
+				result["status"] != "success" || result["location"] != test.location {
+				t.Errorf("%d %v, expected location %q", resp.StatusCode, result, test.location)
+			}
+		})
+	}
+
+	// A form POST from a client that wants JSON back
+	t.Run("form", func(t *testing.T) {
+		client := server.client(t)
+		client.get(t, "/")
+
+		form := url.Values{"email": {"user@example.com"}, "password": {"user password"}, "redir": {"/app/user"}}
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/auth/login", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", jsonContentType)
+		req.Header.Set("X-CSRF-Token", client.csrf)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var result map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result["location"] != "/app/user" {
+			t.Errorf("%d %v (%v)", resp.StatusCode, result, err)
+		}
+	})
+}
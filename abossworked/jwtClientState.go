@@ -0,0 +1,561 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* JWT client state.
+
+   The session store (SessionStore) and the cookie storer (CookieStorer) keep the Authboss
+   client state on the server or in Gorilla securecookies. With client_state:store set to "jwt",
+   JWTClientState keeps it in signed JSON Web Tokens instead, so that any server that has the
+   keys can read it without a shared session store:
+
+   - The session token: a cookie, or the "Authorization: Bearer <token>" header for clients
+     that aren't browsers. A client that sends the header gets the re-issued token back in the
+     X-Session-Token response header. The token lasts as long as a session can
+     (sessions:max_lifetime); SessionTimeouts still enforces the idle timeout.
+   - The cookie state token (the "Remember me" cookie), which lasts as long as a remember-me
+     token (remember:max_age.)
+
+   Tokens are signed (HS256) with the first of client_state:jwt:keys, and the "kid" header says
+   which key signed them. Adding a new key at the top of the list rotates the keys: new tokens
+   are signed with it, while the old keys still verify the tokens they signed until the old key
+   is removed. Without any keys, the key is derived from the session seed. With
+   client_state:jwt:encrypt, the state is encrypted (AES-GCM, keyed from the signing key), not
+   just signed, so the browser can't read it.
+
+   A token can't be deleted, only forgotten by the browser, so signing out, session ID
+   regeneration and revoking a session (see activeSessions.go) put the token ID ("jti") on a
+   deny-list (revoked_tokens table) until every token with that ID has expired.
+*/
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	gsessions "github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/csrf"
+	gorilla "github.com/gorilla/sessions"
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	clientStateSession = "session"
+	clientStateJWT     = "jwt"
+
+	// The session token's and the cookie state token's cookies, also their tokens' audience
+	jwtSessionCookieName = "abossworked_token"
+	jwtCookieStateName   = "abossworked_state"
+
+	// Response header with the re-issued session token, for clients that send it in the
+	// Authorization header
+	jwtTokenHeader = "X-Session-Token"
+
+	// The claim with the client state: "state" when it's only signed, "enc" when encrypted.
+	jwtStateClaim     = "state"
+	jwtEncryptedClaim = "enc"
+
+	// Shortest acceptable signing key, in bytes (HS256)
+	jwtMinKeyLength = 32
+	// The key ID of the key derived from the session seed
+	jwtSeedKeyID = "seed"
+	// Gorilla's default flash key
+	jwtFlashKey = "_flash"
+)
+
+// JWTClientState is an authboss.ClientStateReadWriter that keeps the client state in a JWT.
+// The session token's JWTClientState also signs users out of their sessions (SessionRevoker.)
+type JWTClientState struct {
+	// The token's cookie and audience
+	name string
+	// How long a token lasts
+	ttl time.Duration
+	// Accept the token in the Authorization header
+	header bool
+	// The signing keys, the first one signs new tokens.
+	keys    []jwtKey
+	encrypt bool
+
+	cookieParams gsessions.Options
+	storer       *AuthStorer
+	logger       *log.Logger
+}
+
+// jwtKey is a signing key and the encryption key derived from it.
+type jwtKey struct {
+	id     string
+	secret []byte
+	aead   cipher.AEAD
+}
+
+// makeJWTClientStates creates the session token's and the cookie state token's client states.
+// The session seed is the signing key if client_state:jwt:keys is empty.
+func makeJWTClientStates(cfg *ConfigData, storer *AuthStorer, sessionSeed []byte) (session, cookies *JWTClientState, err error) {
+	keys, err := makeJWTKeys(cfg.ClientState.JWT.Keys, sessionSeed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger := log.New(os.Stdout, "[JWT] ", log.LstdFlags)
+
+	session = &JWTClientState{
+		name:         jwtSessionCookieName,
+		ttl:          cfg.Sessions.MaxLifetime,
+		header:       true,
+		keys:         keys,
+		encrypt:      cfg.ClientState.JWT.Encrypt,
+		cookieParams: sessionCookieParams,
+		storer:       storer,
+		logger:       logger,
+	}
+	session.cookieParams.MaxAge = int(cfg.Sessions.MaxLifetime / time.Second)
+
+	cookies = &JWTClientState{
+		name:         jwtCookieStateName,
+		ttl:          cfg.Remember.MaxAge,
+		keys:         keys,
+		encrypt:      cfg.ClientState.JWT.Encrypt,
+		cookieParams: sessionCookieParams,
+		storer:       storer,
+		logger:       logger,
+	}
+	cookies.cookieParams.MaxAge = int(cfg.Remember.MaxAge / time.Second)
+
+	return session, cookies, nil
+}
+
+// makeJWTKeys decodes the configured signing keys (base64), or derives one from the session
+// seed if there aren't any.
+func makeJWTKeys(keysCfg []jwtKeyData, sessionSeed []byte) ([]jwtKey, error) {
+	if len(keysCfg) == 0 {
+		mac := hmac.New(sha256.New, sessionSeed)
+		mac.Write([]byte("jwt signing key"))
+		keysCfg = []jwtKeyData{{ID: jwtSeedKeyID, Secret: base64.StdEncoding.EncodeToString(mac.Sum(nil))}}
+	}
+
+	keys := make([]jwtKey, 0, len(keysCfg))
+	seen := make(map[string]bool, len(keysCfg))
+	for _, keyCfg := range keysCfg {
+		if len(keyCfg.ID) == 0 || seen[keyCfg.ID] {
+			return nil, fmt.Errorf("client_state:jwt:keys needs a unique id for each key")
+		}
+		seen[keyCfg.ID] = true
+
+		secret, err := base64.StdEncoding.DecodeString(keyCfg.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode JWT key '%s': %w", keyCfg.ID, err)
+		} else if len(secret) < jwtMinKeyLength {
+			return nil, fmt.Errorf("JWT key '%s' is too short, it needs at least %d bytes", keyCfg.ID, jwtMinKeyLength)
+		}
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("jwt encryption"))
+		block, err := aes.NewCipher(mac.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, jwtKey{id: keyCfg.ID, secret: secret, aead: aead})
+	}
+
+	return keys, nil
+}
+
+// sessions is Gin middleware that loads the session token, in place of the gin-contrib session
+// middleware: the session goes where gsessions.Default() looks for it, so the rest of the
+// middleware works the same with either client state.
+func (st *JWTClientState) sessions(ctx *gin.Context) {
+	session := st.load(ctx.Request)
+	session.writer = ctx.Writer
+
+	ctx.Set(gsessions.DefaultKey, session)
+}
+
+// skipCSRF is Gin middleware that exempts requests with a session token in the Authorization
+// header from CSRF protection: a cross-site request can't set the header. It has to run before
+// the CSRF middleware.
+func (st *JWTClientState) skipCSRF(ctx *gin.Context) {
+	if _, header := st.token(ctx.Request); header {
+		ctx.Request = csrf.UnsafeSkipCheck(ctx.Request)
+	}
+}
+
+// ReadState returns the request's session, the one that the sessions middleware loaded if there
+// is one.
+func (st *JWTClientState) ReadState(r *http.Request) (authboss.ClientState, error) {
+	session, loaded := r.Context().Value(httpSessionKey).(*jwtSession)
+	if !loaded || session.state != st {
+		session = st.load(r)
+	}
+
+	return &SessionState{logger: st.logger, gSessionData: session}, nil
+}
+
+// WriteState applies the Authboss client state events to the session and issues a new token.
+func (st *JWTClientState) WriteState(w http.ResponseWriter, state authboss.ClientState, ev []authboss.ClientStateEvent) error {
+	ses := state.(*SessionState)
+	ses.gSessionData.(*jwtSession).writer = w
+
+	return writeSessionState(ses, ev, st.name, st.cookieParams, st.logger)
+}
+
+// RevokeUserSessions puts all of the user's session tokens on the deny-list, signing the user out
+// everywhere, and returns how many sessions it revoked. The user session index (see
+// activeSessions.go) finds the user's sessions.
+func (st *JWTClientState) RevokeUserSessions(pid string) (int64, error) {
+	sessionIDs, err := st.storer.UserSessionIDs(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, sessionID := range sessionIDs {
+		if err := st.revoke(sessionID); err != nil {
+			return 0, err
+		}
+	}
+
+	st.logger.Printf("Revoked %d sessions for %s.", len(sessionIDs), pid)
+	return int64(len(sessionIDs)), nil
+}
+
+// RevokeSession puts the session token on the deny-list, signing out whoever was using it.
+func (st *JWTClientState) RevokeSession(sessionID string) error {
+	return st.revoke(sessionID)
+}
+
+// revoke puts the token ID on the deny-list until the last token it could have been issued with
+// expires, and removes it from the user session index.
+func (st *JWTClientState) revoke(id string) error {
+	if len(id) == 0 {
+		return nil
+	}
+
+	if err := st.storer.RevokeToken(id, time.Now().Add(st.ttl)); err != nil {
+		return err
+	}
+
+	return st.storer.DelUserSession(id)
+}
+
+// load returns the request's session: the token's state if the token is valid, otherwise a new,
+// empty session.
+func (st *JWTClientState) load(r *http.Request) *jwtSession {
+	session := &jwtSession{
+		state:   st,
+		values:  make(map[interface{}]interface{}),
+		options: st.cookieParams,
+	}
+
+	token, header := st.token(r)
+	if len(token) == 0 {
+		return session
+	}
+
+	session.header = header
+
+	id, values, err := st.parse(token)
+	if err != nil {
+		st.logger.Printf("Ignoring %s token: %v", st.name, err)
+		return session
+	}
+
+	session.id, session.values = id, values
+	return session
+}
+
+// token returns the request's token and whether it came in the Authorization header, which
+// takes precedence over the cookie.
+func (st *JWTClientState) token(r *http.Request) (token string, header bool) {
+	if st.header {
+		scheme, bearer, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if found && strings.EqualFold(scheme, "Bearer") && st.signedWithOurKey(bearer) {
+			return bearer, true
+		}
+	}
+
+	if cookie, err := r.Cookie(st.name); err == nil {
+		return cookie.Value, false
+	}
+
+	return "", false
+}
+
+// signedWithOurKey returns true if the token's "kid" header names one of the signing keys. The
+// Authorization header also carries personal access tokens (see apiTokens.go) and the OpenID
+// Connect provider's access tokens, which aren't session tokens.
+func (st *JWTClientState) signedWithOurKey(token string) bool {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return false
+	}
+
+	kid, _ := parsed.Header["kid"].(string)
+	return st.key(kid) != nil
+}
+
+// key returns the signing key with the key ID, nil if there's no such key.
+func (st *JWTClientState) key(kid string) *jwtKey {
+	for i := range st.keys {
+		if st.keys[i].id == kid {
+			return &st.keys[i]
+		}
+	}
+
+	return nil
+}
+
+// parse verifies the token and returns its ID and state. The token has to be signed by one of
+// the keys for this client state (the audience), unexpired and not on the deny-list.
+func (st *JWTClientState) parse(token string) (string, map[interface{}]interface{}, error) {
+	var key *jwtKey
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if key = st.key(kid); key == nil {
+			return nil, fmt.Errorf("unknown key ID '%s'", kid)
+		}
+
+		return key.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(st.name),
+		jwt.WithExpirationRequired(), jwt.WithJSONNumber())
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, _ := claims["jti"].(string)
+	if len(id) == 0 {
+		return "", nil, errors.New("token has no ID")
+	}
+
+	revoked, err := st.storer.IsTokenRevoked(id)
+	if err != nil {
+		return "", nil, err
+	} else if revoked {
+		return "", nil, fmt.Errorf("token %s was revoked", id)
+	}
+
+	var state []byte
+	if encrypted, isEncrypted := claims[jwtEncryptedClaim].(string); isEncrypted {
+		sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+		nonceSize := key.aead.NonceSize()
+		if err != nil || len(sealed) < nonceSize {
+			return "", nil, errors.New("malformed encrypted state")
+		}
+
+		if state, err = key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(id)); err != nil {
+			return "", nil, fmt.Errorf("unable to decrypt the state: %w", err)
+		}
+	} else if state, err = json.Marshal(claims[jwtStateClaim]); err != nil {
+		return "", nil, err
+	}
+
+	values, err := decodeJWTState(state)
+	return id, values, err
+}
+
+// issue signs a token with the ID and state, using the first key.
+func (st *JWTClientState) issue(id string, values map[interface{}]interface{}) (string, error) {
+	stringValues := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		stringValues[fmt.Sprint(key)] = value
+	}
+
+	state, err := json.Marshal(stringValues)
+	if err != nil {
+		return "", err
+	}
+
+	key := st.keys[0]
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"jti": id,
+		"aud": st.name,
+		"iat": now.Unix(),
+		"exp": now.Add(st.ttl).Unix(),
+	}
+
+	if st.encrypt {
+		nonce := make([]byte, key.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+
+		claims[jwtEncryptedClaim] = base64.RawURLEncoding.EncodeToString(key.aead.Seal(nonce, nonce, state, []byte(id)))
+	} else {
+		claims[jwtStateClaim] = json.RawMessage(state)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.id
+
+	return token.SignedString(key.secret)
+}
+
+// decodeJWTState decodes the token's state. Whole numbers are int64, like the session timeout
+// stamps (see sessionTimeouts.go) were before they were encoded.
+func decodeJWTState(state []byte) (map[interface{}]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(state))
+	decoder.UseNumber()
+
+	var stringValues map[string]interface{}
+	if err := decoder.Decode(&stringValues); err != nil {
+		return nil, fmt.Errorf("unable to decode the state: %w", err)
+	}
+
+	values := make(map[interface{}]interface{}, len(stringValues))
+	for key, value := range stringValues {
+		if number, isNumber := value.(json.Number); isNumber {
+			if integer, err := number.Int64(); err == nil {
+				value = integer
+			} else {
+				value, _ = number.Float64()
+			}
+		}
+
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+// jwtSession is the session in a JWT, as a gin-contrib session (gsessions.Session.) Saving it
+// issues a new token.
+type jwtSession struct {
+	state  *JWTClientState
+	writer http.ResponseWriter
+	// The token came in the Authorization header.
+	header bool
+
+	// The token ID, the session's ID
+	id      string
+	values  map[interface{}]interface{}
+	options gsessions.Options
+}
+
+func (session *jwtSession) ID() string {
+	return session.id
+}
+
+func (session *jwtSession) Get(key interface{}) interface{} {
+	return session.values[key]
+}
+
+func (session *jwtSession) Set(key interface{}, val interface{}) {
+	session.values[key] = val
+}
+
+func (session *jwtSession) Delete(key interface{}) {
+	delete(session.values, key)
+}
+
+func (session *jwtSession) Clear() {
+	session.values = make(map[interface{}]interface{})
+}
+
+func (session *jwtSession) AddFlash(value interface{}, vars ...string) {
+	key := jwtFlashKey
+	if len(vars) > 0 {
+		key = vars[0]
+	}
+
+	flashes, _ := session.values[key].([]interface{})
+	session.values[key] = append(flashes, value)
+}
+
+func (session *jwtSession) Flashes(vars ...string) []interface{} {
+	key := jwtFlashKey
+	if len(vars) > 0 {
+		key = vars[0]
+	}
+
+	flashes, _ := session.values[key].([]interface{})
+	delete(session.values, key)
+
+	return flashes
+}
+
+func (session *jwtSession) Options(options gsessions.Options) {
+	session.options = options
+}
+
+// Save issues a new token with the session's state. A session that's marked for a new ID (see
+// sessionRegenerateKey) gets one, and the old ID goes on the deny-list; so does a deleted
+// session's.
+func (session *jwtSession) Save() error {
+	st := session.state
+
+	if regenerate, _ := session.values[sessionRegenerateKey].(bool); regenerate {
+		delete(session.values, sessionRegenerateKey)
+
+		if err := st.revoke(session.id); err != nil {
+			return err
+		}
+
+		session.id = ""
+	}
+
+	var token string
+	if session.options.MaxAge < 0 {
+		if err := st.revoke(session.id); err != nil {
+			return err
+		}
+
+		session.id = ""
+	} else {
+		if len(session.id) == 0 {
+			id := make([]byte, 16)
+			if _, err := rand.Read(id); err != nil {
+				return fmt.Errorf("unable to generate a token ID: %w", err)
+			}
+
+			session.id = base64.RawURLEncoding.EncodeToString(id)
+		}
+
+		var err error
+		if token, err = st.issue(session.id, session.values); err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(session.writer, gorilla.NewCookie(st.name, token, session.options.ToGorillaOptions()))
+	if session.header {
+		session.writer.Header().Set(jwtTokenHeader, token)
+	}
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/volatiletech/authboss/v3"
+)
+
+// startJWTServer starts the worked example with the JWT client state, signed with the keys
+// (derived from the session seed without any) and optionally encrypted.
+func startJWTServer(t *testing.T, keys []jwtKeyData, encrypt bool) *testServer {
+	t.Helper()
+
+	cfg := testConfig(t)
+	cfg.ClientState.Store = clientStateJWT
+	cfg.ClientState.JWT = jwtData{Keys: keys, Encrypt: encrypt}
+
+	return startTestServer(t, cfg)
+}
+
+// makeTestJWTStates returns the session token's and the cookie state token's client states,
+// signed with the keys.
+func makeTestJWTStates(t *testing.T, storer *AuthStorer, keys []jwtKeyData, encrypt bool) (session, cookies *JWTClientState) {
+	t.Helper()
+
+	cfg := testConfig(t)
+	cfg.ClientState.JWT = jwtData{Keys: keys, Encrypt: encrypt}
+
+	session, cookies, err := makeJWTClientStates(cfg, storer, []byte(cfg.Seeds.SessionSeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session, cookies
+}
+
+// sessionToken returns the client's session token cookie.
+func (client *testClient) sessionToken(t *testing.T) string {
+	t.Helper()
+
+	serverURL, _ := url.Parse(client.server.URL)
+	for _, cookie := range client.Jar.Cookies(serverURL) {
+		if cookie.Name == jwtSessionCookieName {
+			return cookie.Value
+		}
+	}
+
+	t.Fatal("no session token")
+	return ""
+}
+
+// bearerRequest sends the request with the token in the Authorization header, without any
+// cookies, and returns the response and the re-issued token.
+func (server *testServer) bearerRequest(t *testing.T, method, path, token, body string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", jsonContentType)
+	}
+
+	resp, err := server.client(t).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp, resp.Header.Get(jwtTokenHeader)
+}
+
+// bearerSignedIn returns true if the token in the Authorization header gets to /app.
+func (server *testServer) bearerSignedIn(t *testing.T, token string) bool {
+	t.Helper()
+
+	resp, _ := server.bearerRequest(t, http.MethodGet, "/app/", token, "")
+	return resp.StatusCode == http.StatusOK
+}
+
+// tokenClaims returns the token's "kid" header and its claims, without checking the signature.
+func tokenClaims(t *testing.T, token string) (string, jwt.MapClaims) {
+	t.Helper()
+
+	claims := jwt.MapClaims{}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kid, _ := parsed.Header["kid"].(string)
+	return kid, claims
+}
+
+// TestJWTClientState runs the session backends' sign in, sign out and revocation steps with
+// the JWT client state, signed and encrypted, and checks what the browser can read.
+func TestJWTClientState(t *testing.T) {
+	for name, encrypt := range map[string]bool{"signed": false, "encrypted": true} {
+		t.Run(name, func(t *testing.T) {
+			server := startJWTServer(t, nil, encrypt)
+			server.createUser(t, "user@example.com", "user password")
+
+			t.Run("state", func(t *testing.T) { testSessionState(t, server) })
+			t.Run("regeneration", func(t *testing.T) { testSessionRegeneration(t, server) })
+			t.Run("revocation", func(t *testing.T) { testSessionRevocation(t, server) })
+
+			browser := server.client(t)
+			browser.signIn(t, "user@example.com", "user password")
+			token := browser.sessionToken(t)
+
+			kid, claims := tokenClaims(t, token)
+			payload, _ := json.Marshal(claims)
+			readable := strings.Contains(string(payload), "user@example.com")
+			_, hasEncrypted := claims[jwtEncryptedClaim]
+			if kid != jwtSeedKeyID || readable == encrypt || hasEncrypted != encrypt {
+				t.Errorf("token: kid %q, claims %s", kid, payload)
+			}
+		})
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	storer, err := OpenUserDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(storer.Close)
+
+	oldKey := jwtKeyData{ID: "old", Secret: testSeed(t, jwtMinKeyLength)}
+	newKey := jwtKeyData{ID: "new", Secret: testSeed(t, jwtMinKeyLength)}
+	values := map[interface{}]interface{}{authboss.SessionKey: "user@example.com"}
+
+	for name, encrypt := range map[string]bool{"signed": false, "encrypted": true} {
+		t.Run(name, func(t *testing.T) {
+			before, _ := makeTestJWTStates(t, storer, []jwtKeyData{oldKey}, encrypt)
+			rotated, _ := makeTestJWTStates(t, storer, []jwtKeyData{newKey, oldKey}, encrypt)
+			after, _ := makeTestJWTStates(t, storer, []jwtKeyData{newKey}, encrypt)
+
+			oldToken, err := before.issue("old token", values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The new key signs the new tokens; the old key still verifies the old ones.
+			if _, parsed, err := rotated.parse(oldToken); err != nil || parsed[authboss.SessionKey] != "user@example.com" {
+				t.Errorf("old token after the rotation: %v %v", parsed, err)
+			}
+
+			newToken, err := rotated.issue("new token", values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if kid, _ := tokenClaims(t, newToken); kid != newKey.ID {
+				t.Errorf("new token signed with %q", kid)
+			}
+
+			// Once the old key is gone, so are its tokens.
+			if _, _, err := after.parse(oldToken); err == nil {
+				t.Error("old token accepted after the old key was removed")
+			}
+
+			if _, _, err := after.parse(newToken); err != nil {
+				t.Errorf("new token: %v", err)
+			}
+
+			// A key with the old key's ID, but another secret
+			forged, _ := makeTestJWTStates(t, storer, []jwtKeyData{{ID: oldKey.ID, Secret: testSeed(t, jwtMinKeyLength)}}, encrypt)
+			if _, _, err := forged.parse(oldToken); err == nil {
+				t.Error("token accepted with another key of the same ID")
+			}
+		})
+	}
+}
+
+func TestJWTAudience(t *testing.T) {
+	storer, err := OpenUserDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(storer.Close)
+
+	// The same keys sign both tokens: only the audience tells them apart.
+	session, cookies := makeTestJWTStates(t, storer, nil, false)
+	values := map[interface{}]interface{}{authboss.SessionKey: "user@example.com"}
+
+	sessionToken, err := session.issue("session token", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookieToken, err := cookies.issue("cookie token", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := cookies.parse(sessionToken); err == nil {
+		t.Error("session token accepted as the cookie state token")
+	}
+
+	if _, _, err := session.parse(cookieToken); err == nil {
+		t.Error("cookie state token accepted as the session token")
+	}
+}
+
+func TestJWTDenyList(t *testing.T) {
+	server := startJWTServer(t, nil, false)
+	server.createUser(t, "user@example.com", "user password")
+
+	isRevoked := func(token string) bool {
+		t.Helper()
+
+		_, claims := tokenClaims(t, token)
+		revoked, err := server.storer.IsTokenRevoked(claims["jti"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return revoked
+	}
+
+	browser := server.client(t)
+	browser.get(t, "/app/")
+	anonymous := browser.sessionToken(t)
+
+	// Signing in regenerates the session ID: the token from before goes on the deny-list.
+	browser.signIn(t, "user@example.com", "user password")
+	signedIn := browser.sessionToken(t)
+	if !isRevoked(anonymous) || isRevoked(signedIn) {
+		t.Errorf("after signing in: revoked %v, %v", isRevoked(anonymous), isRevoked(signedIn))
+	}
+
+	browser.get(t, "/auth/logout")
+	if !isRevoked(signedIn) {
+		t.Error("the signed in token isn't revoked after signing out")
+	}
+
+	if server.bearerSignedIn(t, signedIn) {
+		t.Error("the signed in token still works after signing out")
+	}
+}
+
+func TestJWTAuthorizationHeader(t *testing.T) {
+	server := startJWTServer(t, []jwtKeyData{{ID: "key", Secret: testSeed(t, jwtMinKeyLength)}}, false)
+	server.createUser(t, "user@example.com", "user password")
+
+	// An API client gets a session token, then signs in with it in the Authorization header:
+	// no CSRF token, since a cross-site request can't set the header, and the signed in
+	// token comes back in the response header.
+	browser := server.client(t)
+	browser.get(t, "/app/")
+	anonymous := browser.sessionToken(t)
+
+	resp, token := server.bearerRequest(t, http.MethodPost, "/auth/login", anonymous,
+		`{"email": "user@example.com", "password": "user password"}`)
+	if resp.StatusCode != http.StatusOK || len(token) == 0 {
+		t.Fatalf("sign in with the Authorization header: %d, %s %q", resp.StatusCode, jwtTokenHeader, token)
+	}
+
+	if server.bearerSignedIn(t, anonymous) || !server.bearerSignedIn(t, token) {
+		t.Error("the Authorization header's token isn't the signed in one")
+	}
+
+	// Tokens that other keys signed (personal access tokens, OpenID Connect access tokens)
+	// aren't session tokens.
+	foreign := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user@example.com"})
+	foreign.Header["kid"] = "another key"
+	foreignToken, err := foreign.SignedString([]byte(testSeed(t, jwtMinKeyLength)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.bearerSignedIn(t, foreignToken) {
+		t.Error("signed in with another key's token")
+	}
+
+	// Signing out with the header revokes the token.
+	if resp, _ := server.bearerRequest(t, http.MethodPost, "/app/user/sessions/revoke-all", token, ""); resp.StatusCode != http.StatusFound {
+		t.Errorf("revoke-all with the Authorization header: %d", resp.StatusCode)
+	}
+
+	if server.bearerSignedIn(t, token) {
+		t.Error("signed in after signing out everywhere")
+	}
+}
@@ -0,0 +1,265 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* The outbound mail queue.
+
+   Authboss sends its e-mails inline, while it handles the request: a slow SMTP server holds up
+   the request and a failed delivery is only logged. With mail:outbox:enabled, MailOutbox is
+   Authboss' mailer instead. It only adds the e-mail to the outbox table, and a background worker
+   delivers it with the configured mailer (see mailer.go.)
+
+   A failed delivery is retried with exponential backoff: mail:outbox:initial_backoff after the
+   first failure, doubling up to mail:outbox:max_backoff. After mail:outbox:max_attempts the
+   e-mail is dead-lettered: it stays in the outbox, marked "dead", until an administrator retries
+   or deletes it from the administrator console (/admin/outbox) or with "abossctl mail", or
+   until mail:outbox:keep_dead has passed. Delivered e-mails stay for mail:outbox:keep_sent,
+   without their body: the confirmation and recovery links carry the raw token, which the
+   database otherwise only keeps hashed. Neither the console nor abossctl shows the body.
+
+   The worker claims an e-mail before it delivers it (AuthStorer.ClaimMail), so that several
+   servers can share the outbox without sending an e-mail twice.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	// Outbox e-mail status
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxDead    = "dead"
+	// Not a status: lists the dead e-mails and the pending ones that failed at least once.
+	outboxStuck = "stuck"
+
+	// Most e-mails the worker delivers per pass
+	outboxBatchSize = 20
+	// How long a claimed e-mail belongs to the worker that claimed it
+	outboxClaimLease = 5 * time.Minute
+)
+
+// ErrMailNotFound is returned when there's no such e-mail in the outbox (or it can't be
+// retried, because it was already sent.)
+var ErrMailNotFound = errors.New("no such e-mail in the outbox")
+
+var _ authboss.Mailer = &MailOutbox{}
+
+// MailOutbox is the authboss.Mailer that queues the e-mails in the outbox, and the worker
+// that delivers them.
+type MailOutbox struct {
+	storer *AuthStorer
+	// Delivers the e-mails
+	mailer authboss.Mailer
+
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	pollInterval   time.Duration
+	keepSent       time.Duration
+	keepDead       time.Duration
+
+	// Wakes the worker up when an e-mail is queued
+	wake chan struct{}
+	// Closed to stop the worker.
+	stop chan struct{}
+	// Closed when the worker has stopped.
+	done chan struct{}
+
+	logger *log.Logger
+}
+
+// StartMailOutbox starts the outbox's delivery worker, which delivers the queued e-mails with
+// the mailer, and returns the outbox's mailer for Authboss.
+func (storer *AuthStorer) StartMailOutbox(mailer authboss.Mailer, outboxCfg outboxData) *MailOutbox {
+	if storer.outbox != nil {
+		return storer.outbox
+	}
+
+	outbox := &MailOutbox{
+		storer:         storer,
+		mailer:         mailer,
+		maxAttempts:    outboxCfg.MaxAttempts,
+		initialBackoff: outboxCfg.InitialBackoff,
+		maxBackoff:     outboxCfg.MaxBackoff,
+		pollInterval:   outboxCfg.PollInterval,
+		keepSent:       outboxCfg.KeepSent,
+		keepDead:       outboxCfg.KeepDead,
+		wake:           make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+		logger:         log.New(os.Stdout, "[OUTBOX] ", log.LstdFlags),
+	}
+	storer.outbox = outbox
+
+	go outbox.run()
+
+	return outbox
+}
+
+// StopMailOutbox stops the outbox's delivery worker, if it's running, and waits until it has
+// stopped. The e-mails that are still queued are delivered after the next start.
+func (storer *AuthStorer) StopMailOutbox() {
+	if storer.outbox == nil {
+		return
+	}
+
+	close(storer.outbox.stop)
+	<-storer.outbox.done
+	storer.outbox = nil
+}
+
+// Send queues the e-mail for delivery.
+func (outbox *MailOutbox) Send(ctx context.Context, email authboss.Email) error {
+	id, err := outbox.storer.EnqueueMail(email)
+	if err != nil {
+		return fmt.Errorf("unable to queue the e-mail: %w", err)
+	}
+
+	outbox.logger.Printf("Queued #%d \"%s\".", id, email.Subject)
+
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// run is the delivery worker: it delivers the due e-mails every poll interval, or as soon as an
+// e-mail is queued.
+func (outbox *MailOutbox) run() {
+	defer close(outbox.done)
+
+	ticker := time.NewTicker(outbox.pollInterval)
+	defer ticker.Stop()
+
+	outbox.logger.Printf("Delivering queued e-mails, checking every %v.", outbox.pollInterval)
+	for {
+		outbox.deliverDue()
+
+		if reaped, err := outbox.storer.ReapSentMail(time.Now().Add(-outbox.keepSent)); err != nil {
+			outbox.logger.Printf("Reaping the sent e-mails failed: %v", err)
+		} else if reaped > 0 {
+			outbox.logger.Printf("Removed %d sent e-mails.", reaped)
+		}
+		if reaped, err := outbox.storer.ReapDeadMail(time.Now().Add(-outbox.keepDead)); err != nil {
+			outbox.logger.Printf("Reaping the dead e-mails failed: %v", err)
+		} else if reaped > 0 {
+			outbox.logger.Printf("Removed %d dead e-mails.", reaped)
+		}
+
+		select {
+		case <-outbox.stop:
+			outbox.logger.Print("Stopped.")
+			return
+		case <-ticker.C:
+		case <-outbox.wake:
+		}
+	}
+}
+
+// deliverDue delivers the e-mails that are due, a batch at a time.
+func (outbox *MailOutbox) deliverDue() {
+	for {
+		due, err := outbox.storer.DueMail(outboxBatchSize)
+		if err != nil {
+			outbox.logger.Printf("Unable to read the outbox: %v", err)
+			return
+		}
+
+		for _, queued := range due {
+			select {
+			case <-outbox.stop:
+				return
+			default:
+			}
+
+			if claimed, err := outbox.storer.ClaimMail(queued.ID, outboxClaimLease); err != nil {
+				outbox.logger.Printf("Unable to claim #%d: %v", queued.ID, err)
+				return
+			} else if claimed {
+				outbox.deliver(queued)
+			}
+		}
+
+		if len(due) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// deliver delivers the e-mail and records the outcome: sent, due again after the backoff or,
+// after the last attempt, dead.
+func (outbox *MailOutbox) deliver(queued Outbox) {
+	var email authboss.Email
+
+	err := json.Unmarshal([]byte(queued.Email), &email)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), outboxClaimLease)
+		err = outbox.mailer.Send(ctx, email)
+		cancel()
+	}
+
+	if err == nil {
+		if err = outbox.storer.MarkMailSent(queued.ID); err != nil {
+			outbox.logger.Printf("#%d was sent, but recording that failed: %v", queued.ID, err)
+			return
+		}
+
+		outbox.logger.Printf("Sent #%d \"%s\" to %s.", queued.ID, queued.Subject, queued.Recipients)
+		return
+	}
+
+	attempts := queued.Attempts + 1
+	if attempts >= outbox.maxAttempts {
+		outbox.logger.Printf("Giving up on #%d after %d attempts: %v", queued.ID, attempts, err)
+		err = outbox.storer.MarkMailFailed(queued.ID, attempts, err.Error(), time.Now(), true)
+	} else {
+		backoff := outbox.backoff(attempts)
+		outbox.logger.Printf("Attempt %d for #%d failed, retrying in %v: %v", attempts, queued.ID, backoff, err)
+		err = outbox.storer.MarkMailFailed(queued.ID, attempts, err.Error(), time.Now().Add(backoff), false)
+	}
+
+	if err != nil {
+		outbox.logger.Printf("Unable to record the failed attempt for #%d: %v", queued.ID, err)
+	}
+}
+
+// backoff returns how long to wait after the failed attempt: the initial backoff, doubled for
+// each attempt after the first, up to the maximum backoff.
+func (outbox *MailOutbox) backoff(attempts int) time.Duration {
+	backoff := outbox.initialBackoff
+	for i := 1; i < attempts && backoff < outbox.maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > outbox.maxBackoff {
+		backoff = outbox.maxBackoff
+	}
+
+	return backoff
+}
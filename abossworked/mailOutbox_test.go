@@ -0,0 +1,78 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"testing"
+	"time"
+
+	"github.com/volatiletech/authboss/v3"
+)
+
+// TestOutboxForgetsBodies checks that a delivered e-mail loses its body, with its token, and
+// that dead e-mails are only reaped once they're older than the cutoff.
+func TestOutboxForgetsBodies(t *testing.T) {
+	storer, err := OpenUserDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storer.Close()
+
+	enqueue := func() uint64 {
+		t.Helper()
+		id, err := storer.EnqueueMail(authboss.Email{
+			To:       []string{"someone@example.com"},
+			Subject:  "Confirm your account",
+			TextBody: "http://localhost/auth/confirm?cnf=secret-token",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	sent := enqueue()
+	if err := storer.MarkMailSent(sent); err != nil {
+		t.Fatal(err)
+	}
+	if queued, err := storer.GetMail(sent); err != nil {
+		t.Fatal(err)
+	} else if queued.Status != outboxSent || queued.Email != "" || queued.Subject != "Confirm your account" {
+		t.Errorf("sent e-mail: status %q, subject %q, body %q; want sent, the subject and no body",
+			queued.Status, queued.Subject, queued.Email)
+	}
+
+	dead := enqueue()
+	if err := storer.MarkMailFailed(dead, 8, "refused", time.Now(), true); err != nil {
+		t.Fatal(err)
+	}
+	if reaped, err := storer.ReapDeadMail(time.Now().Add(-time.Hour)); err != nil || reaped != 0 {
+		t.Fatalf("reaping recent dead e-mails removed %d (%v), want 0", reaped, err)
+	}
+	if queued, err := storer.GetMail(dead); err != nil {
+		t.Fatal(err)
+	} else if queued.Email == "" {
+		t.Error("a dead e-mail lost its body, retrying it can't deliver it")
+	}
+	if reaped, err := storer.ReapDeadMail(time.Now().Add(time.Hour)); err != nil || reaped != 1 {
+		t.Fatalf("reaping old dead e-mails removed %d (%v), want 1", reaped, err)
+	}
+	if _, err := storer.GetMail(dead); err != ErrMailNotFound {
+		t.Errorf("reaped e-mail: got %v, want ErrMailNotFound", err)
+	}
+}
@@ -0,0 +1,680 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* E-mail templates.
+
+   The e-mails that Authboss sends (confirmation, account recovery, 2fa e-mail verification) have
+   their own templates in content/mail, separate from the pages: their own master layout
+   (mail_layout.gohtml) and fragments (content/mail/fragments), since an e-mail can't use the
+   site's Bootstrap style sheet or its navigation bar. Templates.MailRenderer() is Authboss'
+   MailRenderer.
+
+   - HTML e-mails ("<name>_html") are rendered inside the layout, then the layout's <style> rules
+     are inlined into the elements' style attributes: Gmail, Outlook and friends ignore <style>.
+
+   - Text e-mails ("<name>_txt") are text/template templates. A text template is optional: when
+     there isn't one, the text part is generated from the HTML e-mail.
+
+   Like the pages, the e-mail templates are reloaded when they change.
+*/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/volatiletech/authboss/v3"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// The e-mail templates' directory (inside the template directory), master layout and
+	// fragment directory (inside the e-mail templates' directory.)
+	mailTemplateDir  = "mail"
+	mailMasterFile   = "mail_layout.gohtml"
+	mailFragmentDir  = "fragments"
+	htmlMailLayout   = "<mail layout>"
+	mailHTMLSuffix   = "_html"
+	mailTextSuffix   = "_txt"
+	mailTemplateType = ".gohtml"
+)
+
+// mailTemplateSet is the parsed e-mail templates.
+type mailTemplateSet struct {
+	// HTML e-mails, each a clone of the master layout
+	html map[string]*template.Template
+	// Text e-mails
+	text map[string]*texttemplate.Template
+	// Every file the templates came from, for reloading
+	files map[string]time.Time
+}
+
+// mailRenderer renders Authboss' e-mails (see Templates.MailRenderer.)
+type mailRenderer struct {
+	templates *Templates
+}
+
+var _ authboss.Renderer = &mailRenderer{}
+
+// MailRenderer returns the e-mail templates' renderer, for ab.Config.Core.MailRenderer.
+func (templates *Templates) MailRenderer() authboss.Renderer {
+	return &mailRenderer{templates: templates}
+}
+
+// Load checks that the e-mail templates Authboss needs are there. A text e-mail only needs its
+// HTML twin.
+func (renderer *mailRenderer) Load(names ...string) error {
+	templates := renderer.templates
+	templates.mailMutex.Lock()
+	defer templates.mailMutex.Unlock()
+
+	for _, name := range names {
+		if _, ok := templates.mail.html[name]; ok {
+			continue
+		} else if _, ok := templates.mail.text[name]; ok {
+			continue
+		}
+
+		if htmlName, isText := mailHTMLTwin(name); isText {
+			if _, ok := templates.mail.html[htmlName]; ok {
+				templates.logger.Printf("MailRenderer.Load: %s will be generated from %s.", name, htmlName)
+				continue
+			}
+		}
+
+		return fmt.Errorf("MailRenderer.Load: no such e-mail template %s loaded", name)
+	}
+
+	return nil
+}
+
+// Render renders an e-mail: the HTML e-mail with its styles inlined, or the text e-mail,
+// generated from the HTML e-mail when there's no text template.
+func (renderer *mailRenderer) Render(ctx context.Context, name string, data authboss.HTMLData) ([]byte, string, error) {
+	templates := renderer.templates
+	templates.mailMutex.Lock()
+	defer templates.mailMutex.Unlock()
+
+	templates.logger.Printf("Rendering e-mail %s", name)
+	if err := templates.reloadMailTemplates(); err != nil {
+		return []byte(fmt.Sprintf("couldn't reload %s", name)), contentTypeText, err
+	}
+
+	if textTmpl, ok := templates.mail.text[name]; ok {
+		buf := &bytes.Buffer{}
+		if err := textTmpl.Execute(buf, data); err != nil {
+			return []byte(fmt.Sprintf("%v", err)), contentTypeText, err
+		}
+
+		return buf.Bytes(), contentTypeText, nil
+	}
+
+	htmlName, isText := mailHTMLTwin(name)
+	if !isText {
+		htmlName = name
+	}
+
+	htmlTmpl, ok := templates.mail.html[htmlName]
+	if !ok {
+		errString := fmt.Sprintf("no such e-mail template '%s'", name)
+		return []byte(errString), contentTypeText, errors.New(errString)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := htmlTmpl.ExecuteTemplate(buf, htmlMailLayout, data); err != nil {
+		return []byte(fmt.Sprintf("%v", err)), contentTypeText, err
+	}
+
+	if isText {
+		text, err := mailText(buf.Bytes())
+		if err != nil {
+			return []byte(fmt.Sprintf("%v", err)), contentTypeText, err
+		}
+
+		return []byte(text), contentTypeText, nil
+	}
+
+	body, err := inlineMailCSS(buf.Bytes())
+	if err != nil {
+		return []byte(fmt.Sprintf("%v", err)), contentTypeText, err
+	}
+
+	return body, contentTypeHTML, nil
+}
+
+// mailHTMLTwin returns the name of the text e-mail's HTML e-mail, and whether name is a text
+// e-mail in the first place.
+func mailHTMLTwin(name string) (string, bool) {
+	if !strings.HasSuffix(name, mailTextSuffix) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(name, mailTextSuffix) + mailHTMLSuffix, true
+}
+
+// loadMailTemplates loads and parses the e-mail master layout, its fragments and the e-mail
+// templates, the same way as loadTemplates does for the pages.
+func (templates *Templates) loadMailTemplates() error {
+	mailDir := filepath.Join(templates.templateDir, mailTemplateDir)
+	layoutPath := filepath.Join(mailDir, mailMasterFile)
+
+	b, err := ioutil.ReadFile(layoutPath)
+	if err != nil {
+		return fmt.Errorf("could not load e-mail master layout: %v", err)
+	}
+
+	layout, err := template.New(htmlMailLayout).Funcs(templates.templateFuncs).Parse(string(b))
+	if err != nil {
+		return fmt.Errorf("failed to parse e-mail master layout: %v", err)
+	}
+
+	mail := mailTemplateSet{
+		html:  map[string]*template.Template{},
+		text:  map[string]*texttemplate.Template{},
+		files: map[string]time.Time{layoutPath: getModTime(layoutPath)},
+	}
+
+	// The fragments, associated with the layout:
+	err = filepath.WalkDir(filepath.Join(mailDir, mailFragmentDir), walkFunction(mailDir,
+		func(_fullPath string, baseName string) bool {
+			return strings.HasPrefix(baseName, "_") && strings.HasSuffix(baseName, mailTemplateType)
+		},
+		func(name, path, relPath string, content []byte) error {
+			if _, err := layout.New(name).Parse(string(content)); err != nil {
+				return fmt.Errorf("failed to parse e-mail fragment: (%s): %v", relPath, err)
+			}
+
+			mail.files[path] = getModTime(path)
+			templates.logger.Printf("Loaded e-mail fragment template '%s' from %s", name, path)
+			return nil
+		}))
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to load e-mail fragment templates: %v", err)
+	}
+
+	// The e-mails: text templates on their own, HTML templates in a clone of the layout.
+	err = filepath.WalkDir(mailDir, walkFunction(mailDir,
+		func(fullPath, baseName string) bool {
+			return fullPath != layoutPath && !strings.HasPrefix(baseName, "_") && strings.HasSuffix(baseName, mailTemplateType)
+		},
+		func(name, path, relPath string, content []byte) error {
+			if strings.HasSuffix(name, mailTextSuffix) {
+				t, err := texttemplate.New(name).Funcs(texttemplate.FuncMap(templates.templateFuncs)).Parse(string(content))
+				if err != nil {
+					return fmt.Errorf("failed to parse e-mail template (%s): %w", relPath, err)
+				}
+
+				mail.text[name] = t
+			} else {
+				clone, err := layout.Clone()
+				if err != nil {
+					return fmt.Errorf("failed to clone e-mail layout: %w", err)
+				}
+
+				t, err := clone.New("content").Parse(string(content))
+				if err != nil {
+					return fmt.Errorf("failed to parse e-mail template (%s): %w", relPath, err)
+				}
+
+				mail.html[name] = t
+			}
+
+			mail.files[path] = getModTime(path)
+			templates.logger.Printf("Loaded e-mail template '%s' from %s", name, path)
+			return nil
+		}))
+
+	if err != nil {
+		return fmt.Errorf("failed to load e-mail templates: %v", err)
+	}
+
+	templates.mail = mail
+	return nil
+}
+
+// reloadMailTemplates reloads all of the e-mail templates if any of their files changed or
+// disappeared (a text template can go away: its HTML twin takes over.)
+func (templates *Templates) reloadMailTemplates() error {
+	for path, lastMod := range templates.mail.files {
+		if info, err := os.Stat(path); err != nil || info.ModTime().After(lastMod) {
+			if err := templates.loadMailTemplates(); err != nil {
+				return err
+			}
+
+			templates.logger.Printf("Reloaded the e-mail templates.")
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// CSS inlining:
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// mailSimpleSelector matches the selectors that can be inlined: an element name, classes and an
+// ID, e.g., "a", ".button", "a.button" or "#footer".
+var (
+	mailSimpleSelector = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9]*)?((?:[.#][-_a-zA-Z0-9]+)*)$`)
+	mailSelectorParts  = regexp.MustCompile(`[.#][-_a-zA-Z0-9]+`)
+	mailCSSComment     = regexp.MustCompile(`(?s)/\*.*?\*/`)
+)
+
+// mailCSSRule is a style rule with a simple selector.
+type mailCSSRule struct {
+	element     string
+	id          string
+	classes     []string
+	specificity int
+	// Where the rule appears: later rules win over earlier ones with the same specificity.
+	order        int
+	declarations string
+}
+
+// inlineMailCSS moves the rules in the e-mail's <style> elements into the style attributes of
+// the elements that they select. Rules that can't be inlined (@media queries, selectors with
+// combinators or pseudo-classes) stay in the <style> element.
+func inlineMailCSS(body []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the HTML e-mail: %w", err)
+	}
+
+	rules := []mailCSSRule{}
+	var remove []*html.Node
+
+	mailWalk(doc, func(node *html.Node) {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Style {
+			css := ""
+			for child := node.FirstChild; child != nil; child = child.NextSibling {
+				css += child.Data
+			}
+
+			var keep string
+			rules, keep = parseMailCSS(css, rules)
+			if strings.TrimSpace(keep) == "" {
+				remove = append(remove, node)
+			} else {
+				for node.FirstChild != nil {
+					node.RemoveChild(node.FirstChild)
+				}
+				node.AppendChild(&html.Node{Type: html.TextNode, Data: keep})
+			}
+		}
+	})
+
+	for _, node := range remove {
+		node.Parent.RemoveChild(node)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].specificity != rules[j].specificity {
+			return rules[i].specificity < rules[j].specificity
+		}
+		return rules[i].order < rules[j].order
+	})
+
+	mailWalk(doc, func(node *html.Node) {
+		if node.Type != html.ElementNode {
+			return
+		}
+
+		styles := []string{}
+		for _, rule := range rules {
+			if rule.matches(node) {
+				styles = append(styles, rule.declarations)
+			}
+		}
+
+		if len(styles) == 0 {
+			return
+		}
+
+		// The element's own style attribute wins.
+		for i, attr := range node.Attr {
+			if attr.Key == "style" {
+				node.Attr = append(node.Attr[:i], node.Attr[i+1:]...)
+				styles = append(styles, mailCSSDeclarations(attr.Val))
+				break
+			}
+		}
+
+		node.Attr = append(node.Attr, html.Attribute{Key: "style", Val: strings.Join(styles, "; ")})
+	})
+
+	buf := &bytes.Buffer{}
+	if err := html.Render(buf, doc); err != nil {
+		return nil, fmt.Errorf("unable to render the HTML e-mail: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parseMailCSS adds the style sheet's inlinable rules to rules and returns the rest of the style
+// sheet.
+func parseMailCSS(css string, rules []mailCSSRule) ([]mailCSSRule, string) {
+	css = mailCSSComment.ReplaceAllString(css, "")
+	keep := &strings.Builder{}
+
+	for {
+		css = strings.TrimSpace(css)
+		open := strings.Index(css, "{")
+		if len(css) == 0 || open < 0 {
+			break
+		}
+
+		// Find the end of the block, which for an at-rule may contain blocks of its own.
+		depth, end := 0, -1
+		for i := open; i < len(css) && end < 0; i++ {
+			switch css[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			end = len(css) - 1
+		}
+
+		prelude := strings.TrimSpace(css[:open])
+		block := css[open+1 : end]
+		whole := css[:end+1]
+		css = css[end+1:]
+
+		if strings.HasPrefix(prelude, "@") {
+			fmt.Fprintf(keep, "%s\n", whole)
+			continue
+		}
+
+		declarations := mailCSSDeclarations(block)
+		kept := []string{}
+		for _, selector := range strings.Split(prelude, ",") {
+			selector = strings.TrimSpace(selector)
+			parts := mailSimpleSelector.FindStringSubmatch(selector)
+			if len(selector) == 0 || parts == nil {
+				kept = append(kept, selector)
+				continue
+			}
+
+			rule := mailCSSRule{
+				element:      strings.ToLower(parts[1]),
+				order:        len(rules),
+				declarations: declarations,
+			}
+			if len(rule.element) > 0 {
+				rule.specificity++
+			}
+
+			for _, qualifier := range mailSelectorParts.FindAllString(parts[2], -1) {
+				if qualifier[0] == '#' {
+					rule.id = qualifier[1:]
+					rule.specificity += 100
+				} else {
+					rule.classes = append(rule.classes, qualifier[1:])
+					rule.specificity += 10
+				}
+			}
+
+			rules = append(rules, rule)
+		}
+
+		if len(kept) > 0 {
+			fmt.Fprintf(keep, "%s { %s }\n", strings.Join(kept, ", "), declarations)
+		}
+	}
+
+	return rules, keep.String()
+}
+
+// mailCSSDeclarations tidies up a declaration block: "a: b; c: d".
+func mailCSSDeclarations(block string) string {
+	declarations := []string{}
+	for _, declaration := range strings.Split(block, ";") {
+		if declaration = strings.TrimSpace(declaration); len(declaration) > 0 {
+			declarations = append(declarations, declaration)
+		}
+	}
+
+	return strings.Join(declarations, "; ")
+}
+
+// matches reports whether the rule selects the element.
+func (rule mailCSSRule) matches(node *html.Node) bool {
+	if len(rule.element) > 0 && rule.element != node.Data {
+		return false
+	}
+
+	id, classes := "", map[string]bool{}
+	for _, attr := range node.Attr {
+		switch attr.Key {
+		case "id":
+			id = attr.Val
+		case "class":
+			for _, class := range strings.Fields(attr.Val) {
+				classes[class] = true
+			}
+		}
+	}
+
+	if len(rule.id) > 0 && rule.id != id {
+		return false
+	}
+
+	for _, class := range rule.classes {
+		if !classes[class] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mailWalk calls visit for the node and its descendants, in document order.
+func mailWalk(node *html.Node, visit func(*html.Node)) {
+	visit(node)
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		mailWalk(child, visit)
+	}
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Text e-mails from HTML e-mails:
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// mailTextBlocks are the elements that start on a line of their own, and the number of line
+// breaks around them (2: a blank line.)
+var mailTextBlocks = map[atom.Atom]int{
+	atom.P: 2, atom.H1: 2, atom.H2: 2, atom.H3: 2, atom.H4: 2, atom.H5: 2, atom.H6: 2,
+	atom.Blockquote: 2, atom.Pre: 2, atom.Table: 2, atom.Ul: 2, atom.Ol: 2,
+	atom.Div: 1, atom.Tr: 1, atom.Li: 1, atom.Br: 1, atom.Hr: 1,
+	atom.Header: 1, atom.Footer: 1, atom.Section: 1, atom.Center: 1,
+}
+
+// mailTextWriter accumulates an e-mail's text part.
+type mailTextWriter struct {
+	text strings.Builder
+	// Whitespace seen since the last word
+	space bool
+	// Nothing written since the last line break (or list bullet)
+	lineStart bool
+}
+
+// mailText converts an HTML e-mail into its text part: block elements become paragraphs, list
+// items get a bullet and links show their URLs.
+func mailText(body []byte) (string, error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("unable to parse the HTML e-mail: %w", err)
+	}
+
+	writer := &mailTextWriter{}
+	writer.node(doc)
+
+	lines := strings.Split(writer.text.String(), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRightFunc(lines[i], unicode.IsSpace)
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n")) + "\n", nil
+}
+
+// node writes the node and its descendants.
+func (writer *mailTextWriter) node(node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		writer.words(node.Data)
+		return
+	case html.ElementNode:
+		switch node.DataAtom {
+		case atom.Head, atom.Style, atom.Script, atom.Title:
+			return
+		case atom.A:
+			writer.link(node)
+			return
+		case atom.Img:
+			for _, attr := range node.Attr {
+				if attr.Key == "alt" {
+					writer.words(attr.Val)
+				}
+			}
+			return
+		case atom.Pre:
+			writer.lineBreaks(2)
+			writer.text.WriteString(mailNodeText(node))
+			writer.lineBreaks(2)
+			return
+		}
+	}
+
+	breaks := mailTextBlocks[node.DataAtom]
+	if node.Type == html.ElementNode && breaks > 0 {
+		writer.lineBreaks(breaks)
+		switch node.DataAtom {
+		case atom.Li:
+			writer.text.WriteString("- ")
+		case atom.Hr:
+			writer.text.WriteString("----")
+		}
+		writer.lineStart = node.DataAtom != atom.Hr
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writer.node(child)
+	}
+
+	if node.Type == html.ElementNode && breaks > 0 {
+		writer.lineBreaks(breaks)
+	}
+}
+
+// link writes a link's text followed by its URL, or just the URL when that's the text.
+func (writer *mailTextWriter) link(node *html.Node) {
+	label := strings.Join(strings.Fields(mailNodeText(node)), " ")
+	href := ""
+	for _, attr := range node.Attr {
+		if attr.Key == "href" {
+			href = strings.TrimSpace(attr.Val)
+		}
+	}
+
+	switch {
+	case len(href) == 0 || strings.HasPrefix(href, "#"):
+		writer.words(label)
+	case len(label) == 0 || label == href:
+		writer.words(href)
+	default:
+		writer.words(label + " (" + href + ")")
+	}
+}
+
+// words writes text, collapsing its whitespace the way a browser does.
+func (writer *mailTextWriter) words(text string) {
+	if len(text) == 0 {
+		return
+	}
+
+	first, _ := utf8.DecodeRuneInString(text)
+	last, _ := utf8.DecodeLastRuneInString(text)
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		writer.space = true
+		return
+	}
+
+	if (writer.space || unicode.IsSpace(first)) && !writer.atLineStart() {
+		writer.text.WriteByte(' ')
+	}
+
+	writer.text.WriteString(strings.Join(words, " "))
+	writer.space = unicode.IsSpace(last)
+	writer.lineStart = false
+}
+
+// lineBreaks ends the current line and, with count 2, leaves a blank line after it.
+func (writer *mailTextWriter) lineBreaks(count int) {
+	writer.space = false
+	writer.lineStart = true
+	if writer.text.Len() == 0 {
+		return
+	}
+
+	text := writer.text.String()
+	for have := len(text) - len(strings.TrimRight(text, "\n")); have < count; have++ {
+		writer.text.WriteByte('\n')
+	}
+}
+
+// atLineStart reports whether the next word starts a line.
+func (writer *mailTextWriter) atLineStart() bool {
+	return writer.text.Len() == 0 || writer.lineStart
+}
+
+// mailNodeText is the text inside the node, as is.
+func mailNodeText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+
+	text := &strings.Builder{}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		text.WriteString(mailNodeText(child))
+	}
+
+	return text.String()
+}
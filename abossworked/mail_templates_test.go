@@ -0,0 +1,230 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// inlinedStyle inlines the style sheet into the body and returns the style attribute of the
+// element with ID "x" and what's left of the <style> element (nothing if it was removed.)
+func inlinedStyle(t *testing.T, css, body string) (style, kept string) {
+	t.Helper()
+
+	inlined, err := inlineMailCSS([]byte("<html><head><style>" + css + "</style></head><body>" + body + "</body></html>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := html.Parse(bytes.NewReader(inlined))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailWalk(doc, func(node *html.Node) {
+		if node.Type != html.ElementNode {
+			return
+		}
+		if node.Data == "style" {
+			kept = mailNodeText(node)
+		}
+		for _, attr := range node.Attr {
+			if attr.Key == "id" && attr.Val == "x" {
+				for _, attr := range node.Attr {
+					if attr.Key == "style" {
+						style = attr.Val
+					}
+				}
+			}
+		}
+	})
+
+	return style, kept
+}
+
+func TestInlineMailCSS(t *testing.T) {
+	tests := []struct {
+		name  string
+		css   string
+		body  string
+		style string
+		kept  string
+	}{
+		{
+			name:  "element",
+			css:   "p { color: red; }",
+			body:  `<p id="x">Hi</p>`,
+			style: "color: red",
+		},
+		{
+			name:  "other element",
+			css:   "a { color: red; }",
+			body:  `<p id="x">Hi</p>`,
+			style: "",
+		},
+		{
+			name:  "class",
+			css:   ".button { color: red }",
+			body:  `<a id="x" class="link button">Hi</a>`,
+			style: "color: red",
+		},
+		{
+			name:  "every class",
+			css:   ".link.button { color: red }",
+			body:  `<a id="x" class="button">Hi</a>`,
+			style: "",
+		},
+		{
+			name:  "id",
+			css:   "#x { color: red } #y { color: blue }",
+			body:  `<p id="x">Hi</p>`,
+			style: "color: red",
+		},
+		{
+			name:  "selector list",
+			css:   "h1, p.note { margin: 0 }",
+			body:  `<p id="x" class="note">Hi</p>`,
+			style: "margin: 0",
+		},
+		{
+			name:  "specificity",
+			css:   "#x { color: red } a.button { color: blue } .button { color: green } a { color: black }",
+			body:  `<a id="x" class="button">Hi</a>`,
+			style: "color: black; color: green; color: blue; color: red",
+		},
+		{
+			name:  "source order",
+			css:   ".b { color: blue } .a { color: red }",
+			body:  `<p id="x" class="a b">Hi</p>`,
+			style: "color: blue; color: red",
+		},
+		{
+			name:  "style attribute",
+			css:   "#x { color: red; margin: 0 }",
+			body:  `<p id="x" style="color: blue;">Hi</p>`,
+			style: "color: red; margin: 0; color: blue",
+		},
+		{
+			name:  "comments",
+			css:   "/* p { color: blue } */ p { /* x */ color: red }",
+			body:  `<p id="x">Hi</p>`,
+			style: "color: red",
+		},
+		{
+			name:  "media query",
+			css:   "@media (max-width: 600px) { p { color: blue } } p { color: red }",
+			body:  `<p id="x">Hi</p>`,
+			style: "color: red",
+			kept:  "@media (max-width: 600px) { p { color: blue } }\n",
+		},
+		{
+			name:  "pseudo-class and combinator",
+			css:   "a:hover, p a { color: blue } a { color: red }",
+			body:  `<p><a id="x">Hi</a></p>`,
+			style: "color: red",
+			kept:  "a:hover, p a { color: blue }\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			style, kept := inlinedStyle(t, test.css, test.body)
+			if style != test.style {
+				t.Errorf("style = %q, want %q", style, test.style)
+			}
+			if kept != test.kept {
+				t.Errorf("kept style sheet = %q, want %q", kept, test.kept)
+			}
+		})
+	}
+}
+
+func TestMailText(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		text string
+	}{
+		{
+			name: "paragraphs",
+			body: "<p>Hello,\n   world</p><p>Bye</p>",
+			text: "Hello, world\n\nBye\n",
+		},
+		{
+			name: "head",
+			body: "<html><head><title>Title</title><style>p { color: red }</style></head><body><p>Hi</p></body></html>",
+			text: "Hi\n",
+		},
+		{
+			name: "link",
+			body: `<p>Click <a href="https://example.com/confirm?cnf=abc">to  confirm</a>.</p>`,
+			text: "Click to confirm (https://example.com/confirm?cnf=abc).\n",
+		},
+		{
+			name: "link showing its URL",
+			body: `<p>Go to <a href=" https://example.com ">https://example.com</a></p>`,
+			text: "Go to https://example.com\n",
+		},
+		{
+			name: "link without text",
+			body: `<p><a href="https://example.com"><img src="logo.png"></a></p>`,
+			text: "https://example.com\n",
+		},
+		{
+			name: "anchor link",
+			body: `<p><a href="#top">Top</a></p>`,
+			text: "Top\n",
+		},
+		{
+			name: "list",
+			body: "<p>Steps:</p><ul><li>One</li><li>Two <b>bold</b></li></ul><p>Done</p>",
+			text: "Steps:\n\n- One\n- Two bold\n\nDone\n",
+		},
+		{
+			name: "pre",
+			body: "<p>Code:</p><pre>  indented\n    more  spaces</pre><p>After</p>",
+			text: "Code:\n\n  indented\n    more  spaces\n\nAfter\n",
+		},
+		{
+			name: "line breaks",
+			body: "<div>One<br>Two</div><hr><div>Three</div>",
+			text: "One\nTwo\n----\nThree\n",
+		},
+		{
+			name: "image",
+			body: `<p>Logo: <img alt="Authboss Worked"></p>`,
+			text: "Logo: Authboss Worked\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := mailText([]byte(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.text {
+				t.Errorf("text:\n%s\nwant:\n%s", strings.ReplaceAll(text, " ", "·"), strings.ReplaceAll(test.text, " ", "·"))
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/volatiletech/authboss/v3"
+	"github.com/volatiletech/authboss/v3/defaults"
+)
+
+const (
+	mailerLog     = "log"
+	mailerSMTP    = "smtp"
+	mailerFile    = "file"
+	mailerMaildir = "maildir"
+)
+
+var (
+	_ authboss.Mailer = &SMTPMailer{}
+	_ authboss.Mailer = &FileMailer{}
+	_ authboss.Mailer = &MaildirMailer{}
+)
+
+// makeMailer creates the authboss.Mailer selected in the configuration's "mail:mailer". Without
+// one, Authboss' defaults.SetCore() installs a log mailer, which is what "log" is.
+//
+// To deliver mail some other way (an e-mail service's HTTP API, ...), implement
+// authboss.Mailer and add a case here.
+func makeMailer(cfg *ConfigData) (authboss.Mailer, error) {
+	switch cfg.Mail.Mailer {
+	case mailerLog:
+		return defaults.NewLogMailer(os.Stdout), nil
+	case mailerSMTP:
+		return makeSMTPMailer(cfg.Mail.SMTP)
+	case mailerFile:
+		return makeFileMailer(mailboxPath(cfg, cfg.Mail.File)), nil
+	case mailerMaildir:
+		return makeMaildirMailer(mailboxPath(cfg, cfg.Mail.Maildir))
+	default:
+		return nil, fmt.Errorf("unknown mailer '%s'", cfg.Mail.Mailer)
+	}
+}
+
+// mailboxPath makes a relative mailbox path relative to the worked example's root directory.
+func mailboxPath(cfg *ConfigData, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(cfg.WorkedRoot, path)
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// SMTP:
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// SMTPMailer sends e-mail through an SMTP server (a mail relay or a mail service's submission
+// port.) Unlike Authboss' defaults.SMTPMailer, it can insist on STARTTLS or use implicit TLS,
+// and gives up after a timeout rather than holding up the request indefinitely.
+type SMTPMailer struct {
+	// The server's host:port and host name (for TLS)
+	address string
+	host    string
+	// Authentication, nil without a user name.
+	auth smtp.Auth
+	// Implicit TLS (SMTPS, usually port 465), or STARTTLS on a plain connection
+	implicitTLS bool
+	startTLS    bool
+	tlsConfig   *tls.Config
+	timeout     time.Duration
+
+	logger *log.Logger
+}
+
+// makeSMTPMailer creates an SMTP mailer for the configured server.
+func makeSMTPMailer(smtpCfg smtpData) (*SMTPMailer, error) {
+	if len(smtpCfg.Host) == 0 {
+		return nil, errors.New("the smtp mailer needs mail:smtp:host")
+	}
+
+	mailer := &SMTPMailer{
+		address:     net.JoinHostPort(smtpCfg.Host, strconv.Itoa(smtpCfg.Port)),
+		host:        smtpCfg.Host,
+		implicitTLS: smtpCfg.TLS,
+		startTLS:    smtpCfg.StartTLS && !smtpCfg.TLS,
+		tlsConfig: &tls.Config{
+			ServerName: smtpCfg.Host,
+			// Only for a development server with a self-signed certificate.
+			InsecureSkipVerify: smtpCfg.InsecureSkipVerify,
+		},
+		timeout: smtpCfg.Timeout,
+		logger:  log.New(os.Stdout, "[MAIL] ", log.LstdFlags),
+	}
+
+	if len(smtpCfg.Username) > 0 {
+		// net/smtp refuses to send PLAIN credentials over an unencrypted connection, except to
+		// localhost.
+		mailer.auth = smtp.PlainAuth("", smtpCfg.Username, smtpCfg.Password, smtpCfg.Host)
+	}
+
+	return mailer, nil
+}
+
+// Send delivers the e-mail to the SMTP server.
+func (mailer *SMTPMailer) Send(ctx context.Context, email authboss.Email) error {
+	message, err := composeMail(email)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(mailer.timeout)
+	if ctxDeadline, hasDeadline := ctx.Deadline(); hasDeadline && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", mailer.address)
+	if err != nil {
+		return fmt.Errorf("unable to connect to SMTP server %s: %w", mailer.address, err)
+	}
+
+	conn.SetDeadline(deadline)
+	if mailer.implicitTLS {
+		conn = tls.Client(conn, mailer.tlsConfig)
+	}
+
+	client, err := smtp.NewClient(conn, mailer.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP server %s: %w", mailer.address, err)
+	}
+	defer client.Close()
+
+	if err = mailer.deliver(client, email, message); err != nil {
+		return fmt.Errorf("SMTP server %s: %w", mailer.address, err)
+	}
+
+	mailer.logger.Printf("Sent \"%s\" to %s via %s", email.Subject, strings.Join(email.To, ", "), mailer.address)
+	return nil
+}
+
+// deliver runs the SMTP conversation.
+func (mailer *SMTPMailer) deliver(client *smtp.Client, email authboss.Email, message []byte) error {
+	if mailer.startTLS {
+		if supported, _ := client.Extension("STARTTLS"); !supported {
+			return errors.New("STARTTLS is required, but the server doesn't support it")
+		}
+
+		if err := client.StartTLS(mailer.tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if mailer.auth != nil {
+		if err := client.Auth(mailer.auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(email.From); err != nil {
+		return err
+	}
+
+	for _, recipients := range [][]string{email.To, email.Cc, email.Bcc} {
+		for _, recipient := range recipients {
+			if err := client.Rcpt(recipient); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = data.Write(message); err != nil {
+		return err
+	}
+
+	if err = data.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Development mailboxes:
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// FileMailer is a development mailer that appends each e-mail to an mbox file, so that you can
+// read the confirmation and recovery e-mails with a mail reader ("mutt -f mail_outbox.mbox") or,
+// in a pinch, "less".
+type FileMailer struct {
+	// Path to the mbox file
+	Path string
+	// Serializes appends to the file
+	mutex  sync.Mutex
+	logger *log.Logger
+}
+
+// makeFileMailer creates a new mbox-backed mailer.
+func makeFileMailer(path string) *FileMailer {
+	return &FileMailer{
+		Path:   path,
+		logger: log.New(os.Stdout, "[MAIL] ", log.LstdFlags),
+	}
+}
+
+// Send appends the e-mail to the mailer's mbox file.
+func (mailer *FileMailer) Send(ctx context.Context, email authboss.Email) error {
+	message, err := composeMail(email)
+	if err != nil {
+		return err
+	}
+
+	// mbox: a "From " line starts each message, and lines in the message that start with
+	// "From " are quoted.
+	message = bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n"))
+	message = bytes.ReplaceAll(message, []byte("\nFrom "), []byte("\n>From "))
+
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+
+	mbox, err := os.OpenFile(mailer.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open mbox %s: %w", mailer.Path, err)
+	}
+	defer mbox.Close()
+
+	_, err = fmt.Fprintf(mbox, "From %s %s\n%s\n", email.From, time.Now().Format(time.ANSIC), message)
+	if err != nil {
+		return fmt.Errorf("unable to write mbox %s: %w", mailer.Path, err)
+	}
+
+	mailer.logger.Printf("E-mail to %s appended to %s", strings.Join(email.To, ", "), mailer.Path)
+	return nil
+}
+
+// MaildirMailer is a development mailer that delivers each e-mail to a Maildir: one file per
+// e-mail in the Maildir's "new" directory ("mutt -f maildir".)
+type MaildirMailer struct {
+	// The Maildir, which has "tmp", "new" and "cur" subdirectories
+	Path string
+	// Makes the file names unique
+	deliveries atomic.Uint64
+	hostname   string
+	logger     *log.Logger
+}
+
+// makeMaildirMailer creates the Maildir, if it doesn't exist, and a mailer that delivers to it.
+func makeMaildirMailer(path string) (*MaildirMailer, error) {
+	for _, subdir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(path, subdir), 0700); err != nil {
+			return nil, fmt.Errorf("unable to create Maildir %s: %w", path, err)
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return &MaildirMailer{
+		Path: path,
+		// '/' and ':' can't be in a Maildir file name.
+		hostname: strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname),
+		logger:   log.New(os.Stdout, "[MAIL] ", log.LstdFlags),
+	}, nil
+}
+
+// Send delivers the e-mail to the Maildir: the e-mail is written to "tmp" and moved to "new"
+// once it's complete, so that a mail reader never sees half an e-mail.
+func (mailer *MaildirMailer) Send(ctx context.Context, email authboss.Email) error {
+	message, err := composeMail(email)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), mailer.deliveries.Add(1),
+		mailer.hostname)
+
+	tmpPath := filepath.Join(mailer.Path, "tmp", name)
+	if err := os.WriteFile(tmpPath, message, 0600); err != nil {
+		return fmt.Errorf("unable to write to Maildir %s: %w", mailer.Path, err)
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(mailer.Path, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to deliver to Maildir %s: %w", mailer.Path, err)
+	}
+
+	mailer.logger.Printf("E-mail to %s delivered to %s", strings.Join(email.To, ", "), mailer.Path)
+	return nil
+}
+
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+// Message composition:
+// =~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=~=
+
+// composeMail formats the e-mail as a MIME message (RFC 5322, CRLF line endings): the text
+// and HTML bodies are the alternative parts, quoted-printable so that non-ASCII text survives,
+// and the Bcc recipients aren't in the headers.
+func composeMail(email authboss.Email) ([]byte, error) {
+	if len(email.TextBody) == 0 && len(email.HTMLBody) == 0 {
+		return nil, errors.New("refusing to send mail without text or html body")
+	}
+
+	messageID, err := mailMessageID(email.From)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &bytes.Buffer{}
+	parts := multipart.NewWriter(message)
+
+	writeHeader := func(key, value string) {
+		fmt.Fprintf(message, "%s: %s\r\n", key, value)
+	}
+
+	writeHeader("Date", time.Now().Format(time.RFC1123Z))
+	writeHeader("Message-ID", messageID)
+	writeHeader("From", mailAddresses([]string{email.FromName}, []string{email.From}))
+	writeHeader("To", mailAddresses(email.ToNames, email.To))
+	if len(email.Cc) > 0 {
+		writeHeader("Cc", mailAddresses(email.CcNames, email.Cc))
+	}
+	if len(email.ReplyTo) > 0 {
+		writeHeader("Reply-To", mailAddresses([]string{email.ReplyToName}, []string{email.ReplyTo}))
+	}
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	writeHeader("MIME-Version", "1.0")
+	writeHeader("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	message.WriteString("\r\n")
+
+	// The last alternative is the preferred one.
+	for _, body := range []struct{ contentType, text string }{
+		{"text/plain; charset=UTF-8", email.TextBody},
+		{"text/html; charset=UTF-8", email.HTMLBody},
+	} {
+		if len(body.text) == 0 {
+			continue
+		}
+
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := quotedprintable.NewWriter(part)
+		if _, err = io.WriteString(encoder, body.text); err != nil {
+			return nil, err
+		}
+
+		if err = encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+// mailAddresses formats the addresses, with their names if there are any, for an address
+// header.
+func mailAddresses(names, addresses []string) string {
+	formatted := make([]string, 0, len(addresses))
+	for i, address := range addresses {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		formatted = append(formatted, (&mail.Address{Name: name, Address: address}).String())
+	}
+
+	return strings.Join(formatted, ", ")
+}
+
+// mailMessageID generates a unique Message-ID in the sender's domain.
+func mailMessageID(from string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("unable to generate a Message-ID: %w", err)
+	}
+
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = from[at+1:]
+	}
+
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), domain), nil
+}
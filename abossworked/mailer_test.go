@@ -0,0 +1,491 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/volatiletech/authboss/v3"
+)
+
+// smtpStub is an in-process SMTP server, just enough of one for SMTPMailer: EHLO, STARTTLS,
+// AUTH PLAIN, MAIL, RCPT, DATA and QUIT. It records what the client did.
+type smtpStub struct {
+	listener net.Listener
+	cert     tls.Certificate
+
+	// What the server offers
+	startTLS    bool
+	implicitTLS bool
+	// AUTH PLAIN credentials that the server accepts; any credentials if empty.
+	username, password string
+
+	mutex sync.Mutex
+	// The commands the client sent, and whether the connection was encrypted when it did.
+	commands []string
+	tlsUsed  []bool
+	// The AUTH PLAIN identity, the envelope and the message.
+	authUser string
+	from     string
+	rcpt     []string
+	data     string
+}
+
+// startSMTPStub starts the SMTP stand-in on a loopback port. The mailer trusts its certificate
+// through the returned pool.
+func startSMTPStub(t *testing.T, stub *smtpStub) *x509.CertPool {
+	t.Helper()
+
+	cert, pool := smtpTestCertificate(t)
+	stub.cert = cert
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stub.implicitTLS {
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	stub.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go stub.serve(conn)
+		}
+	}()
+
+	return pool
+}
+
+// smtpConfig returns the mailer configuration for the stub.
+func (stub *smtpStub) smtpConfig() smtpData {
+	host, port, _ := net.SplitHostPort(stub.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	return smtpData{Host: host, Port: portNumber, TLS: stub.implicitTLS, Timeout: 5 * time.Second}
+}
+
+// serve runs one SMTP session.
+func (stub *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+
+	_, encrypted := conn.(*tls.Conn)
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 smtpstub ESMTP")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+
+		stub.mutex.Lock()
+		stub.commands = append(stub.commands, verb)
+		stub.tlsUsed = append(stub.tlsUsed, encrypted)
+		stub.mutex.Unlock()
+
+		switch verb {
+		case "EHLO":
+			extensions := []string{"250-smtpstub"}
+			if stub.startTLS && !encrypted {
+				extensions = append(extensions, "250-STARTTLS")
+			}
+			extensions = append(extensions, "250 AUTH PLAIN")
+			text.PrintfLine("%s", strings.Join(extensions, "\r\n"))
+		case "STARTTLS":
+			if !stub.startTLS || encrypted {
+				text.PrintfLine("502 not supported")
+				continue
+			}
+
+			text.PrintfLine("220 go ahead")
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{stub.cert}})
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+
+			conn, encrypted = tlsConn, true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			decoded, err := base64.StdEncoding.DecodeString(initial)
+			fields := strings.Split(string(decoded), "\x00")
+			if mechanism != "PLAIN" || err != nil || len(fields) != 3 ||
+				(len(stub.username) > 0 && (fields[1] != stub.username || fields[2] != stub.password)) {
+				text.PrintfLine("535 authentication failed")
+				continue
+			}
+
+			stub.mutex.Lock()
+			stub.authUser = fields[1]
+			stub.mutex.Unlock()
+			text.PrintfLine("235 authenticated")
+		case "MAIL":
+			stub.mutex.Lock()
+			stub.from = smtpStubPath(arg)
+			stub.mutex.Unlock()
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			stub.mutex.Lock()
+			stub.rcpt = append(stub.rcpt, smtpStubPath(arg))
+			stub.mutex.Unlock()
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+
+			stub.mutex.Lock()
+			stub.data = string(data)
+			stub.mutex.Unlock()
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+// smtpStubPath extracts the address from a MAIL FROM:<...> or RCPT TO:<...> argument.
+func smtpStubPath(arg string) string {
+	start, end := strings.Index(arg, "<"), strings.LastIndex(arg, ">")
+	if start < 0 || end < start {
+		return arg
+	}
+
+	return arg[start+1 : end]
+}
+
+// sent returns true if the stub received a message.
+func (stub *smtpStub) sent() bool {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	return len(stub.data) > 0
+}
+
+// smtpTestCertificate creates a self-signed certificate for 127.0.0.1 and a pool that trusts it.
+func smtpTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smtpstub"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// testEmail is the e-mail that the mailer tests send.
+func testEmail() authboss.Email {
+	return authboss.Email{
+		From:     "noreply@example.com",
+		FromName: "Authboss Worked",
+		To:       []string{"user@example.com"},
+		ToNames:  []string{"Jürgen User"},
+		Cc:       []string{"cc@example.com"},
+		Bcc:      []string{"hidden@example.com"},
+		Subject:  "Bestätigen Sie Ihr Konto",
+		TextBody: "Grüße!\nFrom now on, click https://example.com/auth/confirm?cnf=abc\n",
+		HTMLBody: "<p>Grüße!</p>",
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	tests := []struct {
+		name string
+		// The server
+		startTLS, implicitTLS bool
+		username, password    string
+		// The mailer
+		requireStartTLS bool
+		login, secret   string
+
+		wantErr      string
+		wantStartTLS bool
+		wantAuth     string
+	}{
+		{name: "plain"},
+		{name: "STARTTLS required and supported", startTLS: true, requireStartTLS: true, wantStartTLS: true},
+		{name: "STARTTLS required but unsupported", requireStartTLS: true, wantErr: "STARTTLS is required"},
+		{name: "STARTTLS supported but not required", startTLS: true},
+		{name: "implicit TLS", implicitTLS: true},
+		{
+			name: "AUTH after STARTTLS", startTLS: true, username: "mailer", password: "secret",
+			requireStartTLS: true, login: "mailer", secret: "secret", wantStartTLS: true, wantAuth: "mailer",
+		},
+		{
+			name: "AUTH rejected", username: "mailer", password: "secret",
+			login: "mailer", secret: "wrong", wantErr: "535",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &smtpStub{
+				startTLS:    test.startTLS,
+				implicitTLS: test.implicitTLS,
+				username:    test.username,
+				password:    test.password,
+			}
+			pool := startSMTPStub(t, stub)
+
+			smtpCfg := stub.smtpConfig()
+			smtpCfg.StartTLS = test.requireStartTLS
+			smtpCfg.Username, smtpCfg.Password = test.login, test.secret
+
+			mailer, err := makeSMTPMailer(smtpCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mailer.tlsConfig.RootCAs = pool
+
+			err = mailer.Send(context.Background(), testEmail())
+			if len(test.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+
+				if stub.sent() {
+					t.Error("message sent anyway")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			stub.mutex.Lock()
+			defer stub.mutex.Unlock()
+
+			usedStartTLS := strings.Contains(strings.Join(stub.commands, " "), "STARTTLS")
+			if usedStartTLS != test.wantStartTLS {
+				t.Errorf("STARTTLS %v, want %v (commands %v)", usedStartTLS, test.wantStartTLS, stub.commands)
+			}
+
+			for i, command := range stub.commands {
+				if command == "AUTH" && !stub.tlsUsed[i] && test.wantStartTLS {
+					t.Error("AUTH before STARTTLS")
+				}
+			}
+
+			if stub.authUser != test.wantAuth {
+				t.Errorf("AUTH as %q, want %q", stub.authUser, test.wantAuth)
+			}
+
+			if stub.from != "noreply@example.com" {
+				t.Errorf("MAIL FROM %q", stub.from)
+			}
+
+			if want := "user@example.com cc@example.com hidden@example.com"; strings.Join(stub.rcpt, " ") != want {
+				t.Errorf("RCPT TO %v, want %s", stub.rcpt, want)
+			}
+
+			if !strings.Contains(stub.data, "Subject: =?utf-8?q?") {
+				t.Errorf("message not received: %q", stub.data)
+			}
+		})
+	}
+}
+
+func TestComposeMail(t *testing.T) {
+	email := testEmail()
+	composed, err := composeMail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(strings.ReplaceAll(string(composed), "\r\n", ""), "\n") {
+		t.Error("bare LF line ending")
+	}
+
+	message, err := mail.ReadMessage(strings.NewReader(string(composed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := message.Header
+	if bcc := headers.Get("Bcc"); len(bcc) > 0 || strings.Contains(string(composed), "hidden@example.com") {
+		t.Errorf("Bcc recipient in the message: %q", bcc)
+	}
+
+	rawSubject := headers.Get("Subject")
+	if !strings.HasPrefix(rawSubject, "=?utf-8?q?") {
+		t.Errorf("subject %q isn't Q-encoded", rawSubject)
+	}
+
+	decoder := &mime.WordDecoder{}
+	if subject, err := decoder.DecodeHeader(rawSubject); err != nil || subject != email.Subject {
+		t.Errorf("subject %q (%v), want %q", subject, err, email.Subject)
+	}
+
+	to, err := headers.AddressList("To")
+	if err != nil || len(to) != 1 || to[0].Name != "Jürgen User" || to[0].Address != "user@example.com" {
+		t.Errorf("To %v (%v)", to, err)
+	}
+
+	if cc := headers.Get("Cc"); cc != "<cc@example.com>" {
+		t.Errorf("Cc %q", cc)
+	}
+
+	if id := headers.Get("Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Message-ID %q", id)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type %s (%v)", mediaType, err)
+	}
+
+	// Text first, HTML (the preferred alternative) last:
+	want := []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", email.TextBody},
+		{"text/html; charset=UTF-8", email.HTMLBody},
+	}
+
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := parts.NextRawPart()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("%d parts, want %d", i, len(want))
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if i >= len(want) {
+			t.Fatalf("more than %d parts", len(want))
+		}
+
+		if contentType := part.Header.Get("Content-Type"); contentType != want[i].contentType {
+			t.Errorf("part %d: Content-Type %q, want %q", i, contentType, want[i].contentType)
+		}
+
+		// Quoted-printable text has CRLF line endings.
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil || strings.ReplaceAll(string(body), "\r\n", "\n") != want[i].body {
+			t.Errorf("part %d: body %q (%v), want %q", i, body, err, want[i].body)
+		}
+	}
+}
+
+func TestComposeMailWithoutBody(t *testing.T) {
+	email := testEmail()
+	email.TextBody, email.HTMLBody = "", ""
+
+	if _, err := composeMail(email); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestFileMailerQuotesFrom(t *testing.T) {
+	mailer := makeFileMailer(filepath.Join(t.TempDir(), "outbox.mbox"))
+
+	for i := 0; i < 2; i++ {
+		if err := mailer.Send(context.Background(), testEmail()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mbox, err := os.Open(mailer.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+
+	separators, quoted := 0, 0
+	scanner := bufio.NewScanner(mbox)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasSuffix(line, "\r"):
+			t.Errorf("CRLF line ending in the mbox: %q", line)
+		case strings.HasPrefix(line, "From "):
+			separators++
+			if !strings.HasPrefix(line, "From noreply@example.com ") {
+				t.Errorf("separator %q", line)
+			}
+		case strings.HasPrefix(line, ">From now on"):
+			quoted++
+		}
+	}
+
+	// One separator per e-mail; the body's "From now on" line is quoted.
+	if separators != 2 || quoted != 2 {
+		t.Errorf("%d separators and %d quoted lines, want 2 and 2", separators, quoted)
+	}
+}
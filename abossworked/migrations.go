@@ -0,0 +1,468 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* Versioned schema migrations for the user database.
+
+   GORM's AutoMigrate only ever adds tables, columns and indexes: it never drops or renames
+   anything, and it doesn't record which version of the schema a database has. Instead, the
+   user database's schema is an ordered list of migrations, each with an "up" step and a
+   "down" step that undoes it. The schema_migrations table records the migrations that have
+   been applied, along with the schema signature after each one: a SHA-256 hash over the
+   schema's DDL (SQLite's sqlite_master.) OpenUserDB migrates the database up to the latest
+   version and refuses to open a database whose schema no longer matches its recorded
+   signature, i.e., whose schema was changed behind the migrations' back.
+
+   "abossctl migrate" migrates, rolls back and shows the migration status (see userAdmin.go.)
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// userDBMigration is one step in the user database's schema history.
+type userDBMigration struct {
+	Version int
+	Name    string
+	// Up applies the migration, Down undoes it. Both run inside a transaction.
+	Up   func(tx *gorm.DB) error
+	Down func(tx *gorm.DB) error
+}
+
+// userDBMigrations is the user database's schema history, in version order. Versions start
+// at 1 and are consecutive. Add new migrations to the end; never change a migration that
+// has been released, since databases out in the wild have already applied it.
+var userDBMigrations = []userDBMigration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up:      execSQL(initialSchema...),
+		Down:    dropTables(initialSchemaTables...),
+	},
+	{
+		Version: 2,
+		Name:    "remember-me token expiry",
+		// Tokens issued before there were expiry dates get the default remember:max_age.
+		Up: execSQL(
+			"ALTER TABLE `remember` ADD COLUMN `created_at` datetime",
+			"ALTER TABLE `remember` ADD COLUMN `expires_at` datetime",
+			"UPDATE `remember` SET `created_at` = datetime('now'), `expires_at` = datetime('now', '+12 hours')",
+			"CREATE INDEX IF NOT EXISTS `idx_remember_expires_at` ON `remember`(`expires_at`)",
+		),
+		Down: execSQL(
+			"DROP INDEX IF EXISTS `idx_remember_expires_at`",
+			"ALTER TABLE `remember` DROP COLUMN `expires_at`",
+			"ALTER TABLE `remember` DROP COLUMN `created_at`",
+		),
+	},
+	{
+		Version: 3,
+		Name:    "hashed remember-me tokens",
+		// The tokens are hashed with seeds:remember, which SQL doesn't know, so the unhashed
+		// tokens are deleted rather than left in token_hash: remembered users have to sign in
+		// again. Rolling back deletes the hashes for the same reason.
+		Up: execSQL(
+			"DELETE FROM `remember`",
+			"ALTER TABLE `remember` RENAME COLUMN `token` TO `token_hash`",
+		),
+		Down: execSQL(
+			"DELETE FROM `remember`",
+			"ALTER TABLE `remember` RENAME COLUMN `token_hash` TO `token`",
+		),
+	},
+	{
+		Version: 4,
+		Name:    "remember-me series and security events",
+		Up: execSQL(
+			"ALTER TABLE `remember` ADD COLUMN `series` varchar(64) NOT NULL DEFAULT ''",
+			"ALTER TABLE `remember` ADD COLUMN `previous_token_hash` text NOT NULL DEFAULT ''",
+			"ALTER TABLE `remember` ADD COLUMN `rotated_at` datetime",
+			"CREATE INDEX IF NOT EXISTS `idx_remember_series` ON `remember`(`series`)",
+			"CREATE TABLE IF NOT EXISTS `security_events` (`id` integer PRIMARY KEY AUTOINCREMENT,`guid` char(36) NOT NULL,`event` varchar(64) NOT NULL,`detail` text,`remote_addr` varchar(64),`created_at` datetime)",
+			"CREATE INDEX IF NOT EXISTS `idx_security_events_guid` ON `security_events`(`guid`)",
+		),
+		Down: execSQL(
+			"DROP TABLE IF EXISTS `security_events`",
+			"DROP INDEX IF EXISTS `idx_remember_series`",
+			"ALTER TABLE `remember` DROP COLUMN `rotated_at`",
+			"ALTER TABLE `remember` DROP COLUMN `previous_token_hash`",
+			"ALTER TABLE `remember` DROP COLUMN `series`",
+		),
+	},
+	{
+		Version: 5,
+		Name:    "user session index",
+		Up: execSQL(
+			"CREATE TABLE IF NOT EXISTS `user_sessions` (`session_id` varchar(64) NOT NULL,`guid` char(36) NOT NULL,`remember_series` varchar(64),`user_agent` text,`remote_addr` varchar(64),`created_at` datetime,`last_seen` datetime,PRIMARY KEY (`session_id`))",
+			"CREATE INDEX IF NOT EXISTS `idx_user_sessions_guid` ON `user_sessions`(`guid`)",
+		),
+		Down: dropTables("user_sessions"),
+	},
+	{
+		Version: 6,
+		Name:    "JWT deny-list",
+		Up: execSQL(
+			"CREATE TABLE IF NOT EXISTS `revoked_tokens` (`jti` varchar(64) NOT NULL,`expires_at` datetime,`created_at` datetime,PRIMARY KEY (`jti`))",
+			"CREATE INDEX IF NOT EXISTS `idx_revoked_tokens_expires_at` ON `revoked_tokens`(`expires_at`)",
+		),
+		Down: dropTables("revoked_tokens"),
+	},
+	{
+		Version: 7,
+		Name:    "Mail outbox",
+		Up: execSQL(
+			"CREATE TABLE IF NOT EXISTS `outbox` (`id` integer PRIMARY KEY AUTOINCREMENT,`recipients` text,`subject` text,`email` text NOT NULL,`status` varchar(16) NOT NULL,`attempts` integer NOT NULL DEFAULT 0,`next_attempt_at` datetime,`last_error` text,`created_at` datetime,`sent_at` datetime)",
+			"CREATE INDEX IF NOT EXISTS `idx_outbox_status_next_attempt_at` ON `outbox`(`status`,`next_attempt_at`)",
+		),
+		Down: dropTables("outbox"),
+	},
+}
+
+const (
+	// The gin-contrib GORM session store creates and manages its own table, which is
+	// excluded from the migrations and the schema signature.
+	sessionsTable = "sessions"
+
+	schemaMigrationsTable = "schema_migrations"
+	schemaMigrationsDDL   = "CREATE TABLE IF NOT EXISTS `schema_migrations` (`version` integer NOT NULL,`name` text,`signature` char(64),`applied_at` datetime,PRIMARY KEY (`version`))"
+)
+
+var (
+	// ErrSchemaSignature is returned when the user database's schema doesn't match the
+	// signature recorded by its last migration.
+	ErrSchemaSignature = errors.New("user database schema does not match its recorded signature")
+	// ErrSchemaVersion is returned when the user database's schema isn't at the latest
+	// version, or is at a version newer than this program knows about.
+	ErrSchemaVersion = errors.New("user database schema version mismatch")
+)
+
+// initialSchema is the schema as GORM's AutoMigrate created it before there were
+// migrations. The "IF NOT EXISTS" adopts the databases that AutoMigrate created.
+var initialSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `udata` (`guid` char(36) NOT NULL,`email` varchar(256) NOT NULL,`uid_data` varchar(64) NOT NULL,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`guid`),CONSTRAINT `fk_confirmations_user` FOREIGN KEY (`guid`) REFERENCES `confirmations`(`guid`),CONSTRAINT `fk_locked_accounts_user` FOREIGN KEY (`guid`) REFERENCES `locked_accounts`(`guid`),CONSTRAINT `fk_recovery_requests_user` FOREIGN KEY (`guid`) REFERENCES `recovery_requests`(`guid`),CONSTRAINT `fk_totp2fa_user` FOREIGN KEY (`guid`) REFERENCES `totp2fa`(`guid`),CONSTRAINT `fk_sms2fa_user` FOREIGN KEY (`guid`) REFERENCES `sms2fa`(`guid`))",
+	"CREATE UNIQUE INDEX IF NOT EXISTS `idx_udata_email` ON `udata`(`email`)",
+	"CREATE TABLE IF NOT EXISTS `confirmations` (`guid` char(36) NOT NULL,`selector` text,`verifier` text,`confirmed` numeric,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`guid`))",
+	"CREATE UNIQUE INDEX IF NOT EXISTS `idx_confirmations_verifier` ON `confirmations`(`verifier`)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS `idx_confirmations_selector` ON `confirmations`(`selector`)",
+	"CREATE TABLE IF NOT EXISTS `locked_accounts` (`guid` char(36) NOT NULL,`attempt_count` integer,`last_attempt` datetime,`locked` datetime,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`guid`))",
+	"CREATE TABLE IF NOT EXISTS `recovery_requests` (`guid` char(36) NOT NULL,`selector` text,`verifier` text,`token_expiry` datetime,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`guid`))",
+	"CREATE UNIQUE INDEX IF NOT EXISTS `idx_recovery_requests_verifier` ON `recovery_requests`(`verifier`)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS `idx_recovery_requests_selector` ON `recovery_requests`(`selector`)",
+	"CREATE TABLE IF NOT EXISTS `remember` (`guid` char(36) NOT NULL,`token` text NOT NULL,PRIMARY KEY (`token`))",
+	"CREATE INDEX IF NOT EXISTS `idx_remember_guid` ON `remember`(`guid`)",
+	"CREATE TABLE IF NOT EXISTS `totp2fa` (`guid` char(36) NOT NULL,`totp_secret_key` text,`totp_last_code` text,`recovery_codes` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`guid`))",
+	"CREATE TABLE IF NOT EXISTS `sms2fa` (`guid` char(36) NOT NULL,`phone_number` varchar(32),`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`guid`))",
+	"CREATE TABLE IF NOT EXISTS `oauth2` (`provider` varchar(64) NOT NULL,`uid` varchar(256) NOT NULL,`guid` char(36) NOT NULL,`access_token` text,`refresh_token` text,`expiry` datetime,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`provider`,`uid`),CONSTRAINT `fk_oauth2_user` FOREIGN KEY (`guid`) REFERENCES `udata`(`guid`))",
+	"CREATE INDEX IF NOT EXISTS `idx_oauth2_guid` ON `oauth2`(`guid`)",
+	"CREATE TABLE IF NOT EXISTS `webauthn_credentials` (`credential_id` varchar(1024) NOT NULL,`guid` char(36) NOT NULL,`name` varchar(64),`public_key` blob,`attestation_type` text,`transports` text,`aaguid` blob,`sign_count` integer,`clone_warning` numeric,`user_present` numeric,`user_verified` numeric,`backup_eligible` numeric,`backup_state` numeric,`last_used` datetime,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`credential_id`))",
+	"CREATE INDEX IF NOT EXISTS `idx_webauthn_credentials_guid` ON `webauthn_credentials`(`guid`)",
+	"CREATE TABLE IF NOT EXISTS `oidc_clients` (`client_id` varchar(256) NOT NULL,`secret_hash` text,`name` varchar(256),`redirect_uris` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`client_id`))",
+	"CREATE TABLE IF NOT EXISTS `oidc_codes` (`code_hash` char(64) NOT NULL,`client_id` varchar(256) NOT NULL,`guid` char(36) NOT NULL,`redirect_uri` text,`scope` text,`nonce` text,`code_challenge` text,`code_challenge_method` text,`expiry` datetime,`created_at` datetime,PRIMARY KEY (`code_hash`))",
+	"CREATE TABLE IF NOT EXISTS `oidc_consents` (`guid` char(36) NOT NULL,`client_id` varchar(256) NOT NULL,`scope` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`guid`,`client_id`))",
+	"CREATE TABLE IF NOT EXISTS `api_tokens` (`token_id` char(16) NOT NULL,`token_hash` char(64) NOT NULL,`guid` char(36) NOT NULL,`name` varchar(64),`scopes` text,`expiry` datetime,`last_used` datetime,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`token_id`))",
+	"CREATE INDEX IF NOT EXISTS `idx_api_tokens_guid` ON `api_tokens`(`guid`)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS `idx_api_tokens_token_hash` ON `api_tokens`(`token_hash`)",
+	"CREATE TABLE IF NOT EXISTS `roles` (`name` varchar(64) NOT NULL,`description` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`name`))",
+	"CREATE TABLE IF NOT EXISTS `role_permissions` (`role` varchar(64) NOT NULL,`permission` varchar(128) NOT NULL,`created_at` datetime,PRIMARY KEY (`role`,`permission`))",
+	"CREATE TABLE IF NOT EXISTS `user_roles` (`guid` char(36) NOT NULL,`role` varchar(64) NOT NULL,`created_at` datetime,PRIMARY KEY (`guid`,`role`))",
+	"CREATE INDEX IF NOT EXISTS `idx_user_roles_role` ON `user_roles`(`role`)",
+}
+
+// initialSchemaTables are the tables that initialSchema creates.
+var initialSchemaTables = []string{
+	"udata",
+	"confirmations",
+	"locked_accounts",
+	"recovery_requests",
+	"remember",
+	"totp2fa",
+	"sms2fa",
+	"oauth2",
+	"webauthn_credentials",
+	"oidc_clients",
+	"oidc_codes",
+	"oidc_consents",
+	"api_tokens",
+	"roles",
+	"role_permissions",
+	"user_roles",
+}
+
+// SchemaStatus is the user database's migration status.
+type SchemaStatus struct {
+	// The database's schema version and the latest version.
+	Version int `json:"version"`
+	Latest  int `json:"latest"`
+	// Signature recorded by the last applied migration and the schema's actual signature.
+	RecordedSignature string `json:"recorded_signature"`
+	Signature         string `json:"signature"`
+
+	Migrations []SchemaMigrationStatus `json:"migrations"`
+}
+
+// SchemaMigrationStatus is a migration's status.
+type SchemaMigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// execSQL returns a migration step that executes the SQL statements in order.
+func execSQL(statements ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// dropTables returns a migration step that drops the tables in reverse order.
+func dropTables(tables ...string) func(tx *gorm.DB) error {
+	statements := make([]string, 0, len(tables))
+	for i := len(tables) - 1; i >= 0; i-- {
+		statements = append(statements, fmt.Sprintf("DROP TABLE IF EXISTS `%s`", tables[i]))
+	}
+
+	return execSQL(statements...)
+}
+
+// latestSchemaVersion is the version of the last migration.
+func latestSchemaVersion() int {
+	return userDBMigrations[len(userDBMigrations)-1].Version
+}
+
+// schemaSignature computes the schema signature: the SHA-256 hash over the DDL of the
+// tables and indexes, sorted so that the order in which they were created doesn't matter.
+// Whitespace is normalized. SQLite's own tables, the session store's table and the
+// schema_migrations table aren't part of the schema.
+func schemaSignature(tx *gorm.DB) (string, error) {
+	var objects []struct {
+		Type    string `gorm:"column:type"`
+		Name    string `gorm:"column:name"`
+		TblName string `gorm:"column:tbl_name"`
+		SQL     string `gorm:"column:sql"`
+	}
+
+	err := tx.Raw("SELECT type, name, tbl_name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\' AND tbl_name NOT IN (?, ?)",
+		sessionsTable, schemaMigrationsTable).Scan(&objects).Error
+	if err != nil {
+		return "", err
+	}
+
+	lines := make([]string, 0, len(objects))
+	for _, object := range objects {
+		lines = append(lines, strings.Join([]string{object.Type, object.Name, object.TblName,
+			strings.Join(strings.Fields(object.SQL), " ")}, "|"))
+	}
+	sort.Strings(lines)
+
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// lastMigration returns the last applied migration. Version is 0 if there isn't one.
+func lastMigration(tx *gorm.DB) (SchemaMigrations, error) {
+	var last SchemaMigrations
+
+	if !tx.Migrator().HasTable(&SchemaMigrations{}) {
+		return last, nil
+	}
+
+	err := tx.Order("version desc").Limit(1).Find(&last).Error
+	return last, err
+}
+
+// SchemaSignature computes the user database's current schema signature.
+func (storer *AuthStorer) SchemaSignature() (string, error) {
+	return schemaSignature(storer.UserDB)
+}
+
+// VerifySchema checks the user database's schema against the signature recorded by the
+// last migration and returns the schema version.
+func (storer *AuthStorer) VerifySchema() (int, error) {
+	last, err := lastMigration(storer.UserDB)
+	if err != nil {
+		return 0, err
+	}
+
+	if last.Version > latestSchemaVersion() {
+		return last.Version, fmt.Errorf("%w: version %d is newer than this program's latest version %d",
+			ErrSchemaVersion, last.Version, latestSchemaVersion())
+	}
+
+	if last.Version == 0 {
+		// Nothing to verify yet.
+		return 0, nil
+	}
+
+	signature, err := schemaSignature(storer.UserDB)
+	if err != nil {
+		return last.Version, err
+	}
+
+	if signature != last.Signature {
+		return last.Version, fmt.Errorf("%w: migration %d recorded %s, the schema's signature is %s",
+			ErrSchemaSignature, last.Version, last.Signature, signature)
+	}
+
+	return last.Version, nil
+}
+
+// RequireLatestSchema verifies the user database's schema and checks that it's at the
+// latest version.
+func (storer *AuthStorer) RequireLatestSchema() error {
+	version, err := storer.VerifySchema()
+	if err != nil {
+		return err
+	}
+
+	if version != latestSchemaVersion() {
+		return fmt.Errorf("%w: version %d, latest version is %d", ErrSchemaVersion, version, latestSchemaVersion())
+	}
+
+	return nil
+}
+
+// MigrateTo migrates the user database's schema up or down to the target version, one
+// migration (and one transaction) at a time. The schema has to match its recorded
+// signature before anything is migrated.
+func (storer *AuthStorer) MigrateTo(target int) error {
+	if target < 0 || target > latestSchemaVersion() {
+		return fmt.Errorf("%w: no schema version %d (latest version is %d)", ErrSchemaVersion, target, latestSchemaVersion())
+	}
+
+	if err := storer.UserDB.Exec(schemaMigrationsDDL).Error; err != nil {
+		return err
+	}
+
+	version, err := storer.VerifySchema()
+	if err != nil {
+		return err
+	}
+
+	for ; version < target; version++ {
+		migration := userDBMigrations[version]
+
+		err := storer.UserDB.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+
+			signature, err := schemaSignature(tx)
+			if err != nil {
+				return err
+			}
+
+			return tx.Create(&SchemaMigrations{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Signature: signature,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+
+		storer.log.Printf("Applied migration %d (%s)", migration.Version, migration.Name)
+	}
+
+	for ; version > target; version-- {
+		migration := userDBMigrations[version-1]
+
+		err := storer.UserDB.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+
+			if err := tx.Delete(&SchemaMigrations{}, "version = ?", migration.Version).Error; err != nil {
+				return err
+			}
+
+			if migration.Version == 1 {
+				return nil
+			}
+
+			// Record the signature that the schema has now, so that a down step that doesn't
+			// quite restore the previous schema (e.g., column order) doesn't trip the check.
+			signature, err := schemaSignature(tx)
+			if err != nil {
+				return err
+			}
+
+			return tx.Model(&SchemaMigrations{}).Where("version = ?", migration.Version-1).
+				Update("signature", signature).Error
+		})
+
+		if err != nil {
+			return fmt.Errorf("rolling back migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+
+		storer.log.Printf("Rolled back migration %d (%s)", migration.Version, migration.Name)
+	}
+
+	return nil
+}
+
+// MigrationStatus returns the user database's migration status.
+func (storer *AuthStorer) MigrationStatus() (*SchemaStatus, error) {
+	status := &SchemaStatus{Latest: latestSchemaVersion()}
+
+	var applied []SchemaMigrations
+	if storer.UserDB.Migrator().HasTable(&SchemaMigrations{}) {
+		if err := storer.UserDB.Order("version").Find(&applied).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, migration := range applied {
+		appliedAt[migration.Version] = migration.AppliedAt
+		status.Version = migration.Version
+		status.RecordedSignature = migration.Signature
+	}
+
+	var err error
+	if status.Signature, err = schemaSignature(storer.UserDB); err != nil {
+		return nil, err
+	}
+
+	for _, migration := range userDBMigrations {
+		entry := SchemaMigrationStatus{Version: migration.Version, Name: migration.Name}
+		if when, ok := appliedAt[migration.Version]; ok {
+			entry.AppliedAt = &when
+		}
+
+		status.Migrations = append(status.Migrations, entry)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,383 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/csrf"
+	"github.com/volatiletech/authboss/v3"
+	aboauth2 "github.com/volatiletech/authboss/v3/oauth2"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Provider name, as it appears in the configuration and the /auth/oauth2/{provider} paths.
+	mockOAuth2ProviderName = "mock"
+	// URL namespace for the mock provider's endpoints.
+	mockOAuth2Path = "/mock-oauth2"
+
+	// The worked example's client credentials. They're not secret, the mock provider is
+	// only good for testing.
+	mockOAuth2ClientID     = "authboss-worked"
+	mockOAuth2ClientSecret = "authboss-worked-secret"
+
+	// How long authorization codes and access tokens are good for.
+	mockOAuth2CodeLifetime  = time.Minute
+	mockOAuth2TokenLifetime = time.Hour
+)
+
+// mockOAuth2UserInfo is the mock provider's user details (userinfo endpoint) response.
+type mockOAuth2UserInfo struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	// The provider checked that the user owns the e-mail address.
+	EmailVerified bool `json:"email_verified"`
+}
+
+// mockOAuth2Grant is what an authorization code or access token grants access to.
+type mockOAuth2Grant struct {
+	userInfo    mockOAuth2UserInfo
+	redirectURI string
+	expires     time.Time
+}
+
+// mockOAuth2Provider returns the authboss OAuth2 provider configuration for the in-process
+// mock provider. The oauth2 module talks to the mock via HTTP, exactly as it would talk to
+// a real provider.
+func mockOAuth2Provider(rootURL string) authboss.OAuth2Provider {
+	providerURL := rootURL + mockOAuth2Path
+
+	return authboss.OAuth2Provider{
+		OAuth2Config: &oauth2.Config{
+			ClientID:     mockOAuth2ClientID,
+			ClientSecret: mockOAuth2ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   providerURL + "/authorize",
+				TokenURL:  providerURL + "/token",
+				AuthStyle: oauth2.AuthStyleInHeader,
+			},
+			Scopes: []string{"profile", "email"},
+		},
+		FindUserDetails: func(ctx context.Context, cfg oauth2.Config, token *oauth2.Token) (map[string]string, error) {
+			return mockOAuth2UserDetails(ctx, cfg, token, providerURL+"/userinfo")
+		},
+	}
+}
+
+// mockOAuth2UserDetails fetches the user's details from the mock provider's userinfo
+// endpoint, just like authboss' GoogleUserDetails and FacebookUserDetails.
+func mockOAuth2UserDetails(ctx context.Context, cfg oauth2.Config, token *oauth2.Token, userInfoURL string) (map[string]string, error) {
+	client := cfg.Client(ctx, token)
+	resp, err := client.Get(userInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mock OAuth2 userinfo endpoint returned %s", resp.Status)
+	}
+
+	var userInfo mockOAuth2UserInfo
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("unable to decode mock OAuth2 user info: %w", err)
+	}
+
+	return map[string]string{
+		aboauth2.OAuth2UID:   userInfo.ID,
+		aboauth2.OAuth2Email: userInfo.Email,
+		aboauth2.OAuth2Name:  userInfo.Name,
+		oauth2EmailVerified:  strconv.FormatBool(userInfo.EmailVerified),
+	}, nil
+}
+
+// MockOAuth2Server is a fake OAuth2 provider that runs inside the worked example, so that
+// the whole OAuth2 login flow can be exercised offline. It implements just enough of the
+// authorization code flow for the oauth2 module: an authorization page where you sign in
+// as any e-mail address, the token endpoint and a userinfo endpoint.
+//
+// Codes and tokens live in memory and disappear when the server restarts.
+type MockOAuth2Server struct {
+	// The client configuration (ID, secret, callback URL) that the mock accepts.
+	client *oauth2.Config
+	// Renders the authorization page
+	templates *Templates
+
+	mutex  sync.Mutex
+	codes  map[string]mockOAuth2Grant
+	tokens map[string]mockOAuth2Grant
+	logger *log.Logger
+}
+
+// makeMockOAuth2Server creates the mock provider's server side. client is the mock's
+// configuration in ab.Config.Modules.OAuth2Providers, AFTER ab.Init() fills in the callback
+// URL.
+func makeMockOAuth2Server(client *oauth2.Config, templates *Templates) *MockOAuth2Server {
+	return &MockOAuth2Server{
+		client:    client,
+		templates: templates,
+		codes:     map[string]mockOAuth2Grant{},
+		tokens:    map[string]mockOAuth2Grant{},
+		logger:    log.New(os.Stdout, "[MOCKOAUTH2] ", log.LstdFlags),
+	}
+}
+
+// routes adds the mock provider's endpoints to the Gin router.
+func (mock *MockOAuth2Server) routes(engine *gin.Engine) {
+	provider := engine.Group(mockOAuth2Path)
+	provider.GET("/authorize", mock.authorize)
+	provider.POST("/authorize", mock.approve)
+	provider.POST("/token", mock.token)
+	provider.GET("/userinfo", mock.userInfo)
+}
+
+// skipCSRF is Gin middleware that exempts the token endpoint from CSRF protection. The
+// oauth2 module posts to the token endpoint server-to-server, without a CSRF token. It has
+// to run before the CSRF middleware.
+func (mock *MockOAuth2Server) skipCSRF(ctx *gin.Context) {
+	if ctx.Request.Method == http.MethodPost && ctx.Request.URL.Path == mockOAuth2Path+"/token" {
+		ctx.Request = csrf.UnsafeSkipCheck(ctx.Request)
+	}
+}
+
+// authorize renders the mock provider's authorization page.
+func (mock *MockOAuth2Server) authorize(ctx *gin.Context) {
+	clientID := ctx.Query("client_id")
+	redirectURI := ctx.Query("redirect_uri")
+
+	if err := mock.checkClient(clientID, redirectURI); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if responseType := ctx.Query("response_type"); responseType != "code" {
+		ctx.String(http.StatusBadRequest, fmt.Sprintf("unsupported response_type '%s'", responseType))
+		return
+	}
+
+	r := ctx.Request
+	data := authboss.NewHTMLData().Merge(r.Context().Value(authboss.CTXKeyData).(authboss.HTMLData))
+	data.MergeKV(
+		"mock_client_id", clientID,
+		"mock_redirect_uri", redirectURI,
+		"mock_state", ctx.Query("state"),
+	)
+
+	result, contentType, err := mock.templates.Render(r.Context(), "mock_oauth2_authorize", data)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, fmt.Sprintf("template render error: %v", err))
+		return
+	}
+
+	ctx.Data(http.StatusOK, contentType, result)
+}
+
+// approve handles the authorization page's form, sending the browser back to the client's
+// callback URL with either an authorization code or an error.
+func (mock *MockOAuth2Server) approve(ctx *gin.Context) {
+	redirectURI := ctx.PostForm("redirect_uri")
+
+	if err := mock.checkClient(ctx.PostForm("client_id"), redirectURI); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	callback := url.Values{}
+	callback.Set("state", ctx.PostForm("state"))
+
+	if ctx.PostForm("approve") != "yes" {
+		callback.Set("error", "access_denied")
+		callback.Set("error_reason", "user_denied")
+		ctx.Redirect(http.StatusFound, redirectURI+"?"+callback.Encode())
+		return
+	}
+
+	email := strings.TrimSpace(ctx.PostForm("email"))
+	if len(email) == 0 {
+		ctx.String(http.StatusBadRequest, "e-mail address is required")
+		return
+	}
+
+	code, err := mockOAuth2RandomString()
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	mock.mutex.Lock()
+	mock.expireGrants()
+	mock.codes[code] = mockOAuth2Grant{
+		userInfo: mockOAuth2UserInfo{
+			ID:            mockOAuth2UID(email),
+			Email:         email,
+			Name:          strings.TrimSpace(ctx.PostForm("name")),
+			EmailVerified: ctx.PostForm("email_verified") == "yes",
+		},
+		redirectURI: redirectURI,
+		expires:     time.Now().Add(mockOAuth2CodeLifetime),
+	}
+	mock.mutex.Unlock()
+
+	mock.logger.Printf("Authorization code issued for %s", email)
+
+	callback.Set("code", code)
+	ctx.Redirect(http.StatusFound, redirectURI+"?"+callback.Encode())
+}
+
+// token exchanges an authorization code for an access token. Authorization codes can only
+// be used once.
+func (mock *MockOAuth2Server) token(ctx *gin.Context) {
+	clientID, clientSecret, hasBasicAuth := ctx.Request.BasicAuth()
+	if !hasBasicAuth {
+		clientID = ctx.PostForm("client_id")
+		clientSecret = ctx.PostForm("client_secret")
+	}
+
+	if clientID != mock.client.ClientID || clientSecret != mock.client.ClientSecret {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return
+	}
+
+	if grantType := ctx.PostForm("grant_type"); grantType != "authorization_code" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+		return
+	}
+
+	accessToken, err := mockOAuth2RandomString()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	refreshToken, err := mockOAuth2RandomString()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+
+	mock.expireGrants()
+
+	code := ctx.PostForm("code")
+	grant, found := mock.codes[code]
+	delete(mock.codes, code)
+
+	if !found || grant.redirectURI != ctx.PostForm("redirect_uri") {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		return
+	}
+
+	grant.expires = time.Now().Add(mockOAuth2TokenLifetime)
+	mock.tokens[accessToken] = grant
+
+	mock.logger.Printf("Access token issued for %s", grant.userInfo.Email)
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, gin.H{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(mockOAuth2TokenLifetime / time.Second),
+		"refresh_token": refreshToken,
+	})
+}
+
+// userInfo returns the details of the user to whom the bearer access token was issued.
+func (mock *MockOAuth2Server) userInfo(ctx *gin.Context) {
+	accessToken := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+
+	mock.mutex.Lock()
+	mock.expireGrants()
+	grant, found := mock.tokens[accessToken]
+	mock.mutex.Unlock()
+
+	if !found {
+		ctx.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, grant.userInfo)
+}
+
+// checkClient verifies that the client ID and callback URL are the ones configured for the
+// worked example. A real provider would look the client up in its client registry.
+func (mock *MockOAuth2Server) checkClient(clientID, redirectURI string) error {
+	if clientID != mock.client.ClientID {
+		return fmt.Errorf("unknown client_id '%s'", clientID)
+	}
+
+	if redirectURI != mock.client.RedirectURL {
+		return fmt.Errorf("redirect_uri '%s' is not registered for client '%s'", redirectURI, clientID)
+	}
+
+	return nil
+}
+
+// expireGrants removes expired authorization codes and access tokens. The caller holds
+// the mutex.
+func (mock *MockOAuth2Server) expireGrants() {
+	now := time.Now()
+
+	for code, grant := range mock.codes {
+		if now.After(grant.expires) {
+			delete(mock.codes, code)
+		}
+	}
+
+	for token, grant := range mock.tokens {
+		if now.After(grant.expires) {
+			delete(mock.tokens, token)
+		}
+	}
+}
+
+// mockOAuth2UID derives the mock provider's user identifier from the e-mail address, so
+// that signing in with the same e-mail address always returns the same identity.
+func mockOAuth2UID(email string) string {
+	digest := sha256.Sum256([]byte(strings.ToLower(email)))
+	return "mock-" + hex.EncodeToString(digest[:8])
+}
+
+// mockOAuth2RandomString generates authorization codes and tokens.
+func mockOAuth2RandomString() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("unable to generate random string: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,247 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/volatiletech/authboss/v3"
+	"github.com/volatiletech/authboss/v3/confirm"
+	aboauth2 "github.com/volatiletech/authboss/v3/oauth2"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// errOAuth2AccountExists is returned by NewFromOAuth2 when the provider's e-mail address
+// belongs to an existing account, but the provider isn't trusted to link by e-mail.
+var errOAuth2AccountExists = errors.New("an account with this e-mail address already exists")
+
+const (
+	// User details key: "true" if the provider checked that the user owns the e-mail address.
+	// aboauth2's details only have the UID, e-mail address and name.
+	oauth2EmailVerified = "email_verified"
+
+	// Google's user details endpoint (the same one that aboauth2.GoogleUserDetails uses.)
+	googleUserInfoURL = "https://www.googleapis.com/userinfo/v2/me"
+)
+
+// setupOAuth2 configures the OAuth2 login providers listed in the configuration's "oauth2"
+// section.
+//
+// Unlike the 2fa modules, this has to happen BEFORE ab.Init(): the oauth2 module's Init()
+// registers the /auth/oauth2/{provider} and /auth/oauth2/callback/{provider} routes for the
+// providers it finds in ab.Config.Modules.OAuth2Providers.
+func setupOAuth2(cfg *ConfigData, ab *authboss.Authboss, storer *AuthStorer) error {
+	if !cfg.Features.UseOAuth2 {
+		return nil
+	}
+
+	providers := make(map[string]authboss.OAuth2Provider, len(cfg.OAuth2))
+	storer.oauth2LinkByEmail = make(map[string]bool, len(cfg.OAuth2))
+
+	for name, providerCfg := range cfg.OAuth2 {
+		// The oauth2 module lower cases the provider name in the URL path.
+		name = strings.ToLower(name)
+
+		var provider authboss.OAuth2Provider
+
+		switch name {
+		case mockOAuth2ProviderName:
+			provider = mockOAuth2Provider(ab.Config.Paths.RootURL)
+		case "google":
+			provider = authboss.OAuth2Provider{
+				OAuth2Config:    makeOAuth2Config(providerCfg, endpoints.Google, []string{"profile", "email"}),
+				FindUserDetails: googleUserDetails,
+			}
+		case "facebook":
+			provider = authboss.OAuth2Provider{
+				OAuth2Config:    makeOAuth2Config(providerCfg, endpoints.Facebook, []string{"email"}),
+				FindUserDetails: aboauth2.FacebookUserDetails,
+			}
+		default:
+			return fmt.Errorf("unknown OAuth2 provider '%s'", name)
+		}
+
+		providers[name] = provider
+		storer.oauth2LinkByEmail[name] = providerCfg.LinkByEmail
+	}
+
+	if len(providers) == 0 {
+		cfg.ConfigLog.Print("OAuth2 is enabled, but no OAuth2 providers are configured.")
+	}
+
+	ab.Config.Modules.OAuth2Providers = providers
+	ab.Config.Core.ErrorHandler = oauth2ErrorHandler{
+		ErrorHandler: ab.Config.Core.ErrorHandler,
+		ab:           ab,
+	}
+
+	// The provider is one factor, like a password: users with 2fa continue to the 2fa validation.
+	ab.Events.Before(authboss.EventOAuth2, oauth2SecondFactor(ab))
+
+	// New users whose e-mail address the provider didn't verify aren't confirmed (see
+	// SaveOAuth2), so they get a confirmation e-mail just like users who register.
+	if cfg.Features.UseConfirm {
+		confirmer := &confirm.Confirm{Authboss: ab}
+		ab.Events.After(authboss.EventOAuth2, func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+			user, valid := r.Context().Value(authboss.CTXKeyUser).(*WorkedUser)
+			if !valid || user.GetConfirmed() || len(user.GetConfirmSelector()) > 0 {
+				return false, nil
+			}
+
+			return false, confirmer.StartConfirmation(r.Context(), user, true)
+		})
+	}
+
+	return nil
+}
+
+// oauth2SecondFactor sends users with TOTP or SMS 2fa on to the 2fa module's validation page
+// when they sign in with an OAuth2 provider, the way the auth module does after a password
+// verifies. Otherwise, linking a provider to a password account (from the user page or by
+// e-mail address) would be a way around the account's second factor.
+//
+// The oauth2 module fires no EventAuthHijack of its own, so this fires it before the oauth2
+// module signs the user in. Users who are already fully signed in, linking a provider to their
+// own account, have been through their second factor.
+func oauth2SecondFactor(ab *authboss.Authboss) authboss.EventHandler {
+	return func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+		user, valid := r.Context().Value(authboss.CTXKeyUser).(*WorkedUser)
+		if handled || !valid {
+			return handled, nil
+		}
+
+		// Not ab.CurrentUser: that's the context's user, the one signing in.
+		if pid, signedIn := authboss.GetSession(r, authboss.SessionKey); signedIn && authboss.IsFullyAuthed(r) {
+			current, err := ab.Config.Storage.Server.Load(r.Context(), pid)
+			if currentUser, valid := current.(*WorkedUser); err == nil && valid && currentUser.GUID == user.GUID {
+				return false, nil
+			}
+		}
+
+		// The 2fa modules pass the request's query on to the validation page: the callback's
+		// code and state don't belong there.
+		hijack := r.Clone(r.Context())
+		hijack.URL.RawQuery = ""
+
+		return ab.Events.FireBefore(authboss.EventAuthHijack, w, hijack)
+	}
+}
+
+// googleUserDetails is aboauth2.GoogleUserDetails, plus whether Google verified the user's
+// e-mail address.
+func googleUserDetails(ctx context.Context, cfg oauth2.Config, token *oauth2.Token) (map[string]string, error) {
+	resp, err := cfg.Client(ctx, token).Get(googleUserInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("google OAuth2 user details endpoint returned %s", resp.Status)
+	}
+
+	var userInfo struct {
+		ID            string `json:"id"`
+		Email         string `json:"email"`
+		VerifiedEmail bool   `json:"verified_email"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("unable to decode Google user details: %w", err)
+	}
+
+	return map[string]string{
+		aboauth2.OAuth2UID:   userInfo.ID,
+		aboauth2.OAuth2Email: userInfo.Email,
+		oauth2EmailVerified:  strconv.FormatBool(userInfo.VerifiedEmail),
+	}, nil
+}
+
+// makeOAuth2Config creates the golang.org/x/oauth2 configuration for a provider. The oauth2
+// module fills in the redirect (callback) URL.
+func makeOAuth2Config(providerCfg oauth2ProviderData, endpoint oauth2.Endpoint, defaultScopes []string) *oauth2.Config {
+	scopes := providerCfg.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+
+	return &oauth2.Config{
+		ClientID:     providerCfg.ClientID,
+		ClientSecret: providerCfg.ClientSecret,
+		Endpoint:     endpoint,
+		Scopes:       scopes,
+	}
+}
+
+// oauth2ProviderNames returns the sorted names of the configured OAuth2 providers, for the
+// login and user management templates.
+func oauth2ProviderNames(ab *authboss.Authboss) []string {
+	names := make([]string, 0, len(ab.Config.Modules.OAuth2Providers))
+	for name := range ab.Config.Modules.OAuth2Providers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// oauth2ErrorHandler wraps the authboss error handler to tell the user when their OAuth2
+// sign in fails. The default error handler only logs the error, which leaves the user
+// staring at a blank page after the provider redirects back to the callback URL.
+type oauth2ErrorHandler struct {
+	authboss.ErrorHandler
+	ab *authboss.Authboss
+}
+
+// Wrap the handler, redirecting to the OAuth2LoginNotOK path with a flash error message if the
+// OAuth2 callback fails. The error is still passed along to the default error handler so that
+// it gets logged.
+func (handler oauth2ErrorHandler) Wrap(page func(w http.ResponseWriter, r *http.Request) error) http.Handler {
+	return handler.ErrorHandler.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+		err := page(w, r)
+		if err == nil || !strings.HasPrefix(r.URL.Path, "/oauth2/callback/") {
+			return err
+		}
+
+		provider := strings.ToLower(path.Base(r.URL.Path))
+		message := fmt.Sprintf("Sign in with %s failed.", provider)
+		if errors.Is(err, errOAuth2AccountExists) {
+			message = fmt.Sprintf("An account with your %s e-mail address already exists. Sign in with your password and "+
+				"link your %s identity from your user page.", provider, provider)
+		}
+
+		redirectErr := handler.ab.Config.Core.Redirector.Redirect(w, r, authboss.RedirectOptions{
+			Code:         http.StatusTemporaryRedirect,
+			RedirectPath: handler.ab.Config.Paths.OAuth2LoginNotOK,
+			Failure:      message,
+		})
+		if redirectErr != nil {
+			handler.ab.RequestLogger(r).Errorf("unable to redirect after OAuth2 failure: %v", redirectErr)
+		}
+
+		return err
+	})
+}
@@ -0,0 +1,88 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestOAuth2SignInWith2FA(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Features.UseOAuth2 = true
+	cfg.Features.UseTOTP = true
+	cfg.Features.UseSMS = true
+	cfg.SMS.Sender = "log"
+	cfg.OAuth2 = map[string]oauth2ProviderData{mockOAuth2ProviderName: {LinkByEmail: true}}
+	server := startTestServer(t, cfg)
+
+	const secret = "JBSWY3DPEHPK3PXP"
+	server.createUser(t, "totp@example.com", "secret1").PutTOTPSecretKey(secret)
+	server.createUser(t, "sms@example.com", "secret1").PutSMSPhoneNumber("+15555550100")
+	server.createUser(t, "plain@example.com", "secret1")
+
+	tests := []struct {
+		email    string
+		location string
+	}{
+		{"totp@example.com", "/auth/2fa/totp/validate"},
+		{"sms@example.com", "/auth/2fa/sms/validate"},
+		{"plain@example.com", "/app/"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.email, func(t *testing.T) {
+			// Linked to the password account by the verified e-mail address.
+			client := server.client(t)
+			if location := client.oauth2SignIn(t, test.email, true); location != test.location {
+				t.Fatalf("OAuth2 sign in went to %q, want %q", location, test.location)
+			}
+
+			if signedIn := client.signedIn(t); signedIn != (test.location == "/app/") {
+				t.Errorf("signed in: %v", signedIn)
+			}
+		})
+	}
+
+	// The TOTP user signs in once they enter their code.
+	client := server.client(t)
+	client.oauth2SignIn(t, "totp@example.com", true)
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ := client.postForm(t, "/auth/2fa/totp/validate", url.Values{"code": {code}})
+	if location := resp.Header.Get("Location"); resp.StatusCode/100 != 3 || location != "/app/" {
+		t.Fatalf("TOTP validation: %d to %q", resp.StatusCode, location)
+	}
+
+	if !client.signedIn(t) {
+		t.Error("not signed in after the TOTP validation")
+	}
+
+	// Signed in with both factors, the user can use the provider again (linking it, from the
+	// user page) without another code.
+	if location := client.oauth2SignIn(t, "totp@example.com", true); location != "/app/" {
+		t.Errorf("OAuth2 sign in while signed in went to %q, want /app/", location)
+	}
+}
@@ -0,0 +1,762 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/csrf"
+	"github.com/volatiletech/authboss/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// URL namespace for the OpenID Connect provider's endpoints.
+	oidcPath = "/oidc"
+	// Where clients find the discovery document (OpenID Connect Discovery 1.0)
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+	// PageOIDCConsent is the page where the user allows a client application to sign them in.
+	PageOIDCConsent = "oidc_consent"
+
+	// How long authorization codes and tokens are good for.
+	oidcCodeLifetime  = time.Minute
+	oidcTokenLifetime = time.Hour
+
+	// Size of the generated token signing key
+	oidcSigningKeyBits = 2048
+)
+
+// oidcScopes are the scopes that the provider supports and what they mean to the user.
+// Requests for other scopes are ignored.
+var oidcScopes = map[string]string{
+	"openid": "Sign you in with your account",
+	"email":  "See your e-mail address",
+}
+
+// OIDCProvider turns the worked example into an OpenID Connect identity provider, so that
+// other applications can sign their users in with the accounts in the user database. It
+// implements the authorization code flow (with PKCE) and the endpoints that go with it:
+//
+//	GET  /.well-known/openid-configuration  Discovery document
+//	GET  /oidc/jwks                         Token signing key(s)
+//	GET  /oidc/authorize                    Authorization endpoint, asks for consent
+//	POST /oidc/authorize                    The consent page's form
+//	POST /oidc/token                        Exchanges an authorization code for tokens
+//	GET  /oidc/userinfo                     The signed in user's claims
+//
+// The user signs in with authboss, the usual way. The ID and access tokens are RS256-signed
+// JWTs; client applications verify them with the key published at /oidc/jwks.
+type OIDCProvider struct {
+	issuer     string
+	signingKey *rsa.PrivateKey
+	keyID      string
+
+	aboss     *authboss.Authboss
+	storer    *AuthStorer
+	templates *Templates
+	// Which signed in users can sign in to the client applications
+	access userAccess
+
+	logger *log.Logger
+}
+
+// oidcAuthRequest is an authorization request's parameters, which are passed from the
+// authorization endpoint to the consent page and back.
+type oidcAuthRequest struct {
+	client *OIDCClients
+	scopes []string
+	params url.Values
+}
+
+// makeOIDCProvider creates the OpenID Connect provider, loading (or generating) its signing
+// key and registering the client applications listed in the configuration.
+func makeOIDCProvider(cfg *ConfigData, aboss *authboss.Authboss, storer *AuthStorer, templates *Templates) (*OIDCProvider, error) {
+	provider := &OIDCProvider{
+		issuer:    strings.TrimSuffix(cfg.OIDCProvider.Issuer, "/"),
+		aboss:     aboss,
+		storer:    storer,
+		templates: templates,
+		access:    makeUserAccess(cfg),
+		logger:    log.New(os.Stdout, "[OIDC] ", log.LstdFlags),
+	}
+
+	if len(provider.issuer) == 0 {
+		provider.issuer = aboss.Config.Paths.RootURL
+	}
+
+	keyPath := cfg.OIDCProvider.SigningKey
+	if !filepath.IsAbs(keyPath) {
+		keyPath = filepath.Join(cfg.WorkedRoot, keyPath)
+	}
+
+	var err error
+	if provider.signingKey, err = provider.loadSigningKey(keyPath); err != nil {
+		return nil, err
+	}
+
+	// The key ID is derived from the public key, so that it changes when the key does.
+	publicDER, err := x509.MarshalPKIXPublicKey(&provider.signingKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(publicDER)
+	provider.keyID = base64.RawURLEncoding.EncodeToString(digest[:12])
+
+	for _, client := range cfg.OIDCProvider.Clients {
+		if err := provider.registerClient(client); err != nil {
+			return nil, err
+		}
+	}
+
+	return provider, nil
+}
+
+// loadSigningKey reads the RSA private key from the PEM file, generating the key and the file
+// if the file doesn't exist.
+func (provider *OIDCProvider) loadSigningKey(path string) (*rsa.PrivateKey, error) {
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		provider.logger.Printf("Generating token signing key %s", path)
+
+		key, err := rsa.GenerateKey(rand.Reader, oidcSigningKeyBits)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate OIDC signing key: %w", err)
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, encoded, 0600); err != nil {
+			return nil, fmt.Errorf("unable to write OIDC signing key %s: %w", path, err)
+		}
+
+		return key, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read OIDC signing key %s: %w", path, err)
+	}
+
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, fmt.Errorf("OIDC signing key %s is not a PEM file", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if rsaKey, valid := key.(*rsa.PrivateKey); valid {
+			return rsaKey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("OIDC signing key %s is not an RSA private key", path)
+}
+
+// registerClient adds (or updates) a client application from the configuration in the client
+// registry.
+func (provider *OIDCProvider) registerClient(clientData oidcClientData) error {
+	if len(clientData.ClientID) == 0 || len(clientData.RedirectURIs) == 0 {
+		return errors.New("OIDC clients need a client_id and at least one redirect URI")
+	}
+
+	client := &OIDCClients{
+		ClientID:     clientData.ClientID,
+		Name:         clientData.Name,
+		RedirectURIs: strings.Join(clientData.RedirectURIs, " "),
+	}
+
+	if len(client.Name) == 0 {
+		client.Name = client.ClientID
+	}
+
+	if len(clientData.ClientSecret) > 0 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(clientData.ClientSecret), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+
+		client.SecretHash = string(hash)
+	}
+
+	provider.logger.Printf("Registering client %s", client.ClientID)
+	return provider.storer.SaveOIDCClient(client)
+}
+
+// routes adds the provider's endpoints to the Gin router.
+func (provider *OIDCProvider) routes(engine *gin.Engine) {
+	engine.GET(oidcDiscoveryPath, provider.discovery)
+
+	endpoints := engine.Group(oidcPath)
+	endpoints.GET("/jwks", provider.jwks)
+	endpoints.GET("/authorize", provider.authorize)
+	endpoints.POST("/authorize", provider.consent)
+	endpoints.POST("/token", provider.token)
+	endpoints.GET("/userinfo", provider.userInfo)
+	endpoints.POST("/userinfo", provider.userInfo)
+}
+
+// skipCSRF is Gin middleware that exempts the token and userinfo endpoints from CSRF
+// protection. Client applications call them server-to-server, without a CSRF token, and
+// authenticate themselves instead. It has to run before the CSRF middleware.
+func (provider *OIDCProvider) skipCSRF(ctx *gin.Context) {
+	if ctx.Request.Method == http.MethodPost {
+		switch ctx.Request.URL.Path {
+		case oidcPath + "/token", oidcPath + "/userinfo":
+			ctx.Request = csrf.UnsafeSkipCheck(ctx.Request)
+		}
+	}
+}
+
+// discovery returns the discovery document, which tells client applications where the
+// endpoints are and what the provider supports.
+func (provider *OIDCProvider) discovery(ctx *gin.Context) {
+	scopes := make([]string, 0, len(oidcScopes))
+	for scope := range oidcScopes {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"issuer":                                provider.issuer,
+		"authorization_endpoint":                provider.issuer + oidcPath + "/authorize",
+		"token_endpoint":                        provider.issuer + oidcPath + "/token",
+		"userinfo_endpoint":                     provider.issuer + oidcPath + "/userinfo",
+		"jwks_uri":                              provider.issuer + oidcPath + "/jwks",
+		"scopes_supported":                      scopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{jwt.SigningMethodRS256.Alg()},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "nonce", "email", "email_verified"},
+	})
+}
+
+// jwks returns the JSON Web Key Set with the public key that verifies the tokens.
+func (provider *OIDCProvider) jwks(ctx *gin.Context) {
+	publicKey := provider.signingKey.PublicKey
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"keys": []gin.H{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": jwt.SigningMethodRS256.Alg(),
+			"kid": provider.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize is the authorization endpoint. A signed in user who already allowed the client
+// to access the requested scopes goes straight back to the client with an authorization
+// code; otherwise, the user signs in and/or sees the consent page.
+func (provider *OIDCProvider) authorize(ctx *gin.Context) {
+	request, ok := provider.parseAuthRequest(ctx, ctx.Request.URL.Query())
+	if !ok {
+		return
+	}
+
+	prompt := strings.Fields(request.params.Get("prompt"))
+
+	user := provider.currentUser(ctx)
+	if user == nil {
+		if slices.Contains(prompt, "none") {
+			provider.redirectError(ctx, request, "login_required", "the user is not signed in")
+			return
+		}
+
+		// Come back here after signing in.
+		ctx.Redirect(http.StatusFound, provider.aboss.Config.Paths.Mount+"/login?"+
+			url.Values{authboss.FormValueRedirect: {ctx.Request.URL.RequestURI()}}.Encode())
+		return
+	}
+
+	if !provider.access.allowed(user) {
+		provider.logger.Printf("%s is locked or not confirmed", user.Email)
+		provider.redirectError(ctx, request, "access_denied", "the user's account is not usable")
+		return
+	}
+
+	consented := provider.storer.GetOIDCConsent(user.GUID, request.client.ClientID)
+	needConsent := slices.Contains(prompt, "consent")
+	for _, scope := range request.scopes {
+		needConsent = needConsent || !slices.Contains(consented, scope)
+	}
+
+	if !needConsent {
+		provider.issueCode(ctx, request, user)
+		return
+	}
+
+	if slices.Contains(prompt, "none") {
+		provider.redirectError(ctx, request, "consent_required", "the user has to allow access")
+		return
+	}
+
+	scopes := make([]string, 0, len(request.scopes))
+	for _, scope := range request.scopes {
+		scopes = append(scopes, oidcScopes[scope])
+	}
+
+	params := map[string]string{}
+	for name := range request.params {
+		params[name] = request.params.Get(name)
+	}
+
+	r := ctx.Request
+	data := authboss.NewHTMLData().Merge(r.Context().Value(authboss.CTXKeyData).(authboss.HTMLData))
+	data.MergeKV(
+		"oidc_client_name", request.client.Name,
+		"oidc_scopes", scopes,
+		"oidc_params", params,
+	)
+
+	result, contentType, err := provider.templates.Render(r.Context(), PageOIDCConsent, data)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, fmt.Sprintf("template render error: %v", err))
+		return
+	}
+
+	ctx.Data(http.StatusOK, contentType, result)
+}
+
+// consent handles the consent page's form.
+func (provider *OIDCProvider) consent(ctx *gin.Context) {
+	if err := ctx.Request.ParseForm(); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	request, ok := provider.parseAuthRequest(ctx, ctx.Request.PostForm)
+	if !ok {
+		return
+	}
+
+	user := provider.currentUser(ctx)
+	if user == nil || !provider.access.allowed(user) {
+		provider.redirectError(ctx, request, "access_denied", "the user is not signed in")
+		return
+	}
+
+	if ctx.PostForm("approve") != "yes" {
+		provider.logger.Printf("%s denied access to %s", user.Email, request.client.ClientID)
+		provider.redirectError(ctx, request, "access_denied", "the user denied access")
+		return
+	}
+
+	scopes := provider.storer.GetOIDCConsent(user.GUID, request.client.ClientID)
+	for _, scope := range request.scopes {
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if err := provider.storer.PutOIDCConsent(user.GUID, request.client.ClientID, scopes); err != nil {
+		provider.logger.Printf("Unable to record consent: %v", err)
+		provider.redirectError(ctx, request, "server_error", "")
+		return
+	}
+
+	provider.issueCode(ctx, request, user)
+}
+
+// token is the token endpoint, which exchanges an authorization code for an ID token and an
+// access token. Authorization codes can only be used once, and only while the user's account is
+// usable.
+func (provider *OIDCProvider) token(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("Pragma", "no-cache")
+
+	client, err := provider.authenticateClient(ctx)
+	if err != nil {
+		provider.logger.Printf("Client authentication failed: %v", err)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return
+	}
+
+	if grantType := ctx.PostForm("grant_type"); grantType != "authorization_code" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+		return
+	}
+
+	code, err := provider.storer.UseOIDCAuthCode(oidcHash(ctx.PostForm("code")))
+	if errors.Is(err, authboss.ErrTokenNotFound) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "unknown or expired code"})
+		return
+	} else if err != nil {
+		provider.logger.Printf("Authorization code lookup failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	if code.ClientID != client.ClientID || code.RedirectURI != ctx.PostForm("redirect_uri") {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "client or redirect_uri mismatch"})
+		return
+	}
+
+	// PKCE: the code verifier has to hash to the code challenge sent to the authorization
+	// endpoint.
+	verifier := ctx.PostForm("code_verifier")
+	if len(code.CodeChallenge) > 0 || len(verifier) > 0 {
+		digest := sha256.Sum256([]byte(verifier))
+		challenge := base64.RawURLEncoding.EncodeToString(digest[:])
+
+		if len(verifier) == 0 || subtle.ConstantTimeCompare([]byte(challenge), []byte(code.CodeChallenge)) != 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+	}
+
+	user, err := provider.storer.LoadByGUID(ctx.Request.Context(), code.GUID)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "no such user"})
+		return
+	}
+
+	// The account may have been locked since the code was issued.
+	if !provider.access.allowed(user) {
+		provider.logger.Printf("%s is locked or not confirmed", user.Email)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "the user's account is not usable"})
+		return
+	}
+
+	scopes := strings.Fields(code.Scope)
+	now := time.Now()
+	expires := now.Add(oidcTokenLifetime)
+
+	idClaims := jwt.MapClaims{
+		"iss": provider.issuer,
+		"sub": user.GUID,
+		"aud": client.ClientID,
+		"iat": now.Unix(),
+		"exp": expires.Unix(),
+	}
+
+	if len(code.Nonce) > 0 {
+		idClaims["nonce"] = code.Nonce
+	}
+
+	provider.addUserClaims(idClaims, user, scopes)
+
+	idToken, err := provider.sign(idClaims, "JWT")
+	if err != nil {
+		provider.logger.Printf("Unable to sign ID token: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	tokenID, err := oidcRandomString()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	// RFC 9068 JWT access token
+	accessToken, err := provider.sign(jwt.MapClaims{
+		"iss":       provider.issuer,
+		"sub":       user.GUID,
+		"aud":       client.ClientID,
+		"client_id": client.ClientID,
+		"scope":     code.Scope,
+		"jti":       tokenID,
+		"iat":       now.Unix(),
+		"exp":       expires.Unix(),
+	}, "at+jwt")
+	if err != nil {
+		provider.logger.Printf("Unable to sign access token: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	provider.logger.Printf("Tokens issued to %s for %s", client.ClientID, user.Email)
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(oidcTokenLifetime / time.Second),
+		"id_token":     idToken,
+		"scope":        code.Scope,
+	})
+}
+
+// userInfo returns the claims about the user to whom the bearer access token was issued, as
+// long as the user's account is still usable.
+func (provider *OIDCProvider) userInfo(ctx *gin.Context) {
+	bearer, found := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if !found {
+		ctx.Header("WWW-Authenticate", `Bearer realm="`+provider.issuer+`"`)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(bearer, claims, func(token *jwt.Token) (interface{}, error) {
+		// ID tokens are signed with the same key, but they aren't access tokens.
+		if token.Header["typ"] != "at+jwt" {
+			return nil, errors.New("not an access token")
+		}
+
+		return &provider.signingKey.PublicKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}), jwt.WithIssuer(provider.issuer),
+		jwt.WithExpirationRequired())
+
+	var user *WorkedUser
+	if err == nil && token.Valid {
+		subject, _ := claims.GetSubject()
+		user, err = provider.storer.LoadByGUID(ctx.Request.Context(), subject)
+	}
+
+	// ... or since the access token was issued.
+	if err == nil && !provider.access.allowed(user) {
+		err = fmt.Errorf("%s is locked or not confirmed", user.Email)
+	}
+
+	if err != nil {
+		provider.logger.Printf("Invalid access token: %v", err)
+		ctx.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	scope, _ := claims["scope"].(string)
+	userClaims := jwt.MapClaims{"sub": user.GUID}
+	provider.addUserClaims(userClaims, user, strings.Fields(scope))
+
+	ctx.JSON(http.StatusOK, userClaims)
+}
+
+// parseAuthRequest validates an authorization request. Problems with the client or the
+// redirect URI are reported to the user, since the browser can't be sent back to the client;
+// other problems are reported to the client via the redirect URI. Returns false if the
+// request is invalid and the response has been sent.
+func (provider *OIDCProvider) parseAuthRequest(ctx *gin.Context, params url.Values) (*oidcAuthRequest, bool) {
+	client, err := provider.storer.LoadOIDCClient(params.Get("client_id"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, fmt.Sprintf("unknown client_id '%s'", params.Get("client_id")))
+		return nil, false
+	}
+
+	redirectURI := params.Get("redirect_uri")
+	if !slices.Contains(strings.Fields(client.RedirectURIs), redirectURI) {
+		ctx.String(http.StatusBadRequest, fmt.Sprintf("redirect_uri '%s' is not registered for client '%s'", redirectURI, client.ClientID))
+		return nil, false
+	}
+
+	request := &oidcAuthRequest{client: client, params: url.Values{}}
+
+	// Only keep the parameters that the flow needs, so that they can be passed through the
+	// consent page.
+	for _, name := range []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce",
+		"code_challenge", "code_challenge_method", "prompt"} {
+		if value := params.Get(name); len(value) > 0 {
+			request.params.Set(name, value)
+		}
+	}
+
+	for _, scope := range strings.Fields(params.Get("scope")) {
+		if _, supported := oidcScopes[scope]; supported && !slices.Contains(request.scopes, scope) {
+			request.scopes = append(request.scopes, scope)
+		}
+	}
+
+	switch {
+	case params.Get("response_type") != "code":
+		provider.redirectError(ctx, request, "unsupported_response_type", "only the authorization code flow is supported")
+	case !slices.Contains(request.scopes, "openid"):
+		provider.redirectError(ctx, request, "invalid_scope", "the openid scope is required")
+	case len(params.Get("code_challenge")) > 0 && params.Get("code_challenge_method") != "S256":
+		provider.redirectError(ctx, request, "invalid_request", "code_challenge_method must be S256")
+	case len(client.SecretHash) == 0 && len(params.Get("code_challenge")) == 0:
+		provider.redirectError(ctx, request, "invalid_request", "public clients have to use PKCE")
+	default:
+		return request, true
+	}
+
+	return nil, false
+}
+
+// issueCode sends the browser back to the client with a new authorization code.
+func (provider *OIDCProvider) issueCode(ctx *gin.Context, request *oidcAuthRequest, user *WorkedUser) {
+	code, err := oidcRandomString()
+	if err != nil {
+		provider.redirectError(ctx, request, "server_error", "")
+		return
+	}
+
+	err = provider.storer.AddOIDCAuthCode(&OIDCAuthCodes{
+		CodeHash:            oidcHash(code),
+		ClientID:            request.client.ClientID,
+		GUID:                user.GUID,
+		RedirectURI:         request.params.Get("redirect_uri"),
+		Scope:               strings.Join(request.scopes, " "),
+		Nonce:               request.params.Get("nonce"),
+		CodeChallenge:       request.params.Get("code_challenge"),
+		CodeChallengeMethod: request.params.Get("code_challenge_method"),
+		Expiry:              time.Now().Add(oidcCodeLifetime),
+	})
+	if err != nil {
+		provider.logger.Printf("Unable to store authorization code: %v", err)
+		provider.redirectError(ctx, request, "server_error", "")
+		return
+	}
+
+	provider.logger.Printf("Authorization code issued to %s for %s", request.client.ClientID, user.Email)
+	provider.redirect(ctx, request, url.Values{"code": {code}})
+}
+
+// redirectError sends the browser back to the client with an error.
+func (provider *OIDCProvider) redirectError(ctx *gin.Context, request *oidcAuthRequest, code, description string) {
+	values := url.Values{"error": {code}}
+	if len(description) > 0 {
+		values.Set("error_description", description)
+	}
+
+	provider.redirect(ctx, request, values)
+}
+
+// redirect sends the browser back to the client's redirect URI with the response values and
+// the client's state.
+func (provider *OIDCProvider) redirect(ctx *gin.Context, request *oidcAuthRequest, values url.Values) {
+	if state := request.params.Get("state"); len(state) > 0 {
+		values.Set("state", state)
+	}
+
+	redirectURI := request.params.Get("redirect_uri")
+	separator := "?"
+	if strings.Contains(redirectURI, "?") {
+		separator = "&"
+	}
+
+	ctx.Redirect(http.StatusFound, redirectURI+separator+values.Encode())
+}
+
+// authenticateClient checks the client's credentials at the token endpoint, either HTTP basic
+// authentication or the client_id and client_secret form values. Public clients only send
+// their client_id.
+func (provider *OIDCProvider) authenticateClient(ctx *gin.Context) (*OIDCClients, error) {
+	clientID, clientSecret, hasBasicAuth := ctx.Request.BasicAuth()
+	if hasBasicAuth {
+		// RFC 6749 2.3.1: the credentials are form-encoded before they're base64-encoded.
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = ctx.PostForm("client_id")
+		clientSecret = ctx.PostForm("client_secret")
+	}
+
+	client, err := provider.storer.LoadOIDCClient(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("unknown client '%s'", clientID)
+	}
+
+	if len(client.SecretHash) == 0 {
+		if len(clientSecret) > 0 {
+			return nil, fmt.Errorf("public client '%s' sent a secret", clientID)
+		}
+
+		return client, nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(clientSecret)); err != nil {
+		return nil, fmt.Errorf("client '%s': %w", clientID, err)
+	}
+
+	return client, nil
+}
+
+// currentUser returns the fully authenticated user (not "remembered"), or nil if the user
+// isn't signed in.
+func (provider *OIDCProvider) currentUser(ctx *gin.Context) *WorkedUser {
+	if !authboss.IsFullyAuthed(ctx.Request) {
+		return nil
+	}
+
+	abUser, err := provider.aboss.LoadCurrentUser(&ctx.Request)
+	if err != nil {
+		return nil
+	}
+
+	user, _ := abUser.(*WorkedUser)
+	return user
+}
+
+// addUserClaims adds the claims about the user that the scopes allow.
+func (provider *OIDCProvider) addUserClaims(claims jwt.MapClaims, user *WorkedUser, scopes []string) {
+	if slices.Contains(scopes, "email") {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.GetConfirmed()
+	}
+}
+
+// sign creates a signed JWT with the claims.
+func (provider *OIDCProvider) sign(claims jwt.MapClaims, tokenType string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = provider.keyID
+	token.Header["typ"] = tokenType
+
+	return token.SignedString(provider.signingKey)
+}
+
+// oidcHash hashes authorization codes for storage.
+func oidcHash(code string) string {
+	digest := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(digest[:])
+}
+
+// oidcRandomString generates authorization codes and token IDs.
+func oidcRandomString() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("unable to generate random string: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,367 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// The OIDC test clients' callbacks
+	oidcTestCallback      = "https://rp.example.com/callback"
+	oidcTestOtherCallback = "https://rp.example.com/other"
+	// The confidential client's secret
+	oidcTestSecret = "rp secret"
+)
+
+// startOIDCServer starts the worked example as an OpenID Connect provider for a confidential
+// client ("web", with a secret) and a public one ("spa", without.)
+func startOIDCServer(t *testing.T) *testServer {
+	t.Helper()
+
+	cfg := testConfig(t)
+	cfg.Features.UseOIDCProvider = true
+	cfg.OIDCProvider.Clients = []oidcClientData{
+		{ClientID: "web", ClientSecret: oidcTestSecret, RedirectURIs: []string{oidcTestCallback}},
+		{ClientID: "spa", RedirectURIs: []string{oidcTestCallback, oidcTestOtherCallback}},
+	}
+
+	return startTestServer(t, cfg)
+}
+
+// oidcChallenge returns the PKCE S256 code challenge for the verifier.
+func oidcChallenge(verifier string) string {
+	digest := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// oidcAuthorize sends the signed in client to the authorization endpoint, allows access on the
+// consent page if it shows up, and returns the response's parameters.
+func (client *testClient) oidcAuthorize(t *testing.T, params url.Values) url.Values {
+	t.Helper()
+
+	resp, _ := client.get(t, oidcPath+"/authorize?"+params.Encode())
+	if resp.StatusCode == http.StatusOK {
+		consent := url.Values{"approve": {"yes"}}
+		for name := range params {
+			consent.Set(name, params.Get(name))
+		}
+
+		resp, _ = client.postForm(t, oidcPath+"/authorize", consent)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound || !strings.HasPrefix(location.String(), params.Get("redirect_uri")+"?") {
+		t.Fatalf("authorize: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	return location.Query()
+}
+
+// oidcCode returns an authorization code for the client application.
+func (client *testClient) oidcCode(t *testing.T, clientID, verifier string) string {
+	t.Helper()
+
+	params := url.Values{
+		"client_id":     {clientID},
+		"redirect_uri":  {oidcTestCallback},
+		"response_type": {"code"},
+		"scope":         {"openid email"},
+		"state":         {"the state"},
+		"nonce":         {"the nonce"},
+	}
+
+	if len(verifier) > 0 {
+		params.Set("code_challenge", oidcChallenge(verifier))
+		params.Set("code_challenge_method", "S256")
+	}
+
+	response := client.oidcAuthorize(t, params)
+	if len(response.Get("code")) == 0 || response.Get("state") != "the state" {
+		t.Fatalf("authorize: %v", response)
+	}
+
+	return response.Get("code")
+}
+
+// oidcRequest sends a request to one of the endpoints that client applications call, and
+// decodes the JSON response.
+func (server *testServer) oidcRequest(t *testing.T, req *http.Request) (int, map[string]interface{}) {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	result := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("%s: %v", req.URL.Path, err)
+	}
+
+	return resp.StatusCode, result
+}
+
+// oidcToken exchanges an authorization code at the token endpoint. The confidential client
+// authenticates with HTTP basic authentication if the secret isn't empty.
+func (server *testServer) oidcToken(t *testing.T, form url.Values, secret string) (int, map[string]interface{}) {
+	t.Helper()
+
+	clientID := form.Get("client_id")
+	if len(secret) > 0 {
+		form.Del("client_id")
+	}
+
+	form.Set("grant_type", "authorization_code")
+	req, err := http.NewRequest(http.MethodPost, server.URL+oidcPath+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(secret) > 0 {
+		req.SetBasicAuth(clientID, secret)
+	}
+
+	return server.oidcRequest(t, req)
+}
+
+// oidcUserInfo calls the userinfo endpoint with the bearer token.
+func (server *testServer) oidcUserInfo(t *testing.T, bearer string) (int, map[string]interface{}) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+oidcPath+"/userinfo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	return server.oidcRequest(t, req)
+}
+
+// oidcTokens signs the user in to the public client and returns the ID and access tokens.
+func (client *testClient) oidcTokens(t *testing.T) (string, string) {
+	t.Helper()
+
+	verifier := "the code verifier, which is long enough for PKCE"
+	status, result := client.server.oidcToken(t, url.Values{
+		"client_id":     {"spa"},
+		"code":          {client.oidcCode(t, "spa", verifier)},
+		"redirect_uri":  {oidcTestCallback},
+		"code_verifier": {verifier},
+	}, "")
+
+	idToken, _ := result["id_token"].(string)
+	accessToken, _ := result["access_token"].(string)
+	if status != http.StatusOK || len(idToken) == 0 || len(accessToken) == 0 {
+		t.Fatalf("token: %d %v", status, result)
+	}
+
+	return idToken, accessToken
+}
+
+// unverifiedClaims returns the token's header and claims, without checking the signature.
+func unverifiedClaims(t *testing.T, token string) (map[string]interface{}, jwt.MapClaims) {
+	t.Helper()
+
+	claims := jwt.MapClaims{}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Header, claims
+}
+
+func TestOIDCCodeExchange(t *testing.T) {
+	server := startOIDCServer(t)
+	user := server.createUser(t, "rp@example.com", "secret1")
+	client := server.client(t)
+	client.signIn(t, "rp@example.com", "secret1")
+
+	verifier := "the code verifier, which is long enough for PKCE"
+	exchange := func(code, redirectURI, verifier string) (int, map[string]interface{}) {
+		return server.oidcToken(t, url.Values{
+			"client_id":     {"spa"},
+			"code":          {code},
+			"redirect_uri":  {redirectURI},
+			"code_verifier": {verifier},
+		}, "")
+	}
+
+	code := client.oidcCode(t, "spa", verifier)
+	status, result := exchange(code, oidcTestCallback, verifier)
+	if status != http.StatusOK {
+		t.Fatalf("token: %d %v", status, result)
+	}
+
+	header, claims := unverifiedClaims(t, result["id_token"].(string))
+	if header["typ"] != "JWT" || claims["sub"] != user.GUID || claims["aud"] != "spa" || claims["nonce"] != "the nonce" ||
+		claims["email"] != "rp@example.com" {
+		t.Errorf("ID token: %v %v", header, claims)
+	}
+
+	if header, _ = unverifiedClaims(t, result["access_token"].(string)); header["typ"] != "at+jwt" {
+		t.Errorf("access token: %v", header)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		if status, result := exchange(code, oidcTestCallback, verifier); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+			t.Errorf("the code was accepted twice: %d %v", status, result)
+		}
+	})
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		code := client.oidcCode(t, "spa", verifier)
+		if status, result := exchange(code, oidcTestCallback, "another code verifier"); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+			t.Errorf("token: %d %v", status, result)
+		}
+	})
+
+	t.Run("no verifier", func(t *testing.T) {
+		code := client.oidcCode(t, "spa", verifier)
+		if status, result := exchange(code, oidcTestCallback, ""); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+			t.Errorf("token: %d %v", status, result)
+		}
+	})
+
+	t.Run("redirect_uri mismatch", func(t *testing.T) {
+		// Registered for the client, but not the one that the code was issued for.
+		code := client.oidcCode(t, "spa", verifier)
+		if status, result := exchange(code, oidcTestOtherCallback, verifier); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+			t.Errorf("token: %d %v", status, result)
+		}
+	})
+
+	t.Run("another client", func(t *testing.T) {
+		code := client.oidcCode(t, "spa", verifier)
+		status, result := server.oidcToken(t, url.Values{
+			"client_id":     {"web"},
+			"code":          {code},
+			"redirect_uri":  {oidcTestCallback},
+			"code_verifier": {verifier},
+		}, oidcTestSecret)
+		if status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+			t.Errorf("token: %d %v", status, result)
+		}
+	})
+
+	t.Run("confidential client", func(t *testing.T) {
+		form := url.Values{"client_id": {"web"}, "code": {client.oidcCode(t, "web", "")}, "redirect_uri": {oidcTestCallback}}
+		if status, result := server.oidcToken(t, form, "not the secret"); status != http.StatusUnauthorized || result["error"] != "invalid_client" {
+			t.Errorf("wrong secret: %d %v", status, result)
+		}
+
+		form = url.Values{"client_id": {"web"}, "code": {client.oidcCode(t, "web", "")}, "redirect_uri": {oidcTestCallback}}
+		if status, result := server.oidcToken(t, form, oidcTestSecret); status != http.StatusOK {
+			t.Errorf("token: %d %v", status, result)
+		}
+	})
+}
+
+func TestOIDCPublicClientNeedsPKCE(t *testing.T) {
+	server := startOIDCServer(t)
+	server.createUser(t, "rp@example.com", "secret1")
+	client := server.client(t)
+	client.signIn(t, "rp@example.com", "secret1")
+
+	params := url.Values{
+		"client_id":     {"spa"},
+		"redirect_uri":  {oidcTestCallback},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}
+
+	if response := client.oidcAuthorize(t, params); response.Get("error") != "invalid_request" || len(response.Get("code")) > 0 {
+		t.Errorf("without PKCE: %v", response)
+	}
+
+	params.Set("code_challenge", "the code verifier, not its hash")
+	params.Set("code_challenge_method", "plain")
+	if response := client.oidcAuthorize(t, params); response.Get("error") != "invalid_request" || len(response.Get("code")) > 0 {
+		t.Errorf("plain PKCE: %v", response)
+	}
+}
+
+func TestOIDCUserInfoTokenType(t *testing.T) {
+	server := startOIDCServer(t)
+	server.createUser(t, "rp@example.com", "secret1")
+	client := server.client(t)
+	client.signIn(t, "rp@example.com", "secret1")
+	idToken, accessToken := client.oidcTokens(t)
+
+	if status, result := server.oidcUserInfo(t, accessToken); status != http.StatusOK || result["email"] != "rp@example.com" {
+		t.Errorf("access token: %d %v", status, result)
+	}
+
+	// Signed with the same key and for the same user, but not an access token.
+	if status, result := server.oidcUserInfo(t, idToken); status != http.StatusUnauthorized || result["error"] != "invalid_token" {
+		t.Errorf("ID token: %d %v", status, result)
+	}
+}
+
+func TestOIDCAccountNoLongerUsable(t *testing.T) {
+	server := startOIDCServer(t)
+
+	for name, change := range map[string]func(user *WorkedUser){
+		"locked":      func(user *WorkedUser) { user.PutLocked(time.Now().Add(time.Hour)) },
+		"unconfirmed": func(user *WorkedUser) { user.PutConfirmed(false) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			email := name + "@example.com"
+			server.createUser(t, email, "secret1")
+			client := server.client(t)
+			client.signIn(t, email, "secret1")
+
+			verifier := "the code verifier, which is long enough for PKCE"
+			code := client.oidcCode(t, "spa", verifier)
+			_, accessToken := client.oidcTokens(t)
+
+			user := server.loadUser(t, email)
+			change(user)
+			if err := server.storer.Save(context.Background(), user); err != nil {
+				t.Fatal(err)
+			}
+
+			status, result := server.oidcToken(t, url.Values{
+				"client_id":     {"spa"},
+				"code":          {code},
+				"redirect_uri":  {oidcTestCallback},
+				"code_verifier": {verifier},
+			}, "")
+			if status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+				t.Errorf("token: %d %v", status, result)
+			}
+
+			if status, result := server.oidcUserInfo(t, accessToken); status != http.StatusUnauthorized || result["error"] != "invalid_token" {
+				t.Errorf("userinfo: %d %v", status, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"os"
+)
+
+// isTerminal returns false: abossctl reads passwords from stdin, without a prompt, where it
+// doesn't know how to turn off the terminal's echo.
+func isTerminal(file *os.File) bool {
+	return false
+}
+
+// readHiddenLine isn't supported.
+func readHiddenLine(terminal *os.File) (string, error) {
+	return "", errors.New("password prompt not supported on this platform")
+}
@@ -0,0 +1,243 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	// PageAppUsers is the user directory (/app/users.)
+	PageAppUsers = "app_users"
+
+	// Permission that the user directory requires
+	directoryPermission = "users:read"
+	// Most users that the user directory lists
+	directoryCount = 100
+)
+
+// RBAC is role-based access control for the /app namespace. Users have roles (user_roles),
+// roles grant permissions (role_permissions). Routes require a role or a permission with the
+// Gin middleware that RequireRole and RequirePermission create:
+//
+//	appspace.GET("/reports", rbac.RequirePermission("reports:read"), reportsHandler)
+//
+// The middleware has to run after the /app middleware, which ensures that there's a signed
+// in (confirmed, unlocked) user.
+//
+// The roles and the initial role assignments are declared in the YAML configuration's "rbac"
+// section. The assignments are keyed by e-mail address, so they're only made once the address
+// is known to belong to the user: the user has to be confirmed (clicked on the confirmation
+// e-mail's link, or the OAuth2 provider verified the address.) Confirmed users get their roles
+// at startup and when they sign in.
+//
+// The user directory (/app/users) is the /app page that requires a permission.
+type RBAC struct {
+	aboss     *authboss.Authboss
+	storer    *AuthStorer
+	templates *Templates
+
+	// YAML-declared role assignments, keyed by the user's e-mail address.
+	assignments map[string][]string
+
+	logger *log.Logger
+}
+
+// makeRBAC creates the role-based access control middleware factory, saving the roles declared
+// in the configuration and applying the role assignments to the existing (confirmed) users.
+func makeRBAC(cfg *ConfigData, aboss *authboss.Authboss, storer *AuthStorer, templates *Templates) (*RBAC, error) {
+	if err := aboss.Config.Core.ViewRenderer.Load(PageAppUsers); err != nil {
+		return nil, err
+	}
+
+	rbac := &RBAC{
+		aboss:       aboss,
+		storer:      storer,
+		templates:   templates,
+		assignments: cfg.RBAC.Assignments,
+		logger:      log.New(os.Stdout, "[RBAC] ", log.LstdFlags),
+	}
+
+	// Sorted, so that startup is repeatable:
+	roleNames := make([]string, 0, len(cfg.RBAC.Roles))
+	for name := range cfg.RBAC.Roles {
+		roleNames = append(roleNames, name)
+	}
+	sort.Strings(roleNames)
+
+	for _, name := range roleNames {
+		role := cfg.RBAC.Roles[name]
+		if err := storer.SaveRole(name, role.Description, role.Permissions); err != nil {
+			return nil, fmt.Errorf("unable to save role '%s': %w", name, err)
+		}
+	}
+
+	for email, roles := range rbac.assignments {
+		for _, role := range roles {
+			if _, declared := cfg.RBAC.Roles[role]; !declared {
+				return nil, fmt.Errorf("role '%s' assigned to %s isn't declared in rbac:roles", role, email)
+			}
+		}
+
+		abUser, err := storer.Load(context.Background(), email)
+		if errors.Is(err, authboss.ErrUserNotFound) {
+			// Assigned when the user signs in.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := rbac.assign(abUser.(*WorkedUser)); err != nil {
+			return nil, err
+		}
+	}
+
+	aboss.Events.After(authboss.EventAuth, rbac.assignSignedIn)
+	aboss.Events.After(authboss.EventOAuth2, rbac.assignSignedIn)
+
+	return rbac, nil
+}
+
+// RequireRole creates Gin middleware that only lets users with the role through.
+func (rbac *RBAC) RequireRole(role string) gin.HandlerFunc {
+	return rbac.require(func(user *WorkedUser) bool {
+		return slices.Contains(user.GetRoles(), role)
+	})
+}
+
+// RequirePermission creates Gin middleware that only lets users with the permission (via one
+// of their roles) through.
+func (rbac *RBAC) RequirePermission(permission string) gin.HandlerFunc {
+	return rbac.require(func(user *WorkedUser) bool {
+		return slices.Contains(user.GetPermissions(), permission)
+	})
+}
+
+// require creates Gin middleware that responds 403 Forbidden unless allowed returns true for
+// the current user.
+func (rbac *RBAC) require(allowed func(user *WorkedUser) bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		abUser, err := rbac.aboss.LoadCurrentUser(&ctx.Request)
+		if user, valid := abUser.(*WorkedUser); err == nil && valid && allowed(user) {
+			return
+		}
+
+		if err != nil && !errors.Is(err, authboss.ErrUserNotFound) {
+			rbac.logger.Printf("Unable to load the current user: %v", err)
+		}
+
+		if wantsJSON(ctx.Request) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"status": "failure",
+				"error":  "Forbidden",
+			})
+			return
+		}
+
+		ctx.String(http.StatusForbidden, "Forbidden - you don't have access to this page")
+		ctx.Abort()
+	}
+}
+
+// routes adds the user directory to the /app group.
+func (rbac *RBAC) routes(group *gin.RouterGroup) {
+	group.GET("/users", rbac.RequirePermission(directoryPermission), rbac.directory)
+}
+
+// directory lists the users whose e-mail addresses contain the "q" query parameter, with their
+// roles.
+func (rbac *RBAC) directory(ctx *gin.Context) {
+	query := strings.TrimSpace(ctx.Query("q"))
+
+	users, total, err := rbac.storer.SearchUsers(query, 0, directoryCount)
+	if err != nil {
+		rbac.logger.Printf("Unable to search users: %v", err)
+		ctx.String(http.StatusInternalServerError, "unable to search users")
+		return
+	}
+
+	type directoryEntry struct {
+		Email string
+		Roles []string
+	}
+
+	entries := make([]directoryEntry, 0, len(users))
+	for _, userData := range users {
+		user := &WorkedUser{AuthStorer: rbac.storer, UserData: userData}
+		entries = append(entries, directoryEntry{Email: user.Email, Roles: user.GetRoles()})
+	}
+
+	r := ctx.Request
+	pageData := authboss.NewHTMLData().Merge(r.Context().Value(authboss.CTXKeyData).(authboss.HTMLData))
+	pageData.MergeKV(
+		"directory_users", entries,
+		"directory_query", query,
+		"directory_total", total,
+	)
+
+	result, contentType, err := rbac.templates.Render(r.Context(), PageAppUsers, pageData)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, fmt.Sprintf("template render error: %v", err))
+		return
+	}
+
+	ctx.Data(http.StatusOK, contentType, result)
+}
+
+// assignSignedIn applies the YAML-declared role assignments to a user who just signed in with
+// a password, a passkey or OAuth2 (authboss "after" event.)
+func (rbac *RBAC) assignSignedIn(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+	if user, valid := r.Context().Value(authboss.CTXKeyUser).(*WorkedUser); valid {
+		if err := rbac.assign(user); err != nil {
+			rbac.logger.Printf("Unable to assign roles to %s: %v", user.Email, err)
+		}
+	}
+
+	return false, nil
+}
+
+// assign gives the user the roles assigned to them in the configuration, if the user is
+// confirmed: until then, nothing says that the e-mail address is theirs.
+func (rbac *RBAC) assign(user *WorkedUser) error {
+	roles := rbac.assignments[user.Email]
+	if len(roles) > 0 && !user.GetConfirmed() {
+		rbac.logger.Printf("%s isn't confirmed, roles not assigned yet", user.Email)
+		return nil
+	}
+
+	for _, role := range roles {
+		if err := user.AddRole(role); err != nil {
+			return fmt.Errorf("unable to assign role '%s' to %s: %w", role, user.Email, err)
+		}
+
+		rbac.logger.Printf("%s has role '%s'", user.Email, role)
+	}
+
+	return nil
+}
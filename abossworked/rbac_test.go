@@ -0,0 +1,145 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// startRBACServer starts the worked example with an "auditor" role, which grants the user
+// directory's permission, assigned to auditor@example.com. The mock OAuth2 provider is on.
+func startRBACServer(t *testing.T) *testServer {
+	t.Helper()
+
+	cfg := testConfig(t)
+	cfg.Features.UseOAuth2 = true
+	cfg.OAuth2 = map[string]oauth2ProviderData{mockOAuth2ProviderName: {}}
+	cfg.RBAC = rbacData{
+		Roles: map[string]roleData{
+			"auditor": {Description: "Auditors", Permissions: []string{directoryPermission}},
+		},
+		Assignments: map[string][]string{
+			"auditor@example.com": {"auditor"},
+		},
+	}
+
+	return startTestServer(t, cfg)
+}
+
+// loadUser loads the user from the server's database.
+func (server *testServer) loadUser(t *testing.T, email string) *WorkedUser {
+	t.Helper()
+
+	abUser, err := server.storer.Load(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return abUser.(*WorkedUser)
+}
+
+// oauth2SignIn signs in with the mock OAuth2 provider as the e-mail address, which the
+// provider may or may not have verified. It returns where the callback redirects to.
+func (client *testClient) oauth2SignIn(t *testing.T, email string, verified bool) string {
+	t.Helper()
+
+	resp, _ := client.get(t, "/auth/oauth2/"+mockOAuth2ProviderName)
+	authorize, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasSuffix(authorize.Path, mockOAuth2Path+"/authorize") {
+		t.Fatalf("OAuth2 sign in: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	form := url.Values{
+		"client_id":    {authorize.Query().Get("client_id")},
+		"redirect_uri": {authorize.Query().Get("redirect_uri")},
+		"state":        {authorize.Query().Get("state")},
+		"email":        {email},
+		"approve":      {"yes"},
+	}
+	if verified {
+		form.Set("email_verified", "yes")
+	}
+
+	resp, _ = client.postForm(t, mockOAuth2Path+"/authorize", form)
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || len(callback.Query().Get("code")) == 0 {
+		t.Fatalf("mock OAuth2 authorization: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, text := client.get(t, callback.RequestURI())
+	if resp.StatusCode/100 != 3 {
+		t.Fatalf("OAuth2 callback: %d %s", resp.StatusCode, text)
+	}
+
+	return resp.Header.Get("Location")
+}
+
+func TestRBACUserDirectory(t *testing.T) {
+	server := startRBACServer(t)
+	server.createUser(t, "auditor@example.com", "auditor password")
+	server.createUser(t, "user@example.com", "user password")
+
+	// Created after startup: the auditor gets their role when they sign in.
+	auditor := server.client(t)
+	auditor.signIn(t, "auditor@example.com", "auditor password")
+	if resp, text := auditor.get(t, "/app/users"); resp.StatusCode != http.StatusOK || !strings.Contains(text, "user@example.com") {
+		t.Errorf("auditor: /app/users %d", resp.StatusCode)
+	}
+
+	user := server.client(t)
+	user.signIn(t, "user@example.com", "user password")
+	if resp, _ := user.get(t, "/app/users"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("user: /app/users %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestRBACOAuth2Assignment(t *testing.T) {
+	tests := []struct {
+		name      string
+		verified  bool
+		wantRoles []string
+	}{
+		{"verified", true, []string{"auditor"}},
+		{"unverified", false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startRBACServer(t)
+			server.client(t).oauth2SignIn(t, "auditor@example.com", test.verified)
+
+			user := server.loadUser(t, "auditor@example.com")
+			if user.GetConfirmed() != test.verified {
+				t.Errorf("confirmed %v, want %v", user.GetConfirmed(), test.verified)
+			}
+
+			if !test.verified && len(user.GetConfirmSelector()) == 0 {
+				t.Error("no confirmation e-mail for the unverified address")
+			}
+
+			if roles := user.GetRoles(); !slices.Equal(roles, test.wantRoles) {
+				t.Errorf("roles %v, want %v", roles, test.wantRoles)
+			}
+		})
+	}
+}
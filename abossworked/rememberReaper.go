@@ -0,0 +1,110 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* The remember-me token reaper.
+
+   Remember-me tokens expire after remember:max_age, and UseRememberToken won't sign anyone in
+   with an expired token. Tokens that are never used again (the browser's cookie expired, the
+   user cleared their cookies) would still stay in the remember table forever, so the reaper
+   deletes the expired tokens every remember:reap_interval.
+
+   The user session index (see activeSessions.go) has the same problem: the session store
+   deletes its expired sessions, but not their index entries. The reaper removes those, too, and
+   the JWT deny-list's entries for tokens that have expired anyway (see jwtClientState.go.)
+*/
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// rememberReaper is the goroutine that periodically deletes expired remember-me tokens (and
+// expired sessions' index entries.)
+type rememberReaper struct {
+	// Closed to stop the reaper.
+	stop chan struct{}
+	// Closed when the reaper has stopped.
+	done chan struct{}
+
+	logger *log.Logger
+}
+
+// StartRememberReaper starts the remember-me token reaper, which deletes the expired tokens and
+// the expired sessions' index entries every interval.
+func (storer *AuthStorer) StartRememberReaper(interval time.Duration) {
+	if storer.reaper != nil {
+		return
+	}
+
+	reaper := &rememberReaper{
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: log.New(os.Stdout, "[REAPER] ", log.LstdFlags),
+	}
+	storer.reaper = reaper
+
+	go func() {
+		defer close(reaper.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		reaper.logger.Printf("Reaping expired remember-me tokens and sessions every %v.", interval)
+		for {
+			// Reap once at startup, in case the demo wasn't running for a while.
+			if reaped, err := storer.ReapRememberTokens(); err != nil {
+				reaper.logger.Printf("Reaping remember-me tokens failed: %v", err)
+			} else if reaped > 0 {
+				reaper.logger.Printf("Reaped %d expired remember-me tokens.", reaped)
+			}
+
+			if reaped, err := storer.ReapUserSessions(); err != nil {
+				reaper.logger.Printf("Reaping the session index failed: %v", err)
+			} else if reaped > 0 {
+				reaper.logger.Printf("Removed %d expired sessions from the session index.", reaped)
+			}
+
+			if reaped, err := storer.ReapRevokedTokens(); err != nil {
+				reaper.logger.Printf("Reaping the JWT deny-list failed: %v", err)
+			} else if reaped > 0 {
+				reaper.logger.Printf("Removed %d expired tokens from the JWT deny-list.", reaped)
+			}
+
+			select {
+			case <-reaper.stop:
+				reaper.logger.Print("Stopped.")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopRememberReaper stops the remember-me token reaper, if it's running, and waits until it
+// has stopped.
+func (storer *AuthStorer) StopRememberReaper() {
+	if storer.reaper == nil {
+		return
+	}
+
+	close(storer.reaper.stop)
+	<-storer.reaper.done
+	storer.reaper = nil
+}
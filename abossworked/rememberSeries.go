@@ -0,0 +1,315 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	// Authboss module name: this module replaces Authboss' own remember module.
+	rememberModuleName = "remember"
+
+	// Random bytes in a series identifier and in a token
+	rememberSeriesSize = 16
+	rememberTokenSize  = 32
+
+	// How long the previous token still works after it was rotated (see RotateRememberToken)
+	rememberRotationGrace = 10 * time.Second
+
+	// Security event recorded when a stolen remember-me cookie is detected
+	securityEventRememberTheft = "remember_token_theft"
+
+	// Session key for the remember-me series that signed the session in, so that revoking the
+	// session can revoke the series too (see activeSessions.go.)
+	rememberSeriesSessionKey = "remember_series"
+)
+
+// ErrRememberTokenReused is returned by RotateRememberToken when a remember-me series is
+// presented with a token that was already used.
+var ErrRememberTokenReused = errors.New("remember-me token was already used")
+
+// RememberSeries is a replacement for Authboss' remember module that detects stolen
+// remember-me cookies. Each browser on which the user asked to be remembered gets its own
+// series; the remember-me cookie carries the user's PID, the series and the series' current
+// token, and the token rotates every time the cookie signs the user in.
+//
+// Authboss' module just swaps one token for another, so whoever presents a copy of the cookie
+// first wins and nobody notices. With a series, the loser eventually presents a token that
+// the series has already used: someone else has a copy of the cookie. RememberSeries then
+// revokes all of the user's remember-me tokens and sessions (signing out the thief as well as
+// the user) and records a security event.
+type RememberSeries struct {
+	*authboss.Authboss
+
+	storer   *AuthStorer
+	sessions SessionRevoker
+	logger   *log.Logger
+}
+
+// setupRememberSeries registers the RememberSeries module with authboss in place of Authboss'
+// remember module, if enabled in the configuration. This has to happen before ab.Init().
+func setupRememberSeries(cfg *ConfigData, ab *authboss.Authboss) {
+	if !cfg.Features.UseRemember {
+		return
+	}
+
+	authboss.RegisterModule(rememberModuleName, makeRememberSeries(ab))
+}
+
+// makeRememberSeries creates the module from the authboss instance's storage configuration.
+func makeRememberSeries(ab *authboss.Authboss) *RememberSeries {
+	storer, _ := ab.Config.Storage.Server.(*AuthStorer)
+	sessions, _ := ab.Config.Storage.SessionState.(SessionRevoker)
+
+	return &RememberSeries{
+		Authboss: ab,
+		storer:   storer,
+		sessions: sessions,
+		logger:   log.New(os.Stdout, "[REMEMBER] ", log.LstdFlags),
+	}
+}
+
+// Init the module: the same events as Authboss' remember module.
+func (rs *RememberSeries) Init(ab *authboss.Authboss) error {
+	rs.Authboss = ab
+
+	rs.Events.After(authboss.EventAuth, rs.afterAuth)
+	rs.Events.After(authboss.EventOAuth2, rs.afterAuth)
+	rs.Events.After(authboss.EventRecoverEnd, rs.afterPasswordReset)
+
+	return nil
+}
+
+// rememberSeriesMiddleware signs the user in with their remember-me cookie, if they aren't
+// signed in yet. It replaces Authboss' remember.Middleware.
+func rememberSeriesMiddleware(ab *authboss.Authboss) func(http.Handler) http.Handler {
+	rs := makeRememberSeries(ab)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id, _ := ab.CurrentUserID(r); len(id) == 0 {
+				if err := rs.authenticate(w, &r); err != nil {
+					rs.logger.Printf("Failed to authenticate user via remember me: %v", err)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// afterAuth starts a new series when the user signs in and asked to be remembered.
+func (rs *RememberSeries) afterAuth(w http.ResponseWriter, req *http.Request, handled bool) (bool, error) {
+	rmIntf := req.Context().Value(authboss.CTXKeyValues)
+	if rmIntf == nil {
+		return false, nil
+	} else if rm, ok := rmIntf.(authboss.RememberValuer); !ok || !rm.GetShouldRemember() {
+		return false, nil
+	}
+
+	user := rs.Authboss.CurrentUserP(req)
+	return false, rs.startSeries(req.Context(), w, user.GetPID())
+}
+
+// afterPasswordReset forgets the user on every browser, since a password reset should
+// invalidate all of the user's remember-me tokens.
+func (rs *RememberSeries) afterPasswordReset(w http.ResponseWriter, req *http.Request, handled bool) (bool, error) {
+	user, err := rs.Authboss.CurrentUser(req)
+	if err != nil {
+		return false, err
+	}
+
+	authboss.DelCookie(w, authboss.CookieRemember)
+	rs.logger.Printf("Deleting remember-me tokens for %s due to password reset", user.GetPID())
+
+	return false, rs.storer.DelRememberTokens(req.Context(), user.GetPID())
+}
+
+// authenticate signs the user in with the remember-me cookie, rotating its token. A cookie that
+// doesn't sign the user in is deleted.
+func (rs *RememberSeries) authenticate(w http.ResponseWriter, req **http.Request) error {
+	cookie, ok := authboss.GetCookie(*req, authboss.CookieRemember)
+	if !ok {
+		return nil
+	}
+
+	rawCookie, err := base64.URLEncoding.DecodeString(cookie)
+	if err != nil {
+		authboss.DelCookie(w, authboss.CookieRemember)
+		return nil
+	}
+
+	ctx := (*req).Context()
+	pid, series, token, isSeries := parseRememberCookie(string(rawCookie))
+
+	if isSeries {
+		newToken, err := randomRememberValue(rememberTokenSize)
+		if err != nil {
+			return err
+		}
+
+		rotated, err := rs.storer.RotateRememberToken(ctx, pid, series, token, newToken)
+		switch {
+		case errors.Is(err, ErrRememberTokenReused):
+			authboss.DelCookie(w, authboss.CookieRemember)
+			return rs.tokenTheft(ctx, pid, series, clientIP(*req))
+		case errors.Is(err, authboss.ErrTokenNotFound):
+			authboss.DelCookie(w, authboss.CookieRemember)
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if rotated {
+			authboss.PutCookie(w, authboss.CookieRemember, encodeRememberCookie(pid, series, newToken))
+		}
+
+		authboss.PutSession(w, rememberSeriesSessionKey, series)
+	} else {
+		// A cookie issued by Authboss' remember module ("pid;nonce"): Authboss stored the
+		// SHA-512 of the whole cookie. It's good for one sign in, which starts a series.
+		index := strings.IndexByte(string(rawCookie), ';')
+		if index < 0 {
+			authboss.DelCookie(w, authboss.CookieRemember)
+			return nil
+		}
+
+		pid = string(rawCookie[:index])
+		sum := sha512.Sum512(rawCookie)
+
+		err := rs.storer.UseRememberToken(ctx, pid, base64.StdEncoding.EncodeToString(sum[:]))
+		if errors.Is(err, authboss.ErrTokenNotFound) {
+			authboss.DelCookie(w, authboss.CookieRemember)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := rs.startSeries(ctx, w, pid); err != nil {
+			return err
+		}
+	}
+
+	*req = (*req).WithContext(context.WithValue(ctx, authboss.CTXKeyPID, pid))
+	authboss.PutSession(w, authboss.SessionKey, pid)
+	authboss.PutSession(w, authboss.SessionHalfAuthKey, "true")
+
+	return nil
+}
+
+// startSeries starts a new remember-me series and puts its cookie. The session remembers the
+// series, too.
+func (rs *RememberSeries) startSeries(ctx context.Context, w http.ResponseWriter, pid string) error {
+	series, err := randomRememberValue(rememberSeriesSize)
+	if err != nil {
+		return err
+	}
+
+	token, err := randomRememberValue(rememberTokenSize)
+	if err != nil {
+		return err
+	}
+
+	if err := rs.storer.AddRememberSeries(ctx, pid, series, token); err != nil {
+		return fmt.Errorf("failed to save remember-me series: %w", err)
+	}
+
+	authboss.PutCookie(w, authboss.CookieRemember, encodeRememberCookie(pid, series, token))
+	authboss.PutSession(w, rememberSeriesSessionKey, series)
+	return nil
+}
+
+// tokenTheft revokes all of the user's remember-me tokens and sessions and records the security
+// event. The user has to sign in again, and so does whoever has the copy of the cookie.
+func (rs *RememberSeries) tokenTheft(ctx context.Context, pid, series, remoteAddr string) error {
+	rs.logger.Printf("Remember-me series %s... for %s presented with a used token (from %s): revoking tokens and sessions",
+		series[:8], pid, remoteAddr)
+
+	if err := rs.storer.DelRememberTokens(ctx, pid); err != nil {
+		return err
+	}
+
+	var revoked int64
+	if rs.sessions != nil {
+		var err error
+		if revoked, err = rs.sessions.RevokeUserSessions(pid); err != nil {
+			return err
+		}
+	}
+
+	detail := fmt.Sprintf("Remember-me cookie used after it was replaced; it was probably copied. Revoked all remember-me tokens and %d sessions.", revoked)
+	return rs.storer.AddSecurityEvent(ctx, pid, securityEventRememberTheft, detail, remoteAddr)
+}
+
+// encodeRememberCookie encodes the remember-me cookie's value.
+func encodeRememberCookie(pid, series, token string) string {
+	return base64.URLEncoding.EncodeToString([]byte(pid + ";" + series + ";" + token))
+}
+
+// parseRememberCookie splits the decoded remember-me cookie into the PID, the series and the
+// token. The series and token are URL-safe base64, so they don't contain semicolons; the PID
+// (an e-mail address) might. ok is false for cookies that aren't in this format, i.e., the
+// cookies that Authboss' remember module issued.
+func parseRememberCookie(rawCookie string) (pid, series, token string, ok bool) {
+	tokenIndex := strings.LastIndexByte(rawCookie, ';')
+	if tokenIndex < 0 {
+		return "", "", "", false
+	}
+
+	seriesIndex := strings.LastIndexByte(rawCookie[:tokenIndex], ';')
+	if seriesIndex < 1 {
+		return "", "", "", false
+	}
+
+	pid, series, token = rawCookie[:seriesIndex], rawCookie[seriesIndex+1:tokenIndex], rawCookie[tokenIndex+1:]
+	if !isRememberValue(series, rememberSeriesSize) || !isRememberValue(token, rememberTokenSize) {
+		return "", "", "", false
+	}
+
+	return pid, series, token, true
+}
+
+// randomRememberValue generates a series identifier or token: size random bytes, URL-safe
+// base64 encoded.
+func randomRememberValue(size int) (string, error) {
+	value := make([]byte, size)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(value), nil
+}
+
+// isRememberValue checks that value could have come from randomRememberValue(size).
+func isRememberValue(value string, size int) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	return err == nil && len(decoded) == size
+}
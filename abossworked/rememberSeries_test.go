@@ -0,0 +1,152 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"testing"
+	"time"
+)
+
+// rememberSeries returns the user's remember-me series.
+func (server *testServer) rememberSeries(t *testing.T, user *WorkedUser) []RememberMeTokens {
+	t.Helper()
+
+	var series []RememberMeTokens
+	if err := server.storer.UserDB.Where("guid = ?", user.GUID).Find(&series).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return series
+}
+
+// backdateRemember sets the time column (rotated_at, expires_at) of the user's remember-me
+// series to the time that was age ago.
+func (server *testServer) backdateRemember(t *testing.T, user *WorkedUser, column string, age time.Duration) {
+	t.Helper()
+
+	tx := server.storer.UserDB.Model(&RememberMeTokens{}).Where("guid = ?", user.GUID).Update(column, time.Now().UTC().Add(-age))
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+}
+
+// theftEvents returns the user's remember_token_theft security events.
+func (server *testServer) theftEvents(t *testing.T, user *WorkedUser) []SecurityEvents {
+	t.Helper()
+
+	var events []SecurityEvents
+	tx := server.storer.UserDB.Where("guid = ? AND event = ?", user.GUID, securityEventRememberTheft).Find(&events)
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+
+	return events
+}
+
+func TestRememberTokenTheft(t *testing.T) {
+	server := startTestServer(t, testConfig(t))
+	user := server.createUser(t, "user@example.com", "user password")
+
+	victim := server.remembered(t, "user@example.com", "user password")
+	thief := server.client(t)
+	victim.copyCookies(thief)
+
+	// Another browser that the user asked to be remembered on, and one signed in with the
+	// password
+	laptop := server.remembered(t, "user@example.com", "user password")
+	signedIn := server.client(t)
+	signedIn.signIn(t, "user@example.com", "user password")
+
+	// The thief gets there first and rotates the token; the victim's token is the previous one.
+	if !thief.signedIn(t) {
+		t.Fatal("the copied remember-me cookie didn't sign in")
+	}
+
+	server.backdateRemember(t, user, "rotated_at", 2*rememberRotationGrace)
+	if victim.signedIn(t) {
+		t.Error("the reused remember-me token signed in")
+	}
+
+	for name, client := range map[string]*testClient{"thief": thief, "laptop": laptop, "password": signedIn} {
+		if client.signedIn(t) {
+			t.Errorf("%s still signed in after the theft was detected", name)
+		}
+	}
+
+	if series := server.rememberSeries(t, user); len(series) > 0 {
+		t.Errorf("remember-me series left: %d", len(series))
+	}
+
+	if events := server.theftEvents(t, user); len(events) != 1 {
+		t.Errorf("%d %s events", len(events), securityEventRememberTheft)
+	}
+}
+
+func TestRememberRotationGrace(t *testing.T) {
+	server := startTestServer(t, testConfig(t))
+	user := server.createUser(t, "user@example.com", "user password")
+
+	// The browser's concurrent requests carry the same cookie.
+	browser := server.remembered(t, "user@example.com", "user password")
+	concurrent := server.client(t)
+	browser.copyCookies(concurrent)
+	late := server.client(t)
+	browser.copyCookies(late)
+
+	if !browser.signedIn(t) {
+		t.Fatal("the remember-me cookie didn't sign in")
+	}
+
+	if !concurrent.signedIn(t) {
+		t.Error("the previous token didn't sign in within the grace period")
+	}
+
+	if series := server.rememberSeries(t, user); len(series) != 1 || len(server.theftEvents(t, user)) > 0 {
+		t.Fatalf("the previous token within the grace period: %d series, %d events", len(series), len(server.theftEvents(t, user)))
+	}
+
+	// The same token after the grace period is a stolen copy.
+	server.backdateRemember(t, user, "rotated_at", rememberRotationGrace+time.Second)
+	if late.signedIn(t) {
+		t.Error("the previous token signed in after the grace period")
+	}
+
+	if events := server.theftEvents(t, user); len(events) != 1 {
+		t.Errorf("%d %s events", len(events), securityEventRememberTheft)
+	}
+}
+
+func TestRememberExpiredSeries(t *testing.T) {
+	server := startTestServer(t, testConfig(t))
+	user := server.createUser(t, "user@example.com", "user password")
+
+	browser := server.remembered(t, "user@example.com", "user password")
+	server.backdateRemember(t, user, "expires_at", time.Minute)
+
+	if browser.signedIn(t) {
+		t.Error("the expired series signed in")
+	}
+
+	if series := server.rememberSeries(t, user); len(series) > 0 {
+		t.Errorf("the expired series wasn't deleted: %d series", len(series))
+	}
+
+	if events := server.theftEvents(t, user); len(events) > 0 {
+		t.Errorf("%d %s events for an expired series", len(events), securityEventRememberTheft)
+	}
+}
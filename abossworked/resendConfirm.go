@@ -0,0 +1,206 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volatiletech/authboss/v3"
+	"github.com/volatiletech/authboss/v3/confirm"
+)
+
+const (
+	// PageConfirmResend is the page where users ask for another confirmation e-mail.
+	PageConfirmResend = "confirm_resend"
+
+	// Where the page is, inside Authboss' /auth namespace
+	confirmResendPath = "/confirm/resend"
+
+	// What the user sees after asking, whether or not an e-mail was sent: the page doesn't
+	// tell anyone which addresses have unconfirmed accounts.
+	confirmResendSent = "If that address belongs to an account that isn't confirmed yet, a new confirmation e-mail is on its way."
+)
+
+// ResendConfirmation sends another confirmation e-mail to users who lost theirs: the confirm
+// module only sends one when the user registers, and confirm.Middleware and the sign in page
+// just keep telling an unconfirmed user to check their e-mail.
+//
+// Each new e-mail comes with a new confirmation token (confirm.StartConfirmation stores a new
+// selector and verifier), so the links in the earlier e-mails stop working. An account gets at
+// most one e-mail per confirm:resend_account_cooldown (counting the one sent when the user
+// registered), and an address can ask at most once per confirm:resend_ip_cooldown (the
+// client's address, see hoistClientIP, not the reverse proxy's.) The cooldowns are kept in
+// memory.
+type ResendConfirmation struct {
+	aboss   *authboss.Authboss
+	confirm *confirm.Confirm
+
+	accountCooldown time.Duration
+	ipCooldown      time.Duration
+
+	// When each account ("account:" + PID) and client address ("ip:" + address) can ask again
+	mutex sync.Mutex
+	until map[string]time.Time
+
+	logger *log.Logger
+}
+
+// makeResendConfirmation creates the resend confirmation page's handlers. Call it after
+// configureAuthboss (the confirm module has to be loaded.)
+func makeResendConfirmation(cfg *ConfigData, aboss *authboss.Authboss) (*ResendConfirmation, error) {
+	if err := aboss.Config.Core.ViewRenderer.Load(PageConfirmResend); err != nil {
+		return nil, err
+	}
+
+	resend := &ResendConfirmation{
+		aboss:           aboss,
+		confirm:         &confirm.Confirm{Authboss: aboss},
+		accountCooldown: cfg.Confirm.ResendAccountCooldown,
+		ipCooldown:      cfg.Confirm.ResendIPCooldown,
+		until:           map[string]time.Time{},
+		logger:          log.New(os.Stdout, "[CONFIRM] ", log.LstdFlags),
+	}
+
+	// The confirmation e-mail sent when the user registers starts the account's cooldown.
+	aboss.Events.After(authboss.EventRegister, resend.afterRegister)
+
+	return resend, nil
+}
+
+// routes adds the resend confirmation page to the authboss router (/auth/confirm/resend.)
+func (resend *ResendConfirmation) routes(router authboss.Router) {
+	router.Get(confirmResendPath, resend.aboss.Core.ErrorHandler.Wrap(resend.get))
+	router.Post(confirmResendPath, resend.aboss.Core.ErrorHandler.Wrap(resend.post))
+}
+
+// get renders the resend confirmation page.
+func (resend *ResendConfirmation) get(w http.ResponseWriter, r *http.Request) error {
+	return resend.aboss.Core.Responder.Respond(w, r, http.StatusOK, PageConfirmResend, nil)
+}
+
+// post sends a new confirmation e-mail to the address in the "email" form value (or JSON
+// body), if it belongs to an unconfirmed account and neither cooldown is in the way.
+func (resend *ResendConfirmation) post(w http.ResponseWriter, r *http.Request) error {
+	email, err := confirmResendEmail(r)
+	if err != nil {
+		return err
+	}
+
+	if len(email) == 0 {
+		return resend.aboss.Core.Responder.Respond(w, r, http.StatusOK, PageConfirmResend, authboss.HTMLData{
+			authboss.DataErr: "Please enter your e-mail address.",
+		})
+	}
+
+	remoteAddr := clientIP(r)
+	if !resend.allow("ip:"+remoteAddr, resend.ipCooldown) {
+		resend.logger.Printf("%s asked again too soon.", remoteAddr)
+		return resend.aboss.Core.Redirector.Redirect(w, r, authboss.RedirectOptions{
+			Code:         http.StatusTemporaryRedirect,
+			RedirectPath: resend.aboss.Config.Paths.Mount + confirmResendPath,
+			Failure:      "Please wait a little while before asking for another confirmation e-mail.",
+		})
+	}
+
+	ro := authboss.RedirectOptions{
+		Code:         http.StatusTemporaryRedirect,
+		RedirectPath: resend.aboss.Config.Paths.ConfirmNotOK,
+		Success:      confirmResendSent,
+	}
+
+	abUser, err := resend.aboss.Config.Storage.Server.Load(r.Context(), email)
+	if errors.Is(err, authboss.ErrUserNotFound) {
+		resend.logger.Printf("%s asked for %s, which isn't an account.", remoteAddr, email)
+		return resend.aboss.Core.Redirector.Redirect(w, r, ro)
+	} else if err != nil {
+		return err
+	}
+
+	user := authboss.MustBeConfirmable(abUser)
+	if user.GetConfirmed() {
+		resend.logger.Printf("%s asked for %s, which is already confirmed.", remoteAddr, email)
+		return resend.aboss.Core.Redirector.Redirect(w, r, ro)
+	}
+
+	if !resend.allow("account:"+user.GetPID(), resend.accountCooldown) {
+		resend.logger.Printf("%s asked for %s too soon.", remoteAddr, email)
+		return resend.aboss.Core.Redirector.Redirect(w, r, ro)
+	}
+
+	// New selector and verifier (the old link stops working), and the e-mail.
+	if err := resend.confirm.StartConfirmation(r.Context(), user, true); err != nil {
+		return err
+	}
+
+	resend.logger.Printf("Sent %s a new confirmation e-mail (asked by %s.)", email, remoteAddr)
+	return resend.aboss.Core.Redirector.Redirect(w, r, ro)
+}
+
+// afterRegister starts the new user's cooldown: they've just been sent a confirmation e-mail.
+func (resend *ResendConfirmation) afterRegister(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+	if user, valid := r.Context().Value(authboss.CTXKeyUser).(authboss.User); valid {
+		resend.allow("account:"+user.GetPID(), resend.accountCooldown)
+	}
+
+	return handled, nil
+}
+
+// allow returns true and starts the key's cooldown, unless the key's cooldown hasn't ended yet.
+// It also forgets the cooldowns that have ended.
+func (resend *ResendConfirmation) allow(key string, cooldown time.Duration) bool {
+	resend.mutex.Lock()
+	defer resend.mutex.Unlock()
+
+	now := time.Now()
+	for other, until := range resend.until {
+		if !now.Before(until) {
+			delete(resend.until, other)
+		}
+	}
+
+	if _, waiting := resend.until[key]; waiting {
+		return false
+	}
+
+	resend.until[key] = now.Add(cooldown)
+	return true
+}
+
+// confirmResendEmail returns the e-mail address from the form or the JSON body.
+func confirmResendEmail(r *http.Request) (string, error) {
+	if sentJSON(r) {
+		var body struct {
+			Email string `json:"email"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(body.Email), nil
+	}
+
+	return strings.TrimSpace(r.FormValue("email")), nil
+}
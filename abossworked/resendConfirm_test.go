@@ -0,0 +1,79 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// forwardedFor is a reverse proxy in front of the test client: it sets X-Forwarded-For.
+type forwardedFor struct {
+	client string
+}
+
+func (proxy *forwardedFor) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Forwarded-For", proxy.client)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestResendConfirmationIPCooldown(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		// Whether the second visitor, behind the same proxy, may ask right after the first
+		allowed bool
+	}{
+		{name: "trusted proxy", trusted: []string{"127.0.0.1"}, allowed: true},
+		{name: "untrusted proxy", trusted: nil, allowed: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.TrustedProxies = test.trusted
+			server := startTestServer(t, cfg)
+
+			// ask returns true if the visitor's request wasn't turned down by the cooldown.
+			ask := func(visitor string) bool {
+				t.Helper()
+
+				client := server.client(t)
+				client.Transport = &forwardedFor{client: visitor}
+				resp, _ := client.postForm(t, "/auth"+confirmResendPath, url.Values{"email": {"nobody@example.com"}})
+				if resp.StatusCode/100 != 3 {
+					t.Fatalf("resend confirmation: %d", resp.StatusCode)
+				}
+
+				return resp.Header.Get("Location") != "/auth"+confirmResendPath
+			}
+
+			if !ask("203.0.113.1") {
+				t.Fatal("the first visitor was turned down")
+			}
+			if ask("203.0.113.1") {
+				t.Error("the first visitor asked again right away")
+			}
+			if allowed := ask("203.0.113.2"); allowed != test.allowed {
+				t.Errorf("second visitor allowed: %v, want %v", allowed, test.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* Session backends.
+
+   SessionStore (ginRouter.go) keeps its sessions in one of the gin-contrib session stores,
+   selected by sessions:backend:
+
+   - "cookie": the whole session lives in the browser, in an encrypted cookie.
+   - "gorm": the user database's sessions table (github.com/wader/gormstore.) The default.
+   - "memory": the server's memory (github.com/quasoft/memstore.) Sessions are lost when the
+     server restarts and nothing removes the abandoned ones; it's for trying things out.
+   - "redis": a Redis server (sessions:redis.)
+
+   Every backend identifies a session by an ID, which is what the user session index (see
+   activeSessions.go) and session ID regeneration (see regeneratingStore) rely on. The server
+   side backends generate the ID and put it in the cookie. The cookie backend has nothing on the
+   server, so cookieBackend keeps an ID inside the session itself. Deleting a cookie session on
+   the server isn't possible either: a revoked cookie session is signed out because it's no
+   longer in the user session index (see ActiveSessions.verify.)
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	gsessions "github.com/gin-contrib/sessions"
+	gcookie "github.com/gin-contrib/sessions/cookie"
+	gsqlite "github.com/gin-contrib/sessions/gorm"
+	gmemstore "github.com/gin-contrib/sessions/memstore"
+	gredis "github.com/gin-contrib/sessions/redis"
+	gcontext "github.com/gorilla/context"
+	"github.com/gorilla/securecookie"
+	gorilla "github.com/gorilla/sessions"
+	"gorm.io/gorm"
+)
+
+const (
+	sessionBackendCookie = "cookie"
+	sessionBackendGORM   = "gorm"
+	sessionBackendMemory = "memory"
+	sessionBackendRedis  = "redis"
+
+	// The cookie backend's session ID, inside the session.
+	sessionIDKey = "session_id"
+
+	// Connections in the Redis connection pool.
+	redisPoolSize = 10
+)
+
+// sessionBackend is a gin-contrib session store that SessionStore can also delete sessions
+// from, to revoke them and to regenerate their IDs.
+type sessionBackend interface {
+	gsessions.Store
+
+	// deleteSession deletes the session with the ID. r is the request that's using the session,
+	// when the session is deleted to give it a new ID, otherwise nil.
+	deleteSession(r *http.Request, sessionID string) error
+	// serverSide is true if the backend keeps the sessions, i.e., deleting a session signs
+	// out whoever was using it.
+	serverSide() bool
+}
+
+// makeSessionBackend creates the session backend named in the configuration's
+// sessions:backend. The session seed signs the cookies; the cookie backend also encrypts its
+// cookies with a key derived from the seed.
+func makeSessionBackend(cfg *ConfigData, storer *AuthStorer, sessionSeed []byte) (sessionBackend, error) {
+	switch cfg.Sessions.Backend {
+	case sessionBackendCookie:
+		mac := hmac.New(sha256.New, sessionSeed)
+		mac.Write([]byte("session cookie encryption"))
+
+		return &cookieBackend{Store: gcookie.NewStore(sessionSeed, mac.Sum(nil))}, nil
+	case sessionBackendGORM:
+		return &gormBackend{
+			Store: gsqlite.NewStore(storer.UserDB, true, sessionSeed, nil),
+			db:    storer.UserDB,
+		}, nil
+	case sessionBackendMemory:
+		return &keyValueBackend{Store: gmemstore.NewStore(sessionSeed, nil)}, nil
+	case sessionBackendRedis:
+		redisCfg := cfg.Sessions.Redis
+		if len(redisCfg.Address) == 0 {
+			return nil, fmt.Errorf("the redis session backend needs sessions:redis:address")
+		}
+
+		store, err := gredis.NewStoreWithDB(redisPoolSize, "tcp", redisCfg.Address, redisCfg.Password,
+			strconv.Itoa(redisCfg.DB), sessionSeed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to Redis at %s: %w", redisCfg.Address, err)
+		}
+
+		return &keyValueBackend{Store: store, persistent: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown session backend '%s'", cfg.Sessions.Backend)
+	}
+}
+
+// gormBackend keeps the sessions in the user database.
+type gormBackend struct {
+	gsqlite.Store
+	db *gorm.DB
+}
+
+func (backend *gormBackend) deleteSession(r *http.Request, sessionID string) error {
+	if err := backend.db.Where("id = ?", sessionID).Delete(&sessionRecord{}).Error; err != nil {
+		return err
+	}
+
+	// The GORM store remembers the session's row in the request's (Gorilla) context and only
+	// generates an ID for a session without one.
+	if r != nil {
+		gcontext.Clear(r)
+	}
+
+	return nil
+}
+
+func (backend *gormBackend) serverSide() bool {
+	return true
+}
+
+// keyValueBackend keeps the sessions in a key-value store, keyed by session ID: memory or
+// Redis. Both delete a session when it's saved with a negative MaxAge.
+type keyValueBackend struct {
+	gsessions.Store
+
+	// The sessions survive a server restart.
+	persistent bool
+}
+
+func (backend *keyValueBackend) deleteSession(r *http.Request, sessionID string) error {
+	session := gorilla.NewSession(backend, "")
+	session.ID = sessionID
+	session.Options = &gorilla.Options{MaxAge: -1}
+
+	// The deleted session's cookie doesn't go anywhere.
+	return backend.Store.Save(r, &noResponse{header: http.Header{}}, session)
+}
+
+func (backend *keyValueBackend) serverSide() bool {
+	return true
+}
+
+// cookieBackend keeps the sessions in encrypted cookies, with the session's ID inside the
+// session.
+type cookieBackend struct {
+	gcookie.Store
+}
+
+// New decodes the session from its cookie and restores its ID.
+func (backend *cookieBackend) New(r *http.Request, name string) (*gorilla.Session, error) {
+	session, err := backend.Store.New(r, name)
+	if session != nil {
+		session.ID, _ = session.Values[sessionIDKey].(string)
+	}
+
+	return session, err
+}
+
+// Save encodes the session into its cookie, giving it an ID if it doesn't have one.
+func (backend *cookieBackend) Save(r *http.Request, w http.ResponseWriter, session *gorilla.Session) error {
+	if session.Options.MaxAge >= 0 {
+		if len(session.ID) == 0 {
+			session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+		}
+
+		session.Values[sessionIDKey] = session.ID
+	}
+
+	return backend.Store.Save(r, w, session)
+}
+
+// deleteSession does nothing: the session is in the browser's cookie.
+func (backend *cookieBackend) deleteSession(r *http.Request, sessionID string) error {
+	return nil
+}
+
+func (backend *cookieBackend) serverSide() bool {
+	return false
+}
+
+// noResponse is the response writer for deleting a session outside of the request that uses
+// it, e.g., revoking it. There's no browser to send the session's cookie to.
+type noResponse struct {
+	header http.Header
+}
+
+func (w *noResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *noResponse) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *noResponse) WriteHeader(statusCode int) {}
+
+// regeneratingStore wraps the session backend so that a session can get a new ID: when the
+// user signs in (or out), SessionStore.WriteState marks the session and the store saves it
+// under a new ID and deletes the old one. Otherwise, whoever planted the session ID in the
+// user's browser before the user signed in (session fixation) would be signed in, too.
+type regeneratingStore struct {
+	sessionBackend
+
+	// The old ID's user session index entry goes, too.
+	storer *AuthStorer
+}
+
+// Get returns the request's session, from the request's session registry.
+func (st *regeneratingStore) Get(r *http.Request, name string) (*gorilla.Session, error) {
+	return gorilla.GetRegistry(r).Get(st, name)
+}
+
+// New loads the session from the backend, as a session that's saved through this store.
+func (st *regeneratingStore) New(r *http.Request, name string) (*gorilla.Session, error) {
+	loaded, err := st.sessionBackend.New(r, name)
+
+	session := gorilla.NewSession(st, name)
+	if loaded != nil {
+		session.ID = loaded.ID
+		session.Values = loaded.Values
+		session.Options = loaded.Options
+		session.IsNew = loaded.IsNew
+	}
+
+	return session, err
+}
+
+// Save saves the session, under a new ID if it's marked for it.
+func (st *regeneratingStore) Save(r *http.Request, w http.ResponseWriter, session *gorilla.Session) error {
+	if regenerate, _ := session.Values[sessionRegenerateKey].(bool); regenerate {
+		delete(session.Values, sessionRegenerateKey)
+
+		if len(session.ID) > 0 {
+			if err := st.sessionBackend.deleteSession(r, session.ID); err != nil {
+				return err
+			}
+
+			if err := st.storer.DelUserSession(session.ID); err != nil {
+				return err
+			}
+		}
+
+		session.ID = ""
+		session.IsNew = true
+	}
+
+	return st.sessionBackend.Save(r, w, session)
+}
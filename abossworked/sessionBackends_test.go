@@ -0,0 +1,182 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// TestSessionBackends runs the same sign in, sign out and revocation steps with every session
+// backend; miniredis stands in for the Redis server.
+func TestSessionBackends(t *testing.T) {
+	redis := miniredis.RunT(t)
+
+	for _, backend := range []string{sessionBackendCookie, sessionBackendGORM, sessionBackendMemory, sessionBackendRedis} {
+		t.Run(backend, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Sessions.Backend = backend
+			cfg.Sessions.Redis = redisData{Address: redis.Addr()}
+
+			server := startTestServer(t, cfg)
+			server.createUser(t, "user@example.com", "user password")
+
+			t.Run("state", func(t *testing.T) { testSessionState(t, server) })
+			t.Run("regeneration", func(t *testing.T) { testSessionRegeneration(t, server) })
+			t.Run("revocation", func(t *testing.T) { testSessionRevocation(t, server) })
+		})
+	}
+}
+
+func TestSessionBackendConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		address string
+	}{
+		{"unknown backend", "file", ""},
+		{"redis without an address", sessionBackendRedis, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Sessions.Backend = test.backend
+			cfg.Sessions.Redis = redisData{Address: test.address}
+
+			if _, err := makeSessionBackend(cfg, nil, []byte(testSeed(t, 64))); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+// testSessionState signs in (SessionStore.WriteState puts the user in the session), then
+// checks that the next requests find the user in the session (ReadState), until signing out.
+func testSessionState(t *testing.T, server *testServer) {
+	browser := server.client(t)
+	if browser.signedIn(t) {
+		t.Fatal("signed in before signing in")
+	}
+
+	browser.signIn(t, "user@example.com", "user password")
+	for i := 0; i < 2; i++ {
+		if !browser.signedIn(t) {
+			t.Fatalf("request %d after signing in: not signed in", i+1)
+		}
+	}
+
+	browser.get(t, "/auth/logout")
+	if browser.signedIn(t) {
+		t.Error("signed in after signing out")
+	}
+}
+
+// testSessionRegeneration checks that signing in and out gives the session a new ID, so that
+// neither a session planted before signing in nor a copy of the signed in session's cookie
+// made before signing out is signed in.
+func testSessionRegeneration(t *testing.T, server *testServer) {
+	// The session that an attacker plants: /app saves a session for the redirect back to it
+	// after signing in.
+	browser := server.client(t)
+	browser.get(t, "/app/")
+	planted := server.client(t)
+	browser.copyCookies(planted)
+
+	browser.signIn(t, "user@example.com", "user password")
+	if !browser.signedIn(t) {
+		t.Fatal("not signed in")
+	}
+
+	if planted.signedIn(t) {
+		t.Error("planted session signed in")
+	}
+
+	stolen := server.client(t)
+	browser.copyCookies(stolen)
+	if !stolen.signedIn(t) {
+		t.Fatal("copied session cookie isn't signed in")
+	}
+
+	browser.get(t, "/auth/logout")
+	if stolen.signedIn(t) {
+		t.Error("copy of the session cookie still signed in after signing out")
+	}
+}
+
+// testSessionRevocation revokes one of the user's sessions, then all of them.
+func testSessionRevocation(t *testing.T, server *testServer) {
+	first := server.client(t)
+	first.signIn(t, "user@example.com", "user password")
+	firstIDs := server.userSessionIDs(t, "user@example.com")
+
+	second := server.client(t)
+	second.signIn(t, "user@example.com", "user password")
+
+	var secondID string
+	for _, sessionID := range server.userSessionIDs(t, "user@example.com") {
+		if !slices.Contains(firstIDs, sessionID) {
+			secondID = sessionID
+		}
+	}
+
+	third := server.client(t)
+	third.signIn(t, "user@example.com", "user password")
+
+	resp, _ := first.postForm(t, "/app/user/sessions/revoke", url.Values{"session": {sessionHandle(secondID)}})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("revoke: %d", resp.StatusCode)
+	}
+
+	if signedIn := []bool{first.signedIn(t), second.signedIn(t), third.signedIn(t)}; !slices.Equal(signedIn, []bool{true, false, true}) {
+		t.Errorf("signed in after revoking the second session: %v", signedIn)
+	}
+
+	first.postForm(t, "/app/user/sessions/revoke-all", nil)
+	for i, client := range []*testClient{first, second, third} {
+		if client.signedIn(t) {
+			t.Errorf("client %d signed in after signing out everywhere", i+1)
+		}
+	}
+
+	if sessionIDs := server.userSessionIDs(t, "user@example.com"); len(sessionIDs) > 0 {
+		t.Errorf("sessions left in the index: %v", sessionIDs)
+	}
+}
+
+// userSessionIDs returns the IDs of the user's sessions in the user session index.
+func (server *testServer) userSessionIDs(t *testing.T, email string) []string {
+	t.Helper()
+
+	sessionIDs, err := server.storer.UserSessionIDs(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sessionIDs
+}
+
+// copyCookies copies the client's cookies (the session) to another client.
+func (client *testClient) copyCookies(to *testClient) {
+	serverURL, _ := url.Parse(client.server.URL)
+	to.Jar.SetCookies(serverURL, client.Jar.Cookies(serverURL))
+}
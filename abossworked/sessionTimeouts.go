@@ -0,0 +1,174 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* Session timeouts.
+
+   A signed in session ends after sessions:idle_timeout without a request, and
+   sessions:max_lifetime after the user signed in, even if it's in use. The session carries
+   when the user signed in and when it was last used (SessionStore.WriteState stamps both
+   when the user signs in); SessionTimeouts.enforce checks them before Authboss loads the
+   session and keeps the last activity stamp current.
+
+   The session cookie (and the session store's row) lasts max_lifetime, so the idle timeout is
+   enforced here, not by the browser.
+*/
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	gsessions "github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/authboss/v3"
+)
+
+const (
+	// Session keys for when the user signed in and when the session was last used (Unix
+	// time, in seconds.)
+	sessionSignedInKey   = "session_signed_in"
+	sessionLastActiveKey = "session_last_active"
+
+	// How often the last activity stamp is updated, i.e., how often a request saves the
+	// session just to say that it's still in use.
+	sessionActivityResolution = time.Minute
+)
+
+// SessionTimeouts enforces the idle timeout and the maximum lifetime of signed in sessions.
+type SessionTimeouts struct {
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	warnBefore  time.Duration
+
+	// Where a timed out page request goes: Authboss' login page.
+	loginPath string
+
+	logger *log.Logger
+}
+
+// makeSessionTimeouts creates the session timeout middleware from the configuration.
+func makeSessionTimeouts(cfg *ConfigData, aboss *authboss.Authboss) *SessionTimeouts {
+	return &SessionTimeouts{
+		idleTimeout: cfg.Sessions.IdleTimeout,
+		maxLifetime: cfg.Sessions.MaxLifetime,
+		warnBefore:  cfg.Sessions.WarnBefore,
+		loginPath:   aboss.Config.Paths.Mount + "/login",
+		logger:      log.New(os.Stdout, "[SESSION] ", log.LstdFlags),
+	}
+}
+
+// enforce is Gin middleware that signs the user out of a session that was idle too long or
+// has reached its maximum lifetime, and otherwise records the session's activity. It has to run
+// after the session middleware and before aboss.LoadClientStateMiddleware.
+func (timeouts *SessionTimeouts) enforce(ctx *gin.Context) {
+	session := gsessions.Default(ctx)
+	if pid, _ := session.Get(authboss.SessionKey).(string); len(pid) == 0 {
+		return
+	}
+
+	now := time.Now()
+	signedIn, lastActive, stamped := sessionStamps(session)
+	expired := false
+
+	switch {
+	case !stamped:
+		// Signed in before sessions were stamped: start the clocks now.
+		session.Set(sessionSignedInKey, now.Unix())
+		session.Set(sessionLastActiveKey, now.Unix())
+	case now.Sub(signedIn) >= timeouts.maxLifetime:
+		timeouts.expire(session, "Your session reached its maximum lifetime. Please sign in again.")
+		expired = true
+	case now.Sub(lastActive) >= timeouts.idleTimeout:
+		timeouts.expire(session, "You were signed out after a period of inactivity. Please sign in again.")
+		expired = true
+	case now.Sub(lastActive) >= sessionActivityResolution:
+		session.Set(sessionLastActiveKey, now.Unix())
+	default:
+		return
+	}
+
+	if err := session.Save(); err != nil {
+		timeouts.logger.Printf("Unable to save the session: %v", err)
+	}
+
+	// Send a page request straight to the login page. Otherwise, the flash message doesn't
+	// survive: this request's template data takes it, and Authboss' own redirect to the login
+	// page (for the protected pages) replaces it.
+	if expired && ctx.Request.Method == http.MethodGet && !wantsJSON(ctx.Request) {
+		ctx.Redirect(http.StatusFound, timeouts.loginPath+"?redir="+url.QueryEscape(ctx.Request.URL.RequestURI()))
+		ctx.Abort()
+	}
+}
+
+// expire signs the user out of the session, leaving a flash message for the next page. The
+// session gets a new ID, too.
+func (timeouts *SessionTimeouts) expire(session gsessions.Session, message string) {
+	pid, _ := session.Get(authboss.SessionKey).(string)
+	timeouts.logger.Printf("Session for %s expired: %s", pid, message)
+
+	session.Clear()
+	session.Set(sessionRegenerateKey, true)
+	session.Set(authboss.FlashErrorKey, message)
+}
+
+// htmlData returns the template variables that let pages warn the user before their session
+// ends:
+//
+//   - session_expires_in: seconds until the session ends if the user does nothing.
+//   - session_ends: why it ends, "idle" (another request keeps the session going) or
+//     "lifetime" (the user has to sign in again.)
+//   - session_warn_before: seconds before the end that the page should warn the user.
+//   - session_expiring: the session ends within session_warn_before.
+//
+// Pages that aren't for a signed in session get nothing.
+func (timeouts *SessionTimeouts) htmlData(ctx *gin.Context) authboss.HTMLData {
+	session := gsessions.Default(ctx)
+	if pid, _ := session.Get(authboss.SessionKey).(string); len(pid) == 0 {
+		return authboss.HTMLData{}
+	}
+
+	signedIn, _, stamped := sessionStamps(session)
+	if !stamped {
+		return authboss.HTMLData{}
+	}
+
+	// This request is the session's latest activity.
+	expiresIn, ends := timeouts.idleTimeout, "idle"
+	if remaining := time.Until(signedIn.Add(timeouts.maxLifetime)); remaining < expiresIn {
+		expiresIn, ends = remaining, "lifetime"
+	}
+
+	return authboss.HTMLData{
+		"session_expires_in":  int(expiresIn / time.Second),
+		"session_ends":        ends,
+		"session_warn_before": int(timeouts.warnBefore / time.Second),
+		"session_expiring":    expiresIn <= timeouts.warnBefore,
+	}
+}
+
+// sessionStamps returns when the user signed in to the session and when it was last used.
+// stamped is false if the session doesn't have the stamps.
+func sessionStamps(session gsessions.Session) (signedIn, lastActive time.Time, stamped bool) {
+	signedInUnix, signedInOK := session.Get(sessionSignedInKey).(int64)
+	lastActiveUnix, lastActiveOK := session.Get(sessionLastActiveKey).(int64)
+
+	return time.Unix(signedInUnix, 0), time.Unix(lastActiveUnix, 0), signedInOK && lastActiveOK
+}
@@ -0,0 +1,114 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/volatiletech/authboss/v3/otp/twofactor/sms2fa"
+)
+
+// SMSSender sends a text message to a phone number. It is the same interface as
+// authboss' sms2fa.SMSSender, so any SMSSender can be handed to the sms2fa module.
+//
+// The worked example doesn't talk to a real SMS gateway (Twilio, AWS SNS, ...). To
+// add one, implement Send() and add a case to makeSMSSender.
+type SMSSender interface {
+	Send(ctx context.Context, number, text string) error
+}
+
+var (
+	_ SMSSender        = &FileSMSSender{}
+	_ SMSSender        = &LogSMSSender{}
+	_ sms2fa.SMSSender = SMSSender(nil)
+)
+
+// makeSMSSender creates the SMSSender selected in the configuration's "sms:sender".
+func makeSMSSender(cfg *ConfigData) (SMSSender, error) {
+	switch cfg.SMS.Sender {
+	case "file":
+		outbox := cfg.SMS.File
+		if !filepath.IsAbs(outbox) {
+			outbox = filepath.Join(cfg.WorkedRoot, outbox)
+		}
+
+		return makeFileSMSSender(outbox), nil
+	case "log":
+		return &LogSMSSender{
+			logger: log.New(os.Stdout, "[SMS] ", log.LstdFlags),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS sender '%s'", cfg.SMS.Sender)
+	}
+}
+
+// FileSMSSender is a development SMSSender that appends each text message to a file,
+// so that you can exercise SMS 2fa without an SMS gateway. "tail -f" is your friend.
+type FileSMSSender struct {
+	// Path to the file that collects the text messages
+	Path string
+	// Serializes appends to the file
+	mutex  sync.Mutex
+	logger *log.Logger
+}
+
+// makeFileSMSSender creates a new file-backed SMS sender.
+func makeFileSMSSender(path string) *FileSMSSender {
+	return &FileSMSSender{
+		Path:   path,
+		logger: log.New(os.Stdout, "[SMS] ", log.LstdFlags),
+	}
+}
+
+// Send appends the text message to the sender's file.
+func (sender *FileSMSSender) Send(ctx context.Context, number, text string) error {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	outbox, err := os.OpenFile(sender.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open SMS outbox %s: %w", sender.Path, err)
+	}
+	defer outbox.Close()
+
+	_, err = fmt.Fprintf(outbox, "Date: %s\nTo: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), number, text)
+	if err != nil {
+		return fmt.Errorf("unable to write SMS outbox %s: %w", sender.Path, err)
+	}
+
+	sender.logger.Printf("Text message to %s appended to %s", number, sender.Path)
+	return nil
+}
+
+// LogSMSSender is a development SMSSender that just logs the text message, similar to
+// authboss' log mailer.
+type LogSMSSender struct {
+	logger *log.Logger
+}
+
+// Send logs the text message.
+func (sender *LogSMSSender) Send(ctx context.Context, number, text string) error {
+	sender.logger.Printf("To: %s: %s", number, text)
+	return nil
+}
@@ -0,0 +1,124 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"net/http"
+
+	"github.com/volatiletech/authboss/v3"
+	"github.com/volatiletech/authboss/v3/defaults"
+	"github.com/volatiletech/authboss/v3/otp/twofactor"
+	"github.com/volatiletech/authboss/v3/otp/twofactor/sms2fa"
+	"github.com/volatiletech/authboss/v3/otp/twofactor/totp2fa"
+)
+
+const (
+	// Issuer name that shows up in the user's authenticator app.
+	totpIssuer = "Authboss-Worked"
+)
+
+// setupTwoFactor sets up the authboss two factor authentication (2fa) modules enabled in the
+// configuration.
+//
+// Unlike the other authboss modules, the 2fa modules DO NOT register themselves via a blank
+// import. They have to be explicitly constructed and their Setup() called AFTER ab.Init(),
+// once the router, body reader and renderers exist.
+func setupTwoFactor(cfg *ConfigData, ab *authboss.Authboss) error {
+	if !cfg.Features.UseTOTP && !cfg.Features.UseSMS {
+		return nil
+	}
+
+	if cfg.Features.UseTOTP {
+		totp := &totp2fa.TOTP{Authboss: ab}
+		if err := totp.Setup(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Features.UseSMS {
+		sender, err := makeSMSSender(cfg)
+		if err != nil {
+			return err
+		}
+
+		sms := &sms2fa.SMS{Authboss: ab, Sender: sender}
+		if err := sms.Setup(); err != nil {
+			return err
+		}
+	}
+
+	// Recovery code regeneration (/auth/2fa/recovery/regen) is shared by all of the 2fa modules.
+	recovery := &twofactor.Recovery{Authboss: ab}
+	return recovery.Setup()
+}
+
+// recoveryCodeBodyReader wraps the default HTTP body reader to work around a bug in authboss
+// v3.2.0: totp2fa's validation accepts ANY non-empty recovery code, even if the code doesn't
+// match one of the user's bcrypt-ed recovery codes (it only removes the code from the user's
+// list when it does match.)
+//
+// The workaround checks the recovery code before authboss sees it. A recovery code that
+// doesn't match is demoted to an ordinary TOTP code, which fails validation with the usual
+// "2fa code was invalid" message.
+type recoveryCodeBodyReader struct {
+	authboss.BodyReader
+	storer *AuthStorer
+}
+
+// Read the form values for page, checking the recovery code on the 2fa validation pages.
+func (reader recoveryCodeBodyReader) Read(page string, r *http.Request) (authboss.Validator, error) {
+	validator, err := reader.BodyReader.Read(page, r)
+	if err != nil || page != totp2fa.PageTOTPValidate {
+		return validator, err
+	}
+
+	values, valid := validator.(defaults.TwoFA)
+	if !valid || len(values.RecoveryCode) == 0 {
+		return validator, nil
+	}
+
+	if !reader.recoveryCodeMatches(r, totp2fa.SessionTOTPPendingPID, values.RecoveryCode) {
+		values.Code = values.RecoveryCode
+		values.RecoveryCode = ""
+	}
+
+	return values, nil
+}
+
+// recoveryCodeMatches looks up the user the same way authboss does (current user first, then
+// the user whose 2fa validation is pending) and checks code against their recovery codes.
+func (reader recoveryCodeBodyReader) recoveryCodeMatches(r *http.Request, pendingKey, code string) bool {
+	pid, ok := authboss.GetSession(r, authboss.SessionKey)
+	if !ok || len(pid) == 0 {
+		pid, ok = authboss.GetSession(r, pendingKey)
+	}
+
+	if !ok || len(pid) == 0 {
+		return false
+	}
+
+	abUser, err := reader.storer.Load(r.Context(), pid)
+	if err != nil {
+		return false
+	}
+
+	codes := twofactor.DecodeRecoveryCodes(abUser.(*WorkedUser).GetRecoveryCodes())
+	_, matched := twofactor.UseRecoveryCode(codes, code)
+
+	return matched
+}
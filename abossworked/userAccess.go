@@ -0,0 +1,48 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"github.com/volatiletech/authboss/v3/lock"
+)
+
+// userAccess is the /app middleware's rules for signed in users: with the confirm module,
+// unconfirmed accounts are refused; with the lock module, locked accounts are. The endpoints
+// that let users in without the /app middleware (forward-auth, personal access tokens, the
+// OpenID Connect provider) apply the same rules with it.
+type userAccess struct {
+	requireConfirmed bool
+	checkLock        bool
+}
+
+// makeUserAccess creates the rules for the configured modules.
+func makeUserAccess(cfg *ConfigData) userAccess {
+	return userAccess{
+		requireConfirmed: cfg.Features.UseConfirm,
+		checkLock:        cfg.Features.UseLock,
+	}
+}
+
+// allowed returns true if the user's account can be used.
+func (access userAccess) allowed(user *WorkedUser) bool {
+	if access.requireConfirmed && !user.GetConfirmed() {
+		return false
+	}
+
+	return !access.checkLock || !lock.IsLocked(user)
+}
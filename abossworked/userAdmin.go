@@ -0,0 +1,776 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/volatiletech/authboss/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// How long "abossctl user lock" locks the account, unless told otherwise.
+	userAdminLockDuration = 10 * 365 * 24 * time.Hour
+	// Users per "abossctl user list", unless told otherwise.
+	userAdminListLimit = 100
+	// How long "abossctl user delete" keeps the user's session tokens on the deny-list: abossctl
+	// doesn't know sessions:max_lifetime, so longer than any sensible one.
+	userAdminDenyFor = 7 * 24 * time.Hour
+)
+
+// userAdmin is the state for one abossctl command.
+type userAdmin struct {
+	storer *AuthStorer
+	// Authboss instance for password updates, so that abossctl hashes passwords the same
+	// way (and with the same bcrypt cost) as the web site.
+	aboss *authboss.Authboss
+
+	jsonOutput bool
+	stdin      io.Reader
+	stdout     io.Writer
+	// Password prompts go here.
+	stderr io.Writer
+}
+
+// userAdminAction is an "abossctl user" sub-command.
+type userAdminAction struct {
+	run   func(ctl *userAdmin, args []string) error
+	usage string
+}
+
+// userAdminActions are the "abossctl user" sub-commands, by name.
+var userAdminActions = map[string]userAdminAction{
+	"create":          {(*userAdmin).create, "create [-password pw] [-confirmed] email"},
+	"list":            {(*userAdmin).list, "list [-q search] [-offset n] [-limit n]"},
+	"show":            {(*userAdmin).show, "show email|guid"},
+	"delete":          {(*userAdmin).delete, "delete email|guid"},
+	"lock":            {(*userAdmin).lock, "lock [-for duration] email|guid"},
+	"unlock":          {(*userAdmin).unlock, "unlock email|guid"},
+	"confirm":         {(*userAdmin).confirm, "confirm email|guid"},
+	"set-password":    {(*userAdmin).setPassword, "set-password [-password pw] email|guid"},
+	"revoke-remember": {(*userAdmin).revokeRemember, "revoke-remember email|guid"},
+}
+
+// migrateActions are the "abossctl migrate" sub-commands, by name.
+var migrateActions = map[string]userAdminAction{
+	"up":     {(*userAdmin).migrateUp, "up [-to version]"},
+	"down":   {(*userAdmin).migrateDown, "down [-to version]"},
+	"status": {(*userAdmin).migrateStatus, "status"},
+}
+
+// mailActions are the "abossctl mail" sub-commands, by name.
+var mailActions = map[string]userAdminAction{
+	"list":   {(*userAdmin).mailList, "list [-status stuck|pending|dead|sent] [-limit n]"},
+	"show":   {(*userAdmin).mailShow, "show id"},
+	"retry":  {(*userAdmin).mailRetry, "retry id"},
+	"delete": {(*userAdmin).mailDelete, "delete id"},
+}
+
+// userAdminGroup is a group of abossctl sub-commands.
+type userAdminGroup struct {
+	actions map[string]userAdminAction
+	// The sub-commands need the user database's schema at the latest version.
+	latestSchema bool
+}
+
+// userAdminGroups are the abossctl command groups, by name.
+var userAdminGroups = map[string]userAdminGroup{
+	"user":    {userAdminActions, true},
+	"migrate": {migrateActions, false},
+	"mail":    {mailActions, true},
+}
+
+// UserAdminCommand is the command line user administration tool (cmd/abossctl):
+//
+//	abossctl [-root dir] [-json] user <action> [flags] args...
+//	abossctl [-root dir] [-json] migrate up|down|status [flags]
+//	abossctl [-root dir] [-json] mail list|show|retry|delete [flags] args...
+//
+// It opens the user database in the worked example's root directory (the current directory,
+// by default.) Passwords that aren't given with -password are prompted for (without echo) if
+// stdin is a terminal, otherwise read from the first line of stdin. -password is visible to
+// other users in ps' output and goes into the shell's history. With -json, the output is JSON,
+// for scripts. The "user" actions need the database's schema at the latest version; "migrate"
+// gets it there (see migrations.go.) The "mail" actions look after the outbound mail queue
+// (see mailOutbox.go.)
+//
+// Returns the process' exit status.
+func UserAdminCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("abossctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	root := flags.String("root", ".", "the worked example's root `directory` (where worked_udata.sqlite3 lives)")
+	jsonOutput := flags.Bool("json", false, "JSON output")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: abossctl [-root dir] [-json] user|migrate|mail <action> [flags] args...")
+		fmt.Fprintln(stderr, "\nactions:")
+
+		for _, groupName := range sortedKeys(userAdminGroups) {
+			actions := userAdminGroups[groupName].actions
+			for _, name := range sortedKeys(actions) {
+				fmt.Fprintln(stderr, " ", groupName, actions[name].usage)
+			}
+		}
+
+		fmt.Fprintln(stderr, "\nflags:")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	args = flags.Args()
+	if len(args) < 2 {
+		flags.Usage()
+		return 2
+	}
+
+	group, valid := userAdminGroups[args[0]]
+	if !valid {
+		fmt.Fprintf(stderr, "abossctl: unknown command '%s'\n", args[0])
+		flags.Usage()
+		return 2
+	}
+
+	action, valid := group.actions[args[1]]
+	if !valid {
+		fmt.Fprintf(stderr, "abossctl: unknown action '%s'\n", args[1])
+		flags.Usage()
+		return 2
+	}
+
+	dbPath := filepath.Join(*root, workedUserdb)
+	if _, err := os.Stat(dbPath); err != nil {
+		fmt.Fprintf(stderr, "abossctl: no user database: %v\n", err)
+		return 1
+	}
+
+	storer, err := openUserDB(*root, io.Discard)
+	if err != nil {
+		fmt.Fprintf(stderr, "abossctl: unable to open %s: %v\n", dbPath, err)
+		return 1
+	}
+	defer storer.Close()
+
+	if group.latestSchema {
+		if err := storer.RequireLatestSchema(); err != nil {
+			fmt.Fprintf(stderr, "abossctl: %v (see 'abossctl migrate')\n", err)
+			return 1
+		}
+	}
+
+	aboss := authboss.New()
+	aboss.Config.Storage.Server = storer
+
+	ctl := &userAdmin{
+		storer:     storer,
+		aboss:      aboss,
+		jsonOutput: *jsonOutput,
+		stdin:      os.Stdin,
+		stdout:     stdout,
+		stderr:     stderr,
+	}
+
+	if err := action.run(ctl, args[2:]); err != nil {
+		if ctl.jsonOutput {
+			ctl.print(map[string]string{"error": err.Error()}, "")
+		}
+
+		fmt.Fprintf(stderr, "abossctl: %s %s: %v\n", args[0], args[1], err)
+		return 1
+	}
+
+	return 0
+}
+
+// create creates a new user.
+func (ctl *userAdmin) create(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	password := flags.String("password", "", "the user's `password`, visible in ps and the shell history (default: prompt, or read from stdin)")
+	confirmed := flags.Bool("confirmed", false, "confirm the account, so that the user doesn't have to")
+
+	email, err := ctl.parse(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if len(*password) == 0 {
+		if *password, err = ctl.readPassword(); err != nil {
+			return err
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(*password), ctl.aboss.Config.Modules.BCryptCost)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	user := ctl.storer.New(ctx).(*WorkedUser)
+	user.PutPID(email)
+	user.PutPassword(string(hash))
+
+	if err := ctl.storer.Create(ctx, user); err != nil {
+		return err
+	}
+
+	if *confirmed {
+		forceConfirm(user)
+	}
+
+	return ctl.printUser(user, "created")
+}
+
+// list lists the users, a page at a time.
+func (ctl *userAdmin) list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	query := flags.String("q", "", "only list users whose e-mail address contains `search`")
+	offset := flags.Int("offset", 0, "skip the first `n` users")
+	limit := flags.Int("limit", userAdminListLimit, "list at most `n` users")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	users, total, err := ctl.storer.SearchUsers(*query, *offset, *limit)
+	if err != nil {
+		return err
+	}
+
+	type listEntry struct {
+		GUID      string    `json:"guid"`
+		Email     string    `json:"email"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	entries := make([]listEntry, 0, len(users))
+	text := &strings.Builder{}
+	table := tabwriter.NewWriter(text, 0, 8, 2, ' ', 0)
+	for _, user := range users {
+		entries = append(entries, listEntry{GUID: user.GUID, Email: user.Email, CreatedAt: user.CreatedAt})
+		fmt.Fprintf(table, "%s\t%s\t%s\n", user.Email, user.GUID, user.CreatedAt.Format(time.RFC3339))
+	}
+	table.Flush()
+	fmt.Fprintf(text, "(%d of %d users)", len(users), total)
+
+	return ctl.print(map[string]interface{}{"total": total, "users": entries}, text.String())
+}
+
+// show shows the user's account state.
+func (ctl *userAdmin) show(args []string) error {
+	user, err := ctl.loadUser(flag.NewFlagSet("show", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	return ctl.printUser(user, "")
+}
+
+// delete signs the user out of their sessions and deletes their account. The sessions go first,
+// like on the administrator console: the user session index that finds them goes with the
+// account, and they're signed in as the e-mail address, which someone may register again.
+func (ctl *userAdmin) delete(args []string) error {
+	user, err := ctl.loadUser(flag.NewFlagSet("delete", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := ctl.storer.RevokeStoredSessions(user.GetPID(), time.Now().Add(userAdminDenyFor))
+	if err != nil {
+		return fmt.Errorf("unable to revoke the user's sessions: %w", err)
+	}
+
+	if err := ctl.storer.DeleteUser(user.GUID); err != nil {
+		return err
+	}
+
+	return ctl.print(map[string]interface{}{"guid": user.GUID, "email": user.Email, "deleted": true, "sessions_revoked": revoked},
+		fmt.Sprintf("%s: deleted, %d sessions revoked", user.Email, revoked))
+}
+
+// lock locks the user's account.
+func (ctl *userAdmin) lock(args []string) error {
+	flags := flag.NewFlagSet("lock", flag.ContinueOnError)
+	duration := flags.Duration("for", userAdminLockDuration, "lock the account for `duration`")
+
+	user, err := ctl.loadUser(flags, args)
+	if err != nil {
+		return err
+	}
+
+	user.PutLocked(time.Now().Add(*duration))
+	return ctl.printUser(user, "locked")
+}
+
+// unlock unlocks the user's account and resets the failed sign in attempt count.
+func (ctl *userAdmin) unlock(args []string) error {
+	user, err := ctl.loadUser(flag.NewFlagSet("unlock", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	unlockUser(user)
+	return ctl.printUser(user, "unlocked")
+}
+
+// confirm confirms the user's account.
+func (ctl *userAdmin) confirm(args []string) error {
+	user, err := ctl.loadUser(flag.NewFlagSet("confirm", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	forceConfirm(user)
+	return ctl.printUser(user, "confirmed")
+}
+
+// setPassword changes the user's password. Like a password change on the web site, this
+// also revokes the user's remember-me tokens.
+func (ctl *userAdmin) setPassword(args []string) error {
+	flags := flag.NewFlagSet("set-password", flag.ContinueOnError)
+	password := flags.String("password", "", "the new `password`, visible in ps and the shell history (default: prompt, or read from stdin)")
+
+	user, err := ctl.loadUser(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if len(*password) == 0 {
+		if *password, err = ctl.readPassword(); err != nil {
+			return err
+		}
+	}
+
+	if err := ctl.aboss.UpdatePassword(context.Background(), user, *password); err != nil {
+		return err
+	}
+
+	return ctl.printUser(user, "password changed")
+}
+
+// revokeRemember revokes the user's remember-me tokens.
+func (ctl *userAdmin) revokeRemember(args []string) error {
+	user, err := ctl.loadUser(flag.NewFlagSet("revoke-remember", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	if err := ctl.storer.DelRememberTokens(context.Background(), user.GetPID()); err != nil {
+		return err
+	}
+
+	return ctl.printUser(user, "remember-me tokens revoked")
+}
+
+// migrateUp migrates the user database's schema up to the latest version, or to -to.
+func (ctl *userAdmin) migrateUp(args []string) error {
+	flags := flag.NewFlagSet("up", flag.ContinueOnError)
+	to := flags.Int("to", latestSchemaVersion(), "migrate up to schema `version`")
+
+	if err := ctl.parseMigrate(flags, args); err != nil {
+		return err
+	}
+
+	version, err := ctl.storer.VerifySchema()
+	if err != nil {
+		return err
+	} else if *to < version {
+		return fmt.Errorf("schema is already at version %d (use 'migrate down')", version)
+	}
+
+	if err := ctl.storer.MigrateTo(*to); err != nil {
+		return err
+	}
+
+	return ctl.migrateStatus(nil)
+}
+
+// migrateDown rolls the user database's schema back one migration, or down to -to. "-to 0"
+// rolls back every migration, which drops all of the tables.
+func (ctl *userAdmin) migrateDown(args []string) error {
+	flags := flag.NewFlagSet("down", flag.ContinueOnError)
+	to := flags.Int("to", -1, "roll back to schema `version` (default: the previous version)")
+
+	if err := ctl.parseMigrate(flags, args); err != nil {
+		return err
+	}
+
+	version, err := ctl.storer.VerifySchema()
+	if err != nil {
+		return err
+	}
+
+	if *to < 0 {
+		*to = version - 1
+		if *to < 0 {
+			return errors.New("no migrations to roll back")
+		}
+	} else if *to > version {
+		return fmt.Errorf("schema is at version %d (use 'migrate up')", version)
+	}
+
+	if err := ctl.storer.MigrateTo(*to); err != nil {
+		return err
+	}
+
+	return ctl.migrateStatus(nil)
+}
+
+// migrateStatus shows the user database's schema version, its signature and the
+// migrations.
+func (ctl *userAdmin) migrateStatus(args []string) error {
+	if err := ctl.parseMigrate(flag.NewFlagSet("status", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+
+	status, err := ctl.storer.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	signatureState := "ok"
+	if status.Version == 0 {
+		signatureState = "not recorded"
+	} else if status.Signature != status.RecordedSignature {
+		signatureState = "MISMATCH, recorded " + status.RecordedSignature
+	}
+
+	text := &strings.Builder{}
+	table := tabwriter.NewWriter(text, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "Schema version:\t%d (latest %d)\n", status.Version, status.Latest)
+	fmt.Fprintf(table, "Signature:\t%s (%s)\n", status.Signature, signatureState)
+	table.Flush()
+
+	fmt.Fprintln(text)
+	table = tabwriter.NewWriter(text, 0, 8, 2, ' ', 0)
+	for _, migration := range status.Migrations {
+		applied := "pending"
+		if migration.AppliedAt != nil {
+			applied = "applied " + migration.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\n", migration.Version, migration.Name, applied)
+	}
+	table.Flush()
+
+	return ctl.print(status, strings.TrimRight(text.String(), "\n"))
+}
+
+// mailView is what abossctl shows about an e-mail in the outbox.
+type mailView struct {
+	ID            uint64    `json:"id"`
+	Recipients    string    `json:"recipients"`
+	Subject       string    `json:"subject"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error"`
+	CreatedAt     time.Time `json:"created_at"`
+	SentAt        time.Time `json:"sent_at"`
+}
+
+// makeMailView converts the outbox entry for printing.
+func makeMailView(queued Outbox) mailView {
+	return mailView{
+		ID:            queued.ID,
+		Recipients:    queued.Recipients,
+		Subject:       queued.Subject,
+		Status:        queued.Status,
+		Attempts:      queued.Attempts,
+		NextAttemptAt: queued.NextAttemptAt,
+		LastError:     queued.LastError,
+		CreatedAt:     queued.CreatedAt,
+		SentAt:        queued.SentAt,
+	}
+}
+
+// mailList lists the e-mails in the outbox, the stuck ones (dead, or pending after a failed
+// attempt) unless told otherwise.
+func (ctl *userAdmin) mailList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	status := flags.String("status", outboxStuck, "list the e-mails with `status`: stuck, pending, dead or sent")
+	limit := flags.Int("limit", userAdminListLimit, "list at most `n` e-mails")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	switch *status {
+	case outboxStuck, outboxPending, outboxDead, outboxSent:
+	default:
+		return fmt.Errorf("unknown status '%s'", *status)
+	}
+
+	mail, err := ctl.storer.ListMail(*status, *limit)
+	if err != nil {
+		return err
+	}
+
+	views := make([]mailView, 0, len(mail))
+	text := &strings.Builder{}
+	table := tabwriter.NewWriter(text, 0, 8, 2, ' ', 0)
+	for _, queued := range mail {
+		views = append(views, makeMailView(queued))
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%d attempts\t%s\n", queued.ID, queued.Status, queued.Recipients, queued.Subject,
+			queued.Attempts, queued.LastError)
+	}
+	table.Flush()
+	fmt.Fprintf(text, "(%d %s e-mails)", len(mail), *status)
+
+	return ctl.print(map[string]interface{}{"mail": views}, text.String())
+}
+
+// mailShow shows the e-mail's metadata. Not its body: the confirmation and recovery links carry
+// the raw token.
+func (ctl *userAdmin) mailShow(args []string) error {
+	queued, err := ctl.loadMail(flag.NewFlagSet("show", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	view := makeMailView(*queued)
+	text := &strings.Builder{}
+	table := tabwriter.NewWriter(text, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "ID:\t%d\n", view.ID)
+	fmt.Fprintf(table, "To:\t%s\n", view.Recipients)
+	fmt.Fprintf(table, "Subject:\t%s\n", view.Subject)
+	fmt.Fprintf(table, "Status:\t%s\n", view.Status)
+	fmt.Fprintf(table, "Queued:\t%s\n", view.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(table, "Attempts:\t%d\n", view.Attempts)
+	switch view.Status {
+	case outboxPending:
+		fmt.Fprintf(table, "Next attempt:\t%s\n", view.NextAttemptAt.Format(time.RFC3339))
+	case outboxSent:
+		fmt.Fprintf(table, "Sent:\t%s\n", view.SentAt.Format(time.RFC3339))
+	}
+	if len(view.LastError) > 0 {
+		fmt.Fprintf(table, "Last error:\t%s\n", view.LastError)
+	}
+	table.Flush()
+
+	return ctl.print(view, strings.TrimRight(text.String(), "\n"))
+}
+
+// mailRetry makes a pending or dead e-mail due now, with a fresh set of attempts. The running
+// web site's outbox delivers it.
+func (ctl *userAdmin) mailRetry(args []string) error {
+	queued, err := ctl.loadMail(flag.NewFlagSet("retry", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	if err := ctl.storer.RetryMail(queued.ID); err != nil {
+		return err
+	}
+
+	return ctl.print(map[string]interface{}{"id": queued.ID, "retried": true}, fmt.Sprintf("#%d: will be retried", queued.ID))
+}
+
+// mailDelete removes the e-mail from the outbox.
+func (ctl *userAdmin) mailDelete(args []string) error {
+	queued, err := ctl.loadMail(flag.NewFlagSet("delete", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	if err := ctl.storer.DeleteMail(queued.ID); err != nil {
+		return err
+	}
+
+	return ctl.print(map[string]interface{}{"id": queued.ID, "deleted": true}, fmt.Sprintf("#%d: deleted", queued.ID))
+}
+
+// loadMail parses the action's flags and loads the outbox e-mail identified by the argument.
+func (ctl *userAdmin) loadMail(flags *flag.FlagSet, args []string) (*Outbox, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	} else if flags.NArg() != 1 {
+		return nil, errors.New("expected one e-mail ID")
+	}
+
+	id, err := strconv.ParseUint(flags.Arg(0), 10, 64)
+	if err != nil {
+		return nil, ErrMailNotFound
+	}
+
+	return ctl.storer.GetMail(id)
+}
+
+// parseMigrate parses a "migrate" action's flags, which don't take any arguments.
+func (ctl *userAdmin) parseMigrate(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	return nil
+}
+
+// parse parses the action's flags, which have to be followed by exactly one argument (the
+// user's e-mail address or GUID), and returns the argument.
+func (ctl *userAdmin) parse(flags *flag.FlagSet, args []string) (string, error) {
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+
+	if flags.NArg() != 1 {
+		return "", errors.New("expected one e-mail address or GUID")
+	}
+
+	return flags.Arg(0), nil
+}
+
+// loadUser parses the action's flags and loads the user identified by the argument, an
+// e-mail address or a GUID.
+func (ctl *userAdmin) loadUser(flags *flag.FlagSet, args []string) (*WorkedUser, error) {
+	key, err := ctl.parse(flags, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := uuid.Parse(key); err == nil {
+		return ctl.storer.LoadByGUID(context.Background(), key)
+	}
+
+	abUser, err := ctl.storer.Load(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return abUser.(*WorkedUser), nil
+}
+
+// readPassword prompts for the password (twice, without echo) if stdin is a terminal, otherwise
+// reads it from the first line of stdin.
+func (ctl *userAdmin) readPassword() (string, error) {
+	if terminal, isFile := ctl.stdin.(*os.File); isFile && isTerminal(terminal) {
+		return ctl.promptPassword(terminal)
+	}
+
+	line, err := bufio.NewReader(ctl.stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) == 0 {
+		return "", errors.New("empty password")
+	}
+
+	return password, nil
+}
+
+// promptPassword asks for the password on the terminal, then asks for it again to catch typos.
+func (ctl *userAdmin) promptPassword(terminal *os.File) (string, error) {
+	var passwords [2]string
+	for i, prompt := range []string{"Password: ", "Retype password: "} {
+		fmt.Fprint(ctl.stderr, prompt)
+		password, err := readHiddenLine(terminal)
+		fmt.Fprintln(ctl.stderr)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+
+		passwords[i] = password
+	}
+
+	if len(passwords[0]) == 0 {
+		return "", errors.New("empty password")
+	} else if passwords[0] != passwords[1] {
+		return "", errors.New("passwords don't match")
+	}
+
+	return passwords[0], nil
+}
+
+// printUser prints the user's account state, preceded by what was done to the account (if
+// anything) in the text output.
+func (ctl *userAdmin) printUser(user *WorkedUser, done string) error {
+	view := makeAdminUserView(user)
+
+	text := &strings.Builder{}
+	if len(done) > 0 {
+		fmt.Fprintf(text, "%s: %s\n", user.Email, done)
+	}
+
+	table := tabwriter.NewWriter(text, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "GUID:\t%s\n", view.GUID)
+	fmt.Fprintf(table, "E-mail:\t%s\n", view.Email)
+	fmt.Fprintf(table, "Registered:\t%s\n", view.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(table, "Confirmed:\t%t\n", view.Confirmed)
+	fmt.Fprintf(table, "Locked:\t%t\n", view.IsLocked)
+	if view.IsLocked {
+		fmt.Fprintf(table, "Locked until:\t%s\n", view.Locked.Format(time.RFC3339))
+	}
+	fmt.Fprintf(table, "Failed attempts:\t%d\n", view.AttemptCount)
+	fmt.Fprintf(table, "Recovery pending:\t%t\n", view.RecoveryPending)
+	fmt.Fprintf(table, "Remember-me tokens:\t%d\n", view.RememberTokens)
+	fmt.Fprintf(table, "Roles:\t%s\n", strings.Join(view.Roles, ", "))
+	for _, event := range view.SecurityEvents {
+		fmt.Fprintf(table, "Security event:\t%s %s from %s\n", event.CreatedAt.Format(time.RFC3339), event.Event, event.RemoteAddr)
+	}
+	for _, session := range view.Sessions {
+		fmt.Fprintf(table, "Session:\t%s last seen %s from %s (%s)\n",
+			session.Handle, session.LastSeen.Format(time.RFC3339), session.RemoteAddr, session.UserAgent)
+	}
+	table.Flush()
+
+	return ctl.print(view, strings.TrimRight(text.String(), "\n"))
+}
+
+// print prints data as JSON or text, depending on -json.
+func (ctl *userAdmin) print(data interface{}, text string) error {
+	if !ctl.jsonOutput {
+		_, err := fmt.Fprintln(ctl.stdout, text)
+		return err
+	}
+
+	encoder := json.NewEncoder(ctl.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// sortedKeys returns the map's keys, sorted, for the usage message.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,56 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUserAdminDeleteSignsOut(t *testing.T) {
+	for name, setup := range map[string]func(cfg *ConfigData){
+		sessionBackendGORM: func(cfg *ConfigData) { cfg.Sessions.Backend = sessionBackendGORM },
+		"jwt":              func(cfg *ConfigData) { cfg.ClientState.Store = "jwt" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			setup(cfg)
+			server := startTestServer(t, cfg)
+
+			server.createUser(t, "gone@example.com", "secret1")
+			client := server.client(t)
+			client.signIn(t, "gone@example.com", "secret1")
+
+			var stdout, stderr bytes.Buffer
+			if status := UserAdminCommand([]string{"-root", cfg.WorkedRoot, "user", "delete", "gone@example.com"},
+				&stdout, &stderr); status != 0 {
+				t.Fatalf("abossctl user delete: %d, %s", status, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), "1 sessions revoked") {
+				t.Errorf("abossctl user delete: %q", stdout.String())
+			}
+
+			// Someone registers the address again: the old sessions aren't theirs.
+			server.createUser(t, "gone@example.com", "another secret")
+			if client.signedIn(t) {
+				t.Error("the deleted account's session is signed in as the new account")
+			}
+		})
+	}
+}
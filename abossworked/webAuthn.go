@@ -0,0 +1,416 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/volatiletech/authboss/v3"
+	"github.com/volatiletech/authboss/v3/lock"
+)
+
+const (
+	// Authboss module name
+	webAuthnModuleName = "webauthn"
+
+	// PageWebAuthnLogin is the passkey sign in page.
+	PageWebAuthnLogin = "webauthn_login"
+
+	// Session keys for the WebAuthn ceremonies' state (challenge, user, expiration)
+	sessionWebAuthnRegistration = "webauthn_registration"
+	sessionWebAuthnLogin        = "webauthn_login"
+
+	// Longest passkey name that the user can supply
+	webAuthnMaxNameLength = 64
+
+	// How long the user has to complete a ceremony (touch the security key, unlock the phone)
+	webAuthnCeremonyTimeout = 5 * time.Minute
+)
+
+// WebAuthn is an authboss module for passwordless sign in with WebAuthn passkeys. It mounts
+// the WebAuthn registration and assertion ("login") ceremonies under /auth/webauthn:
+//
+//	GET  /webauthn/login            Passkey sign in page
+//	POST /webauthn/login/begin      Assertion options (JSON)
+//	POST /webauthn/login/finish     Verify the assertion, sign the user in (JSON, "rm" query
+//	                                parameter for "Remember me")
+//	POST /webauthn/register/begin   Registration options for the signed in user (JSON)
+//	POST /webauthn/register/finish  Verify and store the new passkey (JSON)
+//	POST /webauthn/remove           Remove one of the signed in user's passkeys (form)
+//
+// Adding and removing passkeys takes a full sign in, not just a remember-me cookie.
+//
+// The JSON endpoints are driven by the JavaScript in the _webauthn_script template fragment.
+// Passkeys are discoverable credentials: the user doesn't type their e-mail address to sign
+// in, the authenticator returns the user handle (the user's GUID.)
+//
+// Signing in with a passkey goes through the same events as the auth module's password sign
+// in, so the confirm, lock and remember modules see it. A passkey that verified the user (PIN,
+// biometrics) is multi-factor on its own, so it skips the 2fa modules. A passkey that only
+// proved the user's presence (a security key without a PIN) is one factor, like a password:
+// users with 2fa continue to the 2fa module's validation page.
+type WebAuthn struct {
+	*authboss.Authboss
+
+	// Relying party configuration
+	rpConfig *webauthn.Config
+	// Where the user manages their passkeys
+	managePath string
+	storer     *AuthStorer
+
+	web *webauthn.WebAuthn
+}
+
+// setupWebAuthn registers the WebAuthn module with authboss, if enabled in the configuration.
+// Like the other authboss modules, ab.Init() initializes it, so this has to happen before
+// ab.Init().
+func setupWebAuthn(cfg *ConfigData, ab *authboss.Authboss, storer *AuthStorer) {
+	if !cfg.Features.UseWebAuthn {
+		return
+	}
+
+	rpID := cfg.WebAuthn.RPID
+	if len(rpID) == 0 {
+		rpID = cfg.ListenAddr["host"]
+	}
+
+	origins := cfg.WebAuthn.Origins
+	if len(origins) == 0 {
+		origins = []string{ab.Config.Paths.RootURL}
+	}
+
+	authboss.RegisterModule(webAuthnModuleName, &WebAuthn{
+		rpConfig: &webauthn.Config{
+			RPID:          rpID,
+			RPDisplayName: cfg.WebAuthn.RPDisplayName,
+			RPOrigins:     origins,
+			// Passkeys: the credential has to be discoverable (resident) so that the user can
+			// sign in without entering their e-mail address.
+			AuthenticatorSelection: protocol.AuthenticatorSelection{
+				RequireResidentKey: protocol.ResidentKeyRequired(),
+				ResidentKey:        protocol.ResidentKeyRequirementRequired,
+				UserVerification:   protocol.VerificationPreferred,
+			},
+			// Enforce the timeouts, so that a stale challenge can't be used.
+			Timeouts: webauthn.TimeoutsConfig{
+				Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: webAuthnCeremonyTimeout},
+				Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: webAuthnCeremonyTimeout},
+			},
+		},
+		managePath: "/app/user",
+		storer:     storer,
+	})
+}
+
+// Init the module (authboss.Moduler interface)
+func (module *WebAuthn) Init(ab *authboss.Authboss) (err error) {
+	module.Authboss = ab
+
+	module.web, err = webauthn.New(module.rpConfig)
+	if err != nil {
+		return err
+	}
+
+	if err = ab.Config.Core.ViewRenderer.Load(PageWebAuthnLogin); err != nil {
+		return err
+	}
+
+	router := ab.Config.Core.Router
+	router.Get("/webauthn/login", ab.Core.ErrorHandler.Wrap(module.LoginGet))
+	router.Post("/webauthn/login/begin", ab.Core.ErrorHandler.Wrap(module.LoginBegin))
+	router.Post("/webauthn/login/finish", ab.Core.ErrorHandler.Wrap(module.LoginFinish))
+	router.Post("/webauthn/register/begin", ab.Core.ErrorHandler.Wrap(module.RegisterBegin))
+	router.Post("/webauthn/register/finish", ab.Core.ErrorHandler.Wrap(module.RegisterFinish))
+	router.Post("/webauthn/remove", ab.Core.ErrorHandler.Wrap(module.Remove))
+
+	return nil
+}
+
+// LoginGet renders the passkey sign in page.
+func (module *WebAuthn) LoginGet(w http.ResponseWriter, r *http.Request) error {
+	return module.Core.Responder.Respond(w, r, http.StatusOK, PageWebAuthnLogin, nil)
+}
+
+// LoginBegin starts the assertion ceremony, returning the options for the browser's
+// navigator.credentials.get().
+func (module *WebAuthn) LoginBegin(w http.ResponseWriter, r *http.Request) error {
+	options, session, err := module.web.BeginDiscoverableLogin()
+	if err != nil {
+		return err
+	}
+
+	if err := putWebAuthnSession(w, sessionWebAuthnLogin, session); err != nil {
+		return err
+	}
+
+	return respondWebAuthnJSON(w, http.StatusOK, options)
+}
+
+// LoginFinish verifies the browser's assertion and signs the user in.
+func (module *WebAuthn) LoginFinish(w http.ResponseWriter, r *http.Request) error {
+	logger := module.RequestLogger(r)
+
+	session, err := getWebAuthnSession(w, r, sessionWebAuthnLogin)
+	if err != nil {
+		logger.Infof("passkey sign in without a login ceremony: %v", err)
+		return respondWebAuthnError(w, http.StatusBadRequest, "Start the passkey sign in again.")
+	}
+
+	var user *WorkedUser
+	credential, err := module.web.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		user, err = module.storer.LoadByGUID(r.Context(), string(userHandle))
+		return user, err
+	}, session, r)
+
+	if err != nil {
+		logger.Infof("passkey sign in failed: %v", webAuthnErrorDetails(err))
+		return respondWebAuthnError(w, http.StatusUnauthorized, "Passkey sign in failed.")
+	}
+
+	user.PutWebAuthnCredentialUse(credential)
+
+	if credential.Authenticator.CloneWarning {
+		logger.Errorf("passkey for %s may have been cloned (signature counter went backwards)", user.GetPID())
+		return respondWebAuthnError(w, http.StatusUnauthorized, "Passkey sign in failed.")
+	}
+
+	if lock.IsLocked(user) {
+		logger.Infof("passkey sign in for locked user %s", user.GetPID())
+		return respondWebAuthnError(w, http.StatusForbidden, "Your account has been locked, please contact the administrator.")
+	}
+
+	// From here on, sign the user in the same way the auth module does after the password
+	// verifies. The event handlers answer with the JSON redirector (the request is JSON), which
+	// the _webauthn_script fragment follows.
+	r = r.WithContext(context.WithValue(r.Context(), authboss.CTXKeyUser, user))
+	r = r.WithContext(context.WithValue(r.Context(), authboss.CTXKeyValues, webAuthnLoginValues{
+		remember: r.URL.Query().Get("rm") == "true",
+	}))
+
+	handled, err := module.Events.FireBefore(authboss.EventAuth, w, r)
+	if err != nil {
+		return err
+	} else if handled {
+		return nil
+	}
+
+	// Without user verification, the passkey is only one factor: users with 2fa continue to the
+	// 2fa module's validation page.
+	if !credential.Flags.UserVerified {
+		if handled, err = module.Events.FireBefore(authboss.EventAuthHijack, w, r); err != nil {
+			return err
+		} else if handled {
+			logger.Infof("passkey for %s didn't verify the user, continuing with 2fa", user.GetPID())
+			return nil
+		}
+	}
+
+	logger.Infof("user %s signed in with a passkey", user.GetPID())
+	authboss.PutSession(w, authboss.SessionKey, user.GetPID())
+	authboss.DelSession(w, authboss.SessionHalfAuthKey)
+
+	if handled, err = module.Events.FireAfter(authboss.EventAuth, w, r); err != nil {
+		return err
+	} else if handled {
+		return nil
+	}
+
+	authboss.PutSession(w, authboss.FlashSuccessKey, "Signed in with your passkey.")
+	return respondWebAuthnJSON(w, http.StatusOK, map[string]string{"location": module.Config.Paths.AuthLoginOK})
+}
+
+// webAuthnLoginValues is the passkey sign in's "Remember me" choice (authboss.RememberValuer
+// interface), for the remember module's EventAuth handler.
+type webAuthnLoginValues struct {
+	remember bool
+}
+
+// GetShouldRemember returns true if the user checked "Remember me".
+func (values webAuthnLoginValues) GetShouldRemember() bool {
+	return values.remember
+}
+
+// RegisterBegin starts the registration ceremony for the signed in user, returning the
+// options for the browser's navigator.credentials.create().
+func (module *WebAuthn) RegisterBegin(w http.ResponseWriter, r *http.Request) error {
+	user, err := module.currentUser(r)
+	if err != nil {
+		return respondWebAuthnError(w, http.StatusUnauthorized, "Sign in to add a passkey.")
+	}
+
+	// Don't register the same authenticator twice.
+	existing := user.WebAuthnCredentials()
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(existing))
+	for _, credential := range existing {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, session, err := module.web.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired))
+	if err != nil {
+		return err
+	}
+
+	if err := putWebAuthnSession(w, sessionWebAuthnRegistration, session); err != nil {
+		return err
+	}
+
+	return respondWebAuthnJSON(w, http.StatusOK, options)
+}
+
+// RegisterFinish verifies the browser's new credential and stores it. The passkey's name
+// is in the "name" query parameter; the request body is the credential.
+func (module *WebAuthn) RegisterFinish(w http.ResponseWriter, r *http.Request) error {
+	logger := module.RequestLogger(r)
+
+	user, err := module.currentUser(r)
+	if err != nil {
+		return respondWebAuthnError(w, http.StatusUnauthorized, "Sign in to add a passkey.")
+	}
+
+	session, err := getWebAuthnSession(w, r, sessionWebAuthnRegistration)
+	if err != nil {
+		logger.Infof("passkey registration without a registration ceremony: %v", err)
+		return respondWebAuthnError(w, http.StatusBadRequest, "Start adding the passkey again.")
+	}
+
+	credential, err := module.web.FinishRegistration(user, session, r)
+	if err != nil {
+		logger.Infof("passkey registration for %s failed: %v", user.GetPID(), webAuthnErrorDetails(err))
+		return respondWebAuthnError(w, http.StatusBadRequest, "The passkey could not be verified.")
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if len(name) == 0 {
+		name = "Passkey added " + time.Now().Format("2006-01-02")
+	} else if len(name) > webAuthnMaxNameLength {
+		name = name[:webAuthnMaxNameLength]
+	}
+
+	if err := user.AddWebAuthnCredential(credential, name); err != nil {
+		return err
+	}
+
+	logger.Infof("user %s added passkey '%s'", user.GetPID(), name)
+	authboss.PutSession(w, authboss.FlashSuccessKey, "Passkey added.")
+
+	return respondWebAuthnJSON(w, http.StatusOK, map[string]string{"location": module.managePath})
+}
+
+// Remove removes one of the signed in user's passkeys ("credential_id" form value.)
+func (module *WebAuthn) Remove(w http.ResponseWriter, r *http.Request) error {
+	user, err := module.currentUser(r)
+	if err != nil {
+		return module.Core.Redirector.Redirect(w, r, authboss.RedirectOptions{
+			Code:         http.StatusTemporaryRedirect,
+			RedirectPath: module.Config.Paths.NotAuthorized,
+			Failure:      "Sign in to manage your passkeys.",
+		})
+	}
+
+	ro := authboss.RedirectOptions{
+		Code:         http.StatusTemporaryRedirect,
+		RedirectPath: module.managePath,
+		Success:      "Passkey removed.",
+	}
+
+	if err := user.DelWebAuthnCredential(r.FormValue("credential_id")); errors.Is(err, authboss.ErrTokenNotFound) {
+		ro.Success = ""
+		ro.Failure = "No such passkey."
+	} else if err != nil {
+		return err
+	}
+
+	return module.Core.Redirector.Redirect(w, r, ro)
+}
+
+// currentUser returns the signed in user, if there is one and they are fully signed in. A user
+// signed in by their remember-me cookie is only half signed in: whoever stole the cookie
+// mustn't be able to add a passkey, which would then skip the second factor.
+func (module *WebAuthn) currentUser(r *http.Request) (*WorkedUser, error) {
+	if !authboss.IsFullyAuthed(r) {
+		return nil, errors.New("the user isn't fully signed in (remember-me)")
+	}
+
+	abUser, err := module.CurrentUser(r)
+	if err != nil {
+		return nil, err
+	}
+
+	user, valid := abUser.(*WorkedUser)
+	if !valid {
+		return nil, errors.New("expected a User struct in authboss.User annotation")
+	}
+
+	return user, nil
+}
+
+// putWebAuthnSession stores the WebAuthn ceremony's state in the user's session.
+func putWebAuthnSession(w http.ResponseWriter, key string, session *webauthn.SessionData) error {
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	authboss.PutSession(w, key, string(encoded))
+	return nil
+}
+
+// getWebAuthnSession retrieves and removes the WebAuthn ceremony's state from the user's
+// session. Each ceremony's state can only be used once.
+func getWebAuthnSession(w http.ResponseWriter, r *http.Request, key string) (session webauthn.SessionData, err error) {
+	encoded, ok := authboss.GetSession(r, key)
+	if !ok || len(encoded) == 0 {
+		return session, errors.New("no WebAuthn session data")
+	}
+
+	authboss.DelSession(w, key)
+	err = json.Unmarshal([]byte(encoded), &session)
+	return session, err
+}
+
+// respondWebAuthnJSON writes the JSON response for the WebAuthn JavaScript.
+func respondWebAuthnJSON(w http.ResponseWriter, status int, data interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(data)
+}
+
+// respondWebAuthnError writes an error message for the WebAuthn JavaScript to display.
+func respondWebAuthnError(w http.ResponseWriter, status int, message string) error {
+	return respondWebAuthnJSON(w, status, map[string]string{"error": message})
+}
+
+// webAuthnErrorDetails digs the details out of a WebAuthn protocol error, which are more
+// useful in the log than the generic error message.
+func webAuthnErrorDetails(err error) string {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) && len(protocolErr.DevInfo) > 0 {
+		return protocolErr.Details + ": " + protocolErr.DevInfo
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,376 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/volatiletech/authboss/v3"
+)
+
+// softAuthenticator is a software WebAuthn authenticator with one passkey (ES256, "none"
+// attestation), standing in for the browser and the security key.
+type softAuthenticator struct {
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+// Authenticator data flags
+const (
+	softFlagUserPresent  = 0x01
+	softFlagUserVerified = 0x04
+	softFlagAttested     = 0x40
+)
+
+// makeSoftAuthenticator creates an authenticator for the server's origin.
+func makeSoftAuthenticator(t *testing.T, server *testServer) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{origin: server.URL, key: key, credentialID: credentialID}
+}
+
+// authenticatorData builds the authenticator data for the relying party.
+func (auth *softAuthenticator) authenticatorData(rpID string, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, auth.signCount)
+	return append(data, attested...)
+}
+
+// clientData builds the browser's client data for the ceremony.
+func (auth *softAuthenticator) clientData(t *testing.T, ceremony string, challenge []byte) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    auth.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// create answers navigator.credentials.create(): the new credential, as the _webauthn_script
+// fragment sends it.
+func (auth *softAuthenticator) create(t *testing.T, options protocol.CredentialCreation) map[string]interface{} {
+	t.Helper()
+
+	auth.userHandle = options.Response.User.ID.([]byte)
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: auth.key.X.FillBytes(make([]byte, 32)),
+		YCoord: auth.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AAGUID (zeros), credential ID length and ID, public key
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(auth.credentialID)))
+	attested = append(append(attested, auth.credentialID...), publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": auth.authenticatorData(options.Response.RelyingParty.ID, softFlagUserPresent|softFlagUserVerified|softFlagAttested, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(auth.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(auth.clientData(t, "webauthn.create", options.Response.Challenge)),
+		},
+	}
+}
+
+// get answers navigator.credentials.get(): the signed assertion, with or without user
+// verification (PIN, biometrics.)
+func (auth *softAuthenticator) get(t *testing.T, options protocol.CredentialAssertion, verified bool) map[string]interface{} {
+	t.Helper()
+
+	flags := byte(softFlagUserPresent)
+	if verified {
+		flags |= softFlagUserVerified
+	}
+
+	auth.signCount++
+	authData := auth.authenticatorData(options.Response.RelyingPartyID, flags, nil)
+	clientData := auth.clientData(t, "webauthn.get", options.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, auth.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(auth.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(auth.userHandle),
+		},
+	}
+}
+
+// registerPasskey signs the user in with their password and adds the authenticator's passkey.
+func registerPasskey(t *testing.T, server *testServer, auth *softAuthenticator, email, password string) {
+	t.Helper()
+
+	client := server.client(t)
+	client.signIn(t, email, password)
+
+	var options protocol.CredentialCreation
+	if resp := client.postJSON(t, "/auth/webauthn/register/begin", nil, &options); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register/begin: %d", resp.StatusCode)
+	}
+
+	// The user ID comes back as base64url.
+	userID, err := base64.RawURLEncoding.DecodeString(options.Response.User.ID.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Response.User.ID = userID
+
+	var result map[string]string
+	if resp := client.postJSON(t, "/auth/webauthn/register/finish?name=soft", auth.create(t, options), &result); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register/finish: %d %v", resp.StatusCode, result)
+	}
+}
+
+// passkeySignIn signs in with the authenticator's passkey on a new client. It returns the
+// client and the login/finish response.
+func passkeySignIn(t *testing.T, server *testServer, auth *softAuthenticator, verified bool, query string) (*testClient, int, map[string]string) {
+	t.Helper()
+
+	client := server.client(t)
+
+	var options protocol.CredentialAssertion
+	if resp := client.postJSON(t, "/auth/webauthn/login/begin", nil, &options); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login/begin: %d", resp.StatusCode)
+	}
+
+	var result map[string]string
+	resp := client.postJSON(t, "/auth/webauthn/login/finish"+query, auth.get(t, options, verified), &result)
+	return client, resp.StatusCode, result
+}
+
+// startWebAuthnServer starts the worked example with passkeys, TOTP and SMS 2fa.
+func startWebAuthnServer(t *testing.T) *testServer {
+	cfg := testConfig(t)
+	cfg.Features.UseWebAuthn = true
+	cfg.Features.UseTOTP = true
+	cfg.Features.UseSMS = true
+	cfg.SMS.Sender = "log"
+
+	return startTestServer(t, cfg)
+}
+
+func TestWebAuthnSignIn(t *testing.T) {
+	server := startWebAuthnServer(t)
+	server.createUser(t, "passkey@example.com", "secret1")
+	auth := makeSoftAuthenticator(t, server)
+	registerPasskey(t, server, auth, "passkey@example.com", "secret1")
+
+	tests := []struct {
+		name     string
+		verified bool
+	}{
+		{"user verified", true},
+		// Without 2fa, a passkey that only proves the user's presence is as good as a password.
+		{"user present", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, status, result := passkeySignIn(t, server, auth, test.verified, "")
+			if status != http.StatusOK || result["location"] != "/app/" {
+				t.Fatalf("login/finish: %d %v", status, result)
+			}
+
+			if !client.signedIn(t) {
+				t.Error("not signed in after the passkey sign in")
+			}
+		})
+	}
+}
+
+func TestWebAuthnSignInWith2FA(t *testing.T) {
+	server := startWebAuthnServer(t)
+
+	tests := []struct {
+		name     string
+		enroll   func(user *WorkedUser)
+		validate string
+	}{
+		{"totp", func(user *WorkedUser) { user.PutTOTPSecretKey("JBSWY3DPEHPK3PXP") }, "/auth/2fa/totp/validate"},
+		{"sms", func(user *WorkedUser) { user.PutSMSPhoneNumber("+15555550100") }, "/auth/2fa/sms/validate"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			email := test.name + "@example.com"
+			user := server.createUser(t, email, "secret1")
+			auth := makeSoftAuthenticator(t, server)
+			registerPasskey(t, server, auth, email, "secret1")
+			// Enrolled after adding the passkey, so that the password sign in didn't need the
+			// second factor.
+			test.enroll(user)
+
+			// A passkey that didn't verify the user is one factor: on to the 2fa validation.
+			client, status, result := passkeySignIn(t, server, auth, false, "")
+			if status != http.StatusOK || result["location"] != test.validate {
+				t.Errorf("user present: %d %v, expected %s", status, result, test.validate)
+			}
+
+			if client.signedIn(t) {
+				t.Error("signed in without the second factor")
+			}
+
+			// One that verified the user is two.
+			client, status, result = passkeySignIn(t, server, auth, true, "")
+			if status != http.StatusOK || result["location"] != "/app/" {
+				t.Errorf("user verified: %d %v", status, result)
+			}
+
+			if !client.signedIn(t) {
+				t.Error("not signed in after the passkey sign in")
+			}
+		})
+	}
+}
+
+func TestWebAuthnSignInEvents(t *testing.T) {
+	server := startWebAuthnServer(t)
+	auth := makeSoftAuthenticator(t, server)
+	user := server.createUser(t, "events@example.com", "secret1")
+	registerPasskey(t, server, auth, "events@example.com", "secret1")
+
+	// "Remember me": the remember module's EventAuth handler sets the cookie.
+	client, status, result := passkeySignIn(t, server, auth, true, "?rm=true")
+	if status != http.StatusOK || result["location"] != "/app/" {
+		t.Fatalf("login/finish: %d %v", status, result)
+	}
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remembered := false
+	for _, cookie := range client.Jar.Cookies(serverURL) {
+		remembered = remembered || cookie.Name == authboss.CookieRemember
+	}
+
+	if !remembered {
+		t.Error("no remember-me cookie after the passkey sign in with rm=true")
+	}
+
+	// Unconfirmed: the confirm module's EventAuth handler refuses the sign in.
+	user.PutConfirmed(false)
+	if client, status, result = passkeySignIn(t, server, auth, true, ""); result["status"] != "failure" || client.signedIn(t) {
+		t.Errorf("unconfirmed user: %d %v", status, result)
+	}
+	user.PutConfirmed(true)
+
+	// Locked
+	user.PutLocked(time.Now().Add(time.Hour))
+	if client, status, result = passkeySignIn(t, server, auth, true, ""); status != http.StatusForbidden || client.signedIn(t) {
+		t.Errorf("locked user: %d %v", status, result)
+	}
+}
+
+func TestWebAuthnManageNeedsFullSignIn(t *testing.T) {
+	server := startWebAuthnServer(t)
+	user := server.createUser(t, "half@example.com", "secret1")
+	auth := makeSoftAuthenticator(t, server)
+	registerPasskey(t, server, auth, "half@example.com", "secret1")
+
+	// Signed in by the remember-me cookie only: half signed in.
+	client := server.remembered(t, "half@example.com", "secret1")
+	if !client.signedIn(t) {
+		t.Fatal("the remember-me cookie didn't sign the user in")
+	}
+
+	if resp := client.postJSON(t, "/auth/webauthn/register/begin", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("register/begin: %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	if resp := client.postJSON(t, "/auth/webauthn/register/finish", map[string]string{}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("register/finish: %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	credentials := user.WebAuthnCredentials()
+	if len(credentials) != 1 {
+		t.Fatalf("%d passkeys, want 1", len(credentials))
+	}
+
+	client.postForm(t, "/auth/webauthn/remove", url.Values{
+		"credential_id": {base64.RawURLEncoding.EncodeToString(credentials[0].ID)},
+	})
+	if reloaded := server.loadUser(t, "half@example.com"); len(reloaded.WebAuthnCredentials()) != 1 {
+		t.Error("a remember-me session removed the passkey")
+	}
+}
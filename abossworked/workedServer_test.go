@@ -0,0 +1,300 @@
+package abossworked
+
+/* "scooter me fecit"
+
+Copyright 2022 B. Scott Michel
+
+This program is free software: you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation, either version 3 of the License, or (at your option) any later
+version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with
+this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/authboss/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Test harness: the worked example's whole Gin router on an httptest server, with a fresh
+// user database, and a client that keeps its cookies and CSRF token like a browser.
+
+// testConfig returns the default configuration with random seeds and a fresh root directory
+// (where the user database goes.)
+func testConfig(t *testing.T) *ConfigData {
+	t.Helper()
+
+	cfg := new(ConfigData)
+	*cfg = defaultConfig
+	cfg.ConfigLog = log.New(io.Discard, "", 0)
+	cfg.WorkedRoot = t.TempDir()
+	cfg.ListenAddr = map[string]string{}
+	cfg.Seeds = seedData{
+		SessionSeed:  testSeed(t, 64),
+		CookieSeed:   testSeed(t, 64),
+		CSRFSeed:     testSeed(t, 32),
+		RememberSeed: testSeed(t, 64),
+	}
+	cfg.Debugging.TemplateVars = false
+
+	return cfg
+}
+
+// testSeed returns a random base64-encoded seed.
+func testSeed(t *testing.T, size int) string {
+	seed := make([]byte, size)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(seed)
+}
+
+// testServer is the worked example running on an httptest server.
+type testServer struct {
+	*httptest.Server
+	cfg    *ConfigData
+	storer *AuthStorer
+}
+
+// startTestServer starts the worked example with the configuration. The server's address is
+// the configuration's listen address, so that Authboss' root URL is right.
+func startTestServer(t *testing.T, cfg *ConfigData) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	server := httptest.NewUnstartedServer(nil)
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ListenAddr["host"] = host
+	cfg.ListenAddr["port"] = port
+
+	storer, err := OpenUserDB(cfg.WorkedRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := TemplateLoader("../content", "../content/fragments", "master_layout.gohtml", nil, cfg)
+	if err != nil {
+		storer.Close()
+		t.Fatal(err)
+	}
+
+	engine, err := GinRouter(cfg, storer, templates)
+	if err != nil {
+		storer.Close()
+		t.Fatal(err)
+	}
+
+	server.Config.Handler = engine
+	server.Start()
+	t.Cleanup(func() {
+		server.Close()
+		storer.Close()
+	})
+
+	return &testServer{Server: server, cfg: cfg, storer: storer}
+}
+
+// createUser creates a confirmed user.
+func (server *testServer) createUser(t *testing.T, email, password string) *WorkedUser {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	user := server.storer.New(ctx).(*WorkedUser)
+	user.PutPID(email)
+	user.PutPassword(string(hash))
+	if err := server.storer.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	forceConfirm(user)
+	return user
+}
+
+// testClient is a browser: it keeps its cookies and the CSRF token, and doesn't follow
+// redirects, so that the tests can see them.
+type testClient struct {
+	*http.Client
+	server *testServer
+	csrf   string
+}
+
+// client returns a new client for the server.
+func (server *testServer) client(t *testing.T) *testClient {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{
+		Client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		server: server,
+	}
+}
+
+// do sends the request, with the CSRF token, and returns the response with its body read.
+func (client *testClient) do(t *testing.T, method, path, contentType string, body io.Reader) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, client.server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if len(client.csrf) > 0 {
+		req.Header.Set("X-CSRF-Token", client.csrf)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	text, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token := resp.Header.Get("X-CSRF-Token"); len(token) > 0 {
+		client.csrf = token
+	}
+
+	return resp, string(text)
+}
+
+// get GETs the path.
+func (client *testClient) get(t *testing.T, path string) (*http.Response, string) {
+	t.Helper()
+	return client.do(t, http.MethodGet, path, "", nil)
+}
+
+// postForm POSTs the form to the path, after a GET for the CSRF token if the client doesn't
+// have one yet.
+func (client *testClient) postForm(t *testing.T, path string, form url.Values) (*http.Response, string) {
+	t.Helper()
+
+	if len(client.csrf) == 0 {
+		client.get(t, "/")
+	}
+
+	return client.do(t, http.MethodPost, path, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+}
+
+// postJSON POSTs the value as JSON to the path and decodes the JSON response into result
+// (unless it's nil.)
+func (client *testClient) postJSON(t *testing.T, path string, value, result interface{}) *http.Response {
+	t.Helper()
+
+	if len(client.csrf) == 0 {
+		client.get(t, "/")
+	}
+
+	var body io.Reader = http.NoBody
+	if value != nil {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body = strings.NewReader(string(encoded))
+	}
+
+	resp, text := client.do(t, http.MethodPost, path, jsonContentType, body)
+	if result != nil {
+		if err := json.Unmarshal([]byte(text), result); err != nil {
+			t.Fatalf("POST %s: %v in %q", path, err, text)
+		}
+	}
+
+	return resp
+}
+
+// signIn signs the user in with their password.
+func (client *testClient) signIn(t *testing.T, email, password string) {
+	t.Helper()
+
+	resp, _ := client.postForm(t, "/auth/login", url.Values{"email": {email}, "password": {password}})
+	if location := resp.Header.Get("Location"); resp.StatusCode/100 != 3 || location != "/app/" {
+		t.Fatalf("sign in as %s: %d to %q", email, resp.StatusCode, location)
+	}
+}
+
+// remembered signs the user in with "Remember me" and returns a new client with only the
+// remember-me cookie: a browser that was closed and opened again, or a stolen cookie.
+func (server *testServer) remembered(t *testing.T, email, password string) *testClient {
+	t.Helper()
+
+	client := server.client(t)
+	resp, _ := client.postForm(t, "/auth/login", url.Values{"email": {email}, "password": {password}, "rm": {"true"}})
+	if location := resp.Header.Get("Location"); resp.StatusCode/100 != 3 || location != "/app/" {
+		t.Fatalf("sign in as %s: %d to %q", email, resp.StatusCode, location)
+	}
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remembered := server.client(t)
+	for _, cookie := range client.Jar.Cookies(serverURL) {
+		if cookie.Name == authboss.CookieRemember {
+			remembered.Jar.SetCookies(serverURL, []*http.Cookie{cookie})
+		}
+	}
+
+	if len(remembered.Jar.Cookies(serverURL)) == 0 {
+		t.Fatalf("no remember-me cookie after signing in as %s", email)
+	}
+
+	return remembered
+}
+
+// signedIn returns true if the client can get to /app.
+func (client *testClient) signedIn(t *testing.T) bool {
+	t.Helper()
+
+	resp, _ := client.get(t, "/app/")
+	return resp.StatusCode == http.StatusOK
+}
@@ -78,6 +78,7 @@ func gracefulShutdown(mainLog *log.Logger, authStorer *abossworked.AuthStorer) {
 	mainLog.Println("Received", sig, "shutting down and exiting.")
 
 	// Cleanups and shutdowns.
+	authStorer.StopRememberReaper()
 	authStorer.Close()
 	os.Exit(0)
 }